@@ -1,64 +1,378 @@
 package bot
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var ErrNotExists = errors.New("no such bot")
 
-type Messager func(user string, args ...string) (string, string, error)
+// DefaultTimeout is the time a bot gets to handle a message unless it
+// implements Timeouter.
+const DefaultTimeout = time.Second * 30
+
+// Message is a chat message a bot is invoked with.
+type Message struct {
+	// Name of the user that sent it.
+	From string
+
+	// Text of the message, without the / of a command.
+	Data string
+
+	// Arguments of the command, empty for passive bots.
+	Args []string
+}
+
+// Sender posts chat messages as a bot. It remains valid after the bot
+// returned, bots can keep it around to send messages later on.
+type Sender interface {
+	// Send posts d in chat as the bot called name.
+	Send(name, d string) error
 
+	// PM sends d to user only.
+	PM(name, user, d string) error
+}
+
+// Bot handles a command or, when added as a passive bot, any message.
+// It replies with zero or more messages using s and should return once ctx
+// is done.
 type Bot interface {
-	Message(user string, args ...string) (string, string, error)
+	Handle(ctx context.Context, s Sender, m Message) error
+}
+
+// Runner is implemented by bots that send messages on their own, e.g.: on a
+// schedule. Run is called once when the chat channel starts and should return
+// once ctx is done.
+type Runner interface {
+	Run(ctx context.Context, s Sender) error
+}
+
+// Persister is implemented by bots with state that should survive a restart,
+// it is saved and loaded along with the chat channel.
+type Persister interface {
+	NeedsSave() bool
+	Save(file string) error
+	Load(file string) error
+}
+
+// Timeouter is implemented by bots that need a timeout other than
+// DefaultTimeout, <= 0 for none.
+type Timeouter interface {
+	Timeout() time.Duration
+}
+
+type Func func(ctx context.Context, s Sender, m Message) error
+
+func (f Func) Handle(ctx context.Context, s Sender, m Message) error { return f(ctx, s, m) }
+
+// WithTimeout overrides the timeout of b.
+func WithTimeout(b Bot, d time.Duration) Bot { return &timeoutBot{b, d} }
+
+type timeoutBot struct {
+	Bot
+	d time.Duration
+}
+
+func (t *timeoutBot) Timeout() time.Duration { return t.d }
+
+func (t *timeoutBot) Run(ctx context.Context, s Sender) error {
+	if r, ok := t.Bot.(Runner); ok {
+		return r.Run(ctx, s)
+	}
+	return nil
+}
+
+func (t *timeoutBot) NeedsSave() bool {
+	if p, ok := t.Bot.(Persister); ok {
+		return p.NeedsSave()
+	}
+	return false
+}
+
+func (t *timeoutBot) Save(file string) error {
+	if p, ok := t.Bot.(Persister); ok {
+		return p.Save(file)
+	}
+	return nil
+}
+
+func (t *timeoutBot) Load(file string) error {
+	if p, ok := t.Bot.(Persister); ok {
+		return p.Load(file)
+	}
+	return nil
+}
+
+// Invoke calls b with m. It returns when b did or when its timeout expires,
+// whichever comes first, a panic of b is returned as an error.
+func Invoke(ctx context.Context, b Bot, s Sender, m Message) error {
+	timeout := DefaultTimeout
+	if t, ok := b.(Timeouter); ok {
+		timeout = t.Timeout()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("bot panicked: %v", r)
+			}
+		}()
+		done <- b.Handle(ctx, s, m)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run calls r.Run and recovers from its panics.
+func Run(ctx context.Context, r Runner, s Sender) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("bot panicked: %v", rec)
+		}
+	}()
+	return r.Run(ctx, s)
+}
+
+type Messager func(user string, args ...string) (string, string, error)
+
+func (m Messager) Message(user string, args ...string) (string, string, error) {
+	return m(user, args...)
+}
+
+// Command replies to a command with a single message from the bot with the
+// returned name, see NewCommand.
+type Command interface {
+	Message(user string, args ...string) (name, reply string, err error)
 }
 
-func NewBotFunc(f Messager) Bot { return &BotFunc{f} }
+// NewCommand turns c into a Bot.
+func NewCommand(c Command) Bot { return &commandBot{c} }
+
+func NewBotFunc(f Messager) Bot { return NewCommand(f) }
 
-type BotFunc struct{ handler Messager }
+type commandBot struct{ c Command }
 
-func (f *BotFunc) Message(user string, args ...string) (string, string, error) {
-	return f.handler(user, args...)
+func (c *commandBot) Handle(ctx context.Context, s Sender, m Message) error {
+	name, d, err := c.c.Message(m.From, m.Args...)
+	if err != nil {
+		return err
+	}
+	if d == "" || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return s.Send(name, d)
 }
 
+type watcher struct {
+	re  *regexp.Regexp
+	bot Bot
+}
+
+// BotCollection dispatches commands to the bot registered for the first
+// argument and messages to the passive bots they match.
 type BotCollection struct {
 	name string
-	bots map[string]Bot
+
+	sem      sync.RWMutex
+	bots     map[string]Bot
+	watchers []watcher
 }
 
 func NewBotCollection(name string) *BotCollection {
-	return &BotCollection{name, make(map[string]Bot)}
+	return &BotCollection{name: name, bots: make(map[string]Bot)}
 }
 
 func (c *BotCollection) AddBot(command string, bot Bot) {
+	c.sem.Lock()
 	c.bots[command] = bot
+	c.sem.Unlock()
+}
+
+// AddPassiveBot registers bot to be called with every message that matches
+// re, or every message if re is nil.
+func (c *BotCollection) AddPassiveBot(re *regexp.Regexp, bot Bot) {
+	c.sem.Lock()
+	c.watchers = append(c.watchers, watcher{re, bot})
+	c.sem.Unlock()
 }
 
 func (c *BotCollection) Commands() string {
+	c.sem.RLock()
 	list := make([]string, 0, len(c.bots))
 	for n := range c.bots {
 		list = append(list, fmt.Sprintf("  - %s", n))
 	}
+	c.sem.RUnlock()
 
 	sort.Strings(list)
 	return strings.Join(list, "\n")
 }
 
-func (c *BotCollection) Message(user string, args ...string) (string, string, error) {
-	if len(args) < 1 || args[0] == "help" || args[0] == "list" {
-		return c.name, c.Commands(), nil
+// Timeout is left to the bots of the collection.
+func (c *BotCollection) Timeout() time.Duration { return 0 }
+
+func (c *BotCollection) Handle(ctx context.Context, s Sender, m Message) error {
+	if len(m.Args) < 1 || m.Args[0] == "help" || m.Args[0] == "list" {
+		return s.Send(c.name, c.Commands())
 	}
 
-	bot := c.bots[args[0]]
+	c.sem.RLock()
+	bot := c.bots[m.Args[0]]
+	c.sem.RUnlock()
 	if bot == nil {
-		return c.name, "unknown command", nil
+		return s.Send(c.name, "unknown command")
 	}
 
-	return bot.Message(user, args[1:]...)
+	m.Args = m.Args[1:]
+	return Invoke(ctx, bot, s, m)
+}
+
+// Passive calls the passive bots m matches concurrently.
+func (c *BotCollection) Passive(ctx context.Context, s Sender, m Message, onErr func(error)) {
+	c.sem.RLock()
+	defer c.sem.RUnlock()
+	for _, w := range c.watchers {
+		if w.re != nil && !w.re.MatchString(m.Data) {
+			continue
+		}
+		go func(b Bot) {
+			if err := Invoke(ctx, b, s, m); err != nil {
+				onErr(err)
+			}
+		}(w.bot)
+	}
+}
+
+// unique returns the bots by command, sorted, a bot that was added for
+// several commands is only returned once.
+func (c *BotCollection) unique() ([]string, []Bot) {
+	c.sem.RLock()
+	defer c.sem.RUnlock()
+	cmds := make([]string, 0, len(c.bots))
+	for cmd := range c.bots {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	seen := make(map[Bot]bool)
+	rcmds := make([]string, 0, len(cmds)+len(c.watchers))
+	bots := make([]Bot, 0, len(cmds)+len(c.watchers))
+	add := func(cmd string, b Bot) {
+		if reflect.TypeOf(b).Comparable() {
+			if seen[b] {
+				return
+			}
+			seen[b] = true
+		}
+		rcmds = append(rcmds, cmd)
+		bots = append(bots, b)
+	}
+	for _, cmd := range cmds {
+		add(cmd, c.bots[cmd])
+	}
+	for _, w := range c.watchers {
+		add("", w.bot)
+	}
+	return rcmds, bots
+}
+
+// Run runs all bots that implement Runner until ctx is done.
+func (c *BotCollection) Run(ctx context.Context, s Sender) error {
+	_, bots := c.unique()
+	runners := make([]Runner, 0)
+	for _, b := range bots {
+		if r, ok := b.(Runner); ok {
+			runners = append(runners, r)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(runners))
+	for _, r := range runners {
+		wg.Add(1)
+		go func(r Runner) {
+			defer wg.Done()
+			if err := Run(ctx, r, s); err != nil {
+				errs <- err
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for e := range errs {
+		err = e
+	}
+	return err
+}
+
+// persisters returns the bots that implement Persister and the file they are
+// stored in, i.e.: file-command.
+func (c *BotCollection) persisters(file string) ([]string, []Persister) {
+	cmds, bots := c.unique()
+	files := make([]string, 0)
+	l := make([]Persister, 0)
+	for i, b := range bots {
+		if p, ok := b.(Persister); ok && cmds[i] != "" {
+			files = append(files, fmt.Sprintf("%s-%s", file, cmds[i]))
+			l = append(l, p)
+		}
+	}
+	return files, l
+}
+
+func (c *BotCollection) NeedsSave() bool {
+	_, l := c.persisters("")
+	for _, p := range l {
+		if p.NeedsSave() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BotCollection) Save(file string) error {
+	files, l := c.persisters(file)
+	for i, p := range l {
+		if !p.NeedsSave() {
+			continue
+		}
+		if err := p.Save(files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *BotCollection) Load(file string) error {
+	files, l := c.persisters(file)
+	for i, p := range l {
+		if err := p.Load(files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func simpleAPI(endpoint string, dataType interface{}) (interface{}, error) {
@@ -0,0 +1,275 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sender records the messages bots send.
+type sender struct {
+	sem  sync.Mutex
+	msgs []string
+}
+
+func (s *sender) Send(name, d string) error {
+	s.sem.Lock()
+	s.msgs = append(s.msgs, name+": "+d)
+	s.sem.Unlock()
+	return nil
+}
+
+func (s *sender) PM(name, user, d string) error {
+	return s.Send(name, "@"+user+" "+d)
+}
+
+func (s *sender) list() []string {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return append([]string{}, s.msgs...)
+}
+
+// stubborn ignores ctx and returns once release is closed.
+type stubborn struct {
+	release chan struct{}
+	d       time.Duration
+}
+
+func (b *stubborn) Handle(ctx context.Context, s Sender, m Message) error {
+	<-b.release
+	return nil
+}
+
+func (b *stubborn) Timeout() time.Duration { return b.d }
+
+func TestInvokePanic(t *testing.T) {
+	b := Func(func(ctx context.Context, s Sender, m Message) error {
+		panic("oops")
+	})
+	err := Invoke(context.Background(), b, &sender{}, Message{})
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("expected the panic as an error, got %v", err)
+	}
+}
+
+func TestInvokeTimeout(t *testing.T) {
+	b := &stubborn{release: make(chan struct{}), d: 20 * time.Millisecond}
+	defer close(b.release)
+
+	start := time.Now()
+	err := Invoke(context.Background(), b, &sender{}, Message{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("returned %s after the timeout", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Invoke(ctx, b, &sender{}, Message{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestTimeouter(t *testing.T) {
+	slow := Func(func(ctx context.Context, s Sender, m Message) error {
+		select {
+		case <-time.After(50 * time.Millisecond):
+			return s.Send("slow", "done")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	tests := []struct {
+		name string
+		bot  Bot
+		err  error
+	}{
+		{"default", slow, nil},
+		{"short", WithTimeout(slow, 10*time.Millisecond), context.DeadlineExceeded},
+		{"long", WithTimeout(slow, time.Second), nil},
+		{"none", WithTimeout(slow, 0), nil},
+		{"negative", WithTimeout(slow, -1), nil},
+		{"overridden", WithTimeout(WithTimeout(slow, time.Second), 10*time.Millisecond), context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		s := &sender{}
+		err := Invoke(context.Background(), test.bot, s, Message{})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if exp := test.err == nil; exp != (len(s.list()) == 1) {
+			t.Errorf("%s: unexpected messages %q", test.name, s.list())
+		}
+	}
+
+	// the collection leaves the timeout to its bots.
+	c := NewBotCollection("bot")
+	c.AddBot("slow", slow)
+	c.AddBot("short", WithTimeout(slow, 10*time.Millisecond))
+	if err := Invoke(context.Background(), c, &sender{}, Message{Args: []string{"slow"}}); err != nil {
+		t.Errorf("collection: %v", err)
+	}
+	err := Invoke(context.Background(), c, &sender{}, Message{Args: []string{"short"}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("collection: expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+type runner struct{ ran chan struct{} }
+
+func (r *runner) Handle(context.Context, Sender, Message) error { return nil }
+
+func (r *runner) Run(ctx context.Context, s Sender) error {
+	close(r.ran)
+	return nil
+}
+
+func TestWithTimeoutRun(t *testing.T) {
+	r := &runner{ran: make(chan struct{})}
+	c := NewBotCollection("bot")
+	c.AddBot("r", WithTimeout(r, time.Second))
+	c.AddBot("f", WithTimeout(Func(func(context.Context, Sender, Message) error { return nil }), 0))
+	if err := c.Run(context.Background(), &sender{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-r.ran:
+	default:
+		t.Fatal("the runner of a bot with a timeout did not run")
+	}
+}
+
+// persister remembers what it was saved to and loaded from.
+type persister struct {
+	changed     bool
+	saved, load string
+}
+
+func (p *persister) Handle(context.Context, Sender, Message) error { return nil }
+func (p *persister) NeedsSave() bool                               { return p.changed }
+
+func (p *persister) Save(file string) error {
+	p.saved, p.changed = file, false
+	return nil
+}
+
+func (p *persister) Load(file string) error {
+	p.load = file
+	return nil
+}
+
+func TestWithTimeoutPersister(t *testing.T) {
+	p := &persister{changed: true}
+	c := NewBotCollection("bot")
+	c.AddBot("p", WithTimeout(p, time.Second))
+	c.AddBot("f", WithTimeout(Func(func(context.Context, Sender, Message) error { return nil }), 0))
+
+	if !c.NeedsSave() {
+		t.Fatal("the persister of a bot with a timeout does not need saving")
+	}
+	if err := c.Save("state"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load("state"); err != nil {
+		t.Fatal(err)
+	}
+	if p.saved != "state-p" || p.load != "state-p" {
+		t.Fatalf("expected state-p to be saved and loaded, got %q and %q", p.saved, p.load)
+	}
+	if c.NeedsSave() {
+		t.Fatal("needs saving after save")
+	}
+}
+
+func TestCollection(t *testing.T) {
+	c := NewBotCollection("bot")
+	c.AddBot("echo", Func(func(ctx context.Context, s Sender, m Message) error {
+		return s.Send("echo", strings.Join(m.Args, " "))
+	}))
+	c.AddBot("upper", NewBotFunc(func(user string, args ...string) (string, string, error) {
+		return "upper", strings.ToUpper(user), nil
+	}))
+
+	s := &sender{}
+	for _, args := range [][]string{{"echo", "a", "b"}, {"upper"}, {"nope"}, {}, {"help"}} {
+		if err := Invoke(context.Background(), c, s, Message{From: "bob", Args: args}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	help := "bot: " + c.Commands()
+	exp := []string{"echo: a b", "upper: BOB", "bot: unknown command", help, help}
+	if got := s.list(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestPassive(t *testing.T) {
+	s := &sender{}
+	c := NewBotCollection("bot")
+	watch := func(name string) Bot {
+		return Func(func(ctx context.Context, s Sender, m Message) error {
+			return s.Send(name, m.Data)
+		})
+	}
+	c.AddPassiveBot(regexp.MustCompile(`(?i)\bhello\b`), watch("hello"))
+	c.AddPassiveBot(regexp.MustCompile(`^\d+$`), watch("digits"))
+	c.AddPassiveBot(nil, watch("all"))
+	c.AddPassiveBot(regexp.MustCompile(`fail`), Func(func(context.Context, Sender, Message) error {
+		return errors.New("failed")
+	}))
+
+	var sem sync.Mutex
+	errs := make([]string, 0)
+	onErr := func(err error) {
+		sem.Lock()
+		errs = append(errs, err.Error())
+		sem.Unlock()
+	}
+	for _, d := range []string{"Hello there", "othello", "123", "12a", "fail"} {
+		c.Passive(context.Background(), s, Message{Data: d}, onErr)
+	}
+
+	exp := []string{
+		"all: 123",
+		"all: 12a",
+		"all: Hello there",
+		"all: fail",
+		"all: othello",
+		"digits: 123",
+		"hello: Hello there",
+	}
+	nerrs := func() int {
+		sem.Lock()
+		defer sem.Unlock()
+		return len(errs)
+	}
+	for i := 0; len(s.list()) < len(exp) || nerrs() < 1; i++ {
+		if i == 500 {
+			t.Fatalf("expected %q, got %q", exp, s.list())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	got := s.list()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+
+	sem.Lock()
+	defer sem.Unlock()
+	if fmt.Sprint(errs) != "[failed]" {
+		t.Fatalf("expected one error, got %q", errs)
+	}
+}
@@ -0,0 +1,311 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	processBackoffMin = time.Second
+	processBackoffMax = time.Minute
+	processMaxLine    = 1024 * 1024
+)
+
+var ErrNotRunning = errors.New("bot is not running")
+
+// ProcessConfig of a bot that runs as an external process, see NewProcess.
+type ProcessConfig struct {
+	// Command and its arguments.
+	Command []string
+
+	// Name the bot posts as, defaults to <command>-bot.
+	Name string
+
+	// Regex public chat messages are matched against, matching messages
+	// are passed to the process as well.
+	Match string
+
+	// Seconds the process gets to reply to a command, 0 = default.
+	Timeout int
+}
+
+// ProcessRequest is written to the stdin of the process as a single line of
+// JSON.
+type ProcessRequest struct {
+	// command or message (a chat message that matched).
+	Type string `json:"type"`
+
+	// Replies refer to this id.
+	ID uint64 `json:"id"`
+
+	Command string   `json:"command,omitempty"`
+	User    string   `json:"user"`
+	Args    []string `json:"args,omitempty"`
+	Data    string   `json:"d,omitempty"`
+}
+
+// ProcessResponse is read from the stdout of the process, one per line.
+type ProcessResponse struct {
+	// reply to the request with ID or a message the process sends on its own.
+	Type string `json:"type"`
+	ID   uint64 `json:"id"`
+
+	Data string `json:"d"`
+
+	// Send as a PM to this user.
+	To string `json:"to"`
+
+	// More replies to ID follow.
+	More bool `json:"more"`
+}
+
+type call struct {
+	s    Sender
+	done chan struct{}
+	err  error
+}
+
+// Process is a bot that runs an executable and exchanges newline delimited
+// JSON with it over stdin and stdout. The process is started by Run and
+// restarted with backoff when it exits.
+type Process struct {
+	log     *log.Logger
+	command string
+	c       ProcessConfig
+	match   *regexp.Regexp
+
+	sem     sync.Mutex
+	in      chan []byte
+	exited  chan struct{}
+	id      uint64
+	pending map[uint64]*call
+}
+
+// NewProcess creates the bot for the given command.
+func NewProcess(l *log.Logger, command string, c ProcessConfig) (*Process, error) {
+	if len(c.Command) == 0 {
+		return nil, fmt.Errorf("bot %s: no command", command)
+	}
+	if c.Name == "" {
+		c.Name = command + "-bot"
+	}
+	p := &Process{log: l, command: command, c: c, pending: make(map[uint64]*call)}
+	if c.Match != "" {
+		var err error
+		if p.match, err = regexp.Compile(c.Match); err != nil {
+			return nil, fmt.Errorf("bot %s: %w", command, err)
+		}
+	}
+	return p, nil
+}
+
+// Match returns the compiled ProcessConfig.Match or nil.
+func (p *Process) Match() *regexp.Regexp { return p.match }
+
+func (p *Process) Timeout() time.Duration {
+	if p.c.Timeout > 0 {
+		return time.Duration(p.c.Timeout) * time.Second
+	}
+	return DefaultTimeout
+}
+
+func (p *Process) Handle(ctx context.Context, s Sender, m Message) error {
+	return p.request(ctx, s, ProcessRequest{Type: "command", Command: p.command, User: m.From, Args: m.Args})
+}
+
+// Passive returns the bot that passes chat messages to the process, see
+// BotCollection.AddPassiveBot.
+func (p *Process) Passive() Bot {
+	return Func(func(ctx context.Context, s Sender, m Message) error {
+		return p.request(ctx, s, ProcessRequest{Type: "message", User: m.From, Data: m.Data})
+	})
+}
+
+func (p *Process) request(ctx context.Context, s Sender, r ProcessRequest) error {
+	c := &call{s: s, done: make(chan struct{})}
+
+	p.sem.Lock()
+	if p.in == nil {
+		p.sem.Unlock()
+		return fmt.Errorf("%s: %w", p.c.Name, ErrNotRunning)
+	}
+	p.id++
+	r.ID = p.id
+	p.pending[r.ID] = c
+	in, exited := p.in, p.exited
+	p.sem.Unlock()
+
+	defer func() {
+		p.sem.Lock()
+		delete(p.pending, r.ID)
+		p.sem.Unlock()
+	}()
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// A process that doesn't read its stdin blocks the writer, not us.
+	select {
+	case in <- append(line, '\n'):
+	case <-exited:
+		return fmt.Errorf("%s exited", p.c.Name)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run keeps the process running until ctx is done.
+func (p *Process) Run(ctx context.Context, s Sender) error {
+	backoff := processBackoffMin
+	for {
+		start := time.Now()
+		err := p.run(ctx, s)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if time.Since(start) > processBackoffMax {
+			backoff = processBackoffMin
+		}
+		p.log.Printf("bot %s exited: %v, restarting in %s", p.c.Name, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > processBackoffMax {
+			backoff = processBackoffMax
+		}
+	}
+}
+
+func (p *Process) run(ctx context.Context, s Sender) error {
+	cmd := exec.CommandContext(ctx, p.c.Command[0], p.c.Command[1:]...)
+	cmd.Env = append(os.Environ(), "HOMECHAT_BOT="+p.c.Name)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	in, exited := make(chan []byte), make(chan struct{})
+	p.sem.Lock()
+	p.in, p.exited = in, exited
+	p.sem.Unlock()
+
+	// stdin is only written here, requests hand over their line through in.
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case line := <-in:
+				if _, err := stdin.Write(line); err != nil {
+					select {
+					case <-exited:
+					default:
+						p.log.Printf("bot %s: %s", p.c.Name, err)
+						cmd.Process.Kill()
+					}
+					return
+				}
+			case <-exited:
+				return
+			}
+		}
+	}()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			p.log.Printf("bot %s: %s", p.c.Name, sc.Text())
+		}
+		close(stderrDone)
+	}()
+
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(nil, processMaxLine)
+	for sc.Scan() {
+		var r ProcessResponse
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			p.log.Printf("bot %s: invalid response: %s", p.c.Name, err)
+			continue
+		}
+		if err := p.response(s, r); err != nil {
+			p.log.Printf("bot %s: %s", p.c.Name, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		p.log.Printf("bot %s: %s", p.c.Name, err)
+		cmd.Process.Kill()
+	}
+
+	p.sem.Lock()
+	p.in, p.exited = nil, nil
+	close(exited)
+	for id, c := range p.pending {
+		c.err = fmt.Errorf("%s exited", p.c.Name)
+		close(c.done)
+		delete(p.pending, id)
+	}
+	p.sem.Unlock()
+
+	stdin.Close()
+	<-writerDone
+	<-stderrDone
+	return cmd.Wait()
+}
+
+func (p *Process) response(s Sender, r ProcessResponse) error {
+	switch r.Type {
+	case "message":
+	case "reply":
+		p.sem.Lock()
+		c, ok := p.pending[r.ID]
+		if ok && !r.More {
+			close(c.done)
+			delete(p.pending, r.ID)
+		}
+		p.sem.Unlock()
+		if !ok {
+			return fmt.Errorf("dropped reply to %d, it timed out", r.ID)
+		}
+		s = c.s
+	default:
+		return fmt.Errorf("invalid response type: '%s'", r.Type)
+	}
+
+	if r.To != "" {
+		return s.PM(p.c.Name, r.To, r.Data)
+	}
+	return s.Send(p.c.Name, r.Data)
+}
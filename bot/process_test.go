@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// script replies with its pid, or the user it is asked to PM, to every
+// request and exits when asked to.
+const script = `
+while read -r l; do
+	id=$(printf '%s' "$l" | sed 's/.*"id":\([0-9]*\).*/\1/')
+	case "$l" in
+	*'"args":["exit"]'*) exit 1 ;;
+	*'"args":["pm"]'*) printf '{"type":"reply","id":%s,"d":"psst","to":"bob"}\n' "$id" ;;
+	*) printf '{"type":"reply","id":%s,"d":"%s"}\n' "$id" "$$" ;;
+	esac
+done
+`
+
+func runProcess(t *testing.T, c ProcessConfig) *Process {
+	t.Helper()
+	p, err := NewProcess(log.New(ioutil.Discard, "", 0), "test", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, &sender{})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p
+}
+
+// pid waits for the process to run and returns the pid it replies with.
+func pid(t *testing.T, p *Process) int {
+	t.Helper()
+	for i := 0; ; i++ {
+		s := &sender{}
+		err := Invoke(context.Background(), p, s, Message{From: "bob"})
+		if err == nil {
+			l := s.list()
+			pid, err := strconv.Atoi(strings.TrimPrefix(l[0], "test-bot: "))
+			if err != nil {
+				t.Fatalf("unexpected reply %q", l)
+			}
+			return pid
+		}
+		if i == 500 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "bot.sh")
+	if err := ioutil.WriteFile(f, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p := runProcess(t, ProcessConfig{Command: []string{"sh", f}})
+
+	first := pid(t, p)
+	s := &sender{}
+	if err := Invoke(context.Background(), p, s, Message{Args: []string{"pm"}}); err != nil {
+		t.Fatal(err)
+	}
+	if l := s.list(); len(l) != 1 || l[0] != "test-bot: @bob psst" {
+		t.Fatalf("unexpected PM %q", l)
+	}
+
+	// pending requests fail when the process exits.
+	if err := Invoke(context.Background(), p, s, Message{Args: []string{"exit"}}); err == nil {
+		t.Fatal("no error for a process that exited")
+	}
+	second := pid(t, p)
+	if second == first {
+		t.Fatal("process was not restarted")
+	}
+
+	proc, err := os.FindProcess(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if third := pid(t, p); third == second || third == first {
+		t.Fatal("process was not restarted after it was killed")
+	}
+}
+
+func TestProcessBlocked(t *testing.T) {
+	// sleep never reads its stdin.
+	p := runProcess(t, ProcessConfig{Command: []string{"sleep", "30"}})
+	for i := 0; ; i++ {
+		p.sem.Lock()
+		running := p.in != nil
+		p.sem.Unlock()
+		if running {
+			break
+		}
+		if i == 500 {
+			t.Fatal("process did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// fill the pipe so the writer blocks.
+	big := Message{Data: strings.Repeat("x", 1024*1024)}
+	go Invoke(context.Background(), WithTimeout(p.Passive(), time.Second), &sender{}, big)
+
+	for i := 0; i < 3; i++ {
+		// no Invoke, it would return on timeout even if Handle blocks.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := p.Handle(ctx, &sender{}, Message{})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("request took %s while the process doesn't read", d)
+		}
+	}
+}
@@ -0,0 +1,685 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frizinak/binary"
+)
+
+const (
+	RemindName = "remind-bot"
+
+	remindSaveVersion = "v1"
+	remindMaxPerUser  = 100
+	remindMaxText     = 4096
+	remindMinEvery    = time.Minute
+	remindMaxAhead    = time.Hour * 24 * 366 * 5
+	remindFormat      = "Mon Jan 2 15:04"
+)
+
+var (
+	reRemindDuration = regexp.MustCompile(`^(?:\d+[a-z]+)+$`)
+	reRemindPart     = regexp.MustCompile(`(\d+)([a-z]+)`)
+
+	remindUnits = map[string]time.Duration{
+		"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+		"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+		"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+		"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	}
+
+	remindWeekdays = map[string]time.Weekday{
+		"sunday": time.Sunday, "sun": time.Sunday,
+		"monday": time.Monday, "mon": time.Monday,
+		"tuesday": time.Tuesday, "tue": time.Tuesday,
+		"wednesday": time.Wednesday, "wed": time.Wednesday,
+		"thursday": time.Thursday, "thu": time.Thursday,
+		"friday": time.Friday, "fri": time.Friday,
+		"saturday": time.Saturday, "sat": time.Saturday,
+	}
+)
+
+const (
+	everyDay     uint8 = 1<<7 - 1
+	everyWeekday uint8 = everyDay &^ (1<<uint(time.Saturday) | 1<<uint(time.Sunday))
+)
+
+// schedule of a recurring reminder, either a fixed interval or a time on
+// certain days of the week.
+type schedule struct {
+	every     time.Duration
+	days      uint8
+	hour, min uint8
+}
+
+func (s schedule) recurring() bool { return s.every > 0 || s.days != 0 }
+
+// next returns the first time after t the schedule is due.
+func (s schedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	for i := 0; i < 8; i++ {
+		d := time.Date(t.Year(), t.Month(), t.Day()+i, int(s.hour), int(s.min), 0, 0, t.Location())
+		if d.After(t) && s.days&(1<<uint(d.Weekday())) != 0 {
+			return d
+		}
+	}
+	return time.Time{}
+}
+
+func (s schedule) String() string {
+	if s.every > 0 {
+		return "every " + remindDuration(s.every)
+	}
+
+	var days string
+	switch s.days {
+	case everyDay:
+		days = "day"
+	case everyWeekday:
+		days = "weekday"
+	default:
+		l := make([]string, 0, 7)
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if s.days&(1<<uint(d)) != 0 {
+				l = append(l, strings.ToLower(d.String()))
+			}
+		}
+		days = strings.Join(l, ",")
+	}
+	return fmt.Sprintf("every %s at %02d:%02d", days, s.hour, s.min)
+}
+
+type reminder struct {
+	id   uint64
+	from string
+	// Empty for the whole chat.
+	to    string
+	text  string
+	due   time.Time
+	sched schedule
+}
+
+func (r *reminder) when() string {
+	if r.sched.recurring() {
+		return fmt.Sprintf("%s (next %s)", r.sched, r.due.Format(remindFormat))
+	}
+	return r.due.Format(remindFormat)
+}
+
+func (r *reminder) message() string {
+	if r.to == r.from {
+		return "reminder: " + r.text
+	}
+	return fmt.Sprintf("reminder from %s: %s", r.from, r.text)
+}
+
+// RemindBot sends reminders to the user that asked for them, another user or
+// the whole chat, once or on a schedule. Times are in the timezone of the
+// server.
+type RemindBot struct {
+	log   *log.Logger
+	users func() []string
+
+	sem     sync.Mutex
+	id      uint64
+	list    []*reminder
+	changed bool
+}
+
+// NewRemindBot creates a reminder bot, users returns the names a reminder
+// can be for without prefixing them with @. It can be nil.
+func NewRemindBot(l *log.Logger, users func() []string) *RemindBot {
+	return &RemindBot{log: l, users: users, list: make([]*reminder, 0)}
+}
+
+func (b *RemindBot) Handle(ctx context.Context, s Sender, m Message) error {
+	args := m.Args
+	if len(args) == 0 || args[0] == "help" {
+		cmds := []string{
+			" - <who> <when> [to] <what>",
+			"       <who>:  me, all, @user or a user in chat, default me",
+			"       <when>: in 20m, in 2h30m, at 18:30, tomorrow 9:00,",
+			"               friday 17:00, 2021-12-24 20:00,",
+			"               every day 8:00, every weekday 8:00,",
+			"               every monday 8:00, every 2h",
+			" - list",
+			"       list your reminders",
+			" - cancel <id>",
+			"       cancel a reminder",
+		}
+		return s.Send(RemindName, strings.Join(cmds, "\n"))
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "list", "ls":
+		return s.Send(RemindName, b.listFor(m.From))
+	case "cancel", "rm", "delete":
+		return s.Send(RemindName, b.cancel(m.From, args[1:]))
+	}
+
+	var users []string
+	if b.users != nil {
+		users = b.users()
+	}
+	r, err := parseReminder(m.From, users, args, time.Now())
+	if err != nil {
+		return s.Send(RemindName, err.Error())
+	}
+
+	b.sem.Lock()
+	n := 0
+	for _, o := range b.list {
+		if o.from == m.From {
+			n++
+		}
+	}
+	if n >= remindMaxPerUser {
+		b.sem.Unlock()
+		return s.Send(RemindName, fmt.Sprintf("you already have %d reminders", n))
+	}
+	b.id++
+	r.id = b.id
+	b.list = append(b.list, r)
+	b.changed = true
+	b.sem.Unlock()
+
+	who := "you"
+	switch {
+	case r.to == "":
+		who = "the chat"
+	case r.to != m.From:
+		who = r.to
+	}
+	return s.Send(RemindName, fmt.Sprintf("#%d: reminding %s %s", r.id, who, r.when()))
+}
+
+func (b *RemindBot) listFor(user string) string {
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	rems := make([]*reminder, 0)
+	for _, r := range b.list {
+		if r.from == user || r.to == user {
+			rems = append(rems, r)
+		}
+	}
+	sortReminders(rems)
+
+	l := make([]string, 0, len(rems))
+	for _, r := range rems {
+		who := r.to
+		switch {
+		case r.to == "":
+			who = "chat"
+		case r.to == user && r.from == user:
+			who = "you"
+		case r.to == user:
+			who = "you, from " + r.from
+		}
+		l = append(l, fmt.Sprintf("#%d %s, %s: %s", r.id, r.when(), who, r.text))
+	}
+	if len(l) == 0 {
+		return "no reminders"
+	}
+	return strings.Join(l, "\n")
+}
+
+// cancel removes the given reminders, those of user and those sent to user.
+func (b *RemindBot) cancel(user string, ids []string) string {
+	if len(ids) == 0 {
+		return "specify the id of the reminder to cancel, see /remind list"
+	}
+
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	res := make([]string, 0, len(ids))
+	for _, str := range ids {
+		id, err := strconv.ParseUint(strings.TrimPrefix(str, "#"), 10, 64)
+		if err != nil {
+			res = append(res, fmt.Sprintf("invalid id '%s'", str))
+			continue
+		}
+		found := false
+		for i, r := range b.list {
+			if r.id != id || (r.from != user && r.to != user) {
+				continue
+			}
+			b.list = append(b.list[:i], b.list[i+1:]...)
+			b.changed, found = true, true
+			res = append(res, fmt.Sprintf("#%d cancelled", id))
+			break
+		}
+		if !found {
+			res = append(res, fmt.Sprintf("#%d not found", id))
+		}
+	}
+	return strings.Join(res, "\n")
+}
+
+// Run sends reminders when they are due. Reminders that were due while the
+// server was down are sent once it is back.
+func (b *RemindBot) Run(ctx context.Context, s Sender) error {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-tick.C:
+			for _, r := range b.due(now) {
+				var err error
+				if r.to == "" {
+					err = s.Send(RemindName, r.message())
+				} else {
+					err = s.PM(RemindName, r.to, r.message())
+				}
+				if err != nil {
+					b.log.Printf("%s: reminder #%d: %s", RemindName, r.id, err)
+				}
+			}
+		}
+	}
+}
+
+// due returns copies of the reminders that are due and reschedules or
+// removes them.
+func (b *RemindBot) due(now time.Time) []reminder {
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	var l []reminder
+	keep := b.list[:0]
+	for _, r := range b.list {
+		if r.due.After(now) {
+			keep = append(keep, r)
+			continue
+		}
+		l = append(l, *r)
+		b.changed = true
+		if !r.sched.recurring() {
+			continue
+		}
+		if r.sched.every > 0 {
+			r.due = r.due.Add((now.Sub(r.due)/r.sched.every + 1) * r.sched.every)
+		} else {
+			r.due = r.sched.next(now)
+		}
+		keep = append(keep, r)
+	}
+	b.list = keep
+	return l
+}
+
+func (b *RemindBot) NeedsSave() bool {
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	return b.changed
+}
+
+func (b *RemindBot) Save(file string) error {
+	b.sem.Lock()
+	id := b.id
+	list := make([]reminder, len(b.list))
+	for i, r := range b.list {
+		list[i] = *r
+	}
+	b.changed = false
+	b.sem.Unlock()
+
+	err := b.save(file, id, list)
+	if err != nil {
+		b.sem.Lock()
+		b.changed = true
+		b.sem.Unlock()
+	}
+	return err
+}
+
+func (b *RemindBot) save(file string, id uint64, list []reminder) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := binary.NewWriter(f)
+	w.WriteString(remindSaveVersion, 16)
+	w.WriteUint64(id)
+	w.WriteUint32(uint32(len(list)))
+	for _, r := range list {
+		w.WriteUint64(r.id)
+		w.WriteString(r.from, 8)
+		w.WriteString(r.to, 8)
+		w.WriteString(r.text, 16)
+		w.WriteUint64(uint64(r.due.Unix()))
+		w.WriteUint64(uint64(r.sched.every))
+		w.WriteUint8(r.sched.days)
+		w.WriteUint8(r.sched.hour)
+		w.WriteUint8(r.sched.min)
+	}
+	if err := w.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (b *RemindBot) Load(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := binary.NewReader(f)
+	if v := r.ReadString(16); v != remindSaveVersion {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		return errors.New("unknown reminders file version")
+	}
+
+	id := r.ReadUint64()
+	n := r.ReadUint32()
+	list := make([]*reminder, 0)
+	for i := uint32(0); i < n && r.Err() == nil; i++ {
+		rem := &reminder{}
+		rem.id = r.ReadUint64()
+		rem.from = r.ReadString(8)
+		rem.to = r.ReadString(8)
+		rem.text = r.ReadString(16)
+		rem.due = time.Unix(int64(r.ReadUint64()), 0)
+		rem.sched.every = time.Duration(r.ReadUint64())
+		rem.sched.days = r.ReadUint8()
+		rem.sched.hour = r.ReadUint8()
+		rem.sched.min = r.ReadUint8()
+		list = append(list, rem)
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	b.id, b.list = id, list
+	return nil
+}
+
+// parseReminder parses a reminder of user from, its first word is only taken
+// as the user to remind if it is me, all, @user or one of users.
+func parseReminder(from string, users, args []string, now time.Time) (*reminder, error) {
+	r := &reminder{from: from, to: from}
+	if !isRemindWhen(args[0]) {
+		to, ok := remindTarget(from, users, args[0])
+		if !ok {
+			return nil, fmt.Errorf("who or when is '%s'? e.g.: /remind me in 2h to take the laundry out", args[0])
+		}
+		r.to = to
+		args = args[1:]
+	}
+
+	due, sched, n, err := parseWhen(args, now)
+	if err != nil {
+		return nil, err
+	}
+	if !due.After(now) {
+		return nil, errors.New("that's in the past")
+	}
+	if due.Sub(now) > remindMaxAhead {
+		return nil, errors.New("that's too far ahead")
+	}
+
+	args = args[n:]
+	if len(args) != 0 && strings.ToLower(args[0]) == "to" {
+		args = args[1:]
+	}
+	r.text = strings.Join(args, " ")
+	switch {
+	case r.text == "":
+		return nil, errors.New("remind of what? e.g.: /remind me in 2h to take the laundry out")
+	case len(r.text) > remindMaxText:
+		return nil, errors.New("that's a bit long")
+	}
+	r.due, r.sched = due, sched
+	return r, nil
+}
+
+// remindTarget returns the user w refers to, empty for the chat.
+func remindTarget(from string, users []string, w string) (string, bool) {
+	to := strings.TrimPrefix(w, "@")
+	switch strings.ToLower(to) {
+	case "me":
+		return from, true
+	case "all", "everyone", "chat", "us":
+		return "", true
+	}
+	for _, u := range users {
+		if strings.EqualFold(u, to) {
+			return u, true
+		}
+	}
+	return to, to != w && to != ""
+}
+
+func isRemindWhen(w string) bool {
+	w = strings.ToLower(w)
+	switch w {
+	case "in", "at", "on", "every", "today", "tomorrow":
+		return true
+	}
+	if _, ok := remindWeekdays[w]; ok {
+		return true
+	}
+	_, err := time.Parse("2006-01-02", w)
+	return err == nil
+}
+
+// parseWhen parses the time at the start of args and returns the amount of
+// args it consists of.
+func parseWhen(args []string, now time.Time) (time.Time, schedule, int, error) {
+	var sched schedule
+	if len(args) == 0 {
+		return time.Time{}, sched, 0, errors.New("when? e.g.: in 20m, at 18:30, every monday 8:00")
+	}
+
+	off := 0
+	w := strings.ToLower(args[0])
+	if w == "on" && len(args) > 1 {
+		off, args = 1, args[1:]
+		w = strings.ToLower(args[0])
+	}
+
+	day := func(t time.Time, days, h, m int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+days, h, m, 0, 0, t.Location())
+	}
+
+	switch w {
+	case "in":
+		d, n, err := parseDuration(args[1:])
+		return now.Add(d), sched, off + 1 + n, err
+
+	case "at", "today":
+		n := 0
+		if w == "today" {
+			n = 1
+		}
+		h, m, k, err := parseAt(args[n:])
+		if err != nil {
+			return time.Time{}, sched, 0, err
+		}
+		due := day(now, 0, h, m)
+		if w == "at" && !due.After(now) {
+			due = day(now, 1, h, m)
+		}
+		return due, sched, off + n + k, nil
+
+	case "tomorrow":
+		h, m, k, err := parseAt(args[1:])
+		return day(now, 1, h, m), sched, off + 1 + k, err
+
+	case "every":
+		if len(args) < 2 {
+			return time.Time{}, sched, 0, errors.New("every what? e.g.: every day 8:00, every 2h")
+		}
+		x := strings.ToLower(args[1])
+		switch x {
+		case "day":
+			sched.days = everyDay
+		case "weekday":
+			sched.days = everyWeekday
+		default:
+			if wd, ok := remindWeekdays[x]; ok {
+				sched.days = 1 << uint(wd)
+			}
+		}
+		if sched.days == 0 {
+			d, n, err := parseDuration(args[1:])
+			if err != nil {
+				return time.Time{}, sched, 0, err
+			}
+			if d < remindMinEvery {
+				return time.Time{}, sched, 0, fmt.Errorf("the shortest interval is %s", remindDuration(remindMinEvery))
+			}
+			sched.every = d
+			return now.Add(d), sched, off + 1 + n, nil
+		}
+		h, m, k, err := parseAt(args[2:])
+		sched.hour, sched.min = uint8(h), uint8(m)
+		return sched.next(now), sched, off + 2 + k, err
+	}
+
+	if wd, ok := remindWeekdays[w]; ok {
+		h, m, k, err := parseAt(args[1:])
+		once := schedule{days: 1 << uint(wd), hour: uint8(h), min: uint8(m)}
+		return once.next(now), sched, off + 1 + k, err
+	}
+
+	if d, err := time.ParseInLocation("2006-01-02", w, now.Location()); err == nil {
+		h, m, k, err := parseAt(args[1:])
+		return day(d, 0, h, m), sched, off + 1 + k, err
+	}
+
+	return time.Time{}, sched, 0, fmt.Errorf("can't make sense of '%s', see /remind help", args[0])
+}
+
+// parseAt parses [at] <clock>.
+func parseAt(args []string) (h, m, n int, err error) {
+	if len(args) != 0 && strings.ToLower(args[0]) == "at" {
+		n = 1
+	}
+	if len(args) <= n {
+		return 0, 0, 0, errors.New("at what time? e.g.: 18:30 or 6:30pm")
+	}
+	h, m, ok := parseClock(args[n])
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid time '%s', e.g.: 18:30 or 6:30pm", args[n])
+	}
+	return h, m, n + 1, nil
+}
+
+func parseClock(s string) (int, int, bool) {
+	s = strings.ToLower(s)
+	half := 0
+	switch {
+	case strings.HasSuffix(s, "am"):
+		half, s = 1, s[:len(s)-2]
+	case strings.HasSuffix(s, "pm"):
+		half, s = 2, s[:len(s)-2]
+	}
+
+	p := strings.SplitN(s, ":", 2)
+	h, err := strconv.Atoi(p[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	var m int
+	if len(p) == 2 {
+		if len(p[1]) != 2 {
+			return 0, 0, false
+		}
+		if m, err = strconv.Atoi(p[1]); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	if half != 0 {
+		if h < 1 || h > 12 {
+			return 0, 0, false
+		}
+		h %= 12
+		if half == 2 {
+			h += 12
+		}
+	}
+	return h, m, h >= 0 && h < 24 && m >= 0 && m < 60
+}
+
+// parseDuration parses e.g.: 20m, 1h30m or 2 hours.
+func parseDuration(args []string) (time.Duration, int, error) {
+	if len(args) == 0 {
+		return 0, 0, errors.New("how long? e.g.: 20m, 1h30m or 2 hours")
+	}
+	s, n := strings.ToLower(args[0]), 1
+	if _, err := strconv.Atoi(s); err == nil && len(args) > 1 {
+		s, n = s+strings.ToLower(args[1]), 2
+	}
+	if !reRemindDuration.MatchString(s) {
+		return 0, 0, fmt.Errorf("invalid duration '%s', e.g.: 20m, 1h30m or 2 hours", s)
+	}
+
+	var d time.Duration
+	for _, p := range reRemindPart.FindAllStringSubmatch(s, -1) {
+		unit, ok := remindUnits[p[2]]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown unit '%s'", p[2])
+		}
+		v, err := strconv.Atoi(p[1])
+		if err != nil || time.Duration(v) > remindMaxAhead/unit {
+			return 0, 0, errors.New("that's too far ahead")
+		}
+		// each part is capped, so the total can't overflow before it is checked.
+		if d += time.Duration(v) * unit; d > remindMaxAhead {
+			return 0, 0, errors.New("that's too far ahead")
+		}
+	}
+	return d, n, nil
+}
+
+func remindDuration(d time.Duration) string {
+	units := []struct {
+		d time.Duration
+		s string
+	}{{7 * 24 * time.Hour, "w"}, {24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}}
+	parts := make([]string, 0, len(units))
+	for _, u := range units {
+		if n := d / u.d; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, u.s))
+			d -= n * u.d
+		}
+	}
+	if len(parts) == 0 {
+		return "0s"
+	}
+	return strings.Join(parts, "")
+}
+
+func sortReminders(l []*reminder) {
+	sort.Slice(l, func(i, j int) bool { return l[i].due.Before(l[j].due) })
+}
@@ -0,0 +1,248 @@
+package bot
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// remindNow is a Wednesday.
+var remindNow = time.Date(2021, 3, 10, 14, 30, 0, 0, time.UTC)
+
+func at(month time.Month, day, h, m int) time.Time {
+	return time.Date(2021, month, day, h, m, 0, 0, time.UTC)
+}
+
+func TestParseWhen(t *testing.T) {
+	tests := []struct {
+		in    string
+		due   time.Time
+		sched schedule
+		n     int
+	}{
+		// relative
+		{"in 20m to eat", remindNow.Add(20 * time.Minute), schedule{}, 2},
+		{"in 1h30m", remindNow.Add(90 * time.Minute), schedule{}, 2},
+		{"in 2 hours to eat", remindNow.Add(2 * time.Hour), schedule{}, 3},
+		{"in 1w2d", remindNow.Add(9 * 24 * time.Hour), schedule{}, 2},
+
+		// absolute
+		{"at 18:30", at(3, 10, 18, 30), schedule{}, 2},
+		{"at 9:00", at(3, 11, 9, 0), schedule{}, 2},
+		{"today 16:00", at(3, 10, 16, 0), schedule{}, 2},
+		{"today at 6:30pm", at(3, 10, 18, 30), schedule{}, 3},
+		{"2021-12-24 20:00", at(12, 24, 20, 0), schedule{}, 2},
+		{"on 2021-12-24 at 8pm", at(12, 24, 20, 0), schedule{}, 4},
+
+		// tomorrow
+		{"tomorrow 9am", at(3, 11, 9, 0), schedule{}, 2},
+		{"tomorrow at 12am", at(3, 11, 0, 0), schedule{}, 3},
+		{"tomorrow 12pm", at(3, 11, 12, 0), schedule{}, 2},
+		{"Tomorrow 23:59", at(3, 11, 23, 59), schedule{}, 2},
+
+		// weekday
+		{"friday 17:00", at(3, 12, 17, 0), schedule{}, 2},
+		{"on fri at 5pm", at(3, 12, 17, 0), schedule{}, 4},
+		{"wednesday 15:00", at(3, 10, 15, 0), schedule{}, 2},
+		{"wednesday 14:30", at(3, 17, 14, 30), schedule{}, 2},
+		{"tuesday 8:00", at(3, 16, 8, 0), schedule{}, 2},
+
+		// every
+		{"every day 8:00", at(3, 11, 8, 0), schedule{days: everyDay, hour: 8}, 3},
+		{"every day 15:00", at(3, 10, 15, 0), schedule{days: everyDay, hour: 15}, 3},
+		{"every weekday 8:00", at(3, 11, 8, 0), schedule{days: everyWeekday, hour: 8}, 3},
+		{"every monday at 7:15am", at(3, 15, 7, 15), schedule{days: 1 << uint(time.Monday), hour: 7, min: 15}, 4},
+		{"every sat 10am", at(3, 13, 10, 0), schedule{days: 1 << uint(time.Saturday), hour: 10}, 3},
+		{"every 2h", remindNow.Add(2 * time.Hour), schedule{every: 2 * time.Hour}, 2},
+		{"every 90 minutes", remindNow.Add(90 * time.Minute), schedule{every: 90 * time.Minute}, 3},
+	}
+
+	for _, test := range tests {
+		due, sched, n, err := parseWhen(strings.Fields(test.in), remindNow)
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if !due.Equal(test.due) || sched != test.sched || n != test.n {
+			t.Errorf(
+				"%s: expected %s %+v %d, got %s %+v %d",
+				test.in,
+				test.due,
+				test.sched,
+				test.n,
+				due,
+				sched,
+				n,
+			)
+		}
+	}
+}
+
+func TestParseWhenInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"in",
+		"in 5x",
+		"in soon",
+		"in 262w",
+		"in 260w260w",
+		"in " + strings.Repeat("260w", 100),
+		"every " + strings.Repeat("260w", 100),
+		"every 30s",
+		"every",
+		"every fortnight",
+		"at",
+		"at 25:00",
+		"at 12:5",
+		"at 13pm",
+		"at 0am",
+		"tomorrow",
+		"friday noon",
+		"next week",
+	}
+	for _, in := range tests {
+		if due, _, _, err := parseWhen(strings.Fields(in), remindNow); err == nil {
+			t.Errorf("%s: expected an error, got %s", in, due)
+		}
+	}
+}
+
+func TestParseReminder(t *testing.T) {
+	tests := []struct {
+		in     string
+		to     string
+		text   string
+		errMsg string
+	}{
+		{"in 20m to eat", "bob", "eat", ""},
+		{"me at 18:30 call mom", "bob", "call mom", ""},
+		{"all every weekday 9:00 to stand up", "", "stand up", ""},
+		{"@alice tomorrow 8am to buy milk", "alice", "buy milk", ""},
+		{"@all in 5m to stand up", "", "stand up", ""},
+		{"carol in 5m to call", "carol", "call", ""},
+		{"Carol in 5m to call", "carol", "call", ""},
+		{"@dave in 5m to call", "dave", "call", ""},
+		{"take out trash in 5m", "", "", "who or when is 'take'?"},
+		{"dave in 5m to call", "", "", "who or when is 'dave'?"},
+		{"@ in 5m to call", "", "", "who or when is '@'?"},
+		{"in 20m", "", "", "remind of what?"},
+		{"2021-03-10 9:00 yesterday", "", "", "in the past"},
+		{"in 260w260w later", "", "", "too far ahead"},
+		{"2030-01-01 9:00 later", "", "", "too far ahead"},
+	}
+	for _, test := range tests {
+		r, err := parseReminder("bob", []string{"bob", "carol"}, strings.Fields(test.in), remindNow)
+		if test.errMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("%s: expected '%s', got %v", test.in, test.errMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.in, err)
+			continue
+		}
+		if r.from != "bob" || r.to != test.to || r.text != test.text {
+			t.Errorf("%s: unexpected reminder %+v", test.in, r)
+		}
+	}
+}
+
+func TestDue(t *testing.T) {
+	b := NewRemindBot(log.New(ioutil.Discard, "", 0), nil)
+	b.list = []*reminder{
+		{id: 1, text: "once", due: remindNow.Add(-time.Minute)},
+		{id: 2, text: "hourly", due: remindNow.Add(-150 * time.Minute), sched: schedule{every: time.Hour}},
+		{id: 3, text: "daily", due: remindNow.Add(-48 * time.Hour), sched: schedule{days: everyDay, hour: 9}},
+		{id: 4, text: "later", due: remindNow.Add(time.Minute)},
+		{id: 5, text: "now", due: remindNow},
+	}
+
+	ids := func(l []reminder) []uint64 {
+		r := make([]uint64, len(l))
+		for i := range l {
+			r[i] = l[i].id
+		}
+		return r
+	}
+	if got := ids(b.due(remindNow)); !reflect.DeepEqual(got, []uint64{1, 2, 3, 5}) {
+		t.Fatalf("unexpected due reminders %v", got)
+	}
+	if !b.NeedsSave() {
+		t.Fatal("reminders were sent but don't need saving")
+	}
+
+	exp := map[uint64]time.Time{
+		// rescheduled on the interval, missed ones are skipped.
+		2: remindNow.Add(30 * time.Minute),
+		3: at(3, 11, 9, 0),
+		4: remindNow.Add(time.Minute),
+	}
+	if len(b.list) != len(exp) {
+		t.Fatalf("expected %d reminders, got %d", len(exp), len(b.list))
+	}
+	for _, r := range b.list {
+		if !r.due.Equal(exp[r.id]) {
+			t.Errorf("#%d: expected %s, got %s", r.id, exp[r.id], r.due)
+		}
+	}
+
+	if got := ids(b.due(remindNow.Add(time.Minute))); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Fatalf("unexpected due reminders %v", got)
+	}
+	if got := b.due(remindNow.Add(2 * time.Minute)); len(got) != 0 {
+		t.Fatalf("unexpected due reminders %v", ids(got))
+	}
+}
+
+func TestRemindSaveLoad(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "remind")
+	l := log.New(ioutil.Discard, "", 0)
+	b := NewRemindBot(l, nil)
+	b.id = 42
+	b.list = []*reminder{
+		{id: 40, from: "bob", to: "bob", text: "eat", due: at(3, 10, 18, 30)},
+		{id: 41, from: "bob", text: "stand up", due: at(3, 11, 9, 0), sched: schedule{days: everyWeekday, hour: 9}},
+		{id: 42, from: "bob", to: "alice", text: "héllo\nthere", due: at(3, 10, 16, 0), sched: schedule{every: 2 * time.Hour}},
+	}
+	b.changed = true
+
+	if err := b.Save(f); err != nil {
+		t.Fatal(err)
+	}
+	if b.NeedsSave() {
+		t.Fatal("needs saving after save")
+	}
+
+	b2 := NewRemindBot(l, nil)
+	if err := b2.Load(f); err != nil {
+		t.Fatal(err)
+	}
+	if b2.id != b.id || len(b2.list) != len(b.list) {
+		t.Fatalf("expected id %d and %d reminders, got %d and %d", b.id, len(b.list), b2.id, len(b2.list))
+	}
+	for i, r := range b2.list {
+		o := b.list[i]
+		if !r.due.Equal(o.due) {
+			t.Errorf("#%d: expected due %s, got %s", o.id, o.due, r.due)
+		}
+		r.due = o.due
+		if !reflect.DeepEqual(r, o) {
+			t.Errorf("expected %+v, got %+v", o, r)
+		}
+	}
+
+	if err := NewRemindBot(l, nil).Load(f + "-missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f, []byte("\x00\x02v9"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRemindBot(l, nil).Load(f); err == nil {
+		t.Fatal("loaded an unknown version")
+	}
+}
@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"net"
 
 	"github.com/frizinak/homechat/client"
@@ -8,16 +9,24 @@ import (
 
 type Client struct {
 	tcpAddr string
+	tls     *tls.Config
 }
 
 type Config struct {
 	TCPAddr string
+
+	// Connect over TLS, nil for a plain tcp connection
+	TLS *tls.Config
 }
 
-func New(c Config) *Client { return &Client{c.TCPAddr} }
+func New(c Config) *Client { return &Client{c.TCPAddr, c.TLS} }
 
 func (c *Client) Connect() (client.Conn, error) {
+	if c.tls != nil {
+		return tls.Dial("tcp", c.tcpAddr, c.tls)
+	}
 	return net.Dial("tcp", c.tcpAddr)
 }
 
 func (c *Client) Framed() bool { return false }
+func (c *Client) TLS() bool    { return c.tls != nil }
@@ -1,22 +1,29 @@
 package ws
 
 import (
+	"crypto/tls"
+	"net"
+
 	"github.com/frizinak/homechat/client"
 	"golang.org/x/net/websocket"
 )
 
 type Client struct {
-	c *websocket.Config
+	c   *websocket.Config
+	tls bool
 }
 
 type Config struct {
 	TLS    bool
 	Domain string
 	Path   string
+
+	// Optional, e.g.: to trust a self-signed server certificate
+	TLSConfig *tls.Config
 }
 
 func New(c Config) (*Client, error) {
-	client := &Client{}
+	client := &Client{tls: c.TLS}
 
 	schemeWS := "wss"
 	scheme := "https"
@@ -30,8 +37,7 @@ func New(c Config) (*Client, error) {
 		return nil, err
 	}
 
-	// todo
-	// wsc.TlsConfig = tlsconf
+	wsc.TlsConfig = c.TLSConfig
 
 	client.c = wsc
 
@@ -39,7 +45,41 @@ func New(c Config) (*Client, error) {
 }
 
 func (c *Client) Connect() (client.Conn, error) {
-	return websocket.DialConfig(c.c)
+	if !c.tls {
+		return websocket.DialConfig(c.c)
+	}
+
+	// Dial TLS ourselves so the session can be exposed, see client.TLSConn.
+	addr := c.c.Location.Host
+	if c.c.Location.Port() == "" {
+		addr = net.JoinHostPort(c.c.Location.Hostname(), "443")
+	}
+	conf := &tls.Config{}
+	if c.c.TlsConfig != nil {
+		conf = c.c.TlsConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = c.c.Location.Hostname()
+	}
+
+	conn, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(c.c, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &tlsConn{ws, conn}, nil
+}
+
+type tlsConn struct {
+	*websocket.Conn
+	tls *tls.Conn
 }
 
+func (t *tlsConn) ConnectionState() tls.ConnectionState { return t.tls.ConnectionState() }
+
 func (c *Client) Framed() bool { return true }
+func (c *Client) TLS() bool    { return c.tls }
@@ -139,6 +139,7 @@ type Client struct {
 	global js.Value
 	uri    string
 	binary bool
+	tls    bool
 }
 
 type Config struct {
@@ -154,7 +155,7 @@ func New(c Config, global js.Value) (*Client, error) {
 		schemeWS = "ws"
 	}
 	uri := fmt.Sprintf("%s://%s/%s", schemeWS, c.Domain, c.Path)
-	return &Client{global: global, uri: uri, binary: c.Binary}, nil
+	return &Client{global: global, uri: uri, binary: c.Binary, tls: c.TLS}, nil
 }
 
 func (c *Client) Connect() (client.Conn, error) {
@@ -162,3 +163,4 @@ func (c *Client) Connect() (client.Conn, error) {
 }
 
 func (c *Client) Framed() bool { return true }
+func (c *Client) TLS() bool    { return c.tls }
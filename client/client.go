@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,8 +13,10 @@ import (
 	"github.com/frizinak/binary"
 	"github.com/frizinak/homechat/crypto"
 	"github.com/frizinak/homechat/server/channel"
+	bridgedata "github.com/frizinak/homechat/server/channel/bridge/data"
 	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
 	historydata "github.com/frizinak/homechat/server/channel/history/data"
+	keysdata "github.com/frizinak/homechat/server/channel/keys/data"
 	musicdata "github.com/frizinak/homechat/server/channel/music/data"
 	pingdata "github.com/frizinak/homechat/server/channel/ping/data"
 	typingdata "github.com/frizinak/homechat/server/channel/typing/data"
@@ -23,18 +26,41 @@ import (
 	"github.com/frizinak/homechat/vars"
 )
 
-var ErrFingerPrint = errors.New("fingerprint mismatch")
+var (
+	ErrFingerPrint  = errors.New("fingerprint mismatch")
+	ErrTimeout      = errors.New("request timed out")
+	ErrDisconnected = errors.New("disconnected before the server replied")
+	ErrClosed       = errors.New("client was closed")
+)
+
+const requestTimeout = time.Second * 30
+
+// RequestError is returned when the server replied to a request
+// with a non-ok status.
+type RequestError struct {
+	Channel string
+	Code    channel.StatusCode
+	Err     string
+}
+
+func (r *RequestError) Error() string {
+	return fmt.Sprintf("request on channel '%s' failed: %s", r.Channel, r.Err)
+}
 
 type Backend interface {
 	Connect() (Conn, error)
 	Framed() bool
+
+	// TLS reports whether the connection is secured by TLS,
+	// in which case the internal crypto layer is skipped.
+	TLS() bool
 }
 
 type Handler interface {
 	HandleName(name string)
 	HandleHistory()
 	HandleLatency(time.Duration)
-	HandleChatMessage(chatdata.ServerMessage) error
+	HandleChatMessage(ChatMessage) error
 	HandleMusicMessage(musicdata.ServerMessage) error
 	HandleMusicStateMessage(MusicState) error
 	HandleMusicPlaylistSongsMessage(musicdata.ServerPlaylistSongsMessage) error
@@ -42,6 +68,16 @@ type Handler interface {
 	HandleMusicNodeMessage(*musicdata.SongDataMessage) error
 	HandleTypingMessage(typingdata.ServerMessage) error
 	HandleUpdateMessage(updatedata.ServerMessage) error
+	HandleOutbox(OutboxEntry, OutboxState, error)
+	HandleConnState(ConnState)
+
+	// HandleKeyRotation is called when the server handed over from the
+	// trusted key to a new one, the new fingerprint should be persisted.
+	HandleKeyRotation(from, to string)
+
+	// HandleBridgeMessage is called with messages of a bridged server,
+	// only servers can subscribe to the BridgeChannel.
+	HandleBridgeMessage(bridgedata.Message) error
 }
 
 type User struct {
@@ -71,6 +107,15 @@ type Conn interface {
 	io.Closer
 }
 
+// TLSConn is implemented by connections of backends that use TLS and can
+// expose the session, the challenge is bound to it, see channel.TLSBinding.
+// The server refuses unbound challenges, TLS backends whose connections can't
+// expose the session (e.g.: a browser websocket) use the internal crypto
+// layer instead.
+type TLSConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
 type RW struct {
 	r    io.Reader
 	w    channel.WriteFlusher
@@ -90,6 +135,12 @@ type Client struct {
 
 	sem sync.Mutex
 
+	// dial serializes connection attempts, sem is not held while waiting
+	// for a backoff or handshake.
+	dial      sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+
 	users    Users
 	allUsers map[string]map[string]User
 
@@ -100,22 +151,53 @@ type Client struct {
 	playlists []string
 
 	conn *RW
+	mux  *channel.Mux
 
 	serverKey *crypto.PubKey
+	rotation  channel.KeyRotationMessage
 
-	lastConnect time.Time
-	fatal       error
+	// nameSem guards c.c.Name, the server can rename us on every
+	// reconnect while the outbox is sending.
+	nameSem sync.Mutex
+
+	keysSem   sync.Mutex
+	keys      map[string]PeerKey
+	keysReady chan struct{}
+
+	attempt int
+	lastErr error
+	fatal   error
 
 	serverFingerprint string
 
+	// Capabilities negotiated with the server
+	caps channel.Capabilities
+
 	lastTyping time.Time
 
+	reqSem  sync.Mutex
+	reqID   uint32
+	pending map[uint32]request
+
+	session string
+	seq     uint32
+	resumed bool
+
 	c Config
 }
 
+type request struct {
+	channel string
+	reply   chan error
+}
+
 type Config struct {
 	Key *crypto.Key
 
+	// Optional key that is presented alongside Key so servers that only
+	// know its fingerprint keep accepting this client while it migrates.
+	LegacyKey *crypto.Key
+
 	ServerURL         string
 	ServerFingerprint string
 
@@ -123,6 +205,19 @@ type Config struct {
 	Channels []string
 	Proto    channel.Proto
 	History  uint16
+
+	// Compress large frames below the encryption layer.
+	Compress bool
+
+	// Optional key to seal private messages with, the KeysChannel has to
+	// be subscribed to as well.
+	SealKey *crypto.SealKey
+
+	// Fingerprints of the keys that were verified out of band by username.
+	Verified map[string]string
+
+	// Optional outbox for the Queue* methods
+	Outbox *Outbox
 }
 
 func New(b Backend, h Handler, log Logger, c Config) *Client {
@@ -130,6 +225,11 @@ func New(b Backend, h Handler, log Logger, c Config) *Client {
 	for _, c := range c.Channels {
 		ch[c] = struct{}{}
 	}
+	verified := make(map[string]string, len(c.Verified))
+	for n, fp := range c.Verified {
+		verified[n] = fp
+	}
+	c.Verified = verified
 	return &Client{
 		backend: b,
 		handler: h,
@@ -138,7 +238,10 @@ func New(b Backend, h Handler, log Logger, c Config) *Client {
 
 		channels: ch,
 
+		closed:   make(chan struct{}),
 		allUsers: make(map[string]map[string]User),
+		pending:  make(map[uint32]request),
+		keys:     make(map[string]PeerKey),
 	}
 }
 
@@ -150,23 +253,58 @@ func (c *Client) In(ch string) bool {
 func (c *Client) Users() Users                   { return c.users }
 func (c *Client) Playlists() []string            { return c.playlists }
 func (c *Client) Latency() time.Duration         { return c.latency }
-func (c *Client) Name() string                   { return c.c.Name }
-func (c *Client) Err() error                     { return c.fatal }
 func (c *Client) ServerFingerprint() string      { return c.serverFingerprint }
 func (c *Client) ServerKey() *crypto.PubKey      { return c.serverKey }
 func (c *Client) SetTrustedFingerprint(n string) { c.c.ServerFingerprint = n }
 
+// Capabilities returns the capabilities negotiated with the server.
+func (c *Client) Capabilities() channel.Capabilities { return c.caps }
+
+// Err returns the error that stopped the client from reconnecting.
+func (c *Client) Err() error {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return c.fatal
+}
+
+func (c *Client) setFatal(err error) {
+	c.sem.Lock()
+	c.fatal = err
+	c.sem.Unlock()
+}
+
+// Name returns the name the server knows us by.
+func (c *Client) Name() string {
+	c.nameSem.Lock()
+	defer c.nameSem.Unlock()
+	return c.c.Name
+}
+
 func (c *Client) ChatTyping() error {
 	now := time.Now()
 	if now.Sub(c.lastTyping) < time.Second*2 {
 		return nil
 	}
 	c.lastTyping = now
-	return c.Send(vars.TypingChannel, typingdata.Message{Channel: vars.ChatChannel})
+	return c.sendAsync(vars.TypingChannel, typingdata.Message{Channel: vars.ChatChannel})
 }
 
+// Chat sends a signed chat message, private messages are sealed if the
+// recipient published a key.
 func (c *Client) Chat(msg string) error {
-	return c.Send(vars.ChatChannel, chatdata.Message{Data: msg})
+	m, err := c.chatMessage(chatdata.Message{Data: msg})
+	if err != nil {
+		return err
+	}
+	return c.Send(vars.ChatChannel, m)
+}
+
+func (c *Client) chatMessage(m chatdata.Message) (chatdata.Message, error) {
+	m, err := c.seal(m)
+	if err != nil {
+		return m, err
+	}
+	return c.sign(m)
 }
 
 func (c *Client) Music(msg string) error {
@@ -174,13 +312,97 @@ func (c *Client) Music(msg string) error {
 }
 
 func (c *Client) MusicSongDownload(ns, id string) error {
-	return c.Send(vars.MusicNodeChannel, musicdata.NodeMessage{NS: ns, ID: id})
+	return c.sendAsync(vars.MusicNodeChannel, musicdata.NodeMessage{NS: ns, ID: id})
 }
 
 func (c *Client) MusicPlaylistSongs(playlist string) error {
-	return c.Send(vars.MusicPlaylistSongsChannel, musicdata.PlaylistSongsMessage{Playlist: playlist})
+	return c.sendAsync(vars.MusicPlaylistSongsChannel, musicdata.PlaylistSongsMessage{Playlist: playlist})
+}
+
+// QueueChat adds a chat message to the outbox, it is sent once connected.
+func (c *Client) QueueChat(msg string) (OutboxEntry, error) {
+	return c.queue(OutboxEntry{Kind: OutboxChat, Data: msg}, nil)
+}
+
+func (c *Client) QueueMusic(msg string) (OutboxEntry, error) {
+	return c.queue(OutboxEntry{Kind: OutboxMusic, Data: msg}, nil)
+}
+
+func (c *Client) QueueUpload(chnl, filename, msg string, r io.Reader) (OutboxEntry, error) {
+	return c.queue(OutboxEntry{Kind: OutboxUpload, Channel: chnl, Filename: filename, Data: msg}, r)
 }
 
+func (c *Client) queue(e OutboxEntry, upload io.Reader) (OutboxEntry, error) {
+	if c.c.Outbox == nil {
+		return e, ErrNoOutbox
+	}
+
+	e, err := c.c.Outbox.add(e, upload)
+	if err != nil {
+		return e, err
+	}
+	c.handler.HandleOutbox(e, OutboxPending, nil)
+	return e, nil
+}
+
+func (c *Client) flushOutbox(done <-chan struct{}) {
+	o := c.c.Outbox
+	for _, e := range o.Pending() {
+		c.handler.HandleOutbox(e, OutboxPending, nil)
+	}
+
+	for {
+		e, ok := o.next(done)
+		if !ok {
+			return
+		}
+
+		err := func() error {
+			chnl, msg, closer, err := e.msg(o)
+			if err != nil {
+				return &RequestError{Channel: chnl, Code: channel.StatusNOK, Err: err.Error()}
+			}
+			if closer != nil {
+				defer closer.Close()
+			}
+			if m, ok := msg.(chatdata.Message); ok {
+				if msg, err = c.chatMessage(m); errors.Is(err, ErrKeyChanged) {
+					return &RequestError{Channel: chnl, Code: channel.StatusNOK, Err: err.Error()}
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return c.Send(chnl, msg)
+		}()
+
+		var rerr *RequestError
+		if err != nil && !errors.As(err, &rerr) {
+			if c.Err() != nil {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		if rmErr := o.remove(e.ID); rmErr != nil {
+			c.log.Err(rmErr)
+		}
+
+		if err != nil {
+			c.handler.HandleOutbox(e, OutboxFailed, err)
+			continue
+		}
+		c.handler.HandleOutbox(e, OutboxSent, nil)
+	}
+}
+
+// Send sends msg and waits for the server to acknowledge it.
+// A *RequestError is returned if the server failed to handle it.
 func (c *Client) Send(chnl string, msg channel.Msg) error {
 	_, w, err := c.connect()
 	if err != nil {
@@ -188,12 +410,74 @@ func (c *Client) Send(chnl string, msg channel.Msg) error {
 		return err
 	}
 
-	return c.send(w, chnl, msg)
+	id, reply := c.request(chnl)
+	if err := c.send(w, chnl, id, msg); err != nil {
+		c.unrequest(id)
+		return err
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-time.After(requestTimeout):
+		c.unrequest(id)
+		return ErrTimeout
+	}
+}
+
+func (c *Client) sendAsync(chnl string, msg channel.Msg) error {
+	_, w, err := c.connect()
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+
+	return c.send(w, chnl, 0, msg)
+}
+
+func (c *Client) request(chnl string) (uint32, <-chan error) {
+	c.reqSem.Lock()
+	c.reqID++
+	if c.reqID == 0 {
+		c.reqID++
+	}
+	id := c.reqID
+	reply := make(chan error, 1)
+	c.pending[id] = request{chnl, reply}
+	c.reqSem.Unlock()
+	return id, reply
+}
+
+func (c *Client) unrequest(id uint32) {
+	c.reqSem.Lock()
+	delete(c.pending, id)
+	c.reqSem.Unlock()
+}
+
+func (c *Client) handleReply(m channel.ReplyMsg) {
+	c.reqSem.Lock()
+	req, ok := c.pending[m.ID]
+	delete(c.pending, m.ID)
+	c.reqSem.Unlock()
+	if !ok {
+		return
+	}
+
+	if m.OK() {
+		req.reply <- nil
+		return
+	}
+	req.reply <- &RequestError{Channel: req.channel, Code: m.Code, Err: m.Err}
 }
 
-func (c *Client) send(w channel.WriteFlusher, chnl string, msg channel.Msg) error {
+func (c *Client) send(w channel.WriteFlusher, chnl string, id uint32, msg channel.Msg) error {
 	c.sem.Lock()
-	if err := c.write(w, channel.ChannelMsg{Data: chnl}, msg); err != nil {
+	msg = channel.ForVersion(msg, c.caps.Version(chnl))
+	if c.mux != nil && channel.IsStreamed(msg) {
+		return c.stream(w, chnl, id, msg)
+	}
+
+	if err := c.write(w, channel.ChannelMsg{Data: chnl, ID: id}.Multiplexed(true), msg); err != nil {
 		c.sem.Unlock()
 		c.disconnect()
 		return err
@@ -203,8 +487,48 @@ func (c *Client) send(w channel.WriteFlusher, chnl string, msg channel.Msg) erro
 	return nil
 }
 
+// stream sends msg on a stream of its own, other messages can be sent
+// while it is being written. c.sem is released once the stream is announced.
+func (c *Client) stream(w channel.WriteFlusher, chnl string, id uint32, msg channel.Msg) error {
+	sid, body := c.mux.Open()
+	if err := c.write(w, channel.ChannelMsg{Data: chnl, ID: id, Stream: sid}.Multiplexed(true)); err != nil {
+		c.sem.Unlock()
+		c.disconnect()
+		return err
+	}
+	c.sem.Unlock()
+
+	err := c.writeRaw(body, msg)
+	if cerr := body.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, channel.ErrStreamReset) {
+		if id != 0 {
+			// The reply will tell why.
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		c.disconnect()
+	}
+	return err
+}
+
+func (c *Client) accept(id uint32) (io.ReadCloser, error) {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	if c.mux == nil {
+		return nil, ErrDisconnected
+	}
+	return c.mux.Accept(id)
+}
+
 func (c *Client) Connect() error {
+	c.sem.Lock()
 	c.fatal = nil
+	c.attempt = 0
+	c.sem.Unlock()
 	_, _, err := c.connect()
 	if err != nil {
 		c.disconnect()
@@ -221,76 +545,225 @@ func (c *Client) Close() {
 	c.sem.Unlock()
 
 	if w != nil {
-		c.send(w, vars.EOFChannel, channel.EOF{})
+		c.send(w, vars.EOFChannel, 0, channel.EOF{})
 	}
 
+	c.closeOnce.Do(func() { close(c.closed) })
 	c.disconnect()
 }
 
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *Client) Upload(chnl, filename, msg string, size int64, r io.Reader) error {
 	return c.Send(chnl, uploaddata.NewMessage(filename, msg, size, r))
 }
 
 func (c *Client) disconnect() {
 	c.sem.Lock()
-	defer c.sem.Unlock()
 	if c.conn != nil {
 		c.conn.conn.Close()
 	}
-	c.conn = nil
+	c.conn, c.mux = nil, nil
+	c.sem.Unlock()
+
+	c.reqSem.Lock()
+	for id, req := range c.pending {
+		req.reply <- ErrDisconnected
+		delete(c.pending, id)
+	}
+	c.reqSem.Unlock()
 }
 
 func (c *Client) tryConnect() (io.Reader, channel.WriteFlusher, bool, error) {
+	c.dial.Lock()
+	defer c.dial.Unlock()
+
 	c.sem.Lock()
-	defer c.sem.Unlock()
-	conn := c.conn
+	conn, attempt, lastErr := c.conn, c.attempt, c.lastErr
+	c.sem.Unlock()
 	if conn != nil {
 		return conn.r, conn.w, false, nil
 	}
+	if c.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
 
-	for time.Since(c.lastConnect) < time.Second*2 {
-		time.Sleep(time.Second)
-		c.log.Log("reconnecting...")
+	if attempt != 0 {
+		delay := backoff(attempt - 1)
+		c.handler.HandleConnState(ConnState{State: StateBackoff, Attempt: attempt, Delay: delay, Err: lastErr})
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-c.closed:
+			t.Stop()
+			return nil, nil, false, ErrClosed
+		}
 	}
 
-	c.lastConnect = time.Now()
-	underlying, err := c.backend.Connect()
+	r, w, mux, underlying, err := c.handshake(attempt)
+	c.sem.Lock()
+	if err == nil && c.isClosed() {
+		err = ErrClosed
+	}
 	if err != nil {
+		if underlying != nil {
+			underlying.Close()
+		}
+		c.attempt++
+		c.lastErr = err
+		attempt, fatal := c.attempt, c.fatal
+		c.sem.Unlock()
+		if fatal != nil {
+			c.handler.HandleConnState(ConnState{State: StateFatal, Attempt: attempt, Err: fatal})
+		}
 		return nil, nil, true, err
 	}
 
-	c.log.Log("connecting...")
-	if err := c.negotiateProto(underlying); err != nil {
-		return nil, nil, true, err
+	c.attempt, c.lastErr = 0, nil
+	c.conn = &RW{r, w, underlying}
+	c.mux = mux
+	c.keysReady = nil
+	if c.sealing() {
+		c.keysReady = make(chan struct{})
 	}
+	c.sem.Unlock()
+
+	c.handler.HandleConnState(ConnState{State: StateConnected})
+	return r, w, true, nil
+}
 
-	c.log.Log("encrypting...")
-	fp, r, w, err := c.negotiateCrypto(underlying, underlying)
+func (c *Client) handshake(attempt int) (io.Reader, channel.WriteFlusher, *channel.Mux, io.Closer, error) {
+	c.handler.HandleConnState(ConnState{State: StateConnecting, Attempt: attempt})
+	underlying, err := c.backend.Connect()
 	if err != nil {
-		return nil, nil, true, err
+		return nil, nil, nil, nil, err
+	}
+
+	c.handler.HandleConnState(ConnState{State: StateHandshaking, Attempt: attempt})
+	tc, _ := underlying.(TLSConn)
+	native := c.backend.TLS() && tc != nil
+	if err := c.negotiateProto(underlying, native); err != nil {
+		return nil, nil, nil, underlying, err
+	}
+
+	negotiate := c.negotiateCrypto
+	if native {
+		negotiate = func(r io.Reader, w io.Writer) (string, io.Reader, channel.WriteFlusher, error) {
+			return c.negotiateChallenge(r, w, tc)
+		}
+	}
+
+	fp, r, w, err := negotiate(underlying, underlying)
+	if err != nil {
+		return nil, nil, nil, underlying, err
+	}
+	if c.c.Compress {
+		w, r = channel.NewCompressed(w, r)
 	}
+	mux := channel.NewMux(w, r)
+	w, r = mux, mux
 
 	c.serverFingerprint = fp
-	if c.c.ServerFingerprint == "" || c.c.ServerFingerprint != fp {
-		c.fatal = ErrFingerPrint
-		return nil, nil, true, ErrFingerPrint
+	if c.c.ServerFingerprint == "" || c.c.ServerFingerprint != fp && !c.rotate(fp) {
+		c.setFatal(ErrFingerPrint)
+		return nil, nil, nil, underlying, ErrFingerPrint
 	}
 
-	if r, err = c.negotiateSymmetric(r, w); err != nil {
-		return nil, nil, true, err
+	if !native {
+		if r, err = c.negotiateSymmetric(r, w); err != nil {
+			return nil, nil, nil, underlying, err
+		}
 	}
 
 	if r, err = c.negotiateUser(r, w); err != nil {
-		return nil, nil, true, err
+		return nil, nil, nil, underlying, err
 	}
-	c.log.Log("connected")
 
-	c.conn = &RW{r, w, underlying}
-	return r, w, true, nil
+	return r, w, mux, underlying, nil
+}
+
+// rotate trusts fp if the server announced it as the successor of the
+// currently trusted key.
+func (c *Client) rotate(fp string) bool {
+	old := c.c.ServerFingerprint
+	if c.rotation.Empty() || c.rotation.From() != old {
+		return false
+	}
+	if err := c.rotation.Verify(c.serverKey); err != nil {
+		return false
+	}
+
+	c.c.ServerFingerprint = fp
+	c.handler.HandleKeyRotation(old, fp)
+	return true
+}
+
+func (c *Client) readRotation(r io.Reader) (io.Reader, error) {
+	rotation, nr, err := c.read(r, channel.KeyRotationMessage{})
+	if err != nil {
+		return nr, err
+	}
+	c.rotation = rotation.(channel.KeyRotationMessage)
+	return nr, nil
+}
+
+func (c *Client) negotiateProto(w io.Writer, native bool) error {
+	base := c.c.Proto | channel.ProtoMux | channel.ProtoExt
+	proto := base | channel.ProtoAEAD
+	if native {
+		proto = base | channel.ProtoTLS | channel.ProtoBind
+	}
+	if c.c.Compress {
+		proto |= channel.ProtoDeflate
+	}
+	return proto.Write(w)
 }
 
-func (c *Client) negotiateProto(w io.Writer) error {
-	return c.c.Proto.Write(w)
+// negotiateChallenge authenticates on a TLS transport, the server's
+// signature and the challenge are bound to the session of tc.
+func (c *Client) negotiateChallenge(r io.Reader, w io.Writer, tc TLSConn) (string, io.Reader, channel.WriteFlusher, error) {
+	wf := channel.NewBuffered(w)
+	nonce, err := channel.NewChallengeNonceMessage()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := c.write(wf, nonce); err != nil {
+		return "", nil, nil, err
+	}
+	bind, err := channel.TLSBinding(tc.ConnectionState(), nonce.Nonce)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	typ := channel.PubKeyServerMessage{}.Bind(bind)
+
+	_server, nr, err := c.read(r, typ)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	server := _server.(channel.PubKeyServerMessage)
+
+	c.serverKey = server.PubKey()
+	if nr, err = c.readRotation(nr); err != nil {
+		return "", nil, nil, err
+	}
+
+	challenge, err := channel.NewPubKeyChallengeMessage(c.c.Key, c.c.LegacyKey, server)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if err := c.write(wf, challenge); err != nil {
+		return "", nil, nil, err
+	}
+
+	return server.Fingerprint(), nr, wf, nil
 }
 
 func (c *Client) negotiateCrypto(r io.Reader, w io.Writer) (string, io.Reader, channel.WriteFlusher, error) {
@@ -299,15 +772,18 @@ func (c *Client) negotiateCrypto(r io.Reader, w io.Writer) (string, io.Reader, c
 		wf = channel.NewBuffered(w)
 	}
 
-	_server, nr, err := c.read(r, channel.PubKeyServerMessage{})
+	_server, nr, err := c.read(r, channel.KeyExchangeServerMessage{})
 	if err != nil {
 		return "", nil, nil, err
 	}
-	server := _server.(channel.PubKeyServerMessage)
+	server := _server.(channel.KeyExchangeServerMessage)
 
 	c.serverKey = server.PubKey()
+	if nr, err = c.readRotation(nr); err != nil {
+		return "", nil, nil, err
+	}
 
-	client, err := channel.NewPubKeyMessage(c.c.Key, server)
+	client, err := channel.NewKeyExchangeMessage(c.c.Key, c.c.LegacyKey, server)
 	if err != nil {
 		return "", nil, nil, err
 	}
@@ -316,24 +792,17 @@ func (c *Client) negotiateCrypto(r io.Reader, w io.Writer) (string, io.Reader, c
 		return "", nil, nil, err
 	}
 
-	derive, err := channel.CommonSecret32(client, server, nil)
+	derive, err := channel.EphemeralSecret32(client, server)
 	if err != nil {
 		return "", nil, nil, err
 	}
 
-	rw := &crypto.ReadWriter{
-		crypto.NewDecrypter(nr, derive(channel.CryptoClientRead)),
-		crypto.NewEncrypter(wf, derive(channel.CryptoClientWrite)),
-	}
-
-	macRSecret := derive(channel.CryptoClientMacRead)
-	macWSecret := derive(channel.CryptoClientMacWrite)
-	macR := crypto.NewSHA1HMACReader(rw, macRSecret[:])
-	macW := crypto.NewSHA1HMACWriter(rw, macWSecret[:], 1<<16-1)
+	aeadR := crypto.NewAEADReader(nr, derive(channel.CryptoClientRead), channel.FrameSize)
+	aeadW := crypto.NewAEADWriter(wf, derive(channel.CryptoClientWrite), channel.FrameSize)
 
-	wf = &channel.WriterFlusher{macW, channel.NewFlushFlusher(macW, wf)}
+	wf = &channel.WriterFlusher{Writer: aeadW, Flusher: channel.NewFlushFlusher(aeadW, wf)}
 
-	return server.Fingerprint(), macR, wf, nil
+	return server.Fingerprint(), aeadR, wf, nil
 }
 
 func (c *Client) negotiateSymmetric(r io.Reader, w channel.WriteFlusher) (io.Reader, error) {
@@ -345,7 +814,14 @@ func (c *Client) negotiateSymmetric(r io.Reader, w channel.WriteFlusher) (io.Rea
 }
 
 func (c *Client) negotiateUser(r io.Reader, w channel.WriteFlusher) (io.Reader, error) {
-	msg := channel.IdentifyMsg{Data: c.c.Name, Channels: c.c.Channels, Version: vars.ProtocolVersion}
+	msg := channel.IdentifyMsg{
+		Data:     c.Name(),
+		Channels: c.c.Channels,
+		Version:  vars.ProtocolVersion,
+		Session:  c.session,
+		Seq:      c.seq,
+		Caps:     vars.Capabilities,
+	}.Extended(true)
 	if err := c.write(w, msg); err != nil {
 		return r, err
 	}
@@ -374,18 +850,26 @@ func (c *Client) negotiateUser(r io.Reader, w channel.WriteFlusher) (io.Reader,
 			err = errors.New("You are not allowed to connect to this server, send your fingerprint and desired username to the administrator.")
 		}
 
-		c.fatal = err
+		c.setFatal(err)
 		return nr, err
 	}
 
-	_identity, nr, err := c.read(nr, channel.IdentifyMsg{})
+	_identity, nr, err := c.read(nr, channel.IdentifyMsg{}.Extended(true))
 	if err != nil {
 		return nr, err
 	}
 
 	identity := _identity.(channel.IdentifyMsg)
+	c.caps = identity.Caps
+	c.resumed = c.session != "" && identity.Session == c.session
+	c.session = identity.Session
+	if !c.resumed {
+		c.seq = 0
+	}
+	c.nameSem.Lock()
 	c.c.Name = identity.Data
-	c.handler.HandleName(c.c.Name)
+	c.nameSem.Unlock()
+	c.handler.HandleName(identity.Data)
 	return nr, nil
 }
 
@@ -395,17 +879,20 @@ func (c *Client) connect() (io.Reader, channel.WriteFlusher, error) {
 	}
 
 	r, w, reconn, err := c.tryConnect()
-	if !reconn || err != nil {
+	if reconn && err == nil && c.sealing() {
+		err = c.publishKey(w)
+	}
+	if !reconn || err != nil || c.resumed {
 		return r, w, err
 	}
 
 	if c.c.History > 0 {
-		if err = c.send(w, vars.HistoryChannel, historydata.New(c.c.History)); err != nil {
+		if err = c.send(w, vars.HistoryChannel, 0, historydata.New(c.c.History)); err != nil {
 			return r, w, err
 		}
 	}
 
-	return r, w, c.send(w, vars.UserChannel, usersdata.Message{})
+	return r, w, c.send(w, vars.UserChannel, 0, usersdata.Message{})
 }
 
 func (c *Client) writeRaw(w io.Writer, m channel.Msg) error {
@@ -444,11 +931,15 @@ func (c *Client) read(r io.Reader, msg channel.Msg) (channel.Msg, io.Reader, err
 
 func (c *Client) Run() error {
 	var pingSent time.Time
-	done := make(chan struct{}, 1)
+	done := make(chan struct{})
+	if c.c.Outbox != nil {
+		go c.flushOutbox(done)
+	}
+
 	go func() {
 		for {
 			pingSent = time.Now()
-			if err := c.Send(vars.PingChannel, pingdata.Message{}); err != nil {
+			if err := c.sendAsync(vars.PingChannel, pingdata.Message{}); err != nil {
 				c.log.Err(err)
 			}
 			select {
@@ -461,20 +952,31 @@ func (c *Client) Run() error {
 
 	musicState := MusicState{}
 
+	var seq uint32
 	doOne := func(r io.Reader) (io.Reader, error) {
 		var msg channel.Msg
 		var err error
 
-		msg, r, err = c.read(r, channel.ChannelMsg{})
+		msg, r, err = c.read(r, channel.ChannelMsg{}.Multiplexed(true))
 		if err != nil {
 			return r, err
 		}
 		chnl := msg.(channel.ChannelMsg)
+		seq = chnl.Seq
+		if chnl.Stream != 0 && chnl.Data != vars.MusicNodeChannel {
+			return r, fmt.Errorf("received unexpected stream for: '%s'", chnl.Data)
+		}
 
 		switch chnl.Data {
 		case vars.PingChannel:
 			c.latency = time.Since(pingSent)
 			c.handler.HandleLatency(c.latency)
+		case vars.ReplyChannel:
+			msg, r, err = c.read(r, channel.ReplyMsg{})
+			if err != nil {
+				return r, err
+			}
+			c.handleReply(msg.(channel.ReplyMsg))
 		case vars.HistoryChannel:
 			_, r, err = c.read(r, historydata.ServerMessage{})
 			if err != nil {
@@ -482,11 +984,20 @@ func (c *Client) Run() error {
 			}
 			c.handler.HandleHistory()
 		case vars.ChatChannel:
-			msg, r, err = c.read(r, chatdata.ServerMessage{})
+			msg, r, err = c.read(r, chatdata.ServerMessage{}.ForVersion(c.caps.Version(chnl.Data)))
 			if err != nil {
 				return r, err
 			}
-			return r, c.handler.HandleChatMessage(msg.(chatdata.ServerMessage))
+			sm := msg.(chatdata.ServerMessage)
+			cm := c.open(sm)
+			cm.Signed, cm.SigErr = c.verify(sm)
+			return r, c.handler.HandleChatMessage(cm)
+		case vars.KeysChannel:
+			msg, r, err = c.read(r, keysdata.ServerMessage{})
+			if err != nil {
+				return r, err
+			}
+			c.handleKeys(msg.(keysdata.ServerMessage))
 		case vars.TypingChannel:
 			msg, r, err = c.read(r, typingdata.ServerMessage{})
 			if err != nil {
@@ -494,7 +1005,7 @@ func (c *Client) Run() error {
 			}
 
 			m := msg.(typingdata.ServerMessage)
-			if m.Who == c.c.Name || !c.In(m.Channel) {
+			if m.Who == c.Name() || !c.In(m.Channel) {
 				return r, nil
 			}
 			return r, c.handler.HandleTypingMessage(m)
@@ -575,11 +1086,28 @@ func (c *Client) Run() error {
 			}
 			c.log.Flash(msg.Err, 0)
 		case vars.MusicNodeChannel:
-			msg, r, err = c.read(r, &musicdata.SongDataMessage{})
+			if chnl.Stream == 0 {
+				msg, r, err = c.read(r, &musicdata.SongDataMessage{})
+				if err != nil {
+					return r, err
+				}
+				return r, c.handler.HandleMusicNodeMessage(msg.(*musicdata.SongDataMessage))
+			}
+
+			body, err := c.accept(chnl.Stream)
 			if err != nil {
 				return r, err
 			}
-			return r, c.handler.HandleMusicNodeMessage(msg.(*musicdata.SongDataMessage))
+			go func() {
+				defer body.Close()
+				msg, _, err := c.read(body, &musicdata.SongDataMessage{})
+				if err == nil {
+					err = c.handler.HandleMusicNodeMessage(msg.(*musicdata.SongDataMessage))
+				}
+				if err != nil {
+					c.log.Err(err)
+				}
+			}()
 		case vars.UpdateChannel:
 			msg, r, err = c.read(r, updatedata.ServerMessage{})
 			if err != nil {
@@ -592,8 +1120,14 @@ func (c *Client) Run() error {
 				return r, err
 			}
 			return r, c.handler.HandleMusicPlaylistSongsMessage(msg.(musicdata.ServerPlaylistSongsMessage))
+		case vars.BridgeChannel:
+			msg, r, err = c.read(r, bridgedata.Message{})
+			if err != nil {
+				return r, err
+			}
+			return r, c.handler.HandleBridgeMessage(msg.(bridgedata.Message))
 		default:
-			return r, fmt.Errorf("received unknown message type: '%s'", chnl)
+			return r, fmt.Errorf("received unknown message type: '%s'", chnl.Data)
 		}
 
 		return r, nil
@@ -602,10 +1136,14 @@ func (c *Client) Run() error {
 	do := func(r io.Reader) error {
 		var err error
 		for {
+			seq = 0
 			r, err = doOne(r)
 			if err != nil {
 				return err
 			}
+			if seq != 0 {
+				c.seq = seq
+			}
 		}
 	}
 
@@ -613,6 +1151,9 @@ func (c *Client) Run() error {
 	for {
 		r, _, err := c.connect()
 		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				break
+			}
 			if err := c.Err(); err != nil {
 				gerr = err
 				break
@@ -625,10 +1166,15 @@ func (c *Client) Run() error {
 		if err := do(r); err != nil {
 			c.disconnect()
 			c.log.Err(err)
+			c.sem.Lock()
+			if c.conn == nil && c.attempt == 0 {
+				c.attempt, c.lastErr = 1, err
+			}
+			c.sem.Unlock()
 			continue
 		}
 	}
 
-	done <- struct{}{}
+	close(done)
 	return gerr
 }
@@ -0,0 +1,61 @@
+package client_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/client"
+	"github.com/frizinak/homechat/client/handler"
+	"github.com/frizinak/homechat/ui"
+)
+
+type offline struct{ attempts chan struct{} }
+
+func (o offline) Connect() (client.Conn, error) {
+	select {
+	case o.attempts <- struct{}{}:
+	default:
+	}
+	return nil, errors.New("offline")
+}
+func (o offline) Framed() bool { return false }
+func (o offline) TLS() bool    { return false }
+
+func TestCloseDuringBackoff(t *testing.T) {
+	b := offline{make(chan struct{}, 10)}
+	cl := client.New(b, handler.NoopHandler{}, ui.Plain(ioutil.Discard), client.Config{})
+
+	errs := make(chan error, 1)
+	go func() { errs <- cl.Run() }()
+
+	// the second attempt backs off for at least half a second.
+	<-b.attempts
+	time.Sleep(time.Millisecond * 50)
+
+	closed := make(chan struct{})
+	go func() {
+		cl.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Millisecond * 200):
+		t.Fatal("Close blocked during backoff")
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Millisecond * 200):
+		t.Fatal("Run did not return after Close")
+	}
+
+	if err := cl.Chat("hi"); !errors.Is(err, client.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
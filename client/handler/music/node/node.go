@@ -241,3 +241,13 @@ func (h *Handler) HandleLatency(d time.Duration) {
 	h.latencies.Add(d)
 	h.latencies.Median()
 }
+
+func (h *Handler) HandleConnState(s client.ConnState) {
+	h.Handler.HandleConnState(s)
+	if s.Online() || h.paused {
+		return
+	}
+
+	h.p.Pause()
+	h.paused = true
+}
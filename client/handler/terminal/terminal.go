@@ -7,12 +7,21 @@ import (
 	"github.com/frizinak/homechat/client"
 	"github.com/frizinak/homechat/ui"
 
-	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
 	musicdata "github.com/frizinak/homechat/server/channel/music/data"
 	typingdata "github.com/frizinak/homechat/server/channel/typing/data"
 	usersdata "github.com/frizinak/homechat/server/channel/users/data"
 )
 
+const (
+	lockVerified   = "\U0001F512"
+	lockUnverified = "\U0001F512?"
+	lockBroken     = "\U0001F512!"
+	lockNone       = "[not encrypted]"
+
+	sigMissing = "[unsigned]"
+	sigInvalid = "[invalid signature: %s]"
+)
+
 type Updates interface {
 	client.Logger
 	Broadcast(msg []ui.Msg, scroll bool)
@@ -21,7 +30,10 @@ type Updates interface {
 	Users([]string)
 	UserTyping(string, bool)
 	Latency(time.Duration)
+	Online(bool)
 	Clear()
+	Pending(id uint64, msg ui.Msg)
+	Unpending(id uint64)
 }
 
 type Handler struct {
@@ -29,7 +41,7 @@ type Handler struct {
 	log Updates
 
 	musicState chan ui.State
-	msgs       chan chatdata.ServerMessage
+	msgs       chan client.ChatMessage
 	songs      chan musicdata.ServerMessage
 	typing     chan typingdata.ServerMessage
 
@@ -44,7 +56,7 @@ func New(log Updates, handler client.Handler) *Handler {
 		log:     log,
 
 		musicState: make(chan ui.State, 1),
-		msgs:       make(chan chatdata.ServerMessage, 8),
+		msgs:       make(chan client.ChatMessage, 8),
 		songs:      make(chan musicdata.ServerMessage, 8),
 		typing:     make(chan typingdata.ServerMessage, 8),
 
@@ -64,7 +76,7 @@ func (h *Handler) HandleLatency(l time.Duration) {
 	h.log.Latency(l)
 }
 
-func (h *Handler) HandleChatMessage(m chatdata.ServerMessage) error {
+func (h *Handler) HandleChatMessage(m client.ChatMessage) error {
 	h.msgs <- m
 	return nil
 }
@@ -94,6 +106,43 @@ func (h *Handler) HandleUsersMessage(m usersdata.ServerMessage, users client.Use
 	return nil
 }
 
+func (h *Handler) HandleConnState(s client.ConnState) {
+	h.log.Online(s.Online())
+	if s.State == client.StateFatal {
+		h.log.Err(s.Err)
+		return
+	}
+	h.log.Log(s.String())
+}
+
+func (h *Handler) HandleKeyRotation(from, to string) {
+	h.log.Log(fmt.Sprintf("server rotated its key, now trusting %s", to))
+}
+
+func (h *Handler) HandleOutbox(e client.OutboxEntry, s client.OutboxState, err error) {
+	switch s {
+	case client.OutboxPending:
+		msg := ui.Msg{
+			Meta:      fmt.Sprintf("%s %15s", "    pending", h.name),
+			Highlight: ui.HLMuted,
+		}
+		switch e.Kind {
+		case client.OutboxChat:
+			msg.Message = e.Data
+		case client.OutboxUpload:
+			msg.Message = fmt.Sprintf("[upload: %s] %s", e.Filename, e.Data)
+		default:
+			return
+		}
+		h.log.Pending(e.ID, msg)
+	case client.OutboxSent:
+		h.log.Unpending(e.ID)
+	case client.OutboxFailed:
+		h.log.Unpending(e.ID)
+		h.log.Err(err)
+	}
+}
+
 func (h *Handler) HandleTypingMessage(m typingdata.ServerMessage) error {
 	h.typing <- m
 	return nil
@@ -171,6 +220,28 @@ func (h *Handler) Run(notify chan ui.Msg) {
 				Notify:  msg.Notify,
 			}
 
+			switch msg.Lock {
+			case client.LockVerified:
+				m.Message = fmt.Sprintf("%s %s", lockVerified, m.Message)
+			case client.LockUnverified:
+				m.Message = fmt.Sprintf("%s %s", lockUnverified, m.Message)
+			case client.LockBroken:
+				m.Message = fmt.Sprintf("%s %s", lockBroken, msg.Err)
+			case client.LockNone:
+				if msg.PM != "" && !msg.Bot {
+					m.Message = fmt.Sprintf("%s %s", lockNone, m.Message)
+				}
+			}
+
+			if !msg.Bot {
+				switch msg.Signed {
+				case client.SignedNone:
+					m.Message = fmt.Sprintf("%s %s", sigMissing, m.Message)
+				case client.SignedInvalid:
+					m.Message = fmt.Sprintf("%s %s", fmt.Sprintf(sigInvalid, msg.SigErr), m.Message)
+				}
+			}
+
 			if msg.PM != "" {
 				m.Message = fmt.Sprintf("[%s > %s] %s", msg.From, msg.PM, m.Message)
 				if msg.PM == h.name {
@@ -190,6 +261,10 @@ func (h *Handler) Run(notify chan ui.Msg) {
 				m.Highlight |= ui.HLMuted
 			}
 
+			if msg.Lock == client.LockBroken || msg.Signed == client.SignedInvalid {
+				m.Highlight |= ui.HLProblem
+			}
+
 			msgsBatch <- m
 			if notify != nil {
 				notify <- m
@@ -36,7 +36,7 @@ func NewUpdateHandler(
 }
 
 func (u *UpdateHandler) Download(os, arch string, w io.Writer) error {
-	u.done = make(chan error)
+	u.done = make(chan error, 1)
 	u.w = w
 	err := u.cl.Send(vars.UpdateChannel, updatedata.Message{GOOS: os, GOARCH: arch})
 	if err != nil {
@@ -0,0 +1,248 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	musicdata "github.com/frizinak/homechat/server/channel/music/data"
+	uploaddata "github.com/frizinak/homechat/server/channel/upload/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+var ErrNoOutbox = errors.New("client has no outbox")
+
+type OutboxKind byte
+
+const (
+	OutboxChat OutboxKind = iota
+	OutboxMusic
+	OutboxUpload
+)
+
+type OutboxState byte
+
+const (
+	OutboxPending OutboxState = iota
+	OutboxSent
+	OutboxFailed
+)
+
+type OutboxEntry struct {
+	ID      uint64
+	Kind    OutboxKind
+	Created time.Time
+
+	// Chat message, music command or upload message
+	Data string
+
+	Channel  string
+	Filename string
+	Size     int64
+
+	// MessageID lets the server recognize a chat message that is resent
+	// because its acknowledgement got lost.
+	MessageID string
+
+	// Spooled upload of an in-memory outbox.
+	upload string
+}
+
+func (e OutboxEntry) msg(o *Outbox) (string, channel.Msg, io.Closer, error) {
+	switch e.Kind {
+	case OutboxChat:
+		return vars.ChatChannel, chatdata.Message{Data: e.Data, ID: e.MessageID}, nil, nil
+	case OutboxMusic:
+		return vars.MusicChannel, musicdata.Message{Command: e.Data}, nil, nil
+	case OutboxUpload:
+		f, err := os.Open(o.uploadFile(e))
+		if err != nil {
+			return e.Channel, nil, nil, err
+		}
+		return e.Channel, uploaddata.NewMessage(e.Filename, e.Data, e.Size, f), f, nil
+	}
+
+	return "", nil, nil, fmt.Errorf("invalid outbox entry kind %d", e.Kind)
+}
+
+// Outbox holds messages until the server acknowledged them.
+// If dir is not empty, the outbox is persisted to that directory, uploads
+// are spooled to a temporary file otherwise.
+type Outbox struct {
+	sem     sync.Mutex
+	dir     string
+	id      uint64
+	entries []OutboxEntry
+	notify  chan struct{}
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	o := &Outbox{dir: dir, entries: make([]OutboxEntry, 0), notify: make(chan struct{}, 1)}
+	if dir == "" {
+		return o, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(o.file())
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&o.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox %s: %w", o.file(), err)
+	}
+
+	for _, e := range o.entries {
+		if e.ID > o.id {
+			o.id = e.ID
+		}
+	}
+
+	return o, nil
+}
+
+func (o *Outbox) file() string { return filepath.Join(o.dir, "outbox.json") }
+func (o *Outbox) uploadFile(e OutboxEntry) string {
+	if o.dir == "" {
+		return e.upload
+	}
+	return filepath.Join(o.dir, fmt.Sprintf("upload-%d", e.ID))
+}
+
+func (o *Outbox) save() error {
+	if o.dir == "" {
+		return nil
+	}
+
+	tmp := o.file() + ".tmp"
+	err := func() error {
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return json.NewEncoder(f).Encode(o.entries)
+	}()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, o.file())
+}
+
+func (o *Outbox) Pending() []OutboxEntry {
+	o.sem.Lock()
+	l := make([]OutboxEntry, len(o.entries))
+	copy(l, o.entries)
+	o.sem.Unlock()
+	return l
+}
+
+func (o *Outbox) add(e OutboxEntry, upload io.Reader) (OutboxEntry, error) {
+	o.sem.Lock()
+	defer o.sem.Unlock()
+	o.id++
+	e.ID = o.id
+	e.Created = time.Now()
+
+	if e.Kind == OutboxChat {
+		id := make([]byte, 12)
+		if _, err := io.ReadFull(rand.Reader, id); err != nil {
+			return e, err
+		}
+		e.MessageID = base64.RawURLEncoding.EncodeToString(id)
+	}
+
+	if upload != nil {
+		var err error
+		if e, err = o.spool(e, upload); err != nil {
+			return e, err
+		}
+	}
+
+	o.entries = append(o.entries, e)
+	if err := o.save(); err != nil {
+		o.entries = o.entries[:len(o.entries)-1]
+		if upload != nil {
+			os.Remove(o.uploadFile(e))
+		}
+		return e, err
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+
+	return e, nil
+}
+
+func (o *Outbox) spool(e OutboxEntry, r io.Reader) (OutboxEntry, error) {
+	var f *os.File
+	var err error
+	if o.dir == "" {
+		f, err = ioutil.TempFile("", "homechat-upload-")
+	} else {
+		f, err = os.Create(o.uploadFile(e))
+	}
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+	e.upload = f.Name()
+	e.Size, err = io.Copy(f, r)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return e, err
+}
+
+func (o *Outbox) remove(id uint64) error {
+	o.sem.Lock()
+	defer o.sem.Unlock()
+	for i, e := range o.entries {
+		if e.ID != id {
+			continue
+		}
+		o.entries = append(o.entries[:i], o.entries[i+1:]...)
+		if e.Kind == OutboxUpload {
+			os.Remove(o.uploadFile(e))
+		}
+		break
+	}
+
+	return o.save()
+}
+
+func (o *Outbox) next(done <-chan struct{}) (OutboxEntry, bool) {
+	for {
+		o.sem.Lock()
+		if len(o.entries) != 0 {
+			e := o.entries[0]
+			o.sem.Unlock()
+			return e, true
+		}
+		o.sem.Unlock()
+
+		select {
+		case <-o.notify:
+		case <-done:
+			return OutboxEntry{}, false
+		}
+	}
+}
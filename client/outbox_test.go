@@ -0,0 +1,140 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	uploaddata "github.com/frizinak/homechat/server/channel/upload/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+func ids(l []OutboxEntry) []uint64 {
+	r := make([]uint64, len(l))
+	for i := range l {
+		r[i] = l[i].ID
+	}
+	return r
+}
+
+func TestOutboxReload(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []struct {
+		e      OutboxEntry
+		upload string
+	}{
+		{OutboxEntry{Kind: OutboxChat, Data: "one"}, ""},
+		{OutboxEntry{Kind: OutboxMusic, Data: "play"}, ""},
+		{OutboxEntry{Kind: OutboxUpload, Channel: vars.UploadChannel, Filename: "f.txt", Data: "a file"}, "contents"},
+		{OutboxEntry{Kind: OutboxChat, Data: "two"}, ""},
+	}
+	for _, e := range entries {
+		var r io.Reader
+		if e.upload != "" {
+			r = strings.NewReader(e.upload)
+		}
+		if _, err := o.add(e.e, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restart keeps the entries, their order and their message ids.
+	o2, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := o.Pending(), o2.Pending()
+	if !reflect.DeepEqual(ids(after), []uint64{1, 2, 3, 4}) {
+		t.Fatalf("unexpected entries after reload: %v", ids(after))
+	}
+	for i := range before {
+		b, a := before[i], after[i]
+		if !a.Created.Equal(b.Created) {
+			t.Errorf("#%d: created changed from %s to %s", b.ID, b.Created, a.Created)
+		}
+		a.Created, b.Created, b.upload = time.Time{}, time.Time{}, ""
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("expected %+v, got %+v", b, a)
+		}
+	}
+	if after[0].MessageID == "" || after[0].MessageID == after[3].MessageID || after[1].MessageID != "" {
+		t.Fatalf("unexpected message ids %q %q %q", after[0].MessageID, after[1].MessageID, after[3].MessageID)
+	}
+
+	// the spooled upload survives as well.
+	chnl, msg, closer, err := after[2].msg(o2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := msg.(uploaddata.Message)
+	if chnl != vars.UploadChannel || up.Filename != "f.txt" || up.Size != int64(len("contents")) {
+		t.Fatalf("unexpected upload %s %+v", chnl, up)
+	}
+	closer.Close()
+
+	// ids continue after the highest one and the outbox is sent in order.
+	e, err := o2.add(OutboxEntry{Kind: OutboxChat, Data: "three"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != 5 {
+		t.Fatalf("expected id 5, got %d", e.ID)
+	}
+	done := make(chan struct{})
+	close(done)
+	for _, id := range []uint64{1, 2, 3, 4, 5} {
+		e, ok := o2.next(done)
+		if !ok || e.ID != id {
+			t.Fatalf("expected #%d next, got #%d", id, e.ID)
+		}
+		if err := o2.remove(e.ID); err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind == OutboxUpload {
+			if _, err := os.Stat(o2.uploadFile(e)); !os.IsNotExist(err) {
+				t.Fatalf("upload not removed: %v", err)
+			}
+		}
+	}
+	if _, ok := o2.next(done); ok {
+		t.Fatal("empty outbox returned an entry")
+	}
+
+	o3, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := o3.Pending(); len(l) != 0 {
+		t.Fatalf("removed entries came back: %v", ids(l))
+	}
+}
+
+func TestOutboxMemory(t *testing.T) {
+	o, err := NewOutbox("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := o.add(OutboxEntry{Kind: OutboxUpload, Channel: vars.UploadChannel, Filename: "f"}, strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadFile(o.uploadFile(e))
+	if err != nil || string(d) != "data" {
+		t.Fatalf("upload not spooled: %q %v", d, err)
+	}
+	if err := o.remove(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(o.uploadFile(e)); !os.IsNotExist(err) {
+		t.Fatalf("spooled upload not removed: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	keysdata "github.com/frizinak/homechat/server/channel/keys/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+var (
+	ErrKeyChanged      = errors.New("key changed since it was verified")
+	ErrNoKey           = errors.New("no published key")
+	ErrSealUnsupported = errors.New("server does not relay sealed messages")
+	ErrNoSealKey       = errors.New("no seal key configured")
+	ErrSenderKey       = errors.New("sealed with a key the sender did not publish")
+	ErrPeerFingerprint = errors.New("fingerprint does not match")
+)
+
+// Lock describes whether a chat message was end-to-end encrypted.
+type Lock byte
+
+const (
+	// LockNone: the message was not end-to-end encrypted.
+	LockNone Lock = iota
+	// LockUnverified: encrypted, but the key of the other party was not
+	// verified.
+	LockUnverified
+	// LockVerified: encrypted with a key that was verified out of band.
+	LockVerified
+	// LockBroken: encrypted but could not be opened or authenticated,
+	// see ChatMessage.Err.
+	LockBroken
+)
+
+// ChatMessage is a chat message as received from the server, sealed
+// messages are opened and signatures verified.
+type ChatMessage struct {
+	chatdata.ServerMessage
+	Lock Lock
+	Err  error
+
+	Signed Signed
+	SigErr error
+}
+
+// PeerKey is the seal key a user published.
+type PeerKey struct {
+	Name string
+	Key  []byte
+
+	// Fingerprint of the identity key that signed Key, this is what users
+	// compare out of band.
+	Fingerprint string
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+}
+
+func (c *Client) sealing() bool {
+	return c.c.SealKey != nil && c.In(vars.KeysChannel)
+}
+
+// PeerKey returns the key user name published.
+func (c *Client) PeerKey(name string) (PeerKey, bool) {
+	c.keysSem.Lock()
+	defer c.keysSem.Unlock()
+	k, ok := c.keys[name]
+	return k, ok
+}
+
+// PeerKeys returns all published keys.
+func (c *Client) PeerKeys() []PeerKey {
+	c.keysSem.Lock()
+	defer c.keysSem.Unlock()
+	l := make([]PeerKey, 0, len(c.keys))
+	for _, k := range c.keys {
+		l = append(l, k)
+	}
+	return l
+}
+
+// Verified reports whether the key of user name matches the one that was
+// verified.
+func (c *Client) Verified(name string) bool {
+	c.keysSem.Lock()
+	defer c.keysSem.Unlock()
+	return c.verified(name)
+}
+
+func (c *Client) verified(name string) bool {
+	k, ok := c.keys[name]
+	return ok && c.c.Verified[name] == k.Fingerprint
+}
+
+// Verify marks the key of user name as verified if its fingerprint matches
+// the one the user handed over out of band.
+func (c *Client) Verify(name, fingerprint string) error {
+	c.keysSem.Lock()
+	defer c.keysSem.Unlock()
+	k, ok := c.keys[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrNoKey)
+	}
+	if normalizeFingerprint(fingerprint) != normalizeFingerprint(k.Fingerprint) {
+		return fmt.Errorf("%s: %w", name, ErrPeerFingerprint)
+	}
+	c.c.Verified[name] = k.Fingerprint
+	return nil
+}
+
+// VerifiedKeys returns the fingerprints of all verified keys by user name.
+func (c *Client) VerifiedKeys() map[string]string {
+	c.keysSem.Lock()
+	defer c.keysSem.Unlock()
+	m := make(map[string]string, len(c.c.Verified))
+	for n, fp := range c.c.Verified {
+		m[n] = fp
+	}
+	return m
+}
+
+func (c *Client) publishKey(w channel.WriteFlusher) error {
+	k, err := keysdata.NewKey(c.Name(), c.c.SealKey.Public(), c.c.Key)
+	if err != nil {
+		return err
+	}
+	return c.send(w, vars.KeysChannel, 0, keysdata.Message{Key: k})
+}
+
+func (c *Client) handleKeys(m keysdata.ServerMessage) {
+	keys := make(map[string]PeerKey, len(m.Keys))
+	for _, k := range m.Keys {
+		pub, err := k.Verify()
+		if err != nil {
+			c.log.Err(fmt.Errorf("ignoring key of %s: %w", k.Name, err))
+			continue
+		}
+		keys[k.Name] = PeerKey{Name: k.Name, Key: k.Key, Fingerprint: pub.FingerprintString()}
+	}
+
+	c.keysSem.Lock()
+	for n, k := range keys {
+		fp, ok := c.c.Verified[n]
+		if ok && fp != k.Fingerprint && c.keys[n].Fingerprint != k.Fingerprint {
+			c.log.Err(fmt.Errorf("%s: %w", n, ErrKeyChanged))
+		}
+	}
+	c.keys = keys
+	c.keysSem.Unlock()
+
+	c.sem.Lock()
+	ready := c.keysReady
+	c.sem.Unlock()
+	if ready == nil {
+		return
+	}
+	select {
+	case <-ready:
+	default:
+		close(ready)
+	}
+}
+
+// waitKeys connects and waits until the server sent the published keys.
+func (c *Client) waitKeys() error {
+	if _, _, err := c.connect(); err != nil {
+		c.disconnect()
+		return err
+	}
+
+	c.sem.Lock()
+	ready := c.keysReady
+	c.sem.Unlock()
+	if ready == nil {
+		return ErrDisconnected
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-time.After(requestTimeout):
+		return ErrTimeout
+	}
+}
+
+// seal seals a private message if its recipient published a key.
+// Messages to a recipient whose key was verified are never sent unsealed.
+func (c *Client) seal(m chatdata.Message) (chatdata.Message, error) {
+	to, body := chatdata.Private(m.Data)
+	if to == "" || body == "" {
+		return m, nil
+	}
+
+	c.keysSem.Lock()
+	fp, verified := c.c.Verified[to]
+	c.keysSem.Unlock()
+	if !c.sealing() {
+		if verified {
+			return m, fmt.Errorf("%s: %w", to, ErrNoSealKey)
+		}
+		return m, nil
+	}
+
+	if err := c.waitKeys(); err != nil {
+		return m, err
+	}
+	if c.caps.Version(vars.ChatChannel) < 2 {
+		if verified {
+			return m, fmt.Errorf("%s: %w", to, ErrSealUnsupported)
+		}
+		return m, nil
+	}
+
+	c.keysSem.Lock()
+	k, ok := c.keys[to]
+	own, ownOK := c.keys[c.Name()]
+	c.keysSem.Unlock()
+	switch {
+	case verified && !ok:
+		return m, fmt.Errorf("%s: %w", to, ErrNoKey)
+	case verified && fp != k.Fingerprint:
+		return m, fmt.Errorf("%s: %w", to, ErrKeyChanged)
+	case verified && (!ownOK || !bytes.Equal(own.Key, c.c.SealKey.Public())):
+		return m, fmt.Errorf("%s: %w", c.Name(), ErrNoKey)
+	case !ok || !ownOK || !bytes.Equal(own.Key, c.c.SealKey.Public()):
+		// The recipient can't open it or can't tell it was sent by us.
+		return m, nil
+	}
+
+	sealed, err := c.c.SealKey.Seal(k.Key, []byte(body))
+	if err != nil {
+		return m, err
+	}
+
+	return chatdata.Message{
+		ID:   m.ID,
+		Data: "@" + to,
+		Sealed: &chatdata.Sealed{
+			From: c.c.SealKey.Public(),
+			To:   k.Key,
+			Data: sealed,
+		},
+	}, nil
+}
+
+// open opens a sealed message and checks whether it was sealed with the keys
+// the sender and recipient published.
+func (c *Client) open(m chatdata.ServerMessage) ChatMessage {
+	cm := ChatMessage{ServerMessage: m}
+	s := m.Sealed
+	if s == nil {
+		return cm
+	}
+
+	cm.Lock = LockBroken
+	if c.c.SealKey == nil {
+		cm.Err = ErrNoSealKey
+		return cm
+	}
+
+	own, peer, peerKey := s.From, m.PM, s.To
+	if m.From != c.Name() {
+		own, peer, peerKey = s.To, m.From, s.From
+	}
+	if !bytes.Equal(own, c.c.SealKey.Public()) {
+		cm.Err = errors.New("sealed for a different key of yours")
+		return cm
+	}
+
+	c.keysSem.Lock()
+	k, ok := c.keys[peer]
+	verified := c.verified(peer)
+	c.keysSem.Unlock()
+	if peer == c.Name() {
+		k, ok, verified = PeerKey{Key: own}, true, true
+	}
+	if !ok || !bytes.Equal(k.Key, peerKey) {
+		cm.Err = ErrSenderKey
+		if m.From == c.Name() {
+			cm.Err = fmt.Errorf("sealed for a key %s no longer uses", peer)
+		}
+		return cm
+	}
+
+	plain, err := c.c.SealKey.Open(s.From, s.To, s.Data)
+	if err != nil {
+		cm.Err = err
+		return cm
+	}
+
+	cm.Data = string(plain)
+	cm.Lock = LockUnverified
+	if verified {
+		cm.Lock = LockVerified
+	}
+	return cm
+}
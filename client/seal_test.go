@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+// connectedClient returns a client that acts as if it is connected and
+// received keys.
+func connectedClient(t *testing.T, seal *crypto.SealKey, chat uint8, verified map[string]string, keys ...PeerKey) *Client {
+	c := New(nil, nil, nil, Config{
+		Name:     "alice",
+		Channels: []string{vars.ChatChannel, vars.KeysChannel},
+		SealKey:  seal,
+		Verified: verified,
+	})
+	ready := make(chan struct{})
+	close(ready)
+	c.conn, c.keysReady = &RW{}, ready
+	c.caps = channel.Capabilities{vars.ChatChannel: chat}
+	for _, k := range keys {
+		c.keys[k.Name] = k
+	}
+	return c
+}
+
+func TestSealVerified(t *testing.T) {
+	own, err := crypto.NewSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := crypto.NewSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := PeerKey{Name: "alice", Key: own.Public(), Fingerprint: "a"}
+	bob := PeerKey{Name: "bob", Key: peer.Public(), Fingerprint: "b"}
+	verified := map[string]string{"bob": "b"}
+
+	tests := []struct {
+		name   string
+		client *Client
+		err    error
+		sealed bool
+	}{
+		{"no seal key", connectedClient(t, nil, 2, verified, alice, bob), ErrNoSealKey, false},
+		{"no seal key unverified", connectedClient(t, nil, 2, nil, alice, bob), nil, false},
+		{"old server", connectedClient(t, own, 1, verified, alice, bob), ErrSealUnsupported, false},
+		{"old server unverified", connectedClient(t, own, 1, nil, alice, bob), nil, false},
+		{"no peer key", connectedClient(t, own, 2, verified, alice), ErrNoKey, false},
+		{"no peer key unverified", connectedClient(t, own, 2, nil, alice), nil, false},
+		{"no own key", connectedClient(t, own, 2, verified, bob), ErrNoKey, false},
+		{"changed", connectedClient(t, own, 2, map[string]string{"bob": "old"}, alice, bob), ErrKeyChanged, false},
+		{"verified", connectedClient(t, own, 2, verified, alice, bob), nil, true},
+		{"unverified", connectedClient(t, own, 2, nil, alice, bob), nil, true},
+	}
+
+	for _, test := range tests {
+		m, err := test.client.seal(chatdata.Message{Data: "@bob hi"})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+		if (m.Sealed != nil) != test.sealed {
+			t.Errorf("%s: expected sealed %t", test.name, test.sealed)
+		}
+		if !test.sealed && m.Data != "@bob hi" {
+			t.Errorf("%s: message changed: %q", test.name, m.Data)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"fmt"
+
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+// Signed describes whether the author of a chat message signed it.
+type Signed byte
+
+const (
+	// SignedNone: the message was not signed.
+	SignedNone Signed = iota
+	// SignedUnverified: signed, but the key of the author was not verified.
+	SignedUnverified
+	// SignedVerified: signed with a key that was verified out of band.
+	SignedVerified
+	// SignedInvalid: the signature or the key that made it is not valid,
+	// see ChatMessage.SigErr.
+	SignedInvalid
+)
+
+// sign signs a chat message with our key.
+func (c *Client) sign(m chatdata.Message) (chatdata.Message, error) {
+	if c.c.Key == nil {
+		return m, nil
+	}
+	return m.Sign(c.Name(), c.c.Key)
+}
+
+// verify checks the signature of a chat message and whether it was made by
+// the key of its author as far as we know it.
+func (c *Client) verify(m chatdata.ServerMessage) (Signed, error) {
+	if m.Sig == nil {
+		return SignedNone, nil
+	}
+	pub, err := m.Verify()
+	if err != nil {
+		return SignedInvalid, err
+	}
+	fp := pub.FingerprintString()
+
+	if m.From == c.Name() && c.c.Key != nil {
+		own, err := c.c.Key.Public()
+		if err != nil {
+			return SignedInvalid, err
+		}
+		if fp != own.FingerprintString() {
+			return SignedInvalid, fmt.Errorf("signed with a key that is not yours: %s", fp)
+		}
+		return SignedVerified, nil
+	}
+
+	c.keysSem.Lock()
+	verified, ok := c.c.Verified[m.From]
+	c.keysSem.Unlock()
+	switch {
+	case !ok:
+		return SignedUnverified, nil
+	case verified != fp:
+		return SignedInvalid, fmt.Errorf("%s: %w", m.From, ErrPeerFingerprint)
+	}
+	return SignedVerified, nil
+}
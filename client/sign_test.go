@@ -0,0 +1,115 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/crypto"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+func fp(t *testing.T, k *crypto.Key) string {
+	pub, err := k.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub.FingerprintString()
+}
+
+// signingClient returns a client called name that signs with key.
+func signingClient(name string, key *crypto.Key, verified map[string]string) *Client {
+	return New(nil, nil, nil, Config{Name: name, Key: key, Verified: verified})
+}
+
+// received returns m as the server relays it from user from.
+func received(m chatdata.Message, from string) chatdata.ServerMessage {
+	s := chatdata.ServerMessage{Message: m, From: from, Stamp: time.Now()}
+	if to, body := chatdata.Private(m.Data); to != "" {
+		s.PM, s.Data = to, body
+	}
+	return s
+}
+
+func TestSignRoundtrip(t *testing.T) {
+	aliceKey, bobKey := crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	alice := signingClient("alice", aliceKey, nil)
+
+	for _, d := range []string{"hi", "@bob  hi", "@bob"} {
+		m, err := alice.sign(chatdata.Message{Data: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Sig == nil {
+			t.Fatalf("%q: not signed", d)
+		}
+		if _, err := m.Verify("alice", time.Now()); err != nil {
+			t.Fatalf("%q: %s", d, err)
+		}
+		s := received(m, "alice")
+
+		tests := []struct {
+			name   string
+			client *Client
+			signed Signed
+		}{
+			{"own", alice, SignedVerified},
+			{"unverified", signingClient("bob", bobKey, nil), SignedUnverified},
+			{"verified", signingClient("bob", bobKey, map[string]string{"alice": fp(t, aliceKey)}), SignedVerified},
+		}
+		for _, test := range tests {
+			signed, err := test.client.verify(s)
+			if err != nil || signed != test.signed {
+				t.Errorf("%q %s: expected %d, got %d %v", d, test.name, test.signed, signed, err)
+			}
+		}
+	}
+
+	unsigned, err := signingClient("anon", nil, nil).sign(chatdata.Message{Data: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed, err := alice.verify(received(unsigned, "anon")); signed != SignedNone || err != nil {
+		t.Fatalf("expected an unsigned message, got %d %v", signed, err)
+	}
+}
+
+func TestSignInvalid(t *testing.T) {
+	aliceKey, bobKey := crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	alice := signingClient("alice", aliceKey, nil)
+	bob := signingClient("bob", bobKey, map[string]string{"alice": fp(t, aliceKey)})
+	m, err := alice.sign(chatdata.Message{Data: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := received(m, "alice")
+	tampered.Data = "bye"
+	impersonated := received(m, "carol")
+	forged, err := signingClient("alice", bobKey, nil).sign(chatdata.Message{Data: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client *Client
+		msg    chatdata.ServerMessage
+		err    error
+	}{
+		{"tampered", bob, tampered, nil},
+		{"other sender", bob, impersonated, nil},
+		{"wrong key", bob, received(forged, "alice"), ErrPeerFingerprint},
+		{"wrong own key", alice, received(forged, "alice"), nil},
+	}
+	for _, test := range tests {
+		signed, err := test.client.verify(test.msg)
+		if signed != SignedInvalid || err == nil {
+			t.Errorf("%s: expected an invalid signature, got %d %v", test.name, signed, err)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type State byte
+
+const (
+	StateConnecting State = iota
+	StateHandshaking
+	StateConnected
+	StateBackoff
+	StateFatal
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateHandshaking:
+		return "handshaking"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backing off"
+	case StateFatal:
+		return "fatal"
+	}
+	return fmt.Sprintf("unknown state %d", s)
+}
+
+// ConnState describes a transition of the connection to the server.
+type ConnState struct {
+	State State
+
+	// Consecutive failed attempts, reset once connected.
+	Attempt int
+
+	// Time until the next attempt when backing off.
+	Delay time.Duration
+
+	// The error that caused the transition, if any.
+	Err error
+}
+
+func (c ConnState) Online() bool { return c.State == StateConnected }
+
+func (c ConnState) String() string {
+	switch c.State {
+	case StateBackoff:
+		s := fmt.Sprintf("reconnecting in %s", c.Delay.Round(time.Second/10))
+		if c.Attempt > 1 {
+			s = fmt.Sprintf("%s (attempt %d)", s, c.Attempt)
+		}
+		if c.Err != nil {
+			s = fmt.Sprintf("%s: %s", s, c.Err)
+		}
+		return s
+	case StateFatal:
+		if c.Err != nil {
+			return c.Err.Error()
+		}
+	}
+	return c.State.String()
+}
+
+const (
+	backoffMin = time.Second
+	backoffMax = time.Minute
+)
+
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// backoff returns an exponentially increasing delay for the given attempt
+// with half of it randomized to avoid all clients reconnecting in lockstep.
+func backoff(attempt int) time.Duration {
+	d := backoffMax
+	if attempt < 16 {
+		d = backoffMin << uint(attempt)
+		if d > backoffMax {
+			d = backoffMax
+		}
+	}
+
+	half := d / 2
+	jitter.Lock()
+	n := jitter.Int63n(int64(half) + 1)
+	jitter.Unlock()
+	return half + time.Duration(n)
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		max := backoffMax
+		if attempt < 16 && backoffMin<<uint(attempt) < backoffMax {
+			max = backoffMin << uint(attempt)
+		}
+
+		seen := make(map[time.Duration]struct{})
+		for i := 0; i < 50; i++ {
+			d := backoff(attempt)
+			if d < max/2 || d > max {
+				t.Fatalf("attempt %d: %s not in [%s, %s]", attempt, d, max/2, max)
+			}
+			seen[d] = struct{}{}
+		}
+		if len(seen) < 2 {
+			t.Fatalf("attempt %d: no jitter", attempt)
+		}
+	}
+
+	if d := backoff(0); d < backoffMin/2 || d > backoffMin {
+		t.Fatalf("first retry %s not around %s", d, backoffMin)
+	}
+	if d := backoff(1 << 20); d < backoffMax/2 {
+		t.Fatalf("large attempt %s below %s", d, backoffMax/2)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -56,17 +57,39 @@ func upload(f *Flags, backend client.Backend) error {
 	}
 	defer r.Close()
 
-	stat, err := r.Stat()
-	if err != nil {
+	// The upload is queued so it survives reconnects.
+	if f.ClientConf.Outbox, err = client.NewOutbox(""); err != nil {
 		return err
 	}
 
+	done := make(chan error, 2)
 	log := ui.Plain(ioutil.Discard)
-	handler := terminal.New(log, handler.NoopHandler{})
-	cl := client.New(backend, handler, log, f.ClientConf)
+	handler := uploadHandler{terminal.New(log, handler.NoopHandler{}), done}
+	cl := client.New(backend, trustRotation(f, handler, log), log, f.ClientConf)
 	defer cl.Close()
 
-	return cl.Upload(vars.UploadChannel, file, f.Upload.Msg, stat.Size(), r)
+	if _, err := cl.QueueUpload(vars.UploadChannel, file, f.Upload.Msg, r); err != nil {
+		return err
+	}
+	go func() { done <- cl.Run() }()
+
+	return <-done
+}
+
+// uploadHandler reports the outcome of the queued upload on done.
+type uploadHandler struct {
+	client.Handler
+	done chan<- error
+}
+
+func (u uploadHandler) HandleOutbox(e client.OutboxEntry, s client.OutboxState, err error) {
+	u.Handler.HandleOutbox(e, s, err)
+	switch s {
+	case client.OutboxSent:
+		u.done <- nil
+	case client.OutboxFailed:
+		u.done <- err
+	}
 }
 
 func update(f *Flags, backend client.Backend) error {
@@ -129,7 +152,7 @@ func update(f *Flags, backend client.Backend) error {
 	rhandler := handler.NoopHandler{}
 	cl := &client.Client{}
 	updateHandler := handler.NewUpdateHandler(rhandler, log, cl)
-	*cl = *client.New(backend, updateHandler, log, f.ClientConf)
+	*cl = *client.New(backend, trustRotation(f, updateHandler, log), log, f.ClientConf)
 
 	defer cl.Close()
 	go cl.Run()
@@ -211,7 +234,7 @@ func musicRemoteCurrent(f *Flags, backend client.Backend) error {
 	updates := make(chan client.MusicState, 8)
 	handler := music.NewCurrentSongHandler(handler.NoopHandler{}, updates)
 	log := ui.Plain(os.Stderr)
-	cl := client.New(backend, handler, log, f.ClientConf)
+	cl := client.New(backend, trustRotation(f, handler, log), log, f.ClientConf)
 	n := f.MusicRemoteCurrent.N
 	neverQuit := n == 0
 	first := true
@@ -253,7 +276,7 @@ func musicDownload(f *Flags, backend client.Backend) error {
 	handler := terminal.New(log, handler.NoopHandler{})
 	cl := &client.Client{}
 	downloadHandler := music.NewDownloadHandler(handler, log, di.Collection(), cl)
-	*cl = *client.New(backend, downloadHandler, log, f.ClientConf)
+	*cl = *client.New(backend, trustRotation(f, downloadHandler, log), log, f.ClientConf)
 	go handler.Run(nil)
 	go cl.Run()
 	defer cl.Close()
@@ -402,7 +425,7 @@ func musicInfoSongs(f *Flags) error {
 func oneoff(f *Flags, backend client.Backend) error {
 	log := ui.Plain(ioutil.Discard)
 	handler := terminal.New(log, handler.NoopHandler{})
-	cl := client.New(backend, handler, log, f.ClientConf)
+	cl := client.New(backend, trustRotation(f, handler, log), log, f.ClientConf)
 	defer cl.Close()
 	var method func(msg string) error
 	switch f.All.Mode {
@@ -427,6 +450,74 @@ func oneoff(f *Flags, backend client.Backend) error {
 	return method(f.All.OneOff)
 }
 
+type rotationHandler struct {
+	client.Handler
+	f   *Flags
+	log client.Logger
+}
+
+func trustRotation(f *Flags, h client.Handler, log client.Logger) client.Handler {
+	return rotationHandler{h, f, log}
+}
+
+func (r rotationHandler) HandleKeyRotation(from, to string) {
+	r.Handler.HandleKeyRotation(from, to)
+	r.f.AppConf.ServerFingerprint = to
+	if err := r.f.SaveConfig(); err != nil {
+		r.log.Err(fmt.Errorf("failed to store new server fingerprint: %w", err))
+	}
+}
+
+// verify lists the published seal keys or, given a user and the fingerprint
+// they handed over out of band, marks their key as verified.
+func verify(f *Flags, cl *client.Client, args []string) (string, error) {
+	state := func(k client.PeerKey) string {
+		if cl.Verified(k.Name) {
+			return "verified"
+		}
+		if _, ok := f.AppConf.VerifiedKeys[k.Name]; ok {
+			return "CHANGED"
+		}
+		return "unverified"
+	}
+
+	switch len(args) {
+	case 0:
+		pk, err := f.All.Key.Public()
+		if err != nil {
+			return "", err
+		}
+		keys := cl.PeerKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+		l := make([]string, 1, len(keys)+1)
+		l[0] = fmt.Sprintf("%-20s %s", "you", pk.FingerprintString())
+		for _, k := range keys {
+			if k.Name == cl.Name() {
+				continue
+			}
+			l = append(l, fmt.Sprintf("%-20s %s %s", k.Name, k.Fingerprint, state(k)))
+		}
+		return strings.Join(l, "\n"), nil
+	case 1:
+		k, ok := cl.PeerKey(args[0])
+		if !ok {
+			return "", fmt.Errorf("%s: %w", args[0], client.ErrNoKey)
+		}
+		return fmt.Sprintf("%s %s %s", k.Name, k.Fingerprint, state(k)), nil
+	case 2:
+		if err := cl.Verify(args[0], args[1]); err != nil {
+			return "", err
+		}
+		f.AppConf.VerifiedKeys = cl.VerifiedKeys()
+		if err := f.SaveConfig(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("verified the key of %s", args[0]), nil
+	}
+
+	return "", errors.New("usage: /verify [user [fingerprint]]")
+}
+
 func fingerprint(f *Flags, remoteAddress string) error {
 	pk, err := f.All.Key.Public()
 	if err != nil {
@@ -438,13 +529,15 @@ func fingerprint(f *Flags, remoteAddress string) error {
 		serverFP = "<none>"
 	}
 
-	fmt.Printf(
-		"%-30s\t%s\n%-30s\t%s\n",
-		"local",
-		pk.FingerprintString(),
-		fmt.Sprintf("remote[%s]", remoteAddress),
-		serverFP,
-	)
+	fmt.Printf("%-30s\t%s\n", "local", pk.FingerprintString())
+	if f.All.LegacyKey != nil {
+		lpk, err := f.All.LegacyKey.Public()
+		if err != nil {
+			return fmt.Errorf("failed to parse legacy publickey: %w", err)
+		}
+		fmt.Printf("%-30s\t%s\n", "local[legacy]", lpk.FingerprintString())
+	}
+	fmt.Printf("%-30s\t%s\n", fmt.Sprintf("remote[%s]", remoteAddress), serverFP)
 
 	return nil
 }
@@ -637,7 +730,7 @@ func main() {
 		})
 	}
 
-	*cl = *client.New(backend, rhandler, tui, f.ClientConf)
+	*cl = *client.New(backend, trustRotation(f, rhandler, tui), tui, f.ClientConf)
 
 	typingSig := make(chan struct{}, 1000)
 	go func() {
@@ -649,7 +742,10 @@ func main() {
 		}
 	}()
 
-	send := cl.Chat
+	send := func(msg string) error {
+		_, err := cl.QueueChat(msg)
+		return err
+	}
 	typing := func() {
 		typingSig <- struct{}{}
 	}
@@ -658,7 +754,12 @@ func main() {
 		typing = func() {}
 	}
 
-	if f.All.Mode == ModeMusicRemote || f.All.Mode == ModeMusicNode {
+	if f.All.Mode == ModeMusicRemote {
+		send = func(msg string) error {
+			_, err := cl.QueueMusic(msg)
+			return err
+		}
+	} else if f.All.Mode == ModeMusicNode {
 		send = cl.Music
 	} else if f.All.Mode == ModeMusicClient {
 		musicClientUI.Input("q")
@@ -754,7 +855,24 @@ func main() {
 					return false
 				}
 
-				send(s)
+				if s == "/verify" || strings.HasPrefix(s, "/verify ") {
+					msg, err := verify(f, cl, strings.Fields(s)[1:])
+					if err != nil {
+						tui.Err(err)
+						return false
+					}
+					tui.Broadcast([]ui.Msg{{
+						From:      "verify",
+						Stamp:     time.Now(),
+						Message:   msg,
+						Highlight: ui.HLSlight,
+					}}, true)
+					return false
+				}
+
+				if err := send(s); err != nil {
+					tui.Err(err)
+				}
 				return false
 			},
 			InputDown: func() bool {
@@ -18,6 +18,8 @@ type Config struct {
 	NotifyWhen        NotifyWhen
 	ServerAddress     string
 	ServerTCPAddress  string
+	ServerTLS         bool
+	ServerCertFile    string
 	ServerFingerprint string
 	Username          string
 	MaxMessages       int
@@ -25,6 +27,10 @@ type Config struct {
 	MusicSocketFile   string
 	OpenURLCommand    string
 	Zug               bool
+	PersistOutbox     bool
+	Compression       *bool
+	EncryptPMs        *bool
+	VerifiedKeys      map[string]string
 
 	resave bool
 }
@@ -45,6 +51,13 @@ func (c *Config) Help() []string {
 		"",
 		"ServerTCPAddress: ip:port of the tcp server",
 		"",
+		"ServerTLS:        true:  connect over tls and skip the internal crypto",
+		"                         the server needs a TLSCertFile",
+		"                  false: use the internal crypto",
+		"",
+		"ServerCertFile:   PEM certificate (or CA) to trust for the tls connection",
+		"                  leave empty to use the system roots",
+		"",
 		"Username:         your desired username",
 		"",
 		"MaxMessages:      maximum amount of messages shown",
@@ -60,6 +73,20 @@ func (c *Config) Help() []string {
 		"Zug:              true:  enable inline images using zug",
 		"                  false: disable inline images",
 		"                  only works if you run X11",
+		"",
+		"PersistOutbox:    true:  store unsent messages in the cache directory",
+		"                         so they survive a restart",
+		"                  false: only keep unsent messages in memory",
+		"",
+		"Compression:      true:  compress large messages (e.g.: history and playlists)",
+		"                  false: send everything uncompressed",
+		"",
+		"EncryptPMs:       true:  end-to-end encrypt direct messages to users that",
+		"                         published a key",
+		"                  false: send direct messages readable by the server",
+		"",
+		"VerifiedKeys:     fingerprints of the keys of other users you verified",
+		"                  with /verify, managed by the client",
 	}
 }
 
@@ -80,6 +107,8 @@ func (c *Config) Decode(file string) error {
 		"NotifyWhen":        &c.NotifyWhen,
 		"ServerAddress":     &c.ServerAddress,
 		"ServerTCPAddress":  &c.ServerTCPAddress,
+		"ServerTLS":         &c.ServerTLS,
+		"ServerCertFile":    &c.ServerCertFile,
 		"ServerFingerprint": &c.ServerFingerprint,
 		"Username":          &c.Username,
 		"MaxMessages":       &c.MaxMessages,
@@ -87,6 +116,10 @@ func (c *Config) Decode(file string) error {
 		"MusicSocketFile":   &c.MusicSocketFile,
 		"OpenURLCommand":    &c.OpenURLCommand,
 		"Zug":               &c.Zug,
+		"PersistOutbox":     &c.PersistOutbox,
+		"Compression":       &c.Compression,
+		"EncryptPMs":        &c.EncryptPMs,
+		"VerifiedKeys":      &c.VerifiedKeys,
 	}
 
 	for k, field := range m {
@@ -160,6 +193,18 @@ func (c *Config) Merge(def *Config) bool {
 		resave = true
 		c.MusicSocketFile = def.MusicSocketFile
 	}
+	if c.Compression == nil {
+		resave = true
+		c.Compression = def.Compression
+	}
+	if c.EncryptPMs == nil {
+		resave = true
+		c.EncryptPMs = def.EncryptPMs
+	}
+	if c.VerifiedKeys == nil {
+		resave = true
+		c.VerifiedKeys = make(map[string]string)
+	}
 
 	return resave
 }
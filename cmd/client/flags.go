@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -54,6 +56,7 @@ type Flags struct {
 
 	All struct {
 		Key        *crypto.Key
+		LegacyKey  *crypto.Key
 		ConfigDir  string
 		CacheDir   string
 		ConfigFile string
@@ -481,26 +484,62 @@ func (f *Flags) Parse() error {
 		return err
 	}
 
-	keyfile := filepath.Join(f.All.ConfigDir, ".rsa_private_key")
-	key, err := crypto.EnsureKey(keyfile, channel.ClientMinKeySize, channel.ClientKeySize)
+	keyfile := filepath.Join(f.All.ConfigDir, ".ed25519_private_key")
+	key, err := crypto.EnsureEd25519Key(keyfile)
 	if err != nil {
 		return err
 	}
 	f.All.Key = key
 
-	f.TCPConf = tcp.Config{TCPAddr: f.AppConf.ServerTCPAddress}
+	// Keep presenting the old RSA key until servers know the new one.
+	legacyfile := filepath.Join(f.All.ConfigDir, ".rsa_private_key")
+	legacy, err := crypto.KeyFromFile(legacyfile, channel.ClientMinKeySize, channel.ClientKeySize)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f.All.LegacyKey = legacy
+
+	if *f.AppConf.EncryptPMs {
+		sealfile := filepath.Join(f.All.ConfigDir, ".x25519_seal_key")
+		if f.ClientConf.SealKey, err = crypto.EnsureSealKey(sealfile); err != nil {
+			return err
+		}
+	}
+
+	var tlsConf *tls.Config
+	scheme := "http://"
+	if f.AppConf.ServerTLS {
+		scheme = "https://"
+		tlsConf = &tls.Config{}
+		if f.AppConf.ServerCertFile != "" {
+			pem, err := ioutil.ReadFile(f.AppConf.ServerCertFile)
+			if err != nil {
+				return fmt.Errorf("could not read server certificate: %w", err)
+			}
+			tlsConf.RootCAs = x509.NewCertPool()
+			if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", f.AppConf.ServerCertFile)
+			}
+		}
+	}
+
+	f.TCPConf = tcp.Config{TCPAddr: f.AppConf.ServerTCPAddress, TLS: tlsConf}
 	f.WSConf = ws.Config{
-		TLS:    false,
-		Domain: f.AppConf.ServerAddress,
-		Path:   "ws",
+		TLS:       f.AppConf.ServerTLS,
+		Domain:    f.AppConf.ServerAddress,
+		Path:      "ws",
+		TLSConfig: tlsConf,
 	}
 
 	f.ClientConf.Key = key
+	f.ClientConf.LegacyKey = legacy
 	f.ClientConf.Name = f.AppConf.Username
 	f.ClientConf.Proto = channel.ProtoBinary
-	f.ClientConf.ServerURL = "http://" + f.AppConf.ServerAddress
+	f.ClientConf.ServerURL = scheme + f.AppConf.ServerAddress
 	f.ClientConf.ServerFingerprint = f.AppConf.ServerFingerprint
 	f.ClientConf.History = uint16(f.AppConf.MaxMessages)
+	f.ClientConf.Compress = *f.AppConf.Compression
+	f.ClientConf.Verified = f.AppConf.VerifiedKeys
 
 	if f.ClientConf.Name == "" {
 		return fmt.Errorf("please specify your desired username in %s", f.All.ConfigFile)
@@ -557,6 +596,9 @@ func (f *Flags) Parse() error {
 		vars.ChatChannel,
 		vars.TypingChannel,
 	}
+	if f.ClientConf.SealKey != nil {
+		f.ClientConf.Channels = append(f.ClientConf.Channels, vars.KeysChannel)
+	}
 
 	f.MusicNode.CacheDir = f.AppConf.MusicDownloads
 	f.MusicNode.Socket = f.AppConf.MusicSocketFile
@@ -658,6 +700,25 @@ func (f *Flags) Parse() error {
 		f.ClientConf.Channels = []string{
 			vars.PingChannel,
 		}
+		return nil
+	}
+
+	outbox := ""
+	switch f.All.Mode {
+	case ModeDefault:
+		outbox = "chat"
+	case ModeMusicRemote:
+		outbox = "music"
+	}
+
+	if outbox != "" {
+		dir := ""
+		if f.AppConf.PersistOutbox {
+			dir = filepath.Join(f.All.CacheDir, "outbox", outbox)
+		}
+		if f.ClientConf.Outbox, err = client.NewOutbox(dir); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -690,6 +751,8 @@ func (f *Flags) validateAppConf() error {
 	}
 
 	notifyCmd := "notify-send 'HomeChat' '%u: %m'"
+	compression := true
+	encryptPMs := true
 	resave := f.AppConf.Merge(&Config{
 		NotifyCommand:    &notifyCmd,
 		NotifyWhen:       NotifyDefault,
@@ -698,6 +761,8 @@ func (f *Flags) validateAppConf() error {
 		Username:         "",
 		MaxMessages:      250,
 		MusicDownloads:   filepath.Join(f.All.CacheDir, "client-ym"),
+		Compression:      &compression,
+		EncryptPMs:       &encryptPMs,
 	})
 
 	if !resave {
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/frizinak/homechat/bot"
 	"github.com/frizinak/homechat/server"
+	"github.com/frizinak/homechat/server/channel/bridge"
+	"github.com/frizinak/homechat/server/webhook"
 )
 
 type Config struct {
@@ -16,12 +19,20 @@ type Config struct {
 
 	ClientPolicy     server.ClientPolicy
 	ClientPolicyFile string
+	APITokenFile     string
 
 	HTTPPublicAddr string
 	HTTPBindAddr   string
 	TCPBindAddr    string
+	IRCBindAddr    string
+	IRCChannel     string
+
+	TLSCertFile string
+	TLSKeyFile  string
 
 	BandwidthIntervalSeconds *int
+	QueueIntervalSeconds     *int
+	ClientQueueSize          int
 	MaxUploadKBytes          *int64
 	MaxChatMessages          int
 
@@ -31,6 +42,16 @@ type Config struct {
 	HueIP   string
 	HuePass string
 
+	ProcessBots map[string]bot.ProcessConfig
+
+	Webhooks map[string]webhook.Config
+
+	OutgoingHooks    map[string]webhook.OutgoingConfig
+	OutgoingHooksLog string
+
+	BridgeName string
+	Bridges    map[string]bridge.PeerConfig
+
 	resave bool
 }
 
@@ -59,6 +80,11 @@ func (c *Config) Help() []string {
 		"                           Each line should contain exactly one fingerprint and username",
 		"                           separated by a space",
 		"",
+		"APITokenFile:              Location of the HTTP API token file",
+		"                           Each line contains the sha256 of a token and the",
+		"                           fingerprint of the client policy entry it acts as",
+		"                           Use the api-token command to create tokens",
+		"",
 		"HTTPPublicAddr:            The publicly reachable domain or ip:port",
 		"                           Used to create download links",
 		"",
@@ -68,9 +94,30 @@ func (c *Config) Help() []string {
 		"TCPBindAddr:               ip:port of the tcp server",
 		"                           use 0.0.0.0:1201 to bind to all interfaces",
 		"",
+		"IRCBindAddr:               ip:port of the IRC gateway, empty to disable it",
+		"                           IRC clients authenticate with a token of the",
+		"                           api-token command as SASL PLAIN password or PASS",
+		"                           and use TLS if the http server does",
+		"",
+		"IRCChannel:                IRC channel the chat is mapped to",
+		"",
+		"TLSCertFile:               PEM certificate for the http and tcp server",
+		"                           Leave empty to disable TLS",
+		"                           Clients connecting over TLS skip the internal crypto",
+		"",
+		"TLSKeyFile:                PEM private key for the above certificate",
+		"",
 		"BandwidthIntervalSeconds:  Log bandwidth usage every n seconds",
 		"                           0 for no logging",
 		"",
+		"QueueIntervalSeconds:      Log client queue depths every n seconds",
+		"                           0 for no logging",
+		"",
+		"ClientQueueSize:           Maximum amount of pending messages per client",
+		"                           state messages of slow clients are dropped,",
+		"                           clients are disconnected once other messages",
+		"                           no longer fit",
+		"",
 		"MaxUploadKBytes:           Maximum file upload size in KiB",
 		"",
 		"MaxChatMessages:           Maximum amount of chat messages",
@@ -90,6 +137,64 @@ func (c *Config) Help() []string {
 		"                           You can use https://github.com/amimof/huego",
 		"                           or https://github.com/frizinak/hue or ...",
 		"                           to find the ip and generate a password",
+		"",
+		"ProcessBots:               Bots by command that run as an external process",
+		"                           and exchange JSON lines over stdin and stdout",
+		"                           e.g.: {\"deploy\": {\"Command\": [\"/usr/local/bin/deploy-bot\"],",
+		"                                  \"Name\": \"deploy-bot\", \"Match\": \"\", \"Timeout\": 30}}",
+		"                           Command: executable and its arguments, restarted",
+		"                                    with backoff when it exits",
+		"                           Name:    name it posts as, default <command>-bot",
+		"                           Match:   regex public chat messages are matched",
+		"                                    against, matches are passed to it as well",
+		"                           Timeout: seconds it gets to reply, 0 for default",
+		"",
+		"Webhooks:                  Incoming webhooks by name, POST to /hook/<name>",
+		"                           to post in chat as a bot with that name",
+		"                           e.g.: {\"doorbell\": {\"Token\": \"secret\", \"Template\": \"title\",",
+		"                                  \"To\": \"\", \"RateLimit\": 10}}",
+		"                           Token:     sent as a bearer token or token query parameter",
+		"                           Template:  text/template for JSON payloads or a preset:",
+		"                                      slack, discord, title or alertmanager",
+		"                                      empty to post text as is and the text, message,",
+		"                                      content or body field of JSON payloads",
+		"                           To:        send as a PM to this user",
+		"                           RateLimit: messages per minute, 0 for unlimited",
+		"",
+		"OutgoingHooks:             Outgoing hooks by name, triggered by chat messages,",
+		"                           mentions, users (dis)connecting and song changes",
+		"                           e.g.: {\"hass\": {\"Match\": \"(?i)leaving work\", \"Mention\": \"hass\",",
+		"                                  \"Events\": [\"connect\", \"disconnect\", \"song\"],",
+		"                                  \"URL\": \"http://127.0.0.1:8123/api/webhook/homechat\",",
+		"                                  \"Command\": null, \"Retries\": 3}}",
+		"                           Match:   regex public chat messages are matched against",
+		"                           Mention: name that triggers the hook when it is",
+		"                                    mentioned or sent a PM",
+		"                           Events:  any of connect, disconnect and song",
+		"                           URL:     POST the event as JSON to this url",
+		"                           Command: or run this command with the event on stdin",
+		"                           Retries: retries of failed deliveries, -1 for none",
+		"                           Bot messages and encrypted messages never trigger hooks",
+		"",
+		"OutgoingHooksLog:          Log of the deliveries of outgoing hooks",
+		"",
+		"BridgeName:                Name this server connects to bridged servers with",
+		"                           should be unique among the servers you bridge",
+		"",
+		"Bridges:                   Bridged homechat servers by name, their users chat",
+		"                           here as user@name",
+		"                           e.g.: {\"parents\": {\"Fingerprint\": \"<server fingerprint>\",",
+		"                                  \"Address\": \"parents.example.com:1201\",",
+		"                                  \"TLS\": false, \"CertFile\": \"\",",
+		"                                  \"Users\": [], \"Channels\": [\"chat\", \"users\"]}}",
+		"                           Fingerprint: fingerprint of its server key",
+		"                           Address:     tcp address to connect to, leave empty",
+		"                                        on one of both servers to have the",
+		"                                        other one connect",
+		"                           TLS:         connect over tls, CertFile to verify it",
+		"                           Users:       local users that are bridged, empty for all",
+		"                           Channels:    chat and/or users (presence), empty for both",
+		"                           Peers can always connect, regardless of ClientPolicy",
 	}
 }
 
@@ -112,16 +217,29 @@ func (c *Config) Decode(file string) error {
 		"ChatMessagesAppendOnlyDir": &c.ChatMessagesAppendOnlyDir,
 		"ClientPolicy":              &c.ClientPolicy,
 		"ClientPolicyFile":          &c.ClientPolicyFile,
+		"APITokenFile":              &c.APITokenFile,
 		"HTTPPublicAddr":            &c.HTTPPublicAddr,
 		"HTTPBindAddr":              &c.HTTPBindAddr,
 		"TCPBindAddr":               &c.TCPBindAddr,
+		"IRCBindAddr":               &c.IRCBindAddr,
+		"IRCChannel":                &c.IRCChannel,
+		"TLSCertFile":               &c.TLSCertFile,
+		"TLSKeyFile":                &c.TLSKeyFile,
 		"BandwidthIntervalSeconds":  &c.BandwidthIntervalSeconds,
+		"QueueIntervalSeconds":      &c.QueueIntervalSeconds,
+		"ClientQueueSize":           &c.ClientQueueSize,
 		"MaxUploadKBytes":           &c.MaxUploadKBytes,
 		"MaxChatMessages":           &c.MaxChatMessages,
 		"WttrCity":                  &c.WttrCity,
 		"HolidayCountryCode":        &c.HolidayCountryCode,
 		"HueIP":                     &c.HueIP,
 		"HuePass":                   &c.HuePass,
+		"ProcessBots":               &c.ProcessBots,
+		"Webhooks":                  &c.Webhooks,
+		"OutgoingHooks":             &c.OutgoingHooks,
+		"OutgoingHooksLog":          &c.OutgoingHooksLog,
+		"BridgeName":                &c.BridgeName,
+		"Bridges":                   &c.Bridges,
 	}
 
 	for k, field := range m {
@@ -195,6 +313,14 @@ func (c *Config) Merge(def *Config) bool {
 		resave = true
 		c.BandwidthIntervalSeconds = def.BandwidthIntervalSeconds
 	}
+	if c.QueueIntervalSeconds == nil {
+		resave = true
+		c.QueueIntervalSeconds = def.QueueIntervalSeconds
+	}
+	if c.ClientQueueSize <= 0 && def.ClientQueueSize > 0 {
+		resave = true
+		c.ClientQueueSize = def.ClientQueueSize
+	}
 	if c.MaxUploadKBytes == nil {
 		resave = true
 		c.MaxUploadKBytes = def.MaxUploadKBytes
@@ -215,6 +341,10 @@ func (c *Config) Merge(def *Config) bool {
 		resave = true
 		c.TCPBindAddr = def.TCPBindAddr
 	}
+	if c.IRCChannel == "" && def.IRCChannel != "" {
+		resave = true
+		c.IRCChannel = def.IRCChannel
+	}
 	if c.ClientPolicy == "" && def.ClientPolicy != "" {
 		resave = true
 		c.ClientPolicy = def.ClientPolicy
@@ -223,5 +353,33 @@ func (c *Config) Merge(def *Config) bool {
 		resave = true
 		c.ClientPolicyFile = def.ClientPolicyFile
 	}
+	if c.APITokenFile == "" && def.APITokenFile != "" {
+		resave = true
+		c.APITokenFile = def.APITokenFile
+	}
+	if c.ProcessBots == nil {
+		resave = true
+		c.ProcessBots = make(map[string]bot.ProcessConfig)
+	}
+	if c.Webhooks == nil {
+		resave = true
+		c.Webhooks = make(map[string]webhook.Config)
+	}
+	if c.OutgoingHooks == nil {
+		resave = true
+		c.OutgoingHooks = make(map[string]webhook.OutgoingConfig)
+	}
+	if c.OutgoingHooksLog == "" && def.OutgoingHooksLog != "" {
+		resave = true
+		c.OutgoingHooksLog = def.OutgoingHooksLog
+	}
+	if c.BridgeName == "" && def.BridgeName != "" {
+		resave = true
+		c.BridgeName = def.BridgeName
+	}
+	if c.Bridges == nil {
+		resave = true
+		c.Bridges = make(map[string]bridge.PeerConfig)
+	}
 	return resave
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -28,11 +31,17 @@ type PolicyLoader struct {
 	rw       sync.RWMutex
 	lastLoad time.Time
 	list     map[string]string
+
+	// Bridged servers by fingerprint, they can always connect.
+	peers map[string]string
 }
 
 func (p *PolicyLoader) Policy() server.ClientPolicy { return p.policy }
 
 func (p *PolicyLoader) Exists(fp string) (string, error) {
+	if name, ok := p.peers[fp]; ok {
+		return name, nil
+	}
 	if err := p.load(); err != nil {
 		return "", err
 	}
@@ -95,6 +104,74 @@ func (p *PolicyLoader) load() error {
 	return nil
 }
 
+// TokenLoader reads the HTTP API token file, each line contains the sha256
+// of a token and the fingerprint of the policy entry it was issued for.
+type TokenLoader struct {
+	file string
+
+	rw       sync.RWMutex
+	lastLoad time.Time
+	list     map[string]string
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func (t *TokenLoader) Fingerprint(token string) (string, error) {
+	if err := t.load(); err != nil {
+		return "", err
+	}
+
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return t.list[hashToken(token)], nil
+}
+
+func (t *TokenLoader) load() error {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	if time.Since(t.lastLoad) < time.Second*5 {
+		return nil
+	}
+
+	t.lastLoad = time.Now()
+	list := make(map[string]string)
+	f, err := os.Open(t.file)
+	if os.IsNotExist(err) {
+		t.list = list
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	scan.Split(bufio.ScanLines)
+	n := 0
+	for scan.Scan() {
+		n++
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		lp := strings.Fields(line)
+		if len(lp) != 2 {
+			return fmt.Errorf("%s: invalid line %d", t.file, n)
+		}
+		list[lp[0]] = lp[1]
+	}
+
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	t.list = list
+	return nil
+}
+
 type Mode byte
 
 const (
@@ -102,6 +179,8 @@ const (
 	ModeLogs
 	ModeHue
 	ModeFingerprint
+	ModeRotateKey
+	ModeAPIToken
 )
 
 type Flags struct {
@@ -113,11 +192,14 @@ type Flags struct {
 	All struct {
 		Mode Mode
 
-		Key        *crypto.Key
-		ConfigFile string
-		CacheDir   string
-		Store      string
-		Uploads    string
+		Key          *crypto.Key
+		KeyFile      string
+		Rotation     channel.KeyRotationMessage
+		RotationFile string
+		ConfigFile   string
+		CacheDir     string
+		Store        string
+		Uploads      string
 	}
 
 	Serve struct {
@@ -125,7 +207,17 @@ type Flags struct {
 	}
 
 	Logs struct {
-		Dir string
+		Dir    string
+		Verify bool
+	}
+
+	RotateKey struct {
+		Grace time.Duration
+		Force bool
+	}
+
+	APIToken struct {
+		Fingerprint string
 	}
 
 	AppConf    *Config
@@ -154,6 +246,8 @@ func (f *Flags) Flags() {
 			h.Add("  - logs:            Append-only logfile operations")
 			h.Add("  - hue:             Configure Philips Hue bridge credentials")
 			h.Add("  - fingerprint:     Show server publickey fingerprint")
+			h.Add("  - rotate-key:      Replace the server key")
+			h.Add("  - api-token:       Create an HTTP API token")
 			h.Add("  - config:          Config options explained")
 			h.Add("  - version:         Print version and exit")
 		}
@@ -189,9 +283,18 @@ func (f *Flags) Flags() {
 			"",
 			"The directory that contains your logs, defaults to server.json setting",
 		)
+		fl.BoolVar(
+			&f.Logs.Verify,
+			"verify",
+			false,
+			"Verify the signature of each message and the key that made it",
+		)
 
 		return func(h *flags.Help) {
 			h.Add("Print contents of the Append-only logs for now")
+			h.Add("With -verify messages that are unsigned or whose signature")
+			h.Add("does not check out are marked and the command fails if")
+			h.Add("any signature is invalid")
 		}
 	}).Handler(func(set *flags.Set, args []string) error {
 		f.All.Mode = ModeLogs
@@ -217,6 +320,48 @@ func (f *Flags) Flags() {
 		return nil
 	})
 
+	f.flags.Add("rotate-key").Define(func(fl *flag.FlagSet) flags.HelpCB {
+		fl.DurationVar(
+			&f.RotateKey.Grace,
+			"grace",
+			time.Hour*24*30,
+			"How long clients are handed over from the old to the new key",
+		)
+		fl.BoolVar(
+			&f.RotateKey.Force,
+			"force",
+			false,
+			"Rotate even if the previous rotation has not ended yet",
+		)
+
+		return func(h *flags.Help) {
+			h.Add("Generate a new server key and sign it with the current one")
+			h.Add("Clients that trust the current key switch to the new one")
+			h.Add("automatically when they connect within the grace period")
+			h.Add("Restart the server afterwards")
+		}
+	}).Handler(func(set *flags.Set, args []string) error {
+		f.All.Mode = ModeRotateKey
+		return nil
+	})
+
+	f.flags.Add("api-token").Define(func(fl *flag.FlagSet) flags.HelpCB {
+		return func(h *flags.Help) {
+			h.Add("Usage: api-token <fingerprint>")
+			h.Add("Create a token for the HTTP API that acts as the user")
+			h.Add("of the given client policy entry")
+			h.Add("Remove its line from the token file or the policy entry")
+			h.Add("to revoke it")
+		}
+	}).Handler(func(set *flags.Set, args []string) error {
+		if len(args) != 1 {
+			set.Usage(1)
+		}
+		f.All.Mode = ModeAPIToken
+		f.APIToken.Fingerprint = args[0]
+		return nil
+	})
+
 	f.flags.Add("config").Define(func(fl *flag.FlagSet) flags.HelpCB {
 		return func(h *flags.Help) {
 			h.Add(fmt.Sprintf("Config file used: '%s'", f.All.ConfigFile))
@@ -290,12 +435,24 @@ func (f *Flags) Parse() error {
 		}
 	}
 
+	// Existing servers keep their RSA key so clients don't have to
+	// update their server fingerprint.
 	keyfile := filepath.Join(f.AppConf.Directory, ".rsa_private_server_key")
-	key, err := crypto.EnsureKey(keyfile, channel.ServerMinKeySize, channel.ServerKeySize)
+	key, err := crypto.KeyFromFile(keyfile, channel.ServerMinKeySize, channel.ServerKeySize)
+	if os.IsNotExist(err) {
+		keyfile = filepath.Join(f.AppConf.Directory, ".ed25519_private_server_key")
+		key, err = crypto.EnsureEd25519Key(keyfile)
+	}
 	if err != nil {
 		return err
 	}
 	f.All.Key = key
+	f.All.KeyFile = keyfile
+
+	f.All.RotationFile = filepath.Join(f.AppConf.Directory, ".server_key_rotation")
+	if f.All.Rotation, err = f.loadRotation(); err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(f.AppConf.ClientPolicyFile); os.IsNotExist(err) {
 		fh, err := os.Create(f.AppConf.ClientPolicyFile)
@@ -311,28 +468,84 @@ func (f *Flags) Parse() error {
 		fmt.Fprintln(fh, "")
 	}
 
+	var cert, certKey []byte
+	if f.AppConf.TLSCertFile != "" || f.AppConf.TLSKeyFile != "" {
+		if cert, err = ioutil.ReadFile(f.AppConf.TLSCertFile); err != nil {
+			return fmt.Errorf("could not read tls certificate: %w", err)
+		}
+		if certKey, err = ioutil.ReadFile(f.AppConf.TLSKeyFile); err != nil {
+			return fmt.Errorf("could not read tls key: %w", err)
+		}
+	}
+
+	peers := make(map[string]string, len(f.AppConf.Bridges))
+	for name, p := range f.AppConf.Bridges {
+		peers[p.Fingerprint] = name
+	}
+
 	f.ServerConf = server.Config{
 		Key:               key,
+		KeyRotation:       f.All.Rotation,
 		ProtocolVersion:   vars.ProtocolVersion,
 		Log:               log.New(f.out, "", 0),
 		HTTPPublicAddress: f.AppConf.HTTPPublicAddr,
 		HTTPAddress:       f.AppConf.HTTPBindAddr,
 		TCPAddress:        f.AppConf.TCPBindAddr,
+		Cert:              cert,
+		CertKey:           certKey,
 		StorePath:         f.All.Store,
 		UploadsPath:       f.All.Uploads,
 		MaxUploadSize:     *f.AppConf.MaxUploadKBytes * 1024,
 		LogBandwidth:      time.Duration(*f.AppConf.BandwidthIntervalSeconds) * time.Second,
+		LogQueues:         time.Duration(*f.AppConf.QueueIntervalSeconds) * time.Second,
+		ClientQueueSize:   f.AppConf.ClientQueueSize,
 		RWFactory:         channel.NewRWFactory(nil),
 
 		PolicyLoader: &PolicyLoader{
 			policy: f.AppConf.ClientPolicy,
 			file:   f.AppConf.ClientPolicyFile,
+			peers:  peers,
 		},
+		TokenLoader: &TokenLoader{file: f.AppConf.APITokenFile},
 	}
 
 	return nil
 }
 
+// loadRotation reads the announcement of the last key rotation and removes it
+// once its grace period has passed.
+func (f *Flags) loadRotation() (channel.KeyRotationMessage, error) {
+	var r channel.KeyRotationMessage
+	fh, err := os.Open(f.All.RotationFile)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	r, _, err = channel.JSONKeyRotationMessage(fh)
+	fh.Close()
+	if err != nil {
+		return r, fmt.Errorf("failed to parse key rotation %s: %w", f.All.RotationFile, err)
+	}
+
+	pk, err := f.All.Key.Public()
+	if err != nil {
+		return r, err
+	}
+
+	switch {
+	case r.Empty():
+	case r.To() != pk.FingerprintString():
+		fmt.Fprintf(f.out, "ignoring key rotation %s, it does not announce the current key\n", f.All.RotationFile)
+		return channel.KeyRotationMessage{}, nil
+	case r.Expired():
+		fmt.Fprintf(f.out, "previous server key %s retired\n", r.From())
+		return channel.KeyRotationMessage{}, os.Remove(f.All.RotationFile)
+	}
+
+	return r, nil
+}
+
 func (f *Flags) validateAppConf() error {
 	if err := f.AppConf.Decode(f.All.ConfigFile); err != nil {
 		if os.IsNotExist(err) {
@@ -360,6 +573,7 @@ func (f *Flags) validateAppConf() error {
 	}
 
 	bandwidthIntervalSeconds := 0
+	queueIntervalSeconds := 0
 	appendChatDir := filepath.Join(cache, "chatlogs")
 	configFileDir, err := filepath.Abs(filepath.Dir(f.All.ConfigFile))
 	if err != nil {
@@ -367,21 +581,28 @@ func (f *Flags) validateAppConf() error {
 	}
 
 	policyFile := filepath.Join(configFileDir, "client.allowlist")
+	hostname, _ := os.Hostname()
 	var maxUploadKBytes int64 = 1024 * 10
 	resave := f.AppConf.Merge(&Config{
 		Directory:      cache,
 		HTTPPublicAddr: fmt.Sprintf("%s:%d", addr[0], port),
 		HTTPBindAddr:   "127.0.0.1:1200",
 		TCPBindAddr:    fmt.Sprintf("%s:%d", addr[0], port+1),
+		IRCChannel:     "#homechat",
 		YMDir:          filepath.Join(cache, "ym"),
 
 		ClientPolicy:     server.PolicyAllow,
 		ClientPolicyFile: policyFile,
+		APITokenFile:     filepath.Join(configFileDir, "api.tokens"),
 
 		BandwidthIntervalSeconds: &bandwidthIntervalSeconds,
+		QueueIntervalSeconds:     &queueIntervalSeconds,
+		ClientQueueSize:          1000,
 		MaxUploadKBytes:          &maxUploadKBytes,
 
 		ChatMessagesAppendOnlyDir: &appendChatDir,
+		OutgoingHooksLog:          filepath.Join(cache, "hooks.log"),
+		BridgeName:                hostname,
 		MaxChatMessages:           500,
 
 		WttrCity:           "tashkent",
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"mime"
@@ -26,11 +27,14 @@ import (
 	"github.com/frizinak/gotls/simplehttp"
 	"github.com/frizinak/homechat/bot"
 	"github.com/frizinak/homechat/bound"
+	"github.com/frizinak/homechat/crypto"
 	"github.com/frizinak/homechat/server"
 	"github.com/frizinak/homechat/server/channel"
+	bridgepkg "github.com/frizinak/homechat/server/channel/bridge"
 	chatpkg "github.com/frizinak/homechat/server/channel/chat"
 	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
 	"github.com/frizinak/homechat/server/channel/history"
+	"github.com/frizinak/homechat/server/channel/keys"
 	"github.com/frizinak/homechat/server/channel/music"
 	"github.com/frizinak/homechat/server/channel/ping"
 	"github.com/frizinak/homechat/server/channel/status"
@@ -38,6 +42,8 @@ import (
 	"github.com/frizinak/homechat/server/channel/update"
 	"github.com/frizinak/homechat/server/channel/upload"
 	"github.com/frizinak/homechat/server/channel/users"
+	"github.com/frizinak/homechat/server/irc"
+	"github.com/frizinak/homechat/server/webhook"
 	"github.com/frizinak/homechat/vars"
 	"github.com/frizinak/libym/acoustid"
 	"github.com/nightlyone/lockfile"
@@ -93,6 +99,103 @@ func fingerprint(f *Flags) error {
 	return nil
 }
 
+func rotateKey(f *Flags) error {
+	if !f.All.Rotation.Empty() && !f.RotateKey.Force {
+		return fmt.Errorf(
+			"the previous key rotation ends at %s, clients that did not connect since will have to manually accept a new key. Use -force to rotate anyway",
+			f.All.Rotation.Expires().Format("2006-01-02 15:04"),
+		)
+	}
+
+	keyfile := filepath.Join(f.AppConf.Directory, ".ed25519_private_server_key")
+	if keyfile != f.All.KeyFile {
+		if _, err := os.Stat(keyfile); !os.IsNotExist(err) {
+			return fmt.Errorf("unused key %s exists, remove it first", keyfile)
+		}
+	}
+
+	retired := fmt.Sprintf("%s.%d.retired", f.All.KeyFile, time.Now().Unix())
+	if err := os.Rename(f.All.KeyFile, retired); err != nil {
+		return err
+	}
+
+	key, err := crypto.EnsureEd25519Key(keyfile)
+	if err != nil {
+		return err
+	}
+	pk, err := key.Public()
+	if err != nil {
+		return err
+	}
+
+	rotation, err := channel.NewKeyRotationMessage(f.All.Key, pk, time.Now().Add(f.RotateKey.Grace))
+	if err != nil {
+		return err
+	}
+
+	tmp := f.All.RotationFile + ".tmp"
+	err = func() error {
+		fh, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		return rotation.JSON(fh)
+	}()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.All.RotationFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("old key: %s\n", rotation.From())
+	fmt.Printf("new key: %s\n", rotation.To())
+	fmt.Printf("the old key is stored in %s and retired at %s\n", retired, rotation.Expires().Format("2006-01-02 15:04"))
+	fmt.Println("restart the server to start using the new key")
+	return nil
+}
+
+func apiToken(f *Flags) error {
+	fp := f.APIToken.Fingerprint
+	name, err := f.ServerConf.PolicyLoader.Exists(fp)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("%s is not in the client policy file %s", fp, f.AppConf.ClientPolicyFile)
+	}
+
+	rnd := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, rnd); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(rnd)
+
+	fh, err := os.OpenFile(f.AppConf.APITokenFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(
+		fh,
+		"# %s %s\n%s %s\n",
+		name,
+		time.Now().Format("2006-01-02 15:04"),
+		hashToken(token),
+		fp,
+	)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("token for %s stored in %s, it is not shown again:\n", name, f.AppConf.APITokenFile)
+	fmt.Println(token)
+	return nil
+}
+
 func logs(f *Flags) error {
 	if f.Logs.Dir == "" {
 		return errors.New("no directory specified")
@@ -111,10 +214,26 @@ func logs(f *Flags) error {
 	}
 	sort.Strings(glob)
 
+	var unsigned, invalid int
 	cb := func(msg channel.Msg) {
 		l := msg.(history.Log)
 		m := l.Msg.(chatdata.Message)
-		fmt.Printf("%s %-10s | %s\n", l.Stamp.Format("2006-01-02 15:04:05"), l.From.Name(), m.Data)
+		d := m.Data
+		if m.Sealed != nil {
+			d += " [end-to-end encrypted]"
+		}
+		if f.Logs.Verify && !l.From.Bot() {
+			err := verifyLog(f, l)
+			switch {
+			case errors.Is(err, channel.ErrUnsigned):
+				unsigned++
+				d = "[unsigned] " + d
+			case err != nil:
+				invalid++
+				d = fmt.Sprintf("[INVALID: %s] %s", err, d)
+			}
+		}
+		fmt.Printf("%s %-10s | %s\n", l.Stamp.Format("2006-01-02 15:04:05"), l.From.Name(), d)
 	}
 
 	do := func(path string) error {
@@ -136,6 +255,45 @@ func logs(f *Flags) error {
 		}
 	}
 
+	if !f.Logs.Verify {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%d unsigned and %d invalid messages\n", unsigned, invalid)
+	if invalid != 0 {
+		return errors.New("log contains messages with an invalid signature")
+	}
+
+	return nil
+}
+
+// verifyLog checks whether a logged message was signed by the key stored
+// alongside it and, unless the server accepts any client, whether that key
+// belongs to the author.
+func verifyLog(f *Flags, l history.Log) error {
+	m := l.Msg.(chatdata.Message)
+	m.Sig = l.Sig
+	pub, err := m.Verify(l.From.Name(), l.Stamp)
+	if err != nil {
+		return err
+	}
+
+	fp := pub.FingerprintString()
+	if fp != l.Fingerprint {
+		return fmt.Errorf("signed by %s but logged as %s", fp, l.Fingerprint)
+	}
+
+	policy := f.ServerConf.PolicyLoader
+	if policy.Policy() == server.PolicyWorld {
+		return nil
+	}
+	name, err := policy.Exists(fp)
+	if err != nil {
+		return err
+	}
+	if name != l.From.Name() {
+		return fmt.Errorf("signed by %s which is not a key of %s", fp, l.From.Name())
+	}
+
 	return nil
 }
 
@@ -243,8 +401,13 @@ func serve(flock flock, f *Flags) error {
 		fh = http.FileServer(http.Dir(f.Serve.HTTPDir))
 	}
 
+	var hooks *webhook.Hooks
 	router := func(r *http.Request, l *log.Logger) (simplehttp.HandleFunc, int) {
 		p := strings.TrimLeft(r.URL.Path, "/")
+		if hooks != nil && strings.HasPrefix("/"+p, webhook.Prefix) {
+			return hooks.Route("/" + p), 0
+		}
+
 		if p == "" {
 			p = "index.html"
 		}
@@ -312,8 +475,43 @@ func serve(flock flock, f *Flags) error {
 	acoustConf := acoustid.Config{Key: f.AppConf.AcoustIDKey}
 	music := music.NewYM(c.Log, musicErr, f.AppConf.YMDir, acoustConf)
 	*chat = *chatpkg.New(c.Log, history)
+	if hooks, err = webhook.New(c.Log, chat, f.AppConf.Webhooks); err != nil {
+		return err
+	}
+	var hooksLog io.Writer = ioutil.Discard
+	if len(f.AppConf.OutgoingHooks) != 0 {
+		fh, err := os.OpenFile(f.AppConf.OutgoingHooksLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		hooksLog = fh
+	}
+	outgoing, err := webhook.NewOutgoing(hooksLog, f.AppConf.OutgoingHooks)
+	if err != nil {
+		return err
+	}
+	chat.OnMessage(outgoing.ChatMessage)
+	music.SongChannel().OnChange(outgoing.SongChange)
+	bridge, err := bridgepkg.New(bridgepkg.Config{
+		Log:   c.Log,
+		Name:  f.AppConf.BridgeName,
+		Key:   f.All.Key,
+		Chat:  chat,
+		Users: s,
+		Peers: f.AppConf.Bridges,
+	})
+	if err != nil {
+		return err
+	}
+	chat.OnMessage(bridge.ChatMessage)
 	upload := upload.New(c.MaxUploadSize, chat, s)
-	users := users.New([]string{vars.ChatChannel, vars.MusicChannel}, s)
+	online := channel.MultiUserCollection(s, bridge)
+	users := users.New(
+		[]string{vars.ChatChannel, vars.MusicChannel},
+		online,
+	)
+	bridge.OnUsersChange(users.Changed)
 	typing := typing.New([]string{vars.ChatChannel})
 	update := update.New(func(os, arch string) (sig []byte, data []byte, ok bool) {
 		suf := ""
@@ -337,6 +535,7 @@ func serve(flock flock, f *Flags) error {
 	s.MustAddChannel(vars.PingChannel, ping.New())
 	s.MustAddChannel(vars.TypingChannel, typing)
 	s.MustAddChannel(vars.UserChannel, users)
+	s.MustAddChannel(vars.KeysChannel, keys.New())
 	s.MustAddChannel(vars.MusicChannel, music)
 	s.MustAddChannel(vars.MusicStateChannel, music.StateChannel())
 	s.MustAddChannel(vars.MusicSongChannel, music.SongChannel())
@@ -344,8 +543,9 @@ func serve(flock flock, f *Flags) error {
 	s.MustAddChannel(vars.MusicPlaylistSongsChannel, music.PlaylistSongsChannel())
 	s.MustAddChannel(vars.MusicErrorChannel, musicErr)
 	s.MustAddChannel(vars.MusicNodeChannel, music.NodeChannel())
+	s.MustAddChannel(vars.BridgeChannel, bridge)
 
-	s.MustSetUserUpdateHandler(channel.MultiUserUpdateHandler(users, chat))
+	s.MustSetUserUpdateHandler(channel.MultiUserUpdateHandler(users, chat, outgoing, bridge))
 
 	go music.SendInterval(time.Millisecond * 1000)
 	go music.StateSendInterval(time.Millisecond * 100)
@@ -357,11 +557,12 @@ func serve(flock flock, f *Flags) error {
 	quoteBots.AddBot("programming", bot.NewBotFunc(bot.ProgrammingQuote))
 	quoteBots.AddBot("cats", bot.NewBotFunc(bot.CatQuote))
 
-	weatherBot := bot.NewWttrBot(f.AppConf.WttrCity)
-	bitcoinBot, err := bot.NewBTCBot()
+	weatherBot := bot.NewCommand(bot.NewWttrBot(f.AppConf.WttrCity))
+	btc, err := bot.NewBTCBot()
 	if err != nil {
 		return err
 	}
+	bitcoinBot := bot.NewCommand(btc)
 
 	if f.AppConf.HueIP != "" {
 		hue := bot.NewHueBot(
@@ -370,16 +571,50 @@ func serve(flock flock, f *Flags) error {
 			[]string{},
 		)
 
-		chat.AddBot("hue", hue)
+		chat.AddBot("hue", bot.NewCommand(hue))
 	}
 
 	chat.AddBot("quote", quoteBots)
-	chat.AddBot("holidays", bot.NewHolidayBot(f.AppConf.HolidayCountryCode))
+	chat.AddBot("holidays", bot.NewCommand(bot.NewHolidayBot(f.AppConf.HolidayCountryCode)))
 	chat.AddBot("wttr", weatherBot)
 	chat.AddBot("weather", weatherBot)
-	chat.AddBot("trivia", bot.NewTriviaBot())
+	chat.AddBot("trivia", bot.NewCommand(bot.NewTriviaBot()))
 	chat.AddBot("btc", bitcoinBot)
 	chat.AddBot("bitcoin", bitcoinBot)
+	chat.AddBot("remind", bot.NewRemindBot(c.Log, func() []string {
+		l := online.GetUsers(vars.ChatChannel)
+		names := make([]string, len(l))
+		for i := range l {
+			names[i] = l[i].Name
+		}
+		return names
+	}))
+
+	for cmd, conf := range f.AppConf.ProcessBots {
+		p, err := bot.NewProcess(c.Log, cmd, conf)
+		if err != nil {
+			return err
+		}
+		chat.AddBot(cmd, p)
+		if re := p.Match(); re != nil {
+			chat.AddPassiveBot(re, bot.WithTimeout(p.Passive(), p.Timeout()))
+		}
+	}
+
+	var gateway *irc.Gateway
+	if f.AppConf.IRCBindAddr != "" {
+		gateway, err = irc.New(irc.Config{
+			Log:     c.Log,
+			Address: f.AppConf.IRCBindAddr,
+			TLS:     s.TLSConfig(),
+			Channel: f.AppConf.IRCChannel,
+			Server:  s,
+			Chat:    chat,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	exit := make(chan struct{}, 1)
 	sig := make(chan os.Signal, 1)
@@ -414,12 +649,16 @@ func serve(flock flock, f *Flags) error {
 		exit <- struct{}{}
 	}()
 
-	fmt.Printf("Starting server on http://%s tcp://%s\n", c.HTTPAddress, c.TCPAddress)
+	if c.Cert != nil {
+		fmt.Printf("Starting server on https://%s tls://%s\n", c.HTTPAddress, c.TCPAddress)
+	} else {
+		fmt.Printf("Starting server on http://%s tcp://%s\n", c.HTTPAddress, c.TCPAddress)
+	}
 	if err := s.Init(); err != nil {
 		return err
 	}
 
-	var tcpErr, httpErr, channelErr error
+	var tcpErr, httpErr, ircErr, channelErr error
 	errs := make(chan struct{})
 
 	go func() {
@@ -472,10 +711,23 @@ func serve(flock flock, f *Flags) error {
 		}
 	}()
 
+	if gateway != nil {
+		fmt.Printf("Starting IRC gateway on %s\n", f.AppConf.IRCBindAddr)
+		go func() {
+			if err := gateway.Run(); err != nil {
+				ircErr = err
+				errs <- struct{}{}
+			}
+		}()
+	}
+
 outer:
 	for {
 		select {
 		case <-exit:
+			if gateway != nil {
+				gateway.Close()
+			}
 			if err := s.Close(); err != nil {
 				return err
 			}
@@ -490,6 +742,10 @@ outer:
 				fmt.Printf("HTTP error: %s\n", httpErr.Error())
 				fmt.Println("Continuing without HTTP")
 				httpErr = nil
+			case ircErr != nil:
+				fmt.Printf("IRC error: %s\n", ircErr.Error())
+				fmt.Println("Continuing without IRC")
+				ircErr = nil
 			case channelErr != nil:
 				if err := s.Close(); err != nil {
 					return fmt.Errorf("%w\nadditionally: %s", channelErr, err)
@@ -542,6 +798,10 @@ func main() {
 		err = hue(f)
 	case ModeFingerprint:
 		err = fingerprint(f)
+	case ModeRotateKey:
+		err = rotateKey(f)
+	case ModeAPIToken:
+		err = apiToken(f)
 	default:
 		err = errors.New("no such mode")
 	}
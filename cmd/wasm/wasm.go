@@ -13,7 +13,6 @@ import (
 	noop "github.com/frizinak/homechat/client/handler"
 	"github.com/frizinak/homechat/crypto"
 	"github.com/frizinak/homechat/server/channel"
-	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
 	musicdata "github.com/frizinak/homechat/server/channel/music/data"
 	usersdata "github.com/frizinak/homechat/server/channel/users/data"
 	"github.com/frizinak/homechat/vars"
@@ -29,6 +28,7 @@ const (
 	OnMusicMessage      handler = "onMusicMessage"
 	OnMusicStateMessage handler = "onMusicStateMessage"
 	OnUsersMessage      handler = "onUsersMessage"
+	OnConnState         handler = "onConnState"
 	OnLog               handler = "onLog"
 	OnFlash             handler = "onFlash"
 	OnError             handler = "onError"
@@ -51,6 +51,7 @@ func newJSHandler(h js.Value, underlying client.Handler) *jsHandler {
 		OnMusicMessage,
 		OnMusicStateMessage,
 		OnUsersMessage,
+		OnConnState,
 		OnLog,
 		OnFlash,
 		OnError,
@@ -100,8 +101,8 @@ func (j *jsHandler) HandleLatency(l time.Duration) {
 	j.handlers[OnLatency].Invoke(l.Milliseconds())
 }
 
-func (j *jsHandler) HandleChatMessage(m chatdata.ServerMessage) error {
-	return j.on(OnChatMessage, m)
+func (j *jsHandler) HandleChatMessage(m client.ChatMessage) error {
+	return j.on(OnChatMessage, m.ServerMessage)
 }
 
 func (j *jsHandler) HandleMusicMessage(m musicdata.ServerMessage) error {
@@ -130,6 +131,26 @@ func (j *jsHandler) HandleUsersMessage(m usersdata.ServerMessage, users client.U
 	return nil
 }
 
+func (j *jsHandler) HandleConnState(s client.ConnState) {
+	var err interface{}
+	if s.Err != nil {
+		err = s.Err.Error()
+	}
+	j.handlers[OnConnState].Invoke(map[string]interface{}{
+		"state":   s.State.String(),
+		"online":  s.Online(),
+		"attempt": s.Attempt,
+		"delay":   s.Delay.Milliseconds(),
+		"err":     err,
+		"status":  s.String(),
+	})
+}
+
+func (j *jsHandler) HandleKeyRotation(from, to string) {
+	js.Global().Get("localStorage").Call("setItem", "fp", to)
+	j.Log("server rotated its key, now trusting " + to)
+}
+
 func (j *jsHandler) Log(s string)                      { j.handlers[OnLog].Invoke(s) }
 func (j *jsHandler) Err(s error)                       { j.handlers[OnError].Invoke(s.Error()) }
 func (j *jsHandler) Flash(s string, dur time.Duration) { j.handlers[OnFlash].Invoke(s) }
@@ -146,7 +167,6 @@ func main() {
 	public := window.Get("Object").New()
 	window.Set("homechat", public)
 
-	pem := localStorage.Call("getItem", "key")
 	_fp := localStorage.Call("getItem", "fp")
 
 	// TODO when server can handle tls and internal encryption is off
@@ -164,24 +184,43 @@ func main() {
 		fp = _fp.String()
 	}
 
-	key := crypto.NewKey(channel.ClientMinKeySize, channel.ClientMinKeySize) // browsers
-	if !pem.IsNull() && !pem.IsUndefined() {
-		if err := key.UnmarshalPEM([]byte(pem.String())); err != nil {
+	loadKey := func(item string, key *crypto.Key) bool {
+		v := localStorage.Call("getItem", item)
+		if v.IsNull() || v.IsUndefined() {
+			return false
+		}
+		if err := key.UnmarshalPEM([]byte(v.String())); err != nil {
 			panic(err)
 		}
+		return true
 	}
-
-	err := key.Generate()
-	if err == nil {
+	storeKey := func(item string, key *crypto.Key) {
 		d, err := key.MarshalPEM()
 		if err != nil {
 			panic(err)
 		}
+		localStorage.Call("setItem", item, string(d))
+	}
+
+	key := crypto.NewEd25519Key()
+	legacy := crypto.NewKey(channel.ClientMinKeySize, channel.ClientMinKeySize) // browsers
+	hasLegacy := loadKey("legacykey", legacy)
+	if loadKey("key", key) && key.Type() != crypto.KeyEd25519 {
+		// Migrate an RSA key generated by an older version.
+		legacy, hasLegacy = key, true
+		storeKey("legacykey", legacy)
+		key = crypto.NewEd25519Key()
+	}
 
-		localStorage.Call("setItem", "key", string(d))
+	err := key.Generate()
+	if err == nil {
+		storeKey("key", key)
 	} else if err != crypto.ErrKeyExists {
 		panic(err)
 	}
+	if !hasLegacy {
+		legacy = nil
+	}
 
 	backend, err := wswasm.New(backendConf, window)
 	if err != nil {
@@ -230,6 +269,7 @@ func main() {
 		handler = newJSHandler(args[0], noop.NoopHandler{})
 		conf := client.Config{
 			Key:               key,
+			LegacyKey:         legacy,
 			ServerFingerprint: fp,
 			ServerURL:         httpProto + "//" + host,
 			Name:              args[0].Get("name").String(),
@@ -244,8 +284,9 @@ func main() {
 				vars.MusicSongChannel,
 				vars.MusicErrorChannel,
 			},
-			Proto:   proto,
-			History: 100,
+			Proto:    proto,
+			History:  100,
+			Compress: true,
 		}
 		c = client.New(backend, handler, handler, conf)
 
@@ -0,0 +1,231 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	aeadHeader = 4
+
+	// aeadFinal is set in the size header of the last frame of a stream.
+	aeadFinal = 1 << 31
+)
+
+var (
+	ErrFrameSize = errors.New("invalid frame size")
+	ErrFrameAuth = errors.New("frame authentication failed")
+	ErrClosed    = errors.New("aead writer closed")
+)
+
+func newGCM(secret [32]byte) cipher.AEAD {
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+// frameNonce derives the nonce from the frame counter and whether it is the
+// final frame, frames that are replayed, dropped, reordered or marked final
+// by someone else will fail authentication.
+func frameNonce(nonce []byte, counter uint64, final bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	if final {
+		nonce[0] = 1
+	}
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], counter)
+}
+
+// AEADWriter buffers writes and seals them as a single AES-GCM frame on Flush
+// or once the buffer is full. Close seals the final frame, without it
+// readers can't tell the end of the stream from truncation.
+type AEADWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	buf     *bytes.Buffer
+	maxLen  int
+	counter uint64
+	nonce   []byte
+	frame   []byte
+	err     error
+}
+
+func NewAEADWriter(w io.Writer, secret [32]byte, buffer uint16) *AEADWriter {
+	aead := newGCM(secret)
+	return &AEADWriter{
+		aead:   aead,
+		w:      w,
+		buf:    bytes.NewBuffer(make([]byte, 0, buffer)),
+		maxLen: int(buffer),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+}
+
+func (a *AEADWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) != 0 {
+		if a.err != nil {
+			return n, a.err
+		}
+
+		cut := a.maxLen - a.buf.Len()
+		if cut > len(b) {
+			cut = len(b)
+		}
+		a.buf.Write(b[:cut])
+		n += cut
+		b = b[cut:]
+		if a.buf.Len() == a.maxLen {
+			if err := a.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (a *AEADWriter) Flush() error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.buf.Len() == 0 {
+		return nil
+	}
+
+	return a.seal(false)
+}
+
+// Close seals the remaining buffered data as the final frame, which may be
+// empty. It does not close the underlying writer.
+func (a *AEADWriter) Close() error {
+	if a.err != nil {
+		return a.err
+	}
+	if err := a.seal(true); err != nil {
+		return err
+	}
+	a.err = ErrClosed
+	return nil
+}
+
+func (a *AEADWriter) seal(final bool) error {
+	size := a.buf.Len() + a.aead.Overhead()
+	if cap(a.frame) < aeadHeader+size {
+		a.frame = make([]byte, aeadHeader, aeadHeader+size)
+	}
+	a.frame = a.frame[:aeadHeader]
+	header := uint32(size)
+	if final {
+		header |= aeadFinal
+	}
+	binary.LittleEndian.PutUint32(a.frame, header)
+
+	frameNonce(a.nonce, a.counter, final)
+	a.counter++
+	a.frame = a.aead.Seal(a.frame, a.nonce, a.buf.Bytes(), a.frame[:aeadHeader])
+	a.buf.Reset()
+
+	if _, err := a.w.Write(a.frame); err != nil {
+		a.err = err
+		return err
+	}
+
+	return nil
+}
+
+// AEADReader reads and authenticates frames written by an AEADWriter.
+// It returns io.EOF after the final frame and io.ErrUnexpectedEOF when the
+// stream ends without one.
+type AEADReader struct {
+	aead    cipher.AEAD
+	r       io.Reader
+	max     int
+	counter uint64
+	nonce   []byte
+	header  []byte
+	frame   []byte
+	plain   []byte
+	err     error
+}
+
+// NewAEADReader creates a reader for frames written by an AEADWriter with
+// at most buffer bytes of plaintext per frame.
+func NewAEADReader(r io.Reader, secret [32]byte, buffer uint16) *AEADReader {
+	aead := newGCM(secret)
+	return &AEADReader{
+		aead:   aead,
+		r:      r,
+		max:    int(buffer) + aead.Overhead(),
+		nonce:  make([]byte, aead.NonceSize()),
+		header: make([]byte, aeadHeader),
+	}
+}
+
+func (a *AEADReader) next() error {
+	if _, err := io.ReadFull(a.r, a.header); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	header := binary.LittleEndian.Uint32(a.header)
+	final := header&aeadFinal != 0
+	size := int(header &^ aeadFinal)
+	if size < a.aead.Overhead() || size > a.max || (!final && size == a.aead.Overhead()) {
+		return ErrFrameSize
+	}
+
+	if cap(a.frame) < size {
+		a.frame = make([]byte, size)
+	}
+	a.frame = a.frame[:size]
+	if _, err := io.ReadFull(a.r, a.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	frameNonce(a.nonce, a.counter, final)
+	plain, err := a.aead.Open(a.frame[:0], a.nonce, a.frame, a.header)
+	if err != nil {
+		return ErrFrameAuth
+	}
+	a.counter++
+	a.plain = plain
+	if final {
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (a *AEADReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for len(a.plain) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		a.err = a.next()
+	}
+
+	n := copy(b, a.plain)
+	a.plain = a.plain[n:]
+	return n, nil
+}
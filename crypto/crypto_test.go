@@ -146,3 +146,330 @@ func TestHMAC(t *testing.T) {
 		t.Errorf("data does not match (len: %d %d)", len(write), len(read))
 	}
 }
+
+func aeadFrames(t *testing.T, key [32]byte, writes ...[]byte) ([]byte, [][]byte) {
+	buf := bytes.NewBuffer(nil)
+	w := NewAEADWriter(buf, key, 100)
+	frames := make([][]byte, 0, len(writes))
+	last := 0
+	for _, d := range writes {
+		if _, err := w.Write(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, buf.Bytes()[last:])
+		last = buf.Len()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, buf.Bytes()[last:])
+
+	return buf.Bytes(), frames
+}
+
+func aeadKey() [32]byte {
+	var key [32]byte
+	copy(key[:], rnd(32))
+	return key
+}
+
+func TestAEAD(t *testing.T) {
+	key := aeadKey()
+	buf := bytes.NewBuffer(nil)
+	w := NewAEADWriter(buf, key, 100)
+
+	write := rnd(1 << 16)
+	w.Write(write[0:10])
+	if err := w.Flush(); err != nil {
+		t.Error(err)
+	}
+
+	w.Write(write[10:300])
+	w.Write(write[300:600])
+	w.Write(write[600:])
+	if err := w.Flush(); err != nil {
+		t.Error(err)
+	}
+	w.Write(write[:10])
+	if err := w.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := w.Write(write[:10]); err != ErrClosed {
+		t.Errorf("expected closed error, got: %v", err)
+	}
+	write = append(write, write[:10]...)
+
+	r := NewAEADReader(buf, key, 100)
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(write, read) {
+		t.Errorf("data does not match (len: %d %d)", len(write), len(read))
+	}
+}
+
+func TestAEADWrongKey(t *testing.T) {
+	data, _ := aeadFrames(t, aeadKey(), rnd(50))
+	r := NewAEADReader(bytes.NewReader(data), aeadKey(), 100)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameAuth {
+		t.Fatalf("expected auth error, got: %v", err)
+	}
+}
+
+func TestAEADTamper(t *testing.T) {
+	key := aeadKey()
+	data, _ := aeadFrames(t, key, rnd(50), rnd(50))
+	for i := range data {
+		tampered := make([]byte, len(data))
+		copy(tampered, data)
+		tampered[i] ^= 1
+
+		r := NewAEADReader(bytes.NewReader(tampered), key, 100)
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Fatalf("flipped bit in byte %d went unnoticed", i)
+		}
+	}
+}
+
+func TestAEADTruncate(t *testing.T) {
+	key := aeadKey()
+	data, frames := aeadFrames(t, key, rnd(50), rnd(50))
+	complete, boundary := 0, 0
+	for i := 0; i < len(data); i++ {
+		if i == boundary+len(frames[complete]) {
+			boundary = i
+			complete++
+		}
+
+		r := NewAEADReader(bytes.NewReader(data[:i]), key, 100)
+		read, err := ioutil.ReadAll(r)
+		if err == nil {
+			t.Fatalf("truncating to %d bytes went unnoticed", i)
+		}
+		if i == boundary && err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncating at frame boundary %d: expected unexpected eof, got: %v", i, err)
+		}
+		if len(read) != 50*complete {
+			t.Fatalf("truncating to %d bytes: expected %d bytes, got %d", i, 50*complete, len(read))
+		}
+	}
+
+	r := NewAEADReader(bytes.NewReader(data), key, 100)
+	if read, err := ioutil.ReadAll(r); err != nil || len(read) != 100 {
+		t.Fatalf("expected 100 bytes, got %d: %v", len(read), err)
+	}
+}
+
+func TestAEADFinal(t *testing.T) {
+	key := aeadKey()
+	data, frames := aeadFrames(t, key)
+	if len(frames) != 1 || len(data) != aeadHeader+16 {
+		t.Fatalf("expected a single empty final frame, got %d bytes", len(data))
+	}
+	r := NewAEADReader(bytes.NewReader(data), key, 100)
+	if read, err := ioutil.ReadAll(r); err != nil || len(read) != 0 {
+		t.Fatalf("expected an empty stream, got %d bytes: %v", len(read), err)
+	}
+
+	// marking an earlier frame final, or unmarking the final one, fails
+	// authentication.
+	_, frames = aeadFrames(t, key, rnd(50), rnd(50))
+	first := append([]byte{}, frames[0]...)
+	first[aeadHeader-1] |= 0x80
+	r = NewAEADReader(bytes.NewReader(first), key, 100)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameAuth {
+		t.Fatalf("expected auth error for forged final frame, got: %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := NewAEADWriter(buf, key, 100)
+	w.Write(rnd(10))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data = buf.Bytes()
+	data[aeadHeader-1] &^= 0x80
+	r = NewAEADReader(bytes.NewReader(data), key, 100)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameAuth {
+		t.Fatalf("expected auth error for unmarked final frame, got: %v", err)
+	}
+}
+
+func TestAEADReorder(t *testing.T) {
+	key := aeadKey()
+	_, frames := aeadFrames(t, key, rnd(50), rnd(50), rnd(50))
+
+	reordered := make([]byte, 0)
+	reordered = append(reordered, frames[0]...)
+	reordered = append(reordered, frames[2]...)
+	reordered = append(reordered, frames[1]...)
+	r := NewAEADReader(bytes.NewReader(reordered), key, 100)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameAuth {
+		t.Fatalf("expected auth error for reordered frames, got: %v", err)
+	}
+
+	replayed := make([]byte, 0)
+	replayed = append(replayed, frames[0]...)
+	replayed = append(replayed, frames[0]...)
+	r = NewAEADReader(bytes.NewReader(replayed), key, 100)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameAuth {
+		t.Fatalf("expected auth error for replayed frame, got: %v", err)
+	}
+}
+
+func TestAEADFrameSize(t *testing.T) {
+	key := aeadKey()
+	data, _ := aeadFrames(t, key, rnd(100))
+	r := NewAEADReader(bytes.NewReader(data), key, 50)
+	if _, err := ioutil.ReadAll(r); err != ErrFrameSize {
+		t.Fatalf("expected frame size error, got: %v", err)
+	}
+}
+
+func TestEphemeral(t *testing.T) {
+	a, err := NewEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEphemeralKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := a.Shared(b.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.Shared(a.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sa, sb) {
+		t.Fatal("shared secrets do not match")
+	}
+
+	if _, err := a.Shared(b.Public()[1:]); err != ErrEphemeralKey {
+		t.Fatalf("expected invalid key error, got: %v", err)
+	}
+	if _, err := a.Shared(make([]byte, 32)); err != ErrEphemeralKey {
+		t.Fatalf("expected low order point to be rejected, got: %v", err)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	a, err := NewSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewSealKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := rnd(100)
+	sealed, err := a.Seal(b.Public(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []*SealKey{a, b} {
+		plain, err := k.Open(a.Public(), b.Public(), sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, msg) {
+			t.Fatal("opened message does not match")
+		}
+	}
+
+	if _, err := c.Open(a.Public(), b.Public(), sealed); err != ErrSealed {
+		t.Fatalf("expected third party to fail, got: %v", err)
+	}
+	if _, err := b.Open(b.Public(), a.Public(), sealed); err != ErrSealed {
+		t.Fatalf("expected reversed direction to fail, got: %v", err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := b.Open(a.Public(), b.Public(), sealed); err != ErrSealed {
+		t.Fatalf("expected tampered message to fail, got: %v", err)
+	}
+
+	d, err := a.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &SealKey{}
+	if err := n.UnmarshalPEM(d); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(n.Public(), a.Public()) {
+		t.Fatal("public key changed after pem roundtrip")
+	}
+}
+
+func TestEd25519Keys(t *testing.T) {
+	k := NewEd25519Key()
+	if err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := k.MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadkey := NewKey(256, 256)
+	if err := loadkey.UnmarshalPEM(d); err != nil {
+		t.Fatal(err)
+	}
+	if loadkey.Type() != KeyEd25519 || !k.ed.Equal(loadkey.ed) {
+		t.Fatal("loaded key does not match")
+	}
+
+	pk, err := k.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpk := NewPubKey(256)
+	if err := rpk.UnmarshalDER(pk.MarshalDER()); err != nil {
+		t.Fatal(err)
+	}
+	if rpk.FingerprintString() != pk.FingerprintString() {
+		t.Fatal("fingerprint changed after der roundtrip")
+	}
+
+	data := rnd(100)
+	sig, err := loadkey.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rpk.Verify(data, sig); err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	if err := rpk.Verify(data, sig); err != ErrInvalidSig {
+		t.Fatalf("expected invalid signature, got: %v", err)
+	}
+
+	if _, err := pk.Encrypt(data); err != ErrNoEncryption {
+		t.Fatalf("expected encryption to be unsupported, got: %v", err)
+	}
+
+	rsaKey := NewKey(128, 128)
+	rsaPub, err := rsaKey.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsaPub.Type() != KeyRSA || rsaPub.FingerprintString() == pk.FingerprintString() {
+		t.Fatal("rsa and ed25519 keys should not share a fingerprint")
+	}
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+var ErrEphemeralKey = errors.New("invalid ephemeral key")
+
+// EphemeralKey is a single use X25519 key.
+type EphemeralKey struct {
+	private []byte
+	public  []byte
+}
+
+func NewEphemeralKey() (*EphemeralKey, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EphemeralKey{private: private, public: public}, nil
+}
+
+func (e *EphemeralKey) Public() []byte { return e.public }
+
+// Shared computes the shared secret with the given peer public key.
+func (e *EphemeralKey) Shared(peer []byte) ([]byte, error) {
+	if len(peer) != curve25519.PointSize {
+		return nil, ErrEphemeralKey
+	}
+
+	s, err := curve25519.X25519(e.private, peer)
+	if err != nil {
+		return nil, ErrEphemeralKey
+	}
+	return s, nil
+}
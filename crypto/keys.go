@@ -3,6 +3,7 @@ package crypto
 import (
 	"bytes"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
@@ -22,16 +23,37 @@ import (
 )
 
 var (
-	ErrKeyExists   = errors.New("a key already exists")
-	ErrKeyTooSmall = errors.New("key is too small")
-	ErrNotRSA      = errors.New("key is not an rsa key")
+	ErrKeyExists    = errors.New("a key already exists")
+	ErrKeyTooSmall  = errors.New("key is too small")
+	ErrNotRSA       = errors.New("key is not an rsa key")
+	ErrKeyType      = errors.New("unsupported key type")
+	ErrInvalidSig   = errors.New("invalid signature")
+	ErrNoEncryption = errors.New("key type does not support encryption")
 )
 
 const (
-	typePrivate = "RSA PRIVATE KEY"
-	typePublic  = "PUBLIC KEY"
+	typePrivate        = "RSA PRIVATE KEY"
+	typePrivateEd25519 = "PRIVATE KEY"
+	typePublic         = "PUBLIC KEY"
 )
 
+type KeyType byte
+
+const (
+	KeyRSA KeyType = iota
+	KeyEd25519
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyRSA:
+		return "rsa"
+	case KeyEd25519:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
 const pkgMinBytes = 128
 
 func HMAC(result, secret, seed []byte) {
@@ -63,16 +85,18 @@ func sigHasher() (crypto.Hash, hash.Hash) {
 	return crypto.SHA256, sha256.New()
 }
 
-func unmarshalPEM(typeHeader string, data []byte) ([]byte, error) {
+func unmarshalPEM(data []byte, typeHeaders ...string) ([]byte, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, errors.New("data is not pem encoded")
 	}
-	if block.Type != typeHeader {
-		return nil, ErrNotRSA
+	for _, h := range typeHeaders {
+		if block.Type == h {
+			return block.Bytes, nil
+		}
 	}
 
-	return block.Bytes, nil
+	return nil, ErrKeyType
 }
 
 func marshalPEM(typeHeader string, data []byte) ([]byte, error) {
@@ -83,34 +107,49 @@ func marshalPEM(typeHeader string, data []byte) ([]byte, error) {
 }
 
 func EnsureKey(file string, minBytes, desiredBytes int) (*Key, error) {
-	k, err := KeyFromFile(file, minBytes, desiredBytes)
+	return ensureKey(file, NewKey(minBytes, desiredBytes))
+}
+
+// EnsureEd25519Key loads the key at file or generates a new Ed25519 key.
+func EnsureEd25519Key(file string) (*Key, error) {
+	return ensureKey(file, NewEd25519Key())
+}
+
+func ensureKey(file string, k *Key) (*Key, error) {
+	d, err := ioutil.ReadFile(file)
+	if err == nil {
+		return k, k.UnmarshalPEM(d)
+	}
 	if !os.IsNotExist(err) {
-		return k, err
+		return nil, err
 	}
 
-	k = NewKey(minBytes, desiredBytes)
 	if err := k.Generate(); err != nil {
 		return nil, err
 	}
 
-	d, err := k.MarshalPEM()
+	d, err = k.MarshalPEM()
 	if err != nil {
 		return nil, err
 	}
 
+	return k, writeKeyFile(file, d)
+}
+
+func writeKeyFile(file string, d []byte) error {
 	tmp := fmt.Sprintf("%s.%d.tmp", file, time.Now().UnixNano())
 	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o400)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	_, err = f.Write(d)
 	f.Close()
 	if err != nil {
 		os.Remove(tmp)
-		return nil, err
+		return err
 	}
-	return k, os.Rename(tmp, file)
+	return os.Rename(tmp, file)
 }
 
 func KeyFromFile(file string, minBytes, desiredBytes int) (*Key, error) {
@@ -134,7 +173,9 @@ func KeyFromReader(r io.Reader, minBytes, desiredBytes int) (*Key, error) {
 }
 
 type Key struct {
+	typ     KeyType
 	private *rsa.PrivateKey
+	ed      ed25519.PrivateKey
 	public  *PubKey
 	min     int
 	size    int
@@ -150,7 +191,18 @@ func NewKey(minBytes, desiredBytes int) *Key {
 	return &Key{min: minBytes, size: desiredBytes}
 }
 
-func (k *Key) Size() int { return k.private.Size() }
+func NewEd25519Key() *Key {
+	return &Key{typ: KeyEd25519, min: pkgMinBytes, size: pkgMinBytes}
+}
+
+func (k *Key) Type() KeyType { return k.typ }
+
+func (k *Key) Size() int {
+	if k.typ == KeyEd25519 {
+		return ed25519.PrivateKeySize
+	}
+	return k.private.Size()
+}
 
 func (k *Key) Public() (*PubKey, error) {
 	if k.public != nil {
@@ -161,7 +213,13 @@ func (k *Key) Public() (*PubKey, error) {
 		return nil, err
 	}
 
-	k.public = &PubKey{k.private.Public().(*rsa.PublicKey), k.min}
+	k.public = &PubKey{typ: k.typ, min: k.min}
+	switch k.typ {
+	case KeyEd25519:
+		k.public.ed = k.ed.Public().(ed25519.PublicKey)
+	default:
+		k.public.public = k.private.Public().(*rsa.PublicKey)
+	}
 	return k.public, nil
 }
 
@@ -169,6 +227,9 @@ func (k *Key) Decrypt(data []byte) ([]byte, error) {
 	if err := k.Generate(); err != nil && err != ErrKeyExists {
 		return nil, err
 	}
+	if k.typ != KeyRSA {
+		return nil, ErrNoEncryption
+	}
 	return rsa.DecryptOAEP(hasher(), rand.Reader, k.private, data, nil)
 }
 
@@ -176,6 +237,10 @@ func (k *Key) Sign(data []byte) ([]byte, error) {
 	if err := k.Generate(); err != nil && err != ErrKeyExists {
 		return nil, err
 	}
+	if k.typ == KeyEd25519 {
+		return ed25519.Sign(k.ed, data), nil
+	}
+
 	t, h := sigHasher()
 	if _, err := h.Write(data); err != nil {
 		return nil, err
@@ -185,10 +250,20 @@ func (k *Key) Sign(data []byte) ([]byte, error) {
 }
 
 func (k *Key) Generate() error {
-	if k.private != nil {
+	if k.private != nil || k.ed != nil {
 		return ErrKeyExists
 	}
 
+	if k.typ == KeyEd25519 {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		k.ed = priv
+		k.public = nil
+		return nil
+	}
+
 	priv, err := rsa.GenerateKey(rand.Reader, k.size*8)
 	if err != nil {
 		return err
@@ -200,7 +275,7 @@ func (k *Key) Generate() error {
 }
 
 func (k *Key) UnmarshalPEM(data []byte) error {
-	der, err := unmarshalPEM(typePrivate, data)
+	der, err := unmarshalPEM(data, typePrivate, typePrivateEd25519)
 	if err != nil {
 		return err
 	}
@@ -213,6 +288,9 @@ func (k *Key) MarshalPEM() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if k.typ == KeyEd25519 {
+		return marshalPEM(typePrivateEd25519, data)
+	}
 	return marshalPEM(typePrivate, data)
 }
 
@@ -221,6 +299,9 @@ func (k *Key) MarshalDER() ([]byte, error) {
 		return nil, err
 	}
 
+	if k.typ == KeyEd25519 {
+		return x509.MarshalPKCS8PrivateKey(k.ed)
+	}
 	return x509.MarshalPKCS8PrivateKey(k.private)
 }
 
@@ -233,22 +314,26 @@ func (k *Key) UnmarshalDER(data []byte) error {
 		}
 	}
 
-	rsa, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return ErrNotRSA
-	}
-
-	if rsa.Size() < k.min {
-		return ErrKeyTooSmall
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.Size() < k.min {
+			return ErrKeyTooSmall
+		}
+		k.typ, k.private, k.ed = KeyRSA, key, nil
+	case ed25519.PrivateKey:
+		k.typ, k.private, k.ed = KeyEd25519, nil, key
+	default:
+		return ErrKeyType
 	}
 
-	k.private = rsa
 	k.public = nil
 	return nil
 }
 
 type PubKey struct {
+	typ    KeyType
 	public *rsa.PublicKey
+	ed     ed25519.PublicKey
 	min    int
 }
 
@@ -259,13 +344,30 @@ func NewPubKey(minBytes int) *PubKey {
 	return &PubKey{min: minBytes}
 }
 
-func (k *PubKey) Size() int { return k.public.Size() }
+func (k *PubKey) Type() KeyType { return k.typ }
+
+func (k *PubKey) Size() int {
+	if k.typ == KeyEd25519 {
+		return ed25519.PublicKeySize
+	}
+	return k.public.Size()
+}
 
 func (k *PubKey) Encrypt(data []byte) ([]byte, error) {
+	if k.typ != KeyRSA {
+		return nil, ErrNoEncryption
+	}
 	return rsa.EncryptOAEP(hasher(), rand.Reader, k.public, data, nil)
 }
 
 func (k *PubKey) Verify(data, sig []byte) error {
+	if k.typ == KeyEd25519 {
+		if !ed25519.Verify(k.ed, data, sig) {
+			return ErrInvalidSig
+		}
+		return nil
+	}
+
 	t, h := sigHasher()
 	if _, err := h.Write(data); err != nil {
 		return err
@@ -275,6 +377,13 @@ func (k *PubKey) Verify(data, sig []byte) error {
 }
 
 func (k *PubKey) Fingerprint() [32]byte {
+	if k.typ == KeyEd25519 {
+		r := make([]byte, 0, len(KeyEd25519.String())+len(k.ed))
+		r = append(r, KeyEd25519.String()...)
+		r = append(r, k.ed...)
+		return sha256.Sum256(r)
+	}
+
 	b := k.public.N.Bytes()
 	r := make([]byte, 0, 1+len(b)+1+8)
 	var sign byte
@@ -308,12 +417,15 @@ func (k *PubKey) FingerprintString() string {
 }
 
 func (k *PubKey) MaxPayload() int {
+	if k.typ != KeyRSA {
+		return 0
+	}
 	h := hasher()
 	return k.public.Size() - 2*h.Size() - 2
 }
 
 func (k *PubKey) UnmarshalPEM(data []byte) error {
-	der, err := unmarshalPEM(typePublic, data)
+	der, err := unmarshalPEM(data, typePublic)
 	if err != nil {
 		return err
 	}
@@ -325,20 +437,44 @@ func (k *PubKey) MarshalPEM() ([]byte, error) {
 	return marshalPEM(typePublic, k.MarshalDER())
 }
 
+// MarshalDER encodes rsa keys as PKCS1 and Ed25519 keys as PKIX.
 func (k *PubKey) MarshalDER() []byte {
+	if k.typ == KeyEd25519 {
+		d, err := x509.MarshalPKIXPublicKey(k.ed)
+		if err != nil {
+			panic(err)
+		}
+		return d
+	}
 	return x509.MarshalPKCS1PublicKey(k.public)
 }
 
 func (k *PubKey) UnmarshalDER(data []byte) error {
-	key, err := x509.ParsePKCS1PublicKey(data)
+	if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		if key.Size() < k.min {
+			return ErrKeyTooSmall
+		}
+
+		k.typ, k.public, k.ed = KeyRSA, key, nil
+		return nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(data)
 	if err != nil {
 		return err
 	}
 
-	if key.Size() < k.min {
-		return ErrKeyTooSmall
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if key.Size() < k.min {
+			return ErrKeyTooSmall
+		}
+		k.typ, k.public, k.ed = KeyRSA, key, nil
+	case ed25519.PublicKey:
+		k.typ, k.public, k.ed = KeyEd25519, nil, key
+	default:
+		return ErrKeyType
 	}
 
-	k.public = key
 	return nil
 }
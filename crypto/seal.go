@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	typeSealKey = "X25519 PRIVATE KEY"
+	sealLabel   = "homechat sealed message"
+	sealNonce   = 12
+)
+
+// SealKeySize is the size of a public seal key.
+const SealKeySize = curve25519.PointSize
+
+var ErrSealed = errors.New("could not open sealed message")
+
+// SealKey is a long-term X25519 key used to seal messages between two peers.
+// Both peers derive the same secret from their own private key and the
+// public key of the other, so the sender can open its own messages as well.
+type SealKey struct {
+	EphemeralKey
+}
+
+func NewSealKey() (*SealKey, error) {
+	e, err := NewEphemeralKey()
+	if err != nil {
+		return nil, err
+	}
+	return &SealKey{*e}, nil
+}
+
+// EnsureSealKey loads the key at file or generates a new one.
+func EnsureSealKey(file string) (*SealKey, error) {
+	d, err := ioutil.ReadFile(file)
+	if err == nil {
+		k := &SealKey{}
+		return k, k.UnmarshalPEM(d)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	k, err := NewSealKey()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err = k.MarshalPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, writeKeyFile(file, d)
+}
+
+func (k *SealKey) MarshalPEM() ([]byte, error) {
+	return marshalPEM(typeSealKey, k.private)
+}
+
+func (k *SealKey) UnmarshalPEM(data []byte) error {
+	b, err := unmarshalPEM(data, typeSealKey)
+	if err != nil {
+		return err
+	}
+	if len(b) != curve25519.ScalarSize {
+		return ErrEphemeralKey
+	}
+
+	public, err := curve25519.X25519(b, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	k.private, k.public = b, public
+	return nil
+}
+
+// secret derives the key for messages sent from one public key to another.
+func (k *SealKey) secret(from, to []byte) ([32]byte, error) {
+	var secret [32]byte
+	peer := to
+	switch {
+	case bytes.Equal(k.public, to):
+		peer = from
+	case !bytes.Equal(k.public, from):
+		return secret, ErrSealed
+	}
+
+	shared, err := k.Shared(peer)
+	if err != nil {
+		return secret, err
+	}
+
+	seed := make([]byte, 0, len(sealLabel)+len(from)+len(to))
+	seed = append(seed, sealLabel...)
+	seed = append(seed, from...)
+	seed = append(seed, to...)
+	HMAC(secret[:], shared, seed)
+	return secret, nil
+}
+
+// Seal encrypts plain for the owner of public key to.
+func (k *SealKey) Seal(to, plain []byte) ([]byte, error) {
+	secret, err := k.secret(k.public, to)
+	if err != nil {
+		return nil, err
+	}
+
+	aead := newGCM(secret)
+	sealed := make([]byte, sealNonce, sealNonce+len(plain)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed[:sealNonce], plain, nil), nil
+}
+
+// Open decrypts a message sealed by the owner of public key from for the
+// owner of public key to. k has to be one of both.
+func (k *SealKey) Open(from, to, sealed []byte) ([]byte, error) {
+	secret, err := k.secret(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < sealNonce {
+		return nil, ErrSealed
+	}
+	plain, err := newGCM(secret).Open(nil, sealed[:sealNonce], sealed[sealNonce:], nil)
+	if err != nil {
+		return nil, ErrSealed
+	}
+	return plain, nil
+}
@@ -290,6 +290,12 @@ function init() {
       users = u;
       updateUsers();
     },
+    onConnState: function (s) {
+      status.status = s.status;
+      elStatus.classList.toggle("is-success", s.online);
+      elStatus.classList.toggle("is-error", !s.online);
+      updateStatus();
+    },
     onLog: function (logstr) {
       status.status = logstr;
       updateStatus();
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frizinak/gotls/simplehttp"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/client"
+	"github.com/frizinak/homechat/vars"
+)
+
+const (
+	apiMaxBody        = 1024 * 1024
+	apiHistoryDefault = 50
+	apiPingInterval   = time.Second * 30
+)
+
+// apiEventChannels maps the event names of the event stream to their channel.
+var apiEventChannels = []struct{ name, channel string }{
+	{"chat", vars.ChatChannel},
+	{"music-state", vars.MusicStateChannel},
+	{"music-song", vars.MusicSongChannel},
+}
+
+// apiClient is a script that authenticated with an API token, it acts as
+// the user of the policy entry the token was issued for.
+type apiClient struct {
+	name string
+	fp   string
+}
+
+func (c *apiClient) Name() string           { return c.name }
+func (c *apiClient) Bot() bool              { return false }
+func (c *apiClient) Fingerprints() []string { return []string{c.fp} }
+
+type apiHandler func(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error)
+
+func (s *Server) routeAPI(p string) simplehttp.HandleFunc {
+	var h apiHandler
+	method := http.MethodGet
+	switch p {
+	case "/api/chat":
+		h, method = s.apiChat, http.MethodPost
+	case "/api/history":
+		h = s.apiHistory
+	case "/api/users":
+		h = s.apiUsers
+	case "/api/music":
+		h = s.apiMusic
+	case "/api/events":
+		h = s.apiEvents
+	default:
+		return nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
+		if r.Method != method {
+			return http.StatusMethodNotAllowed, nil
+		}
+		cl, err := s.apiAuth(r)
+		if err == ErrToken {
+			return apiErr(w, http.StatusUnauthorized, err)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return h(w, r, cl, l)
+	}
+}
+
+// apiAuth resolves the token of the request to the policy entry it was
+// issued for.
+func (s *Server) apiAuth(r *http.Request) (*apiClient, error) {
+	const bearer = "Bearer "
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, bearer) {
+		token = strings.TrimSpace(h[len(bearer):])
+	}
+
+	name, fp, err := s.TokenUser(token)
+	if err != nil {
+		return nil, err
+	}
+	return &apiClient{name: name, fp: fp}, nil
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return 0, json.NewEncoder(w).Encode(v)
+}
+
+func apiErr(w http.ResponseWriter, status int, err error) (int, error) {
+	return apiJSON(w, status, map[string]string{"err": err.Error()})
+}
+
+func apiInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: '%s'", key, v)
+	}
+	return n, nil
+}
+
+func rawJSON(m channel.Msg) (json.RawMessage, error) {
+	buf := bytes.NewBuffer(nil)
+	err := m.JSON(buf)
+	return bytes.TrimSpace(buf.Bytes()), err
+}
+
+func (s *Server) apiChat(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error) {
+	ch, ok := s.channels[vars.ChatChannel]
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	max := ch.LimitReader()
+	if max > apiMaxBody {
+		max = apiMaxBody
+	}
+	body := http.MaxBytesReader(w, r.Body, max)
+	defer body.Close()
+	if _, err := ch.HandleJSON(cl, body); err != nil {
+		return apiErr(w, http.StatusBadRequest, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return 0, nil
+}
+
+type historyPager interface {
+	Page(cl channel.Client, skip, n int) ([]channel.Msg, error)
+}
+
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error) {
+	h, ok := s.channels[vars.HistoryChannel].(historyPager)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	n, err := apiInt(r, "n", apiHistoryDefault)
+	if err != nil {
+		return apiErr(w, http.StatusBadRequest, err)
+	}
+	skip, err := apiInt(r, "skip", 0)
+	if err != nil {
+		return apiErr(w, http.StatusBadRequest, err)
+	}
+
+	msgs, err := h.Page(cl, skip, n)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	res := make([]json.RawMessage, len(msgs))
+	for i, m := range msgs {
+		if res[i], err = rawJSON(m); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	return apiJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) apiUsers(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error) {
+	type user struct {
+		Name    string `json:"name"`
+		Clients int    `json:"clients"`
+	}
+
+	list := func(ch string) []user {
+		users := s.GetUsers(ch)
+		res := make([]user, len(users))
+		for i, u := range users {
+			res[i] = user{u.Name, u.Clients}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+		return res
+	}
+
+	return apiJSON(w, http.StatusOK, map[string][]user{
+		"chat":  list(vars.ChatChannel),
+		"music": list(vars.MusicChannel),
+	})
+}
+
+func (s *Server) apiMusic(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error) {
+	state, ok1 := s.channels[vars.MusicStateChannel].(channel.Stateful)
+	song, ok2 := s.channels[vars.MusicSongChannel].(channel.Stateful)
+	if !ok1 || !ok2 {
+		return http.StatusNotFound, nil
+	}
+
+	var err error
+	m := make(map[string]json.RawMessage, 2)
+	if m["state"], err = rawJSON(state.State()); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if m["song"], err = rawJSON(song.State()); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return apiJSON(w, http.StatusOK, m)
+}
+
+// apiEvents streams the messages of the requested channels as server-sent
+// events. The stream is a regular client with a session so EventSource can
+// resume it with the id of the last event it received.
+func (s *Server) apiEvents(w http.ResponseWriter, r *http.Request, cl *apiClient, l *log.Logger) (int, error) {
+	if gz, ok := w.(*simplehttp.GZIPWriter); ok {
+		w = gz.ResponseWriter
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		return http.StatusInternalServerError, errors.New("response can not be streamed")
+	}
+
+	want := make(map[string]bool)
+	if v := r.URL.Query().Get("events"); v != "" {
+		for _, e := range strings.Split(v, ",") {
+			want[strings.TrimSpace(e)] = true
+		}
+	}
+
+	sw := &sseWriter{w: w, f: fl, events: make(map[string]string)}
+	all := len(want) == 0
+	channels := make([]string, 0, len(apiEventChannels))
+	for _, e := range apiEventChannels {
+		requested := all || want[e.name]
+		delete(want, e.name)
+		if _, ok := s.channels[e.channel]; !ok || !requested {
+			continue
+		}
+		channels = append(channels, e.channel)
+		sw.events[e.channel] = e.name
+	}
+	if len(want) != 0 {
+		names := make([]string, 0, len(want))
+		for e := range want {
+			names = append(names, e)
+		}
+		sort.Strings(names)
+		return apiErr(w, http.StatusBadRequest, fmt.Errorf("no such events: %s", strings.Join(names, ", ")))
+	}
+	if len(channels) == 0 {
+		return http.StatusNotFound, nil
+	}
+
+	var id channel.IdentifyMsg
+	if p := strings.SplitN(r.Header.Get("Last-Event-ID"), ".", 2); len(p) == 2 {
+		if seq, err := strconv.ParseUint(p[1], 10, 32); err == nil {
+			id.Session, id.Seq = p[0], uint32(seq)
+		}
+	}
+
+	conf := s.localConfig(cl.name, cl.fp, channels)
+	sess, seq, err := s.session(id, conf)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	sw.session = sess.Token()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	c := client.New(conf, sw, nil, s.clientErrs)
+	s.setClient(conf, c, sess, seq)
+	defer s.unsetClient(c)
+	defer sw.Close()
+
+	ping := time.NewTicker(apiPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return 0, nil
+		case <-c.Killed():
+			return 0, nil
+		case <-ping.C:
+			if err := sw.Comment("ping"); err != nil {
+				return 0, nil
+			}
+		}
+	}
+}
+
+// sseWriter turns the messages a JSON client writes into server-sent events.
+// Each flush holds the channel header and one message, the header determines
+// the event name and id.
+type sseWriter struct {
+	sem     sync.Mutex
+	w       io.Writer
+	f       http.Flusher
+	closed  bool
+	buf     bytes.Buffer
+	events  map[string]string
+	session string
+}
+
+var errSSEClosed = errors.New("event stream closed")
+
+func (w *sseWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+func (w *sseWriter) Flush() error {
+	defer w.buf.Reset()
+	p := bytes.SplitN(bytes.TrimSpace(w.buf.Bytes()), []byte{'\n'}, 2)
+	if len(p) != 2 {
+		return nil
+	}
+
+	var h channel.ChannelMsg
+	if err := json.Unmarshal(p[0], &h); err != nil {
+		return err
+	}
+	name, ok := w.events[h.Data]
+	if !ok {
+		return nil
+	}
+
+	w.sem.Lock()
+	defer w.sem.Unlock()
+	if w.closed {
+		return errSSEClosed
+	}
+	fmt.Fprintf(w.w, "event: %s\n", name)
+	if h.Seq != 0 {
+		fmt.Fprintf(w.w, "id: %s.%d\n", w.session, h.Seq)
+	}
+	if _, err := fmt.Fprintf(w.w, "data: %s\n\n", p[1]); err != nil {
+		return err
+	}
+	w.f.Flush()
+	return nil
+}
+
+func (w *sseWriter) Comment(c string) error {
+	w.sem.Lock()
+	defer w.sem.Unlock()
+	if w.closed {
+		return errSSEClosed
+	}
+	if _, err := fmt.Fprintf(w.w, ": %s\n\n", c); err != nil {
+		return err
+	}
+	w.f.Flush()
+	return nil
+}
+
+// Close stops all writes, the response can't be written to once its
+// handler returned.
+func (w *sseWriter) Close() {
+	w.sem.Lock()
+	w.closed = true
+	w.sem.Unlock()
+}
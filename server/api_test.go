@@ -0,0 +1,200 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server"
+	"github.com/frizinak/homechat/server/internal/servertest"
+	"github.com/frizinak/homechat/vars"
+)
+
+func apiServer(t *testing.T) (*server.Server, *httptest.Server) {
+	s, _ := servertest.New(t, server.Config{
+		PolicyLoader: servertest.Policies{"fp-alice": "alice"},
+		TokenLoader:  servertest.Tokens{"tok-alice": "fp-alice", "tok-revoked": "fp-gone"},
+	})
+	ts := httptest.NewServer(server.HTTPHandler(s))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func apiRequest(t *testing.T, ctx context.Context, method, url, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAPIAuth(t *testing.T) {
+	_, ts := apiServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		header string
+		status int
+	}{
+		{"header", http.MethodGet, "", "tok-alice", http.StatusOK},
+		{"query", http.MethodGet, "?token=tok-alice", "", http.StatusOK},
+		{"header overrides query", http.MethodGet, "?token=tok-alice", "nope", http.StatusUnauthorized},
+		{"header over bad query", http.MethodGet, "?token=nope", "tok-alice", http.StatusOK},
+		{"no token", http.MethodGet, "", "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "?token=nope", "", http.StatusUnauthorized},
+		{"revoked", http.MethodGet, "", "tok-revoked", http.StatusUnauthorized},
+		{"method", http.MethodPost, "", "tok-alice", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		res := apiRequest(t, ctx, test.method, ts.URL+"/api/users"+test.query, test.header, "")
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, res.StatusCode)
+		}
+	}
+}
+
+type sseEvent struct {
+	event, id, data string
+}
+
+// readEvent reads the next event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = strings.TrimSuffix(l, "\n")
+		switch {
+		case l == "" && e.event != "":
+			return e
+		case strings.HasPrefix(l, "event: "):
+			e.event = l[7:]
+		case strings.HasPrefix(l, "id: "):
+			e.id = l[4:]
+		case strings.HasPrefix(l, "data: "):
+			e.data = l[6:]
+		}
+	}
+}
+
+func chatData(t *testing.T, e sseEvent) (from, d string) {
+	t.Helper()
+	var m struct {
+		From string `json:"from"`
+		D    string `json:"d"`
+	}
+	if err := json.Unmarshal([]byte(e.data), &m); err != nil {
+		t.Fatalf("invalid event data %q: %s", e.data, err)
+	}
+	return m.From, m.D
+}
+
+func postChat(t *testing.T, ts *httptest.Server, d string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"d": d})
+	res := apiRequest(t, context.Background(), http.MethodPost, ts.URL+"/api/chat", "tok-alice", string(body))
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("post %q: status %d", d, res.StatusCode)
+	}
+}
+
+func subscribe(t *testing.T, ts *httptest.Server, lastID string) (*bufio.Reader, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/events?events=chat&token=tok-alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("events: status %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("events: content type %s", ct)
+	}
+	return bufio.NewReader(res.Body), cancel
+}
+
+// waitDisconnected waits until the server removed all chat clients.
+func waitDisconnected(t *testing.T, s *server.Server) {
+	t.Helper()
+	for i := 0; len(s.GetUsers(vars.ChatChannel)) != 0; i++ {
+		if i == 500 {
+			t.Fatal("event stream client was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	s, ts := apiServer(t)
+
+	r, cancel := subscribe(t, ts, "")
+	postChat(t, ts, "first")
+	e := readEvent(t, r)
+	if e.event != "chat" {
+		t.Fatalf("expected a chat event, got %q", e.event)
+	}
+	if p := strings.SplitN(e.id, ".", 2); len(p) != 2 || p[0] == "" || p[1] == "" {
+		t.Fatalf("expected a session.seq id, got %q", e.id)
+	}
+	if from, d := chatData(t, e); from != "alice" || d != "first" {
+		t.Fatalf("unexpected message from %q: %q", from, d)
+	}
+
+	cancel()
+	waitDisconnected(t, s)
+	postChat(t, ts, "missed")
+
+	r, cancel = subscribe(t, ts, e.id)
+	defer cancel()
+	resumed := readEvent(t, r)
+	if _, d := chatData(t, resumed); d != "missed" {
+		t.Fatalf("expected the missed message after resuming, got %q", d)
+	}
+	if resumed.id == e.id || !strings.HasPrefix(resumed.id, strings.SplitN(e.id, ".", 2)[0]+".") {
+		t.Fatalf("expected the next id in the same session, got %q after %q", resumed.id, e.id)
+	}
+
+	postChat(t, ts, "live")
+	if _, d := chatData(t, readEvent(t, r)); d != "live" {
+		t.Fatalf("expected the live message, got %q", d)
+	}
+}
+
+func TestAPIEventsUnknown(t *testing.T) {
+	_, ts := apiServer(t)
+	res := apiRequest(t, context.Background(), http.MethodGet, ts.URL+"/api/events?events=chat,nope", "tok-alice", "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+}
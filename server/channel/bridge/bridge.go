@@ -0,0 +1,582 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/bridge/data"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+const (
+	presenceInterval = time.Second * 2
+	presenceRefresh  = time.Second * 30
+
+	saveVersion = "v1"
+
+	// Ids continue this far past the saved counter, more than are ever sent
+	// between two saves, so ids are not reused after a crash.
+	idGap = 1 << 32
+)
+
+// Names of the channels that can be bridged.
+const (
+	Chat  = "chat"
+	Users = "users"
+)
+
+var bridgeable = map[string]string{
+	Chat:  vars.ChatChannel,
+	Users: vars.UserChannel,
+}
+
+// PeerConfig of a single bridged server. Only one of both servers has to
+// connect to the other, each server only sends what its own PeerConfig
+// allows.
+type PeerConfig struct {
+	// Fingerprint of the server key of the peer.
+	Fingerprint string
+
+	// TCP address of the peer, empty if the peer connects to us.
+	Address string
+
+	// Connect over TLS, optionally verified with the given PEM certificate.
+	TLS      bool
+	CertFile string
+
+	// Local users whose messages and presence are sent to the peer and who
+	// can receive private messages from its users, empty for all.
+	Users []string
+
+	// Bridged channels: chat and/or users, empty for both.
+	Channels []string
+}
+
+// Poster delivers a chat message, i.e.: chat.ChatChannel.
+type Poster interface {
+	Handle(channel.Client, chatdata.Message) error
+}
+
+type Config struct {
+	Log *log.Logger
+
+	// Name this server identifies with when it connects to a peer.
+	Name string
+
+	// Key of this server, peers know us by its fingerprint.
+	Key *crypto.Key
+
+	Chat Poster
+
+	// Local users, i.e.: the server.
+	Users channel.UserCollection
+
+	// Peers by name, their users are known as user@name.
+	Peers map[string]PeerConfig
+}
+
+// remote is a user of a bridged server.
+type remote struct {
+	*channel.NameOnlyClient
+}
+
+type peer struct {
+	name string
+	PeerConfig
+	users    map[string]bool
+	channels map[string]bool
+
+	link *link
+
+	// out orders the ids and the messages they are sent with.
+	out sync.Mutex
+
+	sem     sync.Mutex
+	client  string
+	lastIn  uint64
+	lastOut uint64
+	changed bool
+	remote  []string
+	sent    string
+	sentAt  time.Time
+	refresh bool
+}
+
+func (p *peer) bridges(chnl string) bool { return p.channels[chnl] }
+
+func (p *peer) allows(user string) bool {
+	return len(p.users) == 0 || p.users[user]
+}
+
+// accept reports whether the message with the given id was not handled yet.
+func (p *peer) accept(id uint64) bool {
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	if id <= p.lastIn {
+		return false
+	}
+	p.lastIn, p.changed = id, true
+	return true
+}
+
+// setRemote reports whether users differ from the previous list.
+func (p *peer) setRemote(users []string) bool {
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	changed := len(users) != len(p.remote)
+	for i := 0; !changed && i < len(users); i++ {
+		changed = users[i] != p.remote[i]
+	}
+	p.remote = users
+	return changed
+}
+
+// BridgeChannel mirrors the chat and users of this server with those of its
+// peers. Users of a peer chat as user@peer, their messages are never sent
+// back so two servers can't loop.
+//
+// Messages to a peer that connects to us are broadcast to its client, its
+// session replays what it missed while disconnected. Messages to a peer we
+// connect to are queued until it acknowledged them. Each message carries an
+// id of a counter per peer, replays of messages that were already handled are
+// dropped. Both counters of each peer are saved.
+type BridgeChannel struct {
+	c Config
+
+	sender  channel.Sender
+	channel string
+
+	peers  []*peer
+	byName map[string]*peer
+	byFP   map[string]*peer
+
+	done chan struct{}
+
+	onUsers []func()
+
+	channel.Limit
+}
+
+func New(c Config) (*BridgeChannel, error) {
+	b := &BridgeChannel{
+		c:      c,
+		peers:  make([]*peer, 0, len(c.Peers)),
+		byName: make(map[string]*peer, len(c.Peers)),
+		byFP:   make(map[string]*peer, len(c.Peers)),
+		done:   make(chan struct{}),
+		Limit:  channel.Limiter(chatdata.MaxDataSize + 1024*64),
+	}
+
+	for name, pc := range c.Peers {
+		if !validName(name) {
+			return nil, fmt.Errorf("bridge %s: invalid name", name)
+		}
+		if pc.Fingerprint == "" {
+			return nil, fmt.Errorf("bridge %s: no fingerprint", name)
+		}
+		p := &peer{
+			name:       name,
+			PeerConfig: pc,
+			users:      make(map[string]bool, len(pc.Users)),
+			channels:   make(map[string]bool, len(bridgeable)),
+			// until Load, so a peer that remembers ids of a lost save file
+			// still accepts ours.
+			lastOut: uint64(time.Now().UnixNano()),
+		}
+		for _, u := range pc.Users {
+			p.users[u] = true
+		}
+		chans := pc.Channels
+		if len(chans) == 0 {
+			chans = []string{Chat, Users}
+		}
+		for _, ch := range chans {
+			chnl, ok := bridgeable[ch]
+			if !ok {
+				return nil, fmt.Errorf("bridge %s: channel '%s' can't be bridged", name, ch)
+			}
+			p.channels[chnl] = true
+		}
+
+		if pc.Address != "" {
+			if !validName(c.Name) {
+				return nil, fmt.Errorf("bridge %s: invalid name for this server: '%s'", name, c.Name)
+			}
+			var err error
+			if p.link, err = newLink(b, p); err != nil {
+				return nil, fmt.Errorf("bridge %s: %w", name, err)
+			}
+		}
+
+		b.peers = append(b.peers, p)
+		b.byName[name] = p
+		b.byFP[pc.Fingerprint] = p
+	}
+
+	return b, nil
+}
+
+func validName(n string) bool {
+	if n == "" || len(n) > 64 {
+		return false
+	}
+	for _, r := range n {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) || r == '@' {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BridgeChannel) Register(chnl string, s channel.Sender) error {
+	b.channel = chnl
+	b.sender = s
+	return nil
+}
+
+func (b *BridgeChannel) Run() error {
+	for _, p := range b.peers {
+		if p.link != nil {
+			go p.link.run(b.done)
+		}
+	}
+
+	tick := time.NewTicker(presenceInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-b.done:
+			return nil
+		case <-tick.C:
+			b.presence()
+		}
+	}
+}
+
+func (b *BridgeChannel) Close() error {
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	return nil
+}
+
+// CanSubscribe only allows peers to subscribe.
+func (b *BridgeChannel) CanSubscribe(fingerprints []string) bool {
+	for _, fp := range fingerprints {
+		if _, ok := b.byFP[fp]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BridgeChannel) peerOf(cl channel.Client) (*peer, bool) {
+	for fp, p := range b.byFP {
+		if channel.Authenticated(cl, fp) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (b *BridgeChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) error {
+	m, err := data.BinaryMessage(r)
+	if err != nil {
+		return err
+	}
+	return channel.RequestErr(b.handle(cl, m))
+}
+
+func (b *BridgeChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
+	m, nr, err := data.JSONMessage(r)
+	if err != nil {
+		return nr, err
+	}
+	return nr, channel.RequestErr(b.handle(cl, m))
+}
+
+func (b *BridgeChannel) handle(cl channel.Client, m data.Message) error {
+	p, ok := b.peerOf(cl)
+	if !ok {
+		return errors.New("not a bridged server")
+	}
+	return b.receive(p, m)
+}
+
+// receive handles a message of peer p.
+func (b *BridgeChannel) receive(p *peer, m data.Message) error {
+	if !p.accept(m.ID) {
+		return nil
+	}
+	if !p.bridges(m.Channel) {
+		return fmt.Errorf("channel '%s' is not bridged", m.Channel)
+	}
+
+	switch m.Channel {
+	case vars.UserChannel:
+		users := make([]string, 0, len(m.Users))
+		for _, u := range m.Users {
+			if validName(u) {
+				users = append(users, u)
+			}
+		}
+		b.setRemote(p, users)
+		return nil
+	case vars.ChatChannel:
+	default:
+		return nil
+	}
+
+	if !validName(m.From) {
+		return fmt.Errorf("invalid name: '%s'", m.From)
+	}
+	d := m.Data
+	switch {
+	case strings.TrimSpace(d) == "":
+		return errors.New("empty message")
+	case d[0] == '/':
+		return errors.New("bot commands are not bridged")
+	case d[0] == '@':
+		return errors.New("private messages need a recipient")
+	}
+
+	if m.To != "" {
+		if !p.allows(m.To) {
+			return fmt.Errorf("%s is not bridged", m.To)
+		}
+		d = fmt.Sprintf("@%s %s", m.To, d)
+	}
+
+	cl := &remote{channel.NewUser(fmt.Sprintf("%s@%s", m.From, p.name))}
+	return b.c.Chat.Handle(cl, chatdata.Message{Data: d})
+}
+
+// send sends m to peer p over the link we connected to it or to the client
+// it connected to us with.
+func (b *BridgeChannel) send(p *peer, m data.Message) {
+	p.out.Lock()
+	defer p.out.Unlock()
+
+	p.sem.Lock()
+	name := p.client
+	if p.link != nil || name != "" {
+		p.lastOut++
+		p.changed = true
+		m.ID = p.lastOut
+	}
+	p.sem.Unlock()
+
+	if p.link != nil {
+		p.link.enqueue(m)
+		return
+	}
+	if name == "" {
+		return
+	}
+
+	f := channel.ClientFilter{Channel: b.channel, To: []string{name}}
+	if err := b.sender.Broadcast(f, m); err != nil {
+		b.c.Log.Printf("bridge %s: %s", p.name, err)
+	}
+}
+
+// ChatMessage sends the messages of local users to the peers they are bridged
+// to, see chat.ChatChannel.OnMessage. Messages of bots, bot commands and
+// end-to-end encrypted messages stay local.
+func (b *BridgeChannel) ChatMessage(cl channel.Client, m chatdata.ServerMessage) {
+	if _, ok := cl.(*remote); ok || m.Bot || m.Sealed != nil {
+		return
+	}
+
+	d := m.Data
+	if strings.HasPrefix(d, "/") {
+		return
+	}
+	if m.Shout {
+		d = "!" + d
+	}
+
+	if m.PM != "" {
+		i := strings.LastIndexByte(m.PM, '@')
+		if i == -1 {
+			return
+		}
+		p, ok := b.byName[m.PM[i+1:]]
+		if !ok || !p.bridges(vars.ChatChannel) || !p.allows(m.From) {
+			return
+		}
+		b.send(p, data.Message{Channel: vars.ChatChannel, From: m.From, To: m.PM[:i], Data: d})
+		return
+	}
+
+	for _, p := range b.peers {
+		if p.bridges(vars.ChatChannel) && p.allows(m.From) {
+			b.send(p, data.Message{Channel: vars.ChatChannel, From: m.From, Data: d})
+		}
+	}
+}
+
+// presence sends the local users of the chat channel to each peer when they
+// changed, the peer (re)connected or presenceRefresh passed.
+func (b *BridgeChannel) presence() {
+	local := b.c.Users.GetUsers(vars.ChatChannel)
+	for _, p := range b.peers {
+		if !p.bridges(vars.UserChannel) {
+			continue
+		}
+
+		users := make([]string, 0, len(local))
+		for _, u := range local {
+			if p.allows(u.Name) {
+				users = append(users, u.Name)
+			}
+		}
+		sort.Strings(users)
+		key := strings.Join(users, " ")
+
+		p.sem.Lock()
+		changed := p.refresh || key != p.sent || time.Since(p.sentAt) > presenceRefresh
+		if changed {
+			p.refresh, p.sent, p.sentAt = false, key, time.Now()
+		}
+		p.sem.Unlock()
+		if changed {
+			b.send(p, data.Message{Channel: vars.UserChannel, Users: users})
+		}
+	}
+}
+
+// OnUsersChange registers cb to be called when the users of a peer change,
+// i.e.: the result of GetUsers, cb should not block.
+func (b *BridgeChannel) OnUsersChange(cb func()) {
+	b.onUsers = append(b.onUsers, cb)
+}
+
+func (b *BridgeChannel) setRemote(p *peer, users []string) {
+	if !p.setRemote(users) {
+		return
+	}
+	for _, cb := range b.onUsers {
+		cb()
+	}
+}
+
+// GetUsers returns the users of all peers as user@peer.
+func (b *BridgeChannel) GetUsers(ch string) []channel.User {
+	if ch != vars.ChatChannel {
+		return nil
+	}
+
+	var users []channel.User
+	for _, p := range b.peers {
+		p.sem.Lock()
+		for _, u := range p.remote {
+			users = append(users, channel.User{Name: fmt.Sprintf("%s@%s", u, p.name), Clients: 1})
+		}
+		p.sem.Unlock()
+	}
+	return users
+}
+
+// UserUpdate keeps track of the clients of peers that connect to us.
+func (b *BridgeChannel) UserUpdate(cl channel.Client, r channel.ConnectionReason) error {
+	p, ok := b.peerOf(cl)
+	if !ok {
+		return nil
+	}
+
+	switch r {
+	case channel.Connect:
+		p.sem.Lock()
+		p.client, p.refresh = cl.Name(), true
+		p.sem.Unlock()
+		b.c.Log.Printf("bridge %s: connected as %s", p.name, cl.Name())
+	case channel.Disconnect:
+		b.setRemote(p, nil)
+		b.c.Log.Printf("bridge %s: disconnected", p.name)
+	}
+	return nil
+}
+
+func (b *BridgeChannel) NeedsSave() bool {
+	for _, p := range b.peers {
+		p.sem.Lock()
+		changed := p.changed
+		p.sem.Unlock()
+		if changed {
+			return true
+		}
+	}
+	return false
+}
+
+// Save stores the last id sent to and received from each peer.
+func (b *BridgeChannel) Save(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := binary.NewWriter(f)
+	w.WriteString(saveVersion, 16)
+	w.WriteUint16(uint16(len(b.peers)))
+	for _, p := range b.peers {
+		p.sem.Lock()
+		w.WriteString(p.name, 8)
+		w.WriteUint64(p.lastIn)
+		w.WriteUint64(p.lastOut)
+		p.changed = false
+		p.sem.Unlock()
+	}
+	return w.Err()
+}
+
+func (b *BridgeChannel) Load(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := binary.NewReader(f)
+	if v := r.ReadString(16); v != saveVersion {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		return errors.New("unknown bridge file version")
+	}
+
+	n := int(r.ReadUint16())
+	for i := 0; i < n; i++ {
+		name, in, out := r.ReadString(8), r.ReadUint64(), r.ReadUint64()
+		if err := r.Err(); err != nil {
+			return err
+		}
+		p, ok := b.byName[name]
+		if !ok {
+			continue
+		}
+		p.sem.Lock()
+		p.lastIn, p.lastOut = in, out+idGap
+		p.sem.Unlock()
+	}
+	return r.Err()
+}
@@ -0,0 +1,262 @@
+package bridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/bridge/data"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+// chat records the messages it handles and, like chat.ChatChannel, passes
+// them on to the bridge.
+type chat struct {
+	sem  sync.Mutex
+	b    *BridgeChannel
+	msgs []string
+}
+
+func (c *chat) Handle(cl channel.Client, m chatdata.Message) error {
+	c.sem.Lock()
+	c.msgs = append(c.msgs, fmt.Sprintf("%s: %s", cl.Name(), m.Data))
+	c.sem.Unlock()
+
+	s := chatdata.ServerMessage{From: cl.Name(), Message: m}
+	if to, body := chatdata.Private(m.Data); to != "" {
+		s.PM, s.Data = to, body
+	}
+	c.b.ChatMessage(cl, s)
+	return nil
+}
+
+func (c *chat) list() []string {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return append([]string{}, c.msgs...)
+}
+
+type noUsers struct{}
+
+func (noUsers) GetUsers(string) []channel.User { return nil }
+
+// wire delivers the broadcasts of one bridge to the peer that connected to
+// it and remembers them so they can be replayed.
+type wire struct {
+	sem  sync.Mutex
+	to   *BridgeChannel
+	from string
+	sent []data.Message
+}
+
+func (w *wire) Broadcast(f channel.ClientFilter, m channel.Msg) error {
+	w.sem.Lock()
+	w.sent = append(w.sent, m.(data.Message))
+	w.sem.Unlock()
+	return w.to.receive(w.to.byName[w.from], m.(data.Message))
+}
+
+func (w *wire) BroadcastBatch(b []channel.Batch) error {
+	for _, bat := range b {
+		if err := w.Broadcast(bat.Filter, bat.Msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wire) replay() error {
+	w.sem.Lock()
+	l := append([]data.Message{}, w.sent...)
+	w.sem.Unlock()
+	for _, m := range l {
+		if err := w.to.receive(w.to.byName[w.from], m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type server struct {
+	b    *BridgeChannel
+	chat *chat
+	wire *wire
+}
+
+func newServer(t *testing.T, name, peer string) *server {
+	s := &server{chat: &chat{}, wire: &wire{from: name}}
+	b, err := New(Config{
+		Log:   log.New(ioutil.Discard, "", 0),
+		Name:  name,
+		Chat:  s.chat,
+		Users: noUsers{},
+		Peers: map[string]PeerConfig{peer: {Fingerprint: "fp-" + peer}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.b, s.chat.b = b, b
+	if err := b.Register("bridge", s.wire); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// pair returns two bridged servers that are connected to each other.
+func pair(t *testing.T) (a, b *server) {
+	a, b = newServer(t, "a", "b"), newServer(t, "b", "a")
+	a.wire.to, b.wire.to = b.b, a.b
+	a.b.byName["b"].client = "b"
+	b.b.byName["a"].client = "a"
+	return
+}
+
+func say(t *testing.T, s *server, user, d string) {
+	t.Helper()
+	if err := s.chat.Handle(channel.NewUser(user), chatdata.Message{Data: d}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectChat(t *testing.T, s *server, exp ...string) {
+	t.Helper()
+	if got := s.chat.list(); !reflect.DeepEqual(got, append([]string{}, exp...)) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestBridgeLoop(t *testing.T) {
+	a, b := pair(t)
+
+	say(t, a, "alice", "hi")
+	say(t, a, "alice", "/help")
+	say(t, b, "bob", "@alice@a psst")
+	say(t, b, "bob", "@carol@elsewhere hey")
+
+	// messages of remote users are never sent back.
+	expectChat(t, a, "alice: hi", "alice: /help", "bob@b: @alice psst")
+	expectChat(
+		t,
+		b,
+		"alice@a: hi",
+		"bob: @alice@a psst",
+		"bob: @carol@elsewhere hey",
+	)
+}
+
+func TestBridgeReplay(t *testing.T) {
+	a, b := pair(t)
+	for i := 0; i < 3; i++ {
+		say(t, a, "alice", fmt.Sprint(i))
+	}
+	if err := a.wire.replay(); err != nil {
+		t.Fatal(err)
+	}
+	expectChat(t, b, "alice@a: 0", "alice@a: 1", "alice@a: 2")
+
+	// ids are handed out in the order messages are sent.
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			say(t, a, fmt.Sprintf("user%d", i), "concurrent")
+		}(i)
+	}
+	wg.Wait()
+	if got := len(b.chat.list()); got != n+3 {
+		t.Fatalf("expected %d messages, got %d", n+3, got)
+	}
+}
+
+func TestBridgeSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	a, b := pair(t)
+	say(t, a, "alice", "one")
+	say(t, b, "bob", "two")
+
+	if !a.b.NeedsSave() || !b.b.NeedsSave() {
+		t.Fatal("counters changed but don't need saving")
+	}
+	for _, s := range []*server{a, b} {
+		if err := s.b.Save(filepath.Join(dir, s.wire.from)); err != nil {
+			t.Fatal(err)
+		}
+		if s.b.NeedsSave() {
+			t.Fatal("needs saving after save")
+		}
+	}
+	lastOut := a.b.byName["b"].lastOut
+
+	// both servers restart.
+	a2, b2 := pair(t)
+	for _, s := range []*server{a2, b2} {
+		if err := s.b.Load(filepath.Join(dir, s.wire.from)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := a2.b.byName["b"].lastOut; got != lastOut+idGap {
+		t.Fatalf("expected the counter to continue at %d, got %d", lastOut+idGap, got)
+	}
+
+	// what was handled before the restart is not handled again.
+	b2.wire.to, a.wire.to = a2.b, b2.b
+	if err := a.wire.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.wire.replay(); err != nil {
+		t.Fatal(err)
+	}
+	expectChat(t, a2)
+	expectChat(t, b2)
+
+	say(t, a2, "alice", "three")
+	say(t, b2, "bob", "four")
+	expectChat(t, a2, "alice: three", "bob@b: four")
+	expectChat(t, b2, "alice@a: three", "bob: four")
+
+	// peers that aren't in the file keep their fresh counter.
+	c := newServer(t, "c", "a")
+	fresh := c.b.byName["a"].lastOut
+	if err := c.b.Load(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.b.byName["a"].lastOut; got != fresh {
+		t.Fatalf("counter of an unsaved peer changed from %d to %d", fresh, got)
+	}
+}
+
+func TestBridgeSaveUnknown(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "bridge")
+	if err := ioutil.WriteFile(f, []byte("nope"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newServer(t, "a", "b").b.Load(f); err == nil {
+		t.Fatal("loaded an invalid file")
+	}
+	if err := newServer(t, "a", "b").b.Load(f + "-missing"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBridgeGetUsers(t *testing.T) {
+	a, b := pair(t)
+	b.b.send(b.b.byName["a"], data.Message{Channel: vars.UserChannel, Users: []string{"carol", "bob", "in valid"}})
+	users := a.b.GetUsers(vars.ChatChannel)
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
+	}
+	sort.Strings(names)
+	if exp := []string{"bob@b", "carol@b"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected %q, got %q", exp, names)
+	}
+}
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+// Maximum amount of users in a Message.
+const MaxUsers = 4096
+
+// Message travels both ways between two bridged servers. It holds either a
+// chat message of one of the users of the sending server or the list of its
+// users, depending on Channel.
+type Message struct {
+	// Increases with every message the sending server sends to this peer,
+	// replayed messages that were already handled are dropped.
+	ID uint64 `json:"id"`
+
+	// The bridged channel, i.e.: vars.ChatChannel or vars.UserChannel.
+	Channel string `json:"channel"`
+
+	From string `json:"from"`
+	// Recipient of a private message.
+	To   string `json:"to"`
+	Data string `json:"d"`
+
+	Users []string `json:"users"`
+
+	channel.NoClose
+	channel.NeverEqual
+}
+
+func (m Message) Binary(w channel.BinaryWriter) error {
+	w.WriteUint64(m.ID)
+	w.WriteString(m.Channel, 8)
+	w.WriteString(m.From, 8)
+	w.WriteString(m.To, 8)
+	w.WriteString(m.Data, 32)
+	w.WriteUint16(uint16(len(m.Users)))
+	for _, u := range m.Users {
+		w.WriteString(u, 8)
+	}
+	return w.Err()
+}
+
+func (m Message) JSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (m Message) FromBinary(r channel.BinaryReader) (channel.Msg, error) {
+	return BinaryMessage(r)
+}
+
+func (m Message) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
+	return JSONMessage(r)
+}
+
+func BinaryMessage(r channel.BinaryReader) (Message, error) {
+	var msg Message
+	r = channel.Bounded(r, chatdata.MaxDataSize)
+	msg.ID = r.ReadUint64()
+	msg.Channel = r.ReadString(8)
+	msg.From = r.ReadString(8)
+	msg.To = r.ReadString(8)
+	msg.Data = r.ReadString(32)
+	n, err := channel.ReadCount(r, 16, MaxUsers)
+	if err != nil {
+		return msg, err
+	}
+	msg.Users = make([]string, n)
+	for i := range msg.Users {
+		msg.Users[i] = r.ReadString(8)
+	}
+	return msg, r.Err()
+}
+
+func JSONMessage(r io.Reader) (Message, io.Reader, error) {
+	c := Message{}
+	nr, err := channel.JSON(r, &c)
+	return c, nr, err
+}
@@ -0,0 +1,137 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/frizinak/homechat/client"
+	"github.com/frizinak/homechat/client/backend/tcp"
+	"github.com/frizinak/homechat/client/handler"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/bridge/data"
+	"github.com/frizinak/homechat/vars"
+)
+
+const linkQueue = 1024
+
+// link connects to a peer with the key of this server and subscribes to its
+// bridge channel.
+type link struct {
+	handler.NoopHandler
+
+	b     *BridgeChannel
+	p     *peer
+	cl    *client.Client
+	queue chan data.Message
+}
+
+func newLink(b *BridgeChannel, p *peer) (*link, error) {
+	var tlsConf *tls.Config
+	if p.TLS {
+		tlsConf = &tls.Config{}
+		if p.CertFile != "" {
+			pem, err := ioutil.ReadFile(p.CertFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read certificate: %w", err)
+			}
+			tlsConf.RootCAs = x509.NewCertPool()
+			if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", p.CertFile)
+			}
+		}
+	}
+
+	l := &link{b: b, p: p, queue: make(chan data.Message, linkQueue)}
+	l.cl = client.New(
+		tcp.New(tcp.Config{TCPAddr: p.Address, TLS: tlsConf}),
+		l,
+		l,
+		client.Config{
+			Key:               b.c.Key,
+			ServerFingerprint: p.Fingerprint,
+			Name:              b.c.Name,
+			Channels:          []string{vars.BridgeChannel},
+			Proto:             channel.ProtoBinary,
+		},
+	)
+	return l, nil
+}
+
+func (l *link) Log(msg string)                    { l.b.c.Log.Printf("bridge %s: %s", l.p.name, msg) }
+func (l *link) Err(err error)                     { l.b.c.Log.Printf("bridge %s: %s", l.p.name, err) }
+func (l *link) Flash(msg string, _ time.Duration) { l.Log(msg) }
+
+func (l *link) HandleBridgeMessage(m data.Message) error {
+	if err := l.b.receive(l.p, m); err != nil {
+		l.Err(err)
+	}
+	return nil
+}
+
+func (l *link) HandleConnState(s client.ConnState) {
+	switch s.State {
+	case client.StateConnected:
+		l.p.sem.Lock()
+		l.p.refresh = true
+		l.p.sem.Unlock()
+		l.Log("connected")
+	case client.StateBackoff:
+		l.b.setRemote(l.p, nil)
+	}
+}
+
+func (l *link) HandleKeyRotation(from, to string) {
+	l.Log(fmt.Sprintf("server key rotated, update its fingerprint to %s", to))
+}
+
+func (l *link) enqueue(m data.Message) {
+	select {
+	case l.queue <- m:
+	default:
+		l.Err(errors.New("queue is full, dropping message"))
+	}
+}
+
+func (l *link) run(done <-chan struct{}) {
+	go func() {
+		if err := l.cl.Run(); err != nil {
+			l.Err(err)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			l.cl.Close()
+			return
+		case m := <-l.queue:
+			l.send(done, m)
+		}
+	}
+}
+
+// send retries m until the peer acknowledged or refused it, across
+// reconnects. The client backs off between failed connection attempts.
+func (l *link) send(done <-chan struct{}, m data.Message) {
+	for {
+		err := l.cl.Send(vars.BridgeChannel, m)
+		var rerr *client.RequestError
+		if errors.As(err, &rerr) {
+			l.Err(err)
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package channel
+
+import "sort"
+
+// Capabilities maps a feature or channel name to the highest version of it a
+// peer understands. A missing entry means the peer does not support it.
+type Capabilities map[string]uint8
+
+func (c Capabilities) Version(name string) uint8 { return c[name] }
+func (c Capabilities) Has(name string) bool      { return c[name] != 0 }
+
+// Negotiate returns the capabilities both sides support at the highest
+// version both understand.
+func (c Capabilities) Negotiate(o Capabilities) Capabilities {
+	n := make(Capabilities, len(c))
+	for name, v := range c {
+		ov := o[name]
+		if ov == 0 || v == 0 {
+			continue
+		}
+		if ov < v {
+			v = ov
+		}
+		n[name] = v
+	}
+	return n
+}
+
+// Initial returns c with every entry at version 1, the version peers that
+// don't exchange capabilities speak.
+func (c Capabilities) Initial() Capabilities {
+	n := make(Capabilities, len(c))
+	for name := range c {
+		n[name] = 1
+	}
+	return n
+}
+
+func (c Capabilities) names() []string {
+	l := make([]string, 0, len(c))
+	for name := range c {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (c Capabilities) Binary(w BinaryWriter) {
+	names := c.names()
+	w.WriteUint16(uint16(len(names)))
+	for _, name := range names {
+		w.WriteString(name, 8)
+		w.WriteUint8(c[name])
+	}
+}
+
+func BinaryCapabilities(r BinaryReader) (Capabilities, error) {
+	n, err := ReadCount(r, 16, MaxChannels)
+	if err != nil {
+		return nil, err
+	}
+	c := make(Capabilities, n)
+	for i := 0; i < n; i++ {
+		name := r.ReadString(8)
+		c[name] = r.ReadUint8()
+	}
+	return c, r.Err()
+}
+
+// Versioned is implemented by channels that can serve more than one version
+// of their messages. Channels that don't are assumed to be at version 1.
+type Versioned interface {
+	Versions() (min, max uint8)
+}
+
+// Versions returns the range of message versions ch can serve.
+func Versions(ch Channel) (min, max uint8) {
+	if v, ok := ch.(Versioned); ok {
+		return v.Versions()
+	}
+	return 1, 1
+}
+
+// VersionedMsg is implemented by messages whose shape depends on the version
+// of the channel negotiated with the receiving client.
+type VersionedMsg interface {
+	Msg
+	ForVersion(uint8) Msg
+}
+
+// ForVersion converts m to the given version if it is a VersionedMsg.
+func ForVersion(m Msg, version uint8) Msg {
+	if v, ok := m.(VersionedMsg); ok {
+		return v.ForVersion(version)
+	}
+	return m
+}
+
+// CapabilityClient is implemented by clients that negotiated capabilities.
+type CapabilityClient interface {
+	Client
+	Capabilities() Capabilities
+}
+
+// ClientVersion returns the version of channel name negotiated with c or def
+// if c did not negotiate any (e.g.: bots).
+func ClientVersion(c Client, name string, def uint8) uint8 {
+	if cc, ok := c.(CapabilityClient); ok {
+		if v := cc.Capabilities().Version(name); v != 0 {
+			return v
+		}
+	}
+	return def
+}
@@ -21,6 +21,18 @@ type Channel interface {
 	HandleJSON(Client, io.Reader) (io.Reader, error)
 }
 
+// Restricted is implemented by channels only clients that authenticated with
+// specific keys can subscribe to.
+type Restricted interface {
+	CanSubscribe(fingerprints []string) bool
+}
+
+// Stateful is implemented by channels that broadcast a single piece of state,
+// State returns its current value.
+type Stateful interface {
+	State() Msg
+}
+
 type Sender interface {
 	Broadcast(ClientFilter, Msg) error
 	// BroadcastError(ClientFilter, error) error
@@ -40,6 +52,23 @@ type UserCollection interface {
 	GetUsers(ch string) []User
 }
 
+type multiUserCollection struct {
+	collections []UserCollection
+}
+
+// MultiUserCollection returns the users of all given collections.
+func MultiUserCollection(collections ...UserCollection) UserCollection {
+	return &multiUserCollection{collections}
+}
+
+func (m *multiUserCollection) GetUsers(ch string) []User {
+	var users []User
+	for _, c := range m.collections {
+		users = append(users, c.GetUsers(ch)...)
+	}
+	return users
+}
+
 type ConnectionReason byte
 
 const (
@@ -134,6 +163,28 @@ type Client interface {
 	Bot() bool
 }
 
+// Identified is implemented by clients that authenticated with one or more
+// keys.
+type Identified interface {
+	Client
+	Fingerprints() []string
+}
+
+// Authenticated reports whether cl authenticated with the key of the given
+// fingerprint.
+func Authenticated(cl Client, fp string) bool {
+	id, ok := cl.(Identified)
+	if !ok {
+		return false
+	}
+	for _, f := range id.Fingerprints() {
+		if f == fp {
+			return true
+		}
+	}
+	return false
+}
+
 type NameOnlyClient struct {
 	name string
 	bot  bool
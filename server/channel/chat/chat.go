@@ -1,11 +1,13 @@
 package chat
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"regexp"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/frizinak/homechat/bot"
@@ -20,7 +22,12 @@ var (
 	multiSpaceRE      = regexp.MustCompile(`\s+`)
 )
 
-const serverBot = "server-bot"
+const (
+	serverBot = "server-bot"
+
+	// amount of message ids remembered per user.
+	recentIDs = 128
+)
 
 type ChatChannel struct {
 	log  *log.Logger
@@ -30,17 +37,27 @@ type ChatChannel struct {
 	channel string
 	bots    *bot.BotCollection
 
-	channel.NoSave
+	onMessage []func(channel.Client, data.ServerMessage)
+
+	recentSem sync.Mutex
+	recent    map[string][]string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	channel.Limit
-	channel.NoRunClose
 }
 
 func New(log *log.Logger, hist *history.HistoryChannel) *ChatChannel {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ChatChannel{
-		log:   log,
-		bots:  bot.NewBotCollection(serverBot),
-		hist:  hist,
-		Limit: channel.Limiter(1024 * 1024 * 5),
+		log:    log,
+		bots:   bot.NewBotCollection(serverBot),
+		hist:   hist,
+		recent: make(map[string][]string),
+		ctx:    ctx,
+		cancel: cancel,
+		Limit:  channel.Limiter(1024 * 1024 * 5),
 	}
 }
 
@@ -54,12 +71,45 @@ func (c *ChatChannel) AddBot(cmd string, bot bot.Bot) {
 	c.bots.AddBot(cmd, bot)
 }
 
+// AddPassiveBot registers bot to be called with every public message of a
+// user that matches re, or every such message if re is nil.
+func (c *ChatChannel) AddPassiveBot(re *regexp.Regexp, bot bot.Bot) {
+	c.bots.AddPassiveBot(re, bot)
+}
+
+// Run runs the bots that implement bot.Runner until Close is called.
+func (c *ChatChannel) Run() error {
+	if err := c.bots.Run(c.ctx, botSender{c: c}); err != nil {
+		c.log.Println("bot err", err)
+	}
+	return nil
+}
+
+func (c *ChatChannel) Close() error {
+	c.cancel()
+	return nil
+}
+
+// NeedsSave, Save and Load persist the bots that implement bot.Persister,
+// each in its own file: file-command.
+func (c *ChatChannel) NeedsSave() bool        { return c.bots.NeedsSave() }
+func (c *ChatChannel) Save(file string) error { return c.bots.Save(file) }
+func (c *ChatChannel) Load(file string) error { return c.bots.Load(file) }
+
+// OnMessage registers cb to be called with every message that is handled and
+// the client that sent it, cb should not block.
+func (c *ChatChannel) OnMessage(cb func(channel.Client, data.ServerMessage)) {
+	c.onMessage = append(c.onMessage, cb)
+}
+
+func (c *ChatChannel) Versions() (min, max uint8) { return 1, data.Version }
+
 func (c *ChatChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) error {
-	m, err := data.BinaryMessage(r)
+	m, err := data.BinaryMessageVersion(r, channel.ClientVersion(cl, c.channel, data.Version))
 	if err != nil {
 		return err
 	}
-	return c.Handle(cl, m)
+	return channel.RequestErr(c.Handle(cl, m))
 }
 
 func (c *ChatChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -67,7 +117,7 @@ func (c *ChatChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, err
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.Handle(cl, m)
+	return nr, channel.RequestErr(c.Handle(cl, m))
 }
 
 func (c *ChatChannel) UserUpdate(cl channel.Client, r channel.ConnectionReason) error {
@@ -77,6 +127,7 @@ func (c *ChatChannel) UserUpdate(cl channel.Client, r channel.ConnectionReason)
 
 func (c *ChatChannel) FromHistory(to channel.Client, l history.Log) ([]channel.Batch, error) {
 	msg := l.Msg.(data.Message)
+	msg.Sig = l.Sig
 	_b := c.batch(data.NotifyNever, l.From, msg)
 	b := make([]channel.Batch, 0, len(_b))
 	for _, bat := range _b {
@@ -93,8 +144,20 @@ func (c *ChatChannel) FromHistory(to channel.Client, l history.Log) ([]channel.B
 	return b, nil
 }
 
-func (c *ChatChannel) DecodeHistoryItem(r channel.BinaryReader) (channel.Msg, error) {
-	return data.BinaryMessage(r)
+func (c *ChatChannel) DecodeHistoryItem(r channel.BinaryReader, v channel.DecoderVersion) (channel.Msg, error) {
+	var dv uint8
+	switch v {
+	case "v1", "v2":
+		dv = 1
+	case "v3":
+		dv = 2
+	case "v4":
+		dv = 3
+	default:
+		return data.BinaryMessage(r)
+	}
+	m, err := data.BinaryMessageVersion(r, dv)
+	return m.ForVersion(data.Version), err
 }
 
 func (c *ChatChannel) isShout(str string) (int, bool) {
@@ -113,9 +176,60 @@ func (c *ChatChannel) isToBot(str string) (n int, bot, silent bool) {
 	return
 }
 
+// seen reports whether user already sent a message with the given id and
+// remembers it otherwise.
+func (c *ChatChannel) seen(user, id string) bool {
+	c.recentSem.Lock()
+	defer c.recentSem.Unlock()
+	l := c.recent[user]
+	for _, r := range l {
+		if r == id {
+			return true
+		}
+	}
+	if len(l) >= recentIDs {
+		copy(l, l[1:])
+		l = l[:len(l)-1]
+	}
+	c.recent[user] = append(l, id)
+	return false
+}
+
 func (c *ChatChannel) Handle(cl channel.Client, m data.Message) error {
-	c.hist.AddLog(cl, m)
+	if m.Sealed != nil {
+		if to, body := data.Private(m.Data); to == "" || body != "" {
+			return errors.New("sealed messages must be private and contain no plaintext")
+		}
+	}
+
+	var fp string
+	if m.Sig != nil {
+		pub, err := m.Verify(cl.Name(), time.Now())
+		if err != nil {
+			return err
+		}
+		fp = pub.FingerprintString()
+		if !channel.Authenticated(cl, fp) {
+			return errors.New("message is signed with a key the client did not authenticate with")
+		}
+	}
+
+	if m.ID != "" && c.seen(cl.Name(), m.ID) {
+		return nil
+	}
+
+	// History is always stored in the current encoding, the signature is
+	// stored alongside the message.
+	stored := m.ForVersion(data.Version).(data.Message)
+	stored.Sig = nil
+	stored.ID = ""
+	c.hist.AddSignedLog(cl, stored, m.Sig, fp)
 	b := c.batch(data.NotifyDefault, cl, m)
+	if len(b) != 0 {
+		for _, cb := range c.onMessage {
+			cb(cl, b[0].Msg.(data.ServerMessage))
+		}
+	}
 
 	var gerr error
 	for _, bat := range b {
@@ -124,45 +238,62 @@ func (c *ChatChannel) Handle(cl channel.Client, m data.Message) error {
 		}
 	}
 
+	if cl.Bot() || m.Sealed != nil {
+		return gerr
+	}
+
 	n, isToBot, silent := c.isToBot(m.Data)
 	if !isToBot {
+		if to, _ := data.Private(m.Data); to == "" {
+			c.bots.Passive(c.ctx, botSender{c: c}, bot.Message{From: cl.Name(), Data: m.Data}, c.botErr)
+		}
 		return gerr
 	}
 
 	m.Data = m.Data[n:]
-	go func() {
-		if err := c.botMessage(cl, m, silent); err != nil {
-			c.log.Println("bot err", err)
-		}
-	}()
+	go c.botMessage(cl, m, silent)
 
 	return gerr
 }
 
-func (c *ChatChannel) botMessage(cl channel.Client, m data.Message, silent bool) error {
-	cmd := multiSpaceRE.Split(m.Data, -1)
-	name, d, err := c.bots.Message(cl.Name(), cmd...)
-	if err == bot.ErrNotExists {
-		return nil
+func (c *ChatChannel) botErr(err error) { c.log.Println("bot err", err) }
+
+func (c *ChatChannel) botMessage(cl channel.Client, m data.Message, silent bool) {
+	s := botSender{c: c}
+	if silent {
+		s.to = cl.Name()
+	}
+	msg := bot.Message{From: cl.Name(), Data: m.Data, Args: multiSpaceRE.Split(m.Data, -1)}
+	if err := bot.Invoke(c.ctx, c.bots, s, msg); err != nil {
+		c.botErr(fmt.Errorf("/%s: %w", msg.Args[0], err))
 	}
+}
 
-	if err != nil {
-		return err
+// botSender posts messages of bots in chat, to a single user if to is set.
+type botSender struct {
+	c  *ChatChannel
+	to string
+}
+
+func (s botSender) Send(name, d string) error {
+	if s.to != "" {
+		return s.PM(name, s.to, d)
 	}
+	return s.send(name, d)
+}
 
+func (s botSender) PM(name, user, d string) error {
+	return s.send(name, fmt.Sprintf("@%s \n%s", user, d))
+}
+
+func (s botSender) send(name, d string) error {
 	if name == "" {
 		name = "unknown-bot"
 	}
-
 	if d == "" {
 		return nil
 	}
-
-	if silent {
-		d = fmt.Sprintf("@%s \n%s", cl.Name(), d)
-	}
-
-	return c.Handle(channel.NewBot(name), data.Message{Data: d})
+	return s.c.Handle(channel.NewBot(name), data.Message{Data: d})
 }
 
 func (c *ChatChannel) batch(notify data.Notify, cl channel.Client, m data.Message) []channel.Batch {
@@ -178,14 +309,14 @@ func (c *ChatChannel) batch(notify data.Notify, cl channel.Client, m data.Messag
 	s := data.ServerMessage{
 		From:    cl.Name(),
 		Stamp:   time.Now(),
-		Message: data.Message{Data: m.Data},
+		Message: data.Message{Data: m.Data, Sealed: m.Sealed, Sig: m.Sig},
 		Bot:     fromBot,
 		Notify:  notify,
 	}
 
 	if _, _, isToBotSilent := c.isToBot(s.Data); isToBotSilent {
 		f.To = []string{cl.Name()}
-		b = append(b, channel.Batch{f, s})
+		b = append(b, channel.Batch{Filter: f, Msg: s})
 		return b
 	}
 
@@ -195,51 +326,46 @@ func (c *ChatChannel) batch(notify data.Notify, cl channel.Client, m data.Messag
 		s.Notify = notify | data.NotifyPersonal
 	}
 
-	if len(s.Data) > 0 && s.Data[0] == '@' {
-		p := strings.SplitN(s.Data, " ", 2)
-		if len(p[0]) != 1 {
-			f.To = []string{p[0][1:]}
-			s.Data = ""
-			if len(p) == 2 {
-				s.Data = p[1]
-			}
-			s.PM = p[0][1:]
-			s.Notify = notify | data.NotifyPersonal
-			b = append(b, channel.Batch{f, s})
+	if to, body := data.Private(s.Data); to != "" {
+		f.To = []string{to}
+		s.Data = body
+		s.PM = to
+		s.Notify = notify | data.NotifyPersonal
+		b = append(b, channel.Batch{Filter: f, Msg: s})
 
-			f.To = []string{s.From}
-			s.Notify = notify | data.NotifyNever
-			b = append(b, channel.Batch{f, s})
+		f.To = []string{s.From}
+		s.Notify = notify | data.NotifyNever
+		b = append(b, channel.Batch{Filter: f, Msg: s})
 
-			return b
-		}
+		return b
 	}
 
-	mentions := reMention.FindAllStringSubmatch(s.Data, -1)
-	if len(mentions) > 0 {
-		mentionNames := make([]string, 0, len(mentions))
-		for i := range mentions {
-			mentionNames = append(mentionNames, mentions[i][1])
-			p := reMentionSuffixes.Split(mentions[i][1], 2)
-			if len(p) > 1 && len(p[0]) > 0 {
-				mentionNames = append(
-					mentionNames,
-					p[0],
-				)
-			}
-		}
-
+	if mentionNames := Mentions(s.Data); len(mentionNames) > 0 {
 		f.To = mentionNames
 		s.Notify = notify | data.NotifyPersonal
-		b = append(b, channel.Batch{f, s})
+		b = append(b, channel.Batch{Filter: f, Msg: s})
 
 		f.NotTo = mentionNames
 		f.To = nil
 		s.Notify = notify | data.NotifyNever
-		b = append(b, channel.Batch{f, s})
+		b = append(b, channel.Batch{Filter: f, Msg: s})
 		return b
 	}
 
-	b = append(b, channel.Batch{f, s})
+	b = append(b, channel.Batch{Filter: f, Msg: s})
 	return b
 }
+
+// Mentions returns the names of the users mentioned in d.
+func Mentions(d string) []string {
+	mentions := reMention.FindAllStringSubmatch(d, -1)
+	names := make([]string, 0, len(mentions))
+	for i := range mentions {
+		names = append(names, mentions[i][1])
+		p := reMentionSuffixes.Split(mentions[i][1], 2)
+		if len(p) > 1 && len(p[0]) > 0 {
+			names = append(names, p[0])
+		}
+	}
+	return names
+}
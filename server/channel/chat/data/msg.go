@@ -1,22 +1,159 @@
 package data
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"strings"
 	"time"
 
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/crypto"
 	"github.com/frizinak/homechat/server/channel"
 )
 
+// MaxDataSize is the maximum size of a single chat message.
+const MaxDataSize = 1024 * 1024 * 5
+
+// Version is the current version of the chat messages.
+// Version 2 added sealed private messages.
+// Version 3 added signatures.
+// Version 4 added client message ids.
+const Version = 4
+
+// Sealed is a private message only its sender and recipient can read.
+// From and To are the seal keys of both, Data holds the nonce and ciphertext.
+type Sealed struct {
+	From []byte `json:"from"`
+	To   []byte `json:"to"`
+	Data []byte `json:"data"`
+}
+
+func (s *Sealed) binary(w channel.BinaryWriter) {
+	if s == nil {
+		w.WriteUint8(0)
+		return
+	}
+	w.WriteUint8(1)
+	w.WriteBytes(s.From, 8)
+	w.WriteBytes(s.To, 8)
+	w.WriteBytes(s.Data, 32)
+}
+
+func binarySealed(r channel.BinaryReader) *Sealed {
+	if r.ReadUint8() == 0 {
+		return nil
+	}
+	return &Sealed{
+		From: r.ReadBytes(8),
+		To:   r.ReadBytes(8),
+		Data: r.ReadBytes(32),
+	}
+}
+
+// Private returns the recipient and body of a private message
+// (i.e.: '@user body').
+func Private(d string) (to, body string) {
+	if len(d) < 2 || d[0] != '@' {
+		return
+	}
+	p := strings.SplitN(d, " ", 2)
+	to = p[0][1:]
+	if len(p) == 2 {
+		body = p[1]
+	}
+	return
+}
+
+// canonical returns d in the form a ServerMessage can be reverted to.
+func canonical(d string) string {
+	var shout string
+	if len(d) != 0 && d[0] == '!' {
+		shout, d = "!", d[1:]
+	}
+	if to, body := Private(d); to != "" {
+		d = "@" + to
+		if body != "" {
+			d += " " + body
+		}
+	}
+	return shout + d
+}
+
+func signData(name, d string, s *Sealed) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := binary.NewWriter(buf)
+	w.WriteString(name, 8)
+	w.WriteString(d, 32)
+	s.binary(w)
+	return buf.Bytes()
+}
+
 type Message struct {
-	Data string `json:"d"`
+	Data   string             `json:"d"`
+	Sealed *Sealed            `json:"s,omitempty"`
+	Sig    *channel.Signature `json:"sig,omitempty"`
+
+	// ID is chosen by the client, a message that is resent with the same id
+	// is only posted once.
+	ID string `json:"id,omitempty"`
+
+	// version of the encoding, 0 means Version.
+	version uint8
 
 	channel.NeverEqual
 	channel.NoClose
 }
 
+func (m Message) v() uint8 {
+	if m.version == 0 {
+		return Version
+	}
+	return m.version
+}
+
+// ForVersion returns m in the encoding of the given version, a sealed
+// message can't be represented in version 1, signatures not before
+// version 3 and ids not before version 4.
+func (m Message) ForVersion(v uint8) channel.Msg {
+	m.version = v
+	if m.v() < 2 {
+		m.Sealed = nil
+	}
+	if m.v() < 3 {
+		m.Sig = nil
+	}
+	if m.v() < 4 {
+		m.ID = ""
+	}
+	return m
+}
+
+// Sign signs m as sent by user name.
+func (m Message) Sign(name string, key *crypto.Key) (Message, error) {
+	m.Data = canonical(m.Data)
+	sig, err := channel.NewSignature(key, time.Now(), signData(name, m.Data, m.Sealed))
+	m.Sig = sig
+	return m, err
+}
+
+// Verify checks whether m was signed by user name and returns the signing
+// key.
+func (m Message) Verify(name string, received time.Time) (*crypto.PubKey, error) {
+	return m.Sig.Verify(signData(name, m.Data, m.Sealed), received)
+}
+
 func (m Message) Binary(w channel.BinaryWriter) error {
 	w.WriteString(m.Data, 32)
+	if m.v() >= 2 {
+		m.Sealed.binary(w)
+	}
+	if m.v() >= 3 {
+		channel.WriteSignature(w, m.Sig)
+	}
+	if m.v() >= 4 {
+		w.WriteString(m.ID, 8)
+	}
 	return w.Err()
 }
 
@@ -24,16 +161,38 @@ func (m Message) JSON(w io.Writer) error {
 	return json.NewEncoder(w).Encode(m)
 }
 
-func (m Message) FromBinary(r channel.BinaryReader) (channel.Msg, error) { return BinaryMessage(r) }
-func (m Message) FromJSON(r io.Reader) (channel.Msg, io.Reader, error)   { return JSONMessage(r) }
+func (m Message) FromBinary(r channel.BinaryReader) (channel.Msg, error) {
+	return BinaryMessageVersion(r, m.version)
+}
+
+func (m Message) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
+	c, nr, err := JSONMessage(r)
+	c.version = m.version
+	return c, nr, err
+}
 
 func BinaryMessageFromReader(r io.Reader) Message {
 	return Message{}
 }
 
 func BinaryMessage(r channel.BinaryReader) (Message, error) {
-	c := Message{}
+	return BinaryMessageVersion(r, Version)
+}
+
+// BinaryMessageVersion decodes a message encoded in the given version.
+func BinaryMessageVersion(r channel.BinaryReader, v uint8) (Message, error) {
+	c := Message{version: v}
+	r = channel.Bounded(r, MaxDataSize)
 	c.Data = r.ReadString(32)
+	if c.v() >= 2 {
+		c.Sealed = binarySealed(r)
+	}
+	if c.v() >= 3 {
+		c.Sig = channel.ReadSignature(r)
+	}
+	if c.v() >= 4 {
+		c.ID = r.ReadString(8)
+	}
 	return c, r.Err()
 }
 
@@ -91,16 +250,48 @@ func (m ServerMessage) JSON(w io.Writer) error {
 	return json.NewEncoder(w).Encode(m)
 }
 
+// Verify checks whether m was signed by its sender and returns the signing
+// key.
+func (m ServerMessage) Verify() (*crypto.PubKey, error) {
+	d := m.Data
+	if m.PM != "" {
+		d = "@" + m.PM
+		if m.Data != "" {
+			d += " " + m.Data
+		}
+	}
+	if m.Shout {
+		d = "!" + d
+	}
+	return m.Sig.Verify(signData(m.From, d, m.Sealed), m.Stamp)
+}
+
+// ForVersion returns m in the encoding of the given version, clients that
+// don't understand sealed messages get a placeholder instead.
+func (m ServerMessage) ForVersion(v uint8) channel.Msg {
+	if v < 2 && m.Sealed != nil {
+		m.Data = "[end-to-end encrypted message]"
+	}
+	m.Message = m.Message.ForVersion(v).(Message)
+	return m
+}
+
 func (m ServerMessage) FromBinary(r channel.BinaryReader) (channel.Msg, error) {
-	return BinaryServerMessage(r)
+	return binaryServerMessage(r, m.version)
 }
 
 func (m ServerMessage) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
-	return JSONServerMessage(r)
+	c, nr, err := JSONServerMessage(r)
+	c.version = m.version
+	return c, nr, err
+}
+
+func BinaryServerMessage(r channel.BinaryReader) (ServerMessage, error) {
+	return binaryServerMessage(r, Version)
 }
 
-func BinaryServerMessage(r channel.BinaryReader) (msg ServerMessage, err error) {
-	msg.Message, err = BinaryMessage(r)
+func binaryServerMessage(r channel.BinaryReader, v uint8) (msg ServerMessage, err error) {
+	msg.Message, err = BinaryMessageVersion(r, v)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,210 @@
+package channel
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// Frames smaller than this are never compressed so small messages like
+	// pings and typing notifications don't pay for it.
+	CompressThreshold = 512
+
+	compressHeader = 4
+	compressedFlag = 1 << 31
+)
+
+var ErrCompressedFrame = errors.New("invalid compressed frame")
+
+// CompressWriter buffers writes and writes them as a single frame on Flush
+// or once the buffer is full. Frames of at least threshold bytes are
+// deflated if that makes them smaller.
+type CompressWriter struct {
+	w         io.Writer
+	buf       *bytes.Buffer
+	max       int
+	threshold int
+
+	flate    *flate.Writer
+	deflated *bytes.Buffer
+	header   []byte
+	err      error
+}
+
+func NewCompressWriter(w io.Writer, buffer uint16, threshold int) *CompressWriter {
+	deflated := bytes.NewBuffer(make([]byte, 0, buffer))
+	fw, _ := flate.NewWriter(deflated, flate.DefaultCompression)
+	return &CompressWriter{
+		w:         w,
+		buf:       bytes.NewBuffer(make([]byte, 0, buffer)),
+		max:       int(buffer),
+		threshold: threshold,
+		flate:     fw,
+		deflated:  deflated,
+		header:    make([]byte, compressHeader),
+	}
+}
+
+func (c *CompressWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) != 0 {
+		if c.err != nil {
+			return n, c.err
+		}
+
+		cut := c.max - c.buf.Len()
+		if cut > len(b) {
+			cut = len(b)
+		}
+		c.buf.Write(b[:cut])
+		n += cut
+		b = b[cut:]
+		if c.buf.Len() == c.max {
+			if err := c.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (c *CompressWriter) deflate(b []byte) []byte {
+	c.deflated.Reset()
+	c.flate.Reset(c.deflated)
+	if _, err := c.flate.Write(b); err != nil {
+		return nil
+	}
+	if err := c.flate.Close(); err != nil {
+		return nil
+	}
+	return c.deflated.Bytes()
+}
+
+func (c *CompressWriter) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.buf.Len() == 0 {
+		return nil
+	}
+
+	payload := c.buf.Bytes()
+	var flag uint32
+	if len(payload) >= c.threshold {
+		if d := c.deflate(payload); d != nil && len(d) < len(payload) {
+			payload, flag = d, compressedFlag
+		}
+	}
+
+	binary.LittleEndian.PutUint32(c.header, uint32(len(payload))|flag)
+	_, err := c.w.Write(c.header)
+	if err == nil {
+		_, err = c.w.Write(payload)
+	}
+	c.buf.Reset()
+	if err != nil {
+		c.err = err
+	}
+
+	return err
+}
+
+// CompressReader reads frames written by a CompressWriter with at most
+// buffer bytes per frame.
+type CompressReader struct {
+	r     io.Reader
+	max   int
+	flate io.ReadCloser
+
+	header   []byte
+	frame    []byte
+	inflated *bytes.Buffer
+	plain    []byte
+	err      error
+}
+
+func NewCompressReader(r io.Reader, buffer uint16) *CompressReader {
+	return &CompressReader{
+		r:        r,
+		max:      int(buffer),
+		flate:    flate.NewReader(bytes.NewReader(nil)),
+		header:   make([]byte, compressHeader),
+		inflated: bytes.NewBuffer(make([]byte, 0, buffer)),
+	}
+}
+
+func (c *CompressReader) next() error {
+	if _, err := io.ReadFull(c.r, c.header); err != nil {
+		return err
+	}
+
+	h := binary.LittleEndian.Uint32(c.header)
+	size := int(h &^ compressedFlag)
+	if size == 0 || size > c.max {
+		return ErrCompressedFrame
+	}
+
+	if cap(c.frame) < size {
+		c.frame = make([]byte, size)
+	}
+	c.frame = c.frame[:size]
+	if _, err := io.ReadFull(c.r, c.frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if h&compressedFlag == 0 {
+		c.plain = c.frame
+		return nil
+	}
+
+	if err := c.flate.(flate.Resetter).Reset(bytes.NewReader(c.frame), nil); err != nil {
+		return ErrCompressedFrame
+	}
+	c.inflated.Reset()
+	_, err := c.inflated.ReadFrom(io.LimitReader(c.flate, int64(c.max)+1))
+	if err != nil || c.inflated.Len() > c.max {
+		return ErrCompressedFrame
+	}
+	c.plain = c.inflated.Bytes()
+
+	return nil
+}
+
+func (c *CompressReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for len(c.plain) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.err = c.next()
+	}
+
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// NewCompressed wraps a connection in compression frames.
+//
+// Compression happens before encryption so the size of a frame tells how well
+// its plaintext compressed. Someone who controls part of a frame and sees its
+// size could learn the rest of it byte by byte (see CRIME). To rule that out:
+// every frame is deflated on its own without a dictionary shared with earlier
+// frames, the mux and clients flush each message into a frame of its own, and
+// the only secret on a connection, the session token in IdentifyMsg, is
+// flushed by itself. Messages that put a secret next to data from another
+// user must not be sent on a compressed connection.
+func NewCompressed(w WriteFlusher, r io.Reader) (WriteFlusher, io.Reader) {
+	cw := NewCompressWriter(w, FrameSize, CompressThreshold)
+	return &WriterFlusher{cw, NewFlushFlusher(cw, w)}, NewCompressReader(r, FrameSize)
+}
@@ -0,0 +1,123 @@
+package channel_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/frizinak/homechat/server/channel"
+)
+
+type frame struct {
+	size       int
+	compressed bool
+}
+
+// compressFrames writes each of writes as a frame of its own and returns the
+// stream and the header of every frame.
+func compressFrames(t *testing.T, writes ...[]byte) ([]byte, []frame) {
+	buf := bytes.NewBuffer(nil)
+	w := channel.NewCompressWriter(buf, channel.FrameSize, channel.CompressThreshold)
+	for _, d := range writes {
+		if _, err := w.Write(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var frames []frame
+	for d := buf.Bytes(); len(d) != 0; {
+		h := binary.LittleEndian.Uint32(d)
+		f := frame{int(h &^ (1 << 31)), h&(1<<31) != 0}
+		frames = append(frames, f)
+		d = d[4+f.size:]
+	}
+	return buf.Bytes(), frames
+}
+
+func random(t *testing.T, n int) []byte {
+	d := make([]byte, n)
+	if _, err := rand.Read(d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCompressThreshold(t *testing.T) {
+	const threshold = channel.CompressThreshold
+	tests := []struct {
+		data       []byte
+		compressed bool
+	}{
+		{bytes.Repeat([]byte("a"), 1), false},
+		{bytes.Repeat([]byte("a"), threshold-1), false},
+		{bytes.Repeat([]byte("a"), threshold), true},
+		{bytes.Repeat([]byte("a"), threshold+1), true},
+		{random(t, threshold), false},
+		{random(t, threshold*4), false},
+		{bytes.Repeat([]byte("abcd"), channel.FrameSize/4), true},
+	}
+
+	writes := make([][]byte, 0, len(tests))
+	var all []byte
+	for _, test := range tests {
+		writes = append(writes, test.data)
+		all = append(all, test.data...)
+	}
+	data, frames := compressFrames(t, writes...)
+	if len(frames) != len(tests) {
+		t.Fatalf("expected %d frames, got %d", len(tests), len(frames))
+	}
+	for i, test := range tests {
+		f := frames[i]
+		if f.compressed != test.compressed {
+			t.Errorf("%d bytes: expected compressed %t", len(test.data), test.compressed)
+		}
+		if !f.compressed && f.size != len(test.data) {
+			t.Errorf("%d bytes: stored in a frame of %d bytes", len(test.data), f.size)
+		}
+		if f.compressed && f.size >= len(test.data) {
+			t.Errorf("%d bytes: compressed to %d bytes", len(test.data), f.size)
+		}
+	}
+
+	r := channel.NewCompressReader(bytes.NewReader(data), channel.FrameSize)
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, all) {
+		t.Fatalf("data does not match (len: %d %d)", len(all), len(read))
+	}
+}
+
+// TestCompressIsolation checks that a frame that repeats an earlier secret
+// doesn't compress better than one that doesn't.
+func TestCompressIsolation(t *testing.T) {
+	secret := []byte("session=3q2+7w8ZgEuN1vS5")
+	pad := bytes.Repeat([]byte("."), channel.CompressThreshold)
+	guess := func(g string) int {
+		_, frames := compressFrames(
+			t,
+			append(append([]byte{}, pad...), secret...),
+			append(append([]byte{}, pad...), "session="+g...),
+		)
+		return frames[1].size
+	}
+
+	if right, wrong := guess("3q2+7w8ZgEuN1vS5"), guess("5Sv1NuEgZ8w7+2q3"); right != wrong {
+		t.Fatalf("frame size depends on an earlier frame: %d != %d", right, wrong)
+	}
+}
+
+func TestCompressOversized(t *testing.T) {
+	data, _ := compressFrames(t, bytes.Repeat([]byte("a"), channel.FrameSize))
+	r := channel.NewCompressReader(bytes.NewReader(data), channel.FrameSize/2)
+	if _, err := ioutil.ReadAll(r); err != channel.ErrCompressedFrame {
+		t.Fatalf("expected compressed frame error, got: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package channel
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -17,15 +18,28 @@ const (
 	saltSize      = 255
 	preMasterSize = 64
 	testSize      = 32
+	nonceSize     = 32
+
+	// Maximum size of encoded keys, signatures and encrypted secrets.
+	maxKeyData = 8192
 
 	ServerMinKeySize = 512
 	ServerKeySize    = 512
 
 	ClientMinKeySize = 128
 	ClientKeySize    = 256
+
+	// Maximum amount of plaintext per encrypted frame
+	FrameSize = 1<<16 - 1
 )
 
-var ErrKeyExchange = errors.New("invalid key exchange")
+var (
+	ErrKeyExchange = errors.New("invalid key exchange")
+
+	// Received handshake messages can't be encoded again as that requires
+	// the sender's private key.
+	errReceived = errors.New("can't encode a received handshake message")
+)
 
 type (
 	StringEncoder interface{ EncodeToString([]byte) string }
@@ -112,6 +126,9 @@ type PubKeyServerMessage struct {
 	pkey *crypto.PubKey
 	rnd  []byte
 
+	// Binds the signature to a TLS session, see Bind.
+	bind []byte
+
 	NeverEqual
 	NoClose
 }
@@ -138,12 +155,28 @@ func NewPubKeyServerMessage(key *crypto.Key) (PubKeyServerMessage, error) {
 func (m PubKeyServerMessage) PubKey() *crypto.PubKey { return m.pkey }
 func (m PubKeyServerMessage) Fingerprint() string    { return m.pkey.FingerprintString() }
 
+// Bind returns m with its signature covering b as well, see TLSBinding.
+// A received message has to be decoded from a bound instance
+// (e.g.: PubKeyServerMessage{}.Bind(b)) to be verified against b.
+func (m PubKeyServerMessage) Bind(b []byte) PubKeyServerMessage {
+	m.bind = b
+	return m
+}
+
+func serverData(der, rnd, bind []byte) []byte {
+	d := make([]byte, 0, len(der)+len(rnd)+len(bind))
+	d = append(d, der...)
+	d = append(d, rnd...)
+	return append(d, bind...)
+}
+
 func (m PubKeyServerMessage) do() (der, sig []byte, err error) {
+	if m.key == nil {
+		err = errReceived
+		return
+	}
 	der = m.pkey.MarshalDER()
-	d := make([]byte, 0, len(der)+len(m.rnd))
-	d = append(d, der...)
-	d = append(d, m.rnd...)
-	sig, err = m.key.Sign(d)
+	sig, err = m.key.Sign(serverData(der, m.rnd, m.bind))
 	return
 }
 
@@ -176,14 +209,14 @@ func (m PubKeyServerMessage) JSON(w io.Writer) error {
 }
 
 func (m PubKeyServerMessage) FromBinary(r BinaryReader) (Msg, error) {
-	return BinaryPubKeyServerMessage(r)
+	return binaryPubKeyServerMessage(r, m.bind)
 }
 
 func (m PubKeyServerMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
-	return JSONPubKeyServerMessage(r)
+	return jsonPubKeyServerMessage(r, m.bind)
 }
 
-func verifyServerMessage(der, rnd, sig []byte) (*crypto.PubKey, error) {
+func verifyServerMessage(der, rnd, sig, bind []byte) (*crypto.PubKey, error) {
 	if len(rnd) != saltSize {
 		return nil, errors.New("invalid salt size")
 	}
@@ -192,16 +225,18 @@ func verifyServerMessage(der, rnd, sig []byte) (*crypto.PubKey, error) {
 	if err := pk.UnmarshalDER(der); err != nil {
 		return nil, fmt.Errorf("invalid publickey: %w", err)
 	}
-	d := make([]byte, 0, len(der)+len(rnd))
-	d = append(d, der...)
-	d = append(d, rnd...)
-	if err := pk.Verify(d, sig); err != nil {
+	if err := pk.Verify(serverData(der, rnd, bind), sig); err != nil {
 		return nil, fmt.Errorf("invalid signature: %w", err)
 	}
 	return pk, nil
 }
 
-func BinaryPubKeyServerMessage(r BinaryReader) (p PubKeyServerMessage, err error) {
+func BinaryPubKeyServerMessage(r BinaryReader) (PubKeyServerMessage, error) {
+	return binaryPubKeyServerMessage(r, nil)
+}
+
+func binaryPubKeyServerMessage(r BinaryReader, bind []byte) (p PubKeyServerMessage, err error) {
+	r = Bounded(r, maxKeyData)
 	der := r.ReadBytes(16)
 	rnd := r.ReadBytes(8)
 	sig := r.ReadBytes(16)
@@ -209,13 +244,17 @@ func BinaryPubKeyServerMessage(r BinaryReader) (p PubKeyServerMessage, err error
 		return
 	}
 
-	p.pkey, err = verifyServerMessage(der, rnd, sig)
-	p.rnd = rnd
+	p.pkey, err = verifyServerMessage(der, rnd, sig, bind)
+	p.rnd, p.bind = rnd, bind
 
 	return
 }
 
 func JSONPubKeyServerMessage(r io.Reader) (PubKeyServerMessage, io.Reader, error) {
+	return jsonPubKeyServerMessage(r, nil)
+}
+
+func jsonPubKeyServerMessage(r io.Reader, bind []byte) (PubKeyServerMessage, io.Reader, error) {
 	var p PubKeyServerMessage
 	m := make(map[string]string, 3)
 	nr, err := JSON(r, &m)
@@ -235,8 +274,8 @@ func JSONPubKeyServerMessage(r io.Reader) (PubKeyServerMessage, io.Reader, error
 		return p, nr, fmt.Errorf("publickey not valid: %w", err)
 	}
 
-	p.pkey, err = verifyServerMessage(der, rnd, sig)
-	p.rnd = rnd
+	p.pkey, err = verifyServerMessage(der, rnd, sig, bind)
+	p.rnd, p.bind = rnd, bind
 
 	return p, nr, err
 }
@@ -282,6 +321,10 @@ func (m PubKeyMessage) Fingerprint() string {
 }
 
 func (m PubKeyMessage) do() (der, enc, sig []byte, err error) {
+	if m.key == nil {
+		err = errReceived
+		return
+	}
 	der = m.pkey.MarshalDER()
 	enc, err = m.serverPubKey.Encrypt(m.preMaster)
 	if err != nil {
@@ -347,6 +390,7 @@ func verifyMessage(der, rnd, enc, sig []byte) (*crypto.PubKey, error) {
 }
 
 func BinaryPubKeyMessage(r BinaryReader) (p PubKeyMessage, err error) {
+	r = Bounded(r, maxKeyData)
 	der := r.ReadBytes(16)
 	rnd := r.ReadBytes(8)
 	enc := r.ReadBytes(16)
@@ -392,6 +436,638 @@ func JSONPubKeyMessage(r io.Reader) (PubKeyMessage, io.Reader, error) {
 	return p, nr, err
 }
 
+const (
+	challengeLabel     = "homechat-tls-challenge"
+	challengeBindLabel = "homechat-tls-challenge-bound"
+	tlsExporterLabel   = "EXPORTER-homechat-challenge"
+)
+
+// clientKeys are the keys a client authenticates with. The legacy key is
+// optional and only presented while migrating to a new key type so existing
+// policy entries keep working.
+type clientKeys struct {
+	key, legacy   *crypto.Key
+	pkey, lpkey   *crypto.PubKey
+	der, lder     []byte
+	sig, lsig     []byte
+	signedPayload []byte
+}
+
+func newClientKeys(key, legacy *crypto.Key) (clientKeys, error) {
+	var c clientKeys
+	pkey, err := key.Public()
+	if err != nil {
+		return c, err
+	}
+	c.key, c.pkey, c.der = key, pkey, pkey.MarshalDER()
+
+	if legacy != nil {
+		lpkey, err := legacy.Public()
+		if err != nil {
+			return c, err
+		}
+		c.legacy, c.lpkey, c.lder = legacy, lpkey, lpkey.MarshalDER()
+	}
+
+	return c, nil
+}
+
+func parseClientKeys(der, sig, lder, lsig []byte) (clientKeys, error) {
+	c := clientKeys{der: der, sig: sig}
+	c.pkey = crypto.NewPubKey(ClientMinKeySize)
+	if err := c.pkey.UnmarshalDER(der); err != nil {
+		return c, fmt.Errorf("invalid publickey: %w", err)
+	}
+
+	if len(lder) == 0 {
+		return c, nil
+	}
+
+	c.lder, c.lsig = lder, lsig
+	c.lpkey = crypto.NewPubKey(ClientMinKeySize)
+	if err := c.lpkey.UnmarshalDER(lder); err != nil {
+		return c, fmt.Errorf("invalid legacy publickey: %w", err)
+	}
+
+	return c, nil
+}
+
+// data appends the public keys to d so both signatures cover both keys.
+func (c clientKeys) data(d []byte) []byte {
+	n := make([]byte, 0, len(d)+len(c.der)+len(c.lder))
+	n = append(n, d...)
+	n = append(n, c.der...)
+	return append(n, c.lder...)
+}
+
+func (c clientKeys) sign(d []byte) (sig, lsig []byte, err error) {
+	d = c.data(d)
+	if sig, err = c.key.Sign(d); err != nil || c.legacy == nil {
+		return
+	}
+	lsig, err = c.legacy.Sign(d)
+	return
+}
+
+func (c clientKeys) verify(d []byte) error {
+	d = c.data(d)
+	if err := c.pkey.Verify(d, c.sig); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if c.lpkey == nil {
+		return nil
+	}
+	if err := c.lpkey.Verify(d, c.lsig); err != nil {
+		return fmt.Errorf("invalid legacy signature: %w", err)
+	}
+	return nil
+}
+
+func (c clientKeys) Fingerprint() string { return c.pkey.FingerprintString() }
+
+// Fingerprints returns the fingerprint of the client key followed by that
+// of its legacy key if one was presented.
+func (c clientKeys) Fingerprints() []string {
+	if c.lpkey == nil {
+		return []string{c.pkey.FingerprintString()}
+	}
+	return []string{c.pkey.FingerprintString(), c.lpkey.FingerprintString()}
+}
+
+func (c clientKeys) jsonKeys(sig, lsig []byte, d map[string]string) {
+	d["k"] = stringEnc.EncodeToString(c.der)
+	d["s"] = stringEnc.EncodeToString(sig)
+	if c.lder != nil {
+		d["lk"] = stringEnc.EncodeToString(c.lder)
+		d["ls"] = stringEnc.EncodeToString(lsig)
+	}
+}
+
+func jsonClientKeys(m map[string]string) (der, sig, lder, lsig []byte, err error) {
+	if der, err = stringDec.DecodeString(m["k"]); err != nil {
+		err = fmt.Errorf("publickey not valid: %w", err)
+		return
+	}
+	if sig, err = stringDec.DecodeString(m["s"]); err != nil {
+		err = fmt.Errorf("sig not valid: %w", err)
+		return
+	}
+	if lder, err = stringDec.DecodeString(m["lk"]); err != nil {
+		err = fmt.Errorf("legacy publickey not valid: %w", err)
+		return
+	}
+	if lsig, err = stringDec.DecodeString(m["ls"]); err != nil {
+		err = fmt.Errorf("legacy sig not valid: %w", err)
+	}
+	return
+}
+
+// TLSBinding returns the data a challenge is bound to: the client's nonce
+// and keying material exported from the TLS session both sides see.
+// A challenge relayed by whoever terminated the client's TLS connection
+// won't verify on the server's session.
+func TLSBinding(state tls.ConnectionState, nonce []byte) ([]byte, error) {
+	if len(nonce) != nonceSize {
+		return nil, errors.New("invalid nonce size")
+	}
+	ekm, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, 0, len(nonce)+len(ekm))
+	d = append(d, nonce...)
+	return append(d, ekm...), nil
+}
+
+// ChallengeNonceMessage is sent by clients that set ProtoBind before the
+// server signs its PubKeyServerMessage, see TLSBinding.
+type ChallengeNonceMessage struct {
+	Nonce []byte
+
+	NeverEqual
+	NoClose
+}
+
+func NewChallengeNonceMessage() (ChallengeNonceMessage, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	return ChallengeNonceMessage{Nonce: nonce}, err
+}
+
+func (m ChallengeNonceMessage) Binary(w BinaryWriter) error {
+	w.WriteBytes(m.Nonce, 8)
+	return w.Err()
+}
+
+func (m ChallengeNonceMessage) JSON(w io.Writer) error {
+	d := map[string]string{"n": stringEnc.EncodeToString(m.Nonce)}
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (m ChallengeNonceMessage) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryChallengeNonceMessage(r)
+}
+
+func (m ChallengeNonceMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
+	return JSONChallengeNonceMessage(r)
+}
+
+func BinaryChallengeNonceMessage(r BinaryReader) (ChallengeNonceMessage, error) {
+	m := ChallengeNonceMessage{Nonce: r.ReadBytes(8)}
+	if err := r.Err(); err != nil {
+		return m, err
+	}
+	if len(m.Nonce) != nonceSize {
+		return m, errors.New("invalid nonce size")
+	}
+	return m, nil
+}
+
+func JSONChallengeNonceMessage(r io.Reader) (ChallengeNonceMessage, io.Reader, error) {
+	var m ChallengeNonceMessage
+	d := make(map[string]string, 1)
+	nr, err := JSON(r, &d)
+	if err != nil {
+		return m, nr, err
+	}
+	if m.Nonce, err = stringDec.DecodeString(d["n"]); err != nil {
+		return m, nr, fmt.Errorf("nonce not valid: %w", err)
+	}
+	if len(m.Nonce) != nonceSize {
+		return m, nr, errors.New("invalid nonce size")
+	}
+	return m, nr, nil
+}
+
+// PubKeyChallengeMessage authenticates a client on a TLS transport by signing
+// the server's random and public key and, if bound, the TLS session.
+type PubKeyChallengeMessage struct {
+	clientKeys
+
+	server PubKeyServerMessage
+
+	NeverEqual
+	NoClose
+}
+
+func NewPubKeyChallengeMessage(key, legacy *crypto.Key, m PubKeyServerMessage) (PubKeyChallengeMessage, error) {
+	var p PubKeyChallengeMessage
+	keys, err := newClientKeys(key, legacy)
+	if err != nil {
+		return p, err
+	}
+
+	p.clientKeys = keys
+	p.server = m
+
+	return p, nil
+}
+
+func challengeData(s PubKeyServerMessage) []byte {
+	label := challengeLabel
+	if s.bind != nil {
+		label = challengeBindLabel
+	}
+	der := s.pkey.MarshalDER()
+	d := make([]byte, 0, len(label)+len(der)+len(s.rnd)+len(s.bind))
+	d = append(d, label...)
+	d = append(d, der...)
+	d = append(d, s.rnd...)
+	return append(d, s.bind...)
+}
+
+// Verify checks whether the client signed the challenge of the given server
+// message.
+func (m PubKeyChallengeMessage) Verify(s PubKeyServerMessage) error {
+	return m.verify(challengeData(s))
+}
+
+func (m PubKeyChallengeMessage) Binary(w BinaryWriter) error {
+	if m.key == nil {
+		return errReceived
+	}
+	sig, lsig, err := m.sign(challengeData(m.server))
+	if err != nil {
+		return err
+	}
+
+	w.WriteBytes(m.der, 16)
+	w.WriteBytes(sig, 16)
+	w.WriteBytes(m.lder, 16)
+	w.WriteBytes(lsig, 16)
+	return w.Err()
+}
+
+func (m PubKeyChallengeMessage) JSON(w io.Writer) error {
+	if m.key == nil {
+		return errReceived
+	}
+	sig, lsig, err := m.sign(challengeData(m.server))
+	if err != nil {
+		return err
+	}
+
+	d := make(map[string]string, 4)
+	m.jsonKeys(sig, lsig, d)
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (m PubKeyChallengeMessage) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryPubKeyChallengeMessage(r)
+}
+
+func (m PubKeyChallengeMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
+	return JSONPubKeyChallengeMessage(r)
+}
+
+func BinaryPubKeyChallengeMessage(r BinaryReader) (p PubKeyChallengeMessage, err error) {
+	r = Bounded(r, maxKeyData)
+	der := r.ReadBytes(16)
+	sig := r.ReadBytes(16)
+	lder := r.ReadBytes(16)
+	lsig := r.ReadBytes(16)
+	if err = r.Err(); err != nil {
+		return
+	}
+
+	p.clientKeys, err = parseClientKeys(der, sig, lder, lsig)
+	return
+}
+
+func JSONPubKeyChallengeMessage(r io.Reader) (PubKeyChallengeMessage, io.Reader, error) {
+	var p PubKeyChallengeMessage
+	m := make(map[string]string, 4)
+	nr, err := JSON(r, &m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	der, sig, lder, lsig, err := jsonClientKeys(m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	p.clientKeys, err = parseClientKeys(der, sig, lder, lsig)
+	return p, nr, err
+}
+
+const (
+	kxServerLabel = "homechat-kx-server"
+	kxClientLabel = "homechat-kx-client"
+)
+
+// KeyExchangeServerMessage offers an ephemeral X25519 key signed by the
+// server's long-term key.
+type KeyExchangeServerMessage struct {
+	key  *crypto.Key
+	pkey *crypto.PubKey
+	rnd  []byte
+
+	eph  *crypto.EphemeralKey
+	epub []byte
+
+	NeverEqual
+	NoClose
+}
+
+func NewKeyExchangeServerMessage(key *crypto.Key) (KeyExchangeServerMessage, error) {
+	var p KeyExchangeServerMessage
+	pkey, err := key.Public()
+	if err != nil {
+		return p, err
+	}
+
+	rnd := make([]byte, saltSize)
+	if _, err = io.ReadFull(rand.Reader, rnd); err != nil {
+		return p, err
+	}
+
+	eph, err := crypto.NewEphemeralKey()
+	if err != nil {
+		return p, err
+	}
+
+	p.key = key
+	p.pkey = pkey
+	p.rnd = rnd
+	p.eph = eph
+	p.epub = eph.Public()
+
+	return p, nil
+}
+
+func (m KeyExchangeServerMessage) PubKey() *crypto.PubKey { return m.pkey }
+func (m KeyExchangeServerMessage) Fingerprint() string    { return m.pkey.FingerprintString() }
+
+func kxServerData(der, rnd, epub []byte) []byte {
+	d := make([]byte, 0, len(kxServerLabel)+len(der)+len(rnd)+len(epub))
+	d = append(d, kxServerLabel...)
+	d = append(d, der...)
+	d = append(d, rnd...)
+	d = append(d, epub...)
+	return d
+}
+
+func (m KeyExchangeServerMessage) do() (der, sig []byte, err error) {
+	if m.key == nil {
+		err = errReceived
+		return
+	}
+	der = m.pkey.MarshalDER()
+	sig, err = m.key.Sign(kxServerData(der, m.rnd, m.epub))
+	return
+}
+
+func (m KeyExchangeServerMessage) Binary(w BinaryWriter) error {
+	der, sig, err := m.do()
+	if err != nil {
+		return err
+	}
+
+	w.WriteBytes(der, 16)
+	w.WriteBytes(m.rnd, 8)
+	w.WriteBytes(m.epub, 8)
+	w.WriteBytes(sig, 16)
+	return w.Err()
+}
+
+func (m KeyExchangeServerMessage) JSON(w io.Writer) error {
+	der, sig, err := m.do()
+	if err != nil {
+		return err
+	}
+
+	d := map[string]string{
+		"k": stringEnc.EncodeToString(der),
+		"r": stringEnc.EncodeToString(m.rnd),
+		"e": stringEnc.EncodeToString(m.epub),
+		"s": stringEnc.EncodeToString(sig),
+	}
+
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (m KeyExchangeServerMessage) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryKeyExchangeServerMessage(r)
+}
+
+func (m KeyExchangeServerMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
+	return JSONKeyExchangeServerMessage(r)
+}
+
+func verifyKeyExchangeServer(der, rnd, epub, sig []byte) (*crypto.PubKey, error) {
+	if len(rnd) != saltSize {
+		return nil, errors.New("invalid salt size")
+	}
+
+	pk := crypto.NewPubKey(ServerMinKeySize)
+	if err := pk.UnmarshalDER(der); err != nil {
+		return nil, fmt.Errorf("invalid publickey: %w", err)
+	}
+	if err := pk.Verify(kxServerData(der, rnd, epub), sig); err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	return pk, nil
+}
+
+func BinaryKeyExchangeServerMessage(r BinaryReader) (p KeyExchangeServerMessage, err error) {
+	r = Bounded(r, maxKeyData)
+	der := r.ReadBytes(16)
+	rnd := r.ReadBytes(8)
+	epub := r.ReadBytes(8)
+	sig := r.ReadBytes(16)
+	if err = r.Err(); err != nil {
+		return
+	}
+
+	p.pkey, err = verifyKeyExchangeServer(der, rnd, epub, sig)
+	p.rnd = rnd
+	p.epub = epub
+
+	return
+}
+
+func JSONKeyExchangeServerMessage(r io.Reader) (KeyExchangeServerMessage, io.Reader, error) {
+	var p KeyExchangeServerMessage
+	m := make(map[string]string, 4)
+	nr, err := JSON(r, &m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	var der, rnd, epub, sig []byte
+	if der, err = stringDec.DecodeString(m["k"]); err != nil {
+		return p, nr, fmt.Errorf("publickey not valid: %w", err)
+	}
+	if rnd, err = stringDec.DecodeString(m["r"]); err != nil {
+		return p, nr, fmt.Errorf("rnd not valid: %w", err)
+	}
+	if epub, err = stringDec.DecodeString(m["e"]); err != nil {
+		return p, nr, fmt.Errorf("ephemeral key not valid: %w", err)
+	}
+	if sig, err = stringDec.DecodeString(m["s"]); err != nil {
+		return p, nr, fmt.Errorf("sig not valid: %w", err)
+	}
+
+	p.pkey, err = verifyKeyExchangeServer(der, rnd, epub, sig)
+	p.rnd = rnd
+	p.epub = epub
+
+	return p, nr, err
+}
+
+// KeyExchangeMessage answers a KeyExchangeServerMessage with the client's
+// ephemeral X25519 key, signed by the client's long-term key(s).
+type KeyExchangeMessage struct {
+	clientKeys
+	rnd []byte
+
+	eph  *crypto.EphemeralKey
+	epub []byte
+
+	server KeyExchangeServerMessage
+
+	NeverEqual
+	NoClose
+}
+
+func NewKeyExchangeMessage(key, legacy *crypto.Key, m KeyExchangeServerMessage) (KeyExchangeMessage, error) {
+	var p KeyExchangeMessage
+	keys, err := newClientKeys(key, legacy)
+	if err != nil {
+		return p, err
+	}
+
+	rnd := make([]byte, saltSize)
+	if _, err = io.ReadFull(rand.Reader, rnd); err != nil {
+		return p, err
+	}
+
+	eph, err := crypto.NewEphemeralKey()
+	if err != nil {
+		return p, err
+	}
+
+	p.clientKeys = keys
+	p.rnd = rnd
+	p.eph = eph
+	p.epub = eph.Public()
+	p.server = m
+
+	return p, nil
+}
+
+func kxClientData(rnd, epub []byte, s KeyExchangeServerMessage) []byte {
+	d := make([]byte, 0, len(kxClientLabel)+len(rnd)+len(epub)+len(s.rnd)+len(s.epub))
+	d = append(d, kxClientLabel...)
+	d = append(d, rnd...)
+	d = append(d, epub...)
+	d = append(d, s.rnd...)
+	d = append(d, s.epub...)
+	return d
+}
+
+// Verify checks whether the client signed its ephemeral key in response to
+// the given server message.
+func (m KeyExchangeMessage) Verify(s KeyExchangeServerMessage) error {
+	return m.verify(kxClientData(m.rnd, m.epub, s))
+}
+
+func (m KeyExchangeMessage) Binary(w BinaryWriter) error {
+	if m.key == nil {
+		return errReceived
+	}
+	sig, lsig, err := m.sign(kxClientData(m.rnd, m.epub, m.server))
+	if err != nil {
+		return err
+	}
+
+	w.WriteBytes(m.der, 16)
+	w.WriteBytes(m.rnd, 8)
+	w.WriteBytes(m.epub, 8)
+	w.WriteBytes(sig, 16)
+	w.WriteBytes(m.lder, 16)
+	w.WriteBytes(lsig, 16)
+	return w.Err()
+}
+
+func (m KeyExchangeMessage) JSON(w io.Writer) error {
+	if m.key == nil {
+		return errReceived
+	}
+	sig, lsig, err := m.sign(kxClientData(m.rnd, m.epub, m.server))
+	if err != nil {
+		return err
+	}
+
+	d := map[string]string{
+		"r": stringEnc.EncodeToString(m.rnd),
+		"e": stringEnc.EncodeToString(m.epub),
+	}
+	m.jsonKeys(sig, lsig, d)
+
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (m KeyExchangeMessage) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryKeyExchangeMessage(r)
+}
+
+func (m KeyExchangeMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
+	return JSONKeyExchangeMessage(r)
+}
+
+func keyExchangeMessage(rnd, epub, der, sig, lder, lsig []byte) (KeyExchangeMessage, error) {
+	p := KeyExchangeMessage{rnd: rnd, epub: epub}
+	if len(rnd) != saltSize {
+		return p, errors.New("invalid salt size")
+	}
+
+	var err error
+	p.clientKeys, err = parseClientKeys(der, sig, lder, lsig)
+	return p, err
+}
+
+func BinaryKeyExchangeMessage(r BinaryReader) (KeyExchangeMessage, error) {
+	r = Bounded(r, maxKeyData)
+	der := r.ReadBytes(16)
+	rnd := r.ReadBytes(8)
+	epub := r.ReadBytes(8)
+	sig := r.ReadBytes(16)
+	lder := r.ReadBytes(16)
+	lsig := r.ReadBytes(16)
+	if err := r.Err(); err != nil {
+		return KeyExchangeMessage{}, err
+	}
+
+	return keyExchangeMessage(rnd, epub, der, sig, lder, lsig)
+}
+
+func JSONKeyExchangeMessage(r io.Reader) (KeyExchangeMessage, io.Reader, error) {
+	var p KeyExchangeMessage
+	m := make(map[string]string, 6)
+	nr, err := JSON(r, &m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	var rnd, epub []byte
+	if rnd, err = stringDec.DecodeString(m["r"]); err != nil {
+		return p, nr, fmt.Errorf("rnd not valid: %w", err)
+	}
+	if epub, err = stringDec.DecodeString(m["e"]); err != nil {
+		return p, nr, fmt.Errorf("ephemeral key not valid: %w", err)
+	}
+
+	der, sig, lder, lsig, err := jsonClientKeys(m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	p, err = keyExchangeMessage(rnd, epub, der, sig, lder, lsig)
+	return p, nr, err
+}
+
 type (
 	DeriveSecret   func(label CryptoLabel) []byte
 	DeriveSecret32 func(label CryptoLabel) [32]byte
@@ -428,6 +1104,10 @@ func CommonSecret(c PubKeyMessage, s PubKeyServerMessage, serverPrivate *crypto.
 		return nil, errors.New("invalid data to generate common secret")
 	}
 
+	return deriveSecret(preMaster, clientRandom, serverRandom, size), nil
+}
+
+func deriveSecret(preMaster, clientRandom, serverRandom []byte, size int) DeriveSecret {
 	return func(label CryptoLabel) []byte {
 		seed := make([]byte, 0, len(label)+len(clientRandom)+len(serverRandom))
 		seed = append(seed, label...)
@@ -437,15 +1117,10 @@ func CommonSecret(c PubKeyMessage, s PubKeyServerMessage, serverPrivate *crypto.
 		crypto.HMAC(master, preMaster, seed)
 
 		return master
-	}, nil
-}
-
-func CommonSecret32(c PubKeyMessage, s PubKeyServerMessage, serverPrivate *crypto.Key) (DeriveSecret32, error) {
-	d, err := CommonSecret(c, s, serverPrivate, 32)
-	if err != nil {
-		return nil, err
 	}
+}
 
+func deriveSecret32(d DeriveSecret) DeriveSecret32 {
 	return func(label CryptoLabel) [32]byte {
 		n := d(label)
 		if len(n) != 32 {
@@ -457,5 +1132,34 @@ func CommonSecret32(c PubKeyMessage, s PubKeyServerMessage, serverPrivate *crypt
 		}
 
 		return b
-	}, nil
+	}
+}
+
+func CommonSecret32(c PubKeyMessage, s PubKeyServerMessage, serverPrivate *crypto.Key) (DeriveSecret32, error) {
+	d, err := CommonSecret(c, s, serverPrivate, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveSecret32(d), nil
+}
+
+// EphemeralSecret32 derives session secrets from the X25519 exchange,
+// the long-term keys are not involved.
+func EphemeralSecret32(c KeyExchangeMessage, s KeyExchangeServerMessage) (DeriveSecret32, error) {
+	var shared []byte
+	var err error
+	switch {
+	case c.eph != nil:
+		shared, err = c.eph.Shared(s.epub)
+	case s.eph != nil:
+		shared, err = s.eph.Shared(c.epub)
+	default:
+		err = errors.New("no ephemeral private key")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveSecret32(deriveSecret(shared, c.rnd, s.rnd, 32)), nil
 }
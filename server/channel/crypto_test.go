@@ -0,0 +1,173 @@
+package channel_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/internal/servertest"
+)
+
+// tlsSession returns the state of both ends of a fresh TLS session.
+func tlsSession(t *testing.T) (client, server tls.ConnectionState) {
+	cc, sc := servertest.TLSConfigs(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	errs := make(chan error, 1)
+	srv := tls.Server(b, sc)
+	go func() { errs <- srv.Handshake() }()
+
+	cl := tls.Client(a, cc)
+	if err := cl.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return cl.ConnectionState(), srv.ConnectionState()
+}
+
+func binding(t *testing.T, state tls.ConnectionState, nonce []byte) []byte {
+	b, err := channel.TLSBinding(state, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestChallengeBinding(t *testing.T) {
+	serverKey := crypto.NewEd25519Key()
+	clientKey := crypto.NewEd25519Key()
+	if err := serverKey.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientKey.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, err := channel.NewChallengeNonceMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := encBinary(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decBinary(channel.ChallengeNonceMessage{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.(channel.ChallengeNonceMessage).Nonce, nonce.Nonce) {
+		t.Fatal("nonce changed in transit")
+	}
+
+	clientState, serverState := tlsSession(t)
+	clientBind := binding(t, clientState, nonce.Nonce)
+	serverBind := binding(t, serverState, nonce.Nonce)
+	if !bytes.Equal(clientBind, serverBind) {
+		t.Fatal("both ends of a session should export the same binding")
+	}
+
+	_server, err := channel.NewPubKeyServerMessage(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := _server.Bind(serverBind)
+	d, err = encBinary(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decBinary(channel.PubKeyServerMessage{}, d); err == nil {
+		t.Fatal("bound server message verified without binding")
+	}
+	other, _ := tlsSession(t)
+	if _, err := decBinary(channel.PubKeyServerMessage{}.Bind(binding(t, other, nonce.Nonce)), d); err == nil {
+		t.Fatal("bound server message verified on another session")
+	}
+	received, err := decBinary(channel.PubKeyServerMessage{}.Bind(clientBind), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, err := channel.NewPubKeyChallengeMessage(clientKey, nil, received.(channel.PubKeyServerMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = encBinary(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = decBinary(channel.PubKeyChallengeMessage{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.(channel.PubKeyChallengeMessage).Verify(server); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.(channel.PubKeyChallengeMessage).Verify(_server); err == nil {
+		t.Fatal("bound challenge verified without binding")
+	}
+}
+
+// TestChallengeRelay relays a client's handshake through a party that
+// terminates its TLS session and opens another one to the server.
+func TestChallengeRelay(t *testing.T) {
+	serverKey := crypto.NewEd25519Key()
+	clientKey := crypto.NewEd25519Key()
+	if err := serverKey.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientKey.Generate(); err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, err := channel.NewChallengeNonceMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	victim, _ := tlsSession(t)
+	_, real := tlsSession(t)
+
+	// the server signs the relayed nonce bound to its own session.
+	_server, err := channel.NewPubKeyServerMessage(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := _server.Bind(binding(t, real, nonce.Nonce))
+	d, err := encBinary(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decBinary(channel.PubKeyServerMessage{}.Bind(binding(t, victim, nonce.Nonce)), d); err == nil {
+		t.Fatal("client accepted a server message relayed from another session")
+	}
+
+	// even if the client would sign, the server rejects the relayed
+	// challenge.
+	forged, err := channel.NewPubKeyServerMessage(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged = forged.Bind(binding(t, victim, nonce.Nonce))
+	challenge, err := channel.NewPubKeyChallengeMessage(clientKey, nil, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = encBinary(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := decBinary(channel.PubKeyChallengeMessage{}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.(channel.PubKeyChallengeMessage).Verify(server); err == nil {
+		t.Fatal("server accepted a challenge bound to another session")
+	}
+}
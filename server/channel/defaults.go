@@ -56,3 +56,48 @@ func (m NilMsg) FromBinary(r BinaryReader) (Msg, error)       { return BinaryNil
 func (m NilMsg) FromJSON(r io.Reader) (Msg, io.Reader, error) { return JSONNilMessage(r) }
 func BinaryNilMessage(r BinaryReader) (m NilMsg, err error)   { return }
 func JSONNilMessage(r io.Reader) (NilMsg, io.Reader, error)   { return NilMsg{}, r, nil }
+
+type Droppable interface {
+	Droppable() bool
+}
+
+func IsDroppable(m Msg) bool {
+	d, ok := m.(Droppable)
+	return ok && d.Droppable()
+}
+
+// StateMsg marks a message as droppable, i.e.: it only describes the current
+// state and is superseded by any newer message on the same channel.
+type StateMsg struct{}
+
+func (s StateMsg) Droppable() bool { return true }
+
+type Ephemeral interface {
+	Ephemeral() bool
+}
+
+func IsEphemeral(m Msg) bool {
+	e, ok := m.(Ephemeral)
+	return ok && e.Ephemeral()
+}
+
+// NoReplay marks a message as ephemeral, i.e.: it only makes sense on the
+// connection it was sent on and won't be replayed to resumed sessions.
+type NoReplay struct{}
+
+func (n NoReplay) Ephemeral() bool { return true }
+
+type Streamed interface {
+	Streamed() bool
+}
+
+func IsStreamed(m Msg) bool {
+	s, ok := m.(Streamed)
+	return ok && s.Streamed()
+}
+
+// StreamMsg marks a message as large, it is sent on a stream of its own so
+// it does not hold up other messages on the same connection.
+type StreamMsg struct{}
+
+func (s StreamMsg) Streamed() bool { return true }
@@ -0,0 +1,269 @@
+//go:build go1.18
+// +build go1.18
+
+package channel_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+	bridgedata "github.com/frizinak/homechat/server/channel/bridge/data"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	historydata "github.com/frizinak/homechat/server/channel/history/data"
+	keysdata "github.com/frizinak/homechat/server/channel/keys/data"
+	musicdata "github.com/frizinak/homechat/server/channel/music/data"
+	pingdata "github.com/frizinak/homechat/server/channel/ping/data"
+	typingdata "github.com/frizinak/homechat/server/channel/typing/data"
+	updatedata "github.com/frizinak/homechat/server/channel/update/data"
+	uploaddata "github.com/frizinak/homechat/server/channel/upload/data"
+	usersdata "github.com/frizinak/homechat/server/channel/users/data"
+)
+
+// msgs returns a populated instance of every decodable channel.Msg.
+// history.Log and client.MusicState are left out as they only combine the
+// messages below.
+func msgs(tb testing.TB) []channel.Msg {
+	must := func(err error) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	key := crypto.NewEd25519Key()
+	must(key.Generate())
+	next := crypto.NewEd25519Key()
+	must(next.Generate())
+	npub, err := next.Public()
+	must(err)
+
+	symmetric, err := channel.NewSymmetricTestMessage()
+	must(err)
+	pkServer, err := channel.NewPubKeyServerMessage(key)
+	must(err)
+	challenge, err := channel.NewPubKeyChallengeMessage(next, nil, pkServer)
+	must(err)
+	nonce, err := channel.NewChallengeNonceMessage()
+	must(err)
+	kxServer, err := channel.NewKeyExchangeServerMessage(key)
+	must(err)
+	kx, err := channel.NewKeyExchangeMessage(next, key, kxServer)
+	must(err)
+	rotation, err := channel.NewKeyRotationMessage(key, npub, time.Now().Add(time.Hour))
+	must(err)
+
+	song := musicdata.Song{P_NS: "yt", P_ID: "id", P_Title: "title", Active: true}
+	stamp := time.Unix(1600000000, 0)
+
+	seal, err := crypto.NewSealKey()
+	must(err)
+	sealKey, err := keysdata.NewKey("name", seal.Public(), key)
+	must(err)
+	sealed := chatdata.Message{
+		Data:   "@pm",
+		Sealed: &chatdata.Sealed{From: seal.Public(), To: seal.Public(), Data: []byte("data")},
+	}
+	sealedServer := chatdata.ServerMessage{Message: sealed, From: "from", Stamp: stamp, PM: "pm"}
+	signed, err := sealed.Sign("from", key)
+	must(err)
+	signedServer := chatdata.ServerMessage{Message: signed, From: "from", Stamp: stamp, PM: "pm"}
+
+	return []channel.Msg{
+		channel.StatusMsg{Code: channel.StatusNOK, Err: "err"},
+		channel.ReplyMsg{ID: 3, StatusMsg: channel.StatusMsg{Code: channel.StatusOK}},
+		channel.IdentifyMsg{
+			Data:     "name",
+			Channels: []string{"c", "p"},
+			Version:  "1",
+			Caps:     channel.Capabilities{"c": 1, "p": 2},
+			Session:  "token",
+			Seq:      9,
+		}.Extended(true),
+		channel.IdentifyMsg{Data: "name", Channels: []string{"c"}, Version: "1"},
+		channel.ChannelMsg{Data: "c", ID: 1, Seq: 2, Stream: 3}.Multiplexed(true),
+		channel.ChannelMsg{Data: "c", ID: 1, Seq: 2},
+		channel.EOF{},
+		channel.NilMsg{},
+		symmetric,
+		pkServer,
+		pkServer.Bind(nonce.Nonce),
+		nonce,
+		challenge,
+		kxServer,
+		kx,
+		rotation,
+		channel.KeyRotationMessage{},
+
+		chatdata.Message{Data: "hello", ID: "a1b2"},
+		chatdata.ServerMessage{
+			Message: chatdata.Message{Data: "hello"},
+			From:    "from",
+			Stamp:   stamp,
+			PM:      "pm",
+			Notify:  chatdata.NotifyPersonal,
+			Bot:     true,
+		},
+		sealed,
+		sealed.ForVersion(1),
+		sealedServer,
+		sealedServer.ForVersion(1),
+		signed,
+		signed.ForVersion(2),
+		signedServer,
+		signedServer.ForVersion(2),
+		historydata.New(10),
+		historydata.ServerMessage{},
+		keysdata.Message{Key: sealKey},
+		keysdata.Message{},
+		keysdata.ServerMessage{Keys: []keysdata.Key{sealKey}},
+		pingdata.Message{},
+		typingdata.Message{Channel: "c"},
+		typingdata.ServerMessage{Channel: "c", Who: "who"},
+		usersdata.Message{},
+		usersdata.ServerMessage{Channel: "c", Users: []usersdata.User{{Name: "a", Clients: 2}}},
+		updatedata.Message{GOOS: "linux", GOARCH: "amd64"},
+		updatedata.NewServerMessage(4, []byte("sig"), bytes.NewReader([]byte("data"))),
+		updatedata.NewNoServerMessage(),
+		uploaddata.NewMessage("file", "msg", 4, bytes.NewReader([]byte("data"))),
+
+		bridgedata.Message{ID: 7, Channel: "c", From: "from", To: "to", Data: "hello"},
+		bridgedata.Message{ID: 8, Channel: "u", Users: []string{"a", "b"}},
+
+		musicdata.Message{Command: "play"},
+		musicdata.ServerMessage{View: 1, Title: "title", Text: "text", Songs: []musicdata.Song{song}},
+		musicdata.ServerPlaylistMessage{List: []string{"a", "b"}},
+		musicdata.PlaylistSongsMessage{Playlist: "a"},
+		musicdata.ServerPlaylistSongsMessage{List: []musicdata.Song{song}},
+		musicdata.NodeMessage{NS: "yt", ID: "id"},
+		musicdata.NewNoSongDataMessage(),
+		musicdata.ServerStateMessage{Paused: true, Position: time.Second, Duration: time.Minute, Volume: 1},
+		musicdata.ServerSongMessage{Song: song},
+	}
+}
+
+func encBinary(m channel.Msg) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := m.Binary(binary.NewWriter(buf))
+	return buf.Bytes(), err
+}
+
+func encJSON(m channel.Msg) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	err := m.JSON(buf)
+	return buf.Bytes(), err
+}
+
+func decBinary(typ channel.Msg, d []byte) (channel.Msg, error) {
+	return typ.FromBinary(binary.NewReader(bytes.NewReader(d)))
+}
+
+func decJSON(typ channel.Msg, d []byte) (channel.Msg, error) {
+	m, _, err := typ.FromJSON(bytes.NewReader(d))
+	return m, err
+}
+
+// roundtrip decodes d, anything that decodes must encode to a stable form.
+func roundtrip(
+	t *testing.T,
+	typ channel.Msg,
+	d []byte,
+	enc func(channel.Msg) ([]byte, error),
+	dec func(channel.Msg, []byte) (channel.Msg, error),
+) {
+	m, err := dec(typ, d)
+	if err != nil {
+		return
+	}
+	first, err := enc(m)
+	if err != nil {
+		return
+	}
+
+	m, err = dec(typ, first)
+	if err != nil {
+		t.Fatalf("%T: re-decode failed: %s", typ, err)
+	}
+	second, err := enc(m)
+	if err != nil {
+		t.Fatalf("%T: re-encode failed: %s", typ, err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("%T: round trip mismatch:\n%q\n%q", typ, first, second)
+	}
+}
+
+// binaryOnly reports whether m has no JSON form, files are only transferred
+// by native clients.
+func binaryOnly(m channel.Msg) bool {
+	switch m.(type) {
+	case updatedata.ServerMessage, uploaddata.Message, *musicdata.SongDataMessage:
+		return true
+	}
+	return false
+}
+
+func fuzz(
+	f *testing.F,
+	enc func(channel.Msg) ([]byte, error),
+	dec func(channel.Msg, []byte) (channel.Msg, error),
+	skip func(channel.Msg) bool,
+) {
+	l := msgs(f)
+	for i, m := range l {
+		if skip != nil && skip(m) {
+			continue
+		}
+		d, err := enc(m)
+		if err != nil {
+			f.Fatalf("%T: seed does not encode: %s", m, err)
+		}
+		f.Add(uint8(i), d)
+	}
+
+	f.Fuzz(func(t *testing.T, i uint8, d []byte) {
+		roundtrip(t, l[int(i)%len(l)], d, enc, dec)
+	})
+}
+
+func FuzzBinary(f *testing.F) { fuzz(f, encBinary, decBinary, nil) }
+func FuzzJSON(f *testing.F)   { fuzz(f, encJSON, decJSON, binaryOnly) }
+
+func TestRoundtrip(t *testing.T) {
+	for _, m := range msgs(t) {
+		if d, err := encBinary(m); err != nil {
+			t.Errorf("%T: binary encode: %s", m, err)
+		} else if _, err := decBinary(m, d); err != nil {
+			t.Errorf("%T: binary: %s", m, err)
+		}
+		if binaryOnly(m) {
+			continue
+		}
+		if d, err := encJSON(m); err != nil {
+			t.Errorf("%T: json encode: %s", m, err)
+		} else if _, err := decJSON(m, d); err != nil {
+			t.Errorf("%T: json: %s", m, err)
+		}
+	}
+}
+
+func TestBounds(t *testing.T) {
+	huge := bytes.NewBuffer(nil)
+	w := binary.NewWriter(huge)
+	w.WriteUint8(0)
+	w.WriteString("", 16)
+	w.WriteString("", 32)
+	w.WriteUint32(1<<32 - 1)
+	if _, err := decBinary(musicdata.ServerMessage{}, huge.Bytes()); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	huge.Reset()
+	w.WriteUint32(1<<32 - 1)
+	huge.Write(make([]byte, 64))
+	if _, err := decBinary(chatdata.Message{}, huge.Bytes()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
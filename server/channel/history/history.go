@@ -14,6 +14,12 @@ type Log struct {
 	From  channel.Client
 	Stamp time.Time
 	Msg   channel.Msg
+
+	// Signature of the author over Msg and the fingerprint of its key,
+	// both empty for unsigned messages.
+	Sig         *channel.Signature
+	Fingerprint string
+
 	channel.NeverEqual
 	channel.NoClose
 }
@@ -26,6 +32,8 @@ func (l Log) Binary(w channel.BinaryWriter) error {
 	w.WriteString(l.From.Name(), 8)
 	w.WriteUint8(b)
 	w.WriteUint64(uint64(l.Stamp.Unix()))
+	w.WriteString(l.Fingerprint, 8)
+	channel.WriteSignature(w, l.Sig)
 	return l.Msg.Binary(w)
 }
 
@@ -40,7 +48,9 @@ func (l Log) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
 
 type Output interface {
 	FromHistory(to channel.Client, l Log) ([]channel.Batch, error)
-	DecodeHistoryItem(channel.BinaryReader) (channel.Msg, error)
+	// DecodeHistoryItem decodes a message stored in a history file of the
+	// given version.
+	DecodeHistoryItem(channel.BinaryReader, channel.DecoderVersion) (channel.Msg, error)
 }
 
 type HistoryChannel struct {
@@ -60,23 +70,19 @@ func New(log *log.Logger, amount int, appendOnlyFile string, o Output) (*History
 	bin, err := channel.NewBinaryHistory(
 		amount,
 		appendOnlyFile,
-		"v2",
+		"v5",
 		map[channel.DecoderVersion]channel.Decoder{
 			"v1": func(r channel.BinaryReader) (channel.Msg, error) {
 				var l Log
 				var err error
 				l.From = channel.NewClient(r.ReadString(8), r.ReadUint8() == 1)
-				l.Msg, err = o.DecodeHistoryItem(r)
-				return l, err
-			},
-			"v2": func(r channel.BinaryReader) (channel.Msg, error) {
-				var l Log
-				var err error
-				l.From = channel.NewClient(r.ReadString(8), r.ReadUint8() == 1)
-				l.Stamp = time.Unix(int64(r.ReadUint64()), 0)
-				l.Msg, err = o.DecodeHistoryItem(r)
+				l.Msg, err = o.DecodeHistoryItem(r, "v1")
 				return l, err
 			},
+			"v2": stamped(o, "v2"),
+			"v3": stamped(o, "v3"),
+			"v4": signed(o, "v4"),
+			"v5": signed(o, "v5"),
 		},
 	)
 	if err != nil {
@@ -93,10 +99,40 @@ func New(log *log.Logger, amount int, appendOnlyFile string, o Output) (*History
 	}, nil
 }
 
+func stamped(o Output, v channel.DecoderVersion) channel.Decoder {
+	return func(r channel.BinaryReader) (channel.Msg, error) {
+		var l Log
+		var err error
+		l.From = channel.NewClient(r.ReadString(8), r.ReadUint8() == 1)
+		l.Stamp = time.Unix(int64(r.ReadUint64()), 0)
+		l.Msg, err = o.DecodeHistoryItem(r, v)
+		return l, err
+	}
+}
+
+func signed(o Output, v channel.DecoderVersion) channel.Decoder {
+	return func(r channel.BinaryReader) (channel.Msg, error) {
+		var l Log
+		var err error
+		l.From = channel.NewClient(r.ReadString(8), r.ReadUint8() == 1)
+		l.Stamp = time.Unix(int64(r.ReadUint64()), 0)
+		l.Fingerprint = r.ReadString(8)
+		l.Sig = channel.ReadSignature(r)
+		l.Msg, err = o.DecodeHistoryItem(r, v)
+		return l, err
+	}
+}
+
 func (c *HistoryChannel) Add(m channel.Msg) { panic("do not use add directly") }
 
 func (c *HistoryChannel) AddLog(cl channel.Client, m channel.Msg) {
-	c.BinaryHistory.Add(Log{From: cl, Msg: m, Stamp: time.Now()})
+	c.AddSignedLog(cl, m, nil, "")
+}
+
+// AddSignedLog adds m along with the signature of its author and the
+// fingerprint of the key that made it.
+func (c *HistoryChannel) AddSignedLog(cl channel.Client, m channel.Msg, sig *channel.Signature, fp string) {
+	c.BinaryHistory.Add(Log{From: cl, Msg: m, Stamp: time.Now(), Sig: sig, Fingerprint: fp})
 }
 
 func (c *HistoryChannel) Close() error {
@@ -122,7 +158,7 @@ func (c *HistoryChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) er
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, msg)
+	return channel.RequestErr(c.handle(cl, msg))
 }
 
 func (c *HistoryChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -130,7 +166,7 @@ func (c *HistoryChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader,
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, msg)
+	return nr, channel.RequestErr(c.handle(cl, msg))
 }
 
 func (c *HistoryChannel) handle(cl channel.Client, msg data.Message) error {
@@ -167,3 +203,36 @@ func (c *HistoryChannel) handle(cl channel.Client, msg data.Message) error {
 
 	return c.sender.BroadcastBatch(b)
 }
+
+// Page returns at most n of the messages in history visible to cl after
+// skipping the skip most recent ones, oldest first.
+func (c *HistoryChannel) Page(cl channel.Client, skip, n int) ([]channel.Msg, error) {
+	if n > c.amount {
+		n = c.amount
+	}
+	var gerr error
+	l := make([]channel.Msg, 0, n)
+	if n == 0 {
+		return l, nil
+	}
+	c.BinaryHistory.Reverse(func(m channel.Msg) bool {
+		b, err := c.output.FromHistory(cl, m.(Log))
+		if err != nil {
+			gerr = err
+			return false
+		}
+		for i := len(b) - 1; i >= 0 && len(l) < n; i-- {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			l = append(l, b[i].Msg)
+		}
+		return len(l) < n
+	})
+
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+	return l, gerr
+}
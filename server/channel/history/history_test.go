@@ -0,0 +1,93 @@
+package history_test
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/chat"
+	"github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/server/channel/history"
+)
+
+func newHistory(t *testing.T, amount int) *history.HistoryChannel {
+	l := log.New(ioutil.Discard, "", 0)
+	c := &chat.ChatChannel{}
+	hist, err := history.New(l, amount, "", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*c = *chat.New(l, hist)
+	return hist
+}
+
+func page(t *testing.T, h *history.HistoryChannel, cl channel.Client, skip, n int) []string {
+	t.Helper()
+	msgs, err := h.Page(cl, skip, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := make([]string, len(msgs))
+	for i, m := range msgs {
+		l[i] = m.(data.ServerMessage).Data
+	}
+	return l
+}
+
+func TestPage(t *testing.T) {
+	h := newHistory(t, 10)
+	bob := channel.NewClient("bob", false)
+	alice := channel.NewClient("alice", false)
+	carol := channel.NewClient("carol", false)
+	for _, d := range []string{
+		"one",
+		"@carol to carol",
+		"two",
+		"@alice to alice",
+		"three",
+		"@carol again",
+	} {
+		h.AddLog(bob, data.Message{Data: d})
+	}
+
+	tests := []struct {
+		name    string
+		cl      channel.Client
+		skip, n int
+		exp     []string
+	}{
+		{"all", alice, 0, 10, []string{"one", "two", "to alice", "three"}},
+		{"recipient", carol, 0, 10, []string{"one", "to carol", "two", "three", "again"}},
+		{"sender", bob, 0, 10, []string{"one", "to carol", "two", "to alice", "three", "again"}},
+		{"last", alice, 0, 2, []string{"to alice", "three"}},
+		// hidden PMs don't count towards skip.
+		{"skip", alice, 1, 2, []string{"two", "to alice"}},
+		{"skip recipient", carol, 1, 2, []string{"two", "three"}},
+		{"skip to start", alice, 3, 10, []string{"one"}},
+		{"skip all", alice, 4, 10, []string{}},
+		{"none", alice, 0, 0, []string{}},
+		// n is capped at the amount of messages kept.
+		{"over", bob, 0, 100, []string{"one", "to carol", "two", "to alice", "three", "again"}},
+	}
+
+	for _, test := range tests {
+		if got := page(t, h, test.cl, test.skip, test.n); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.exp, got)
+		}
+	}
+}
+
+func TestPageAmount(t *testing.T) {
+	h := newHistory(t, 3)
+	bob := channel.NewClient("bob", false)
+	for _, d := range []string{"one", "two", "three", "four"} {
+		h.AddLog(bob, data.Message{Data: d})
+	}
+
+	exp := []string{"two", "three", "four"}
+	if got := page(t, h, bob, 0, 10); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+}
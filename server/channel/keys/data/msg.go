@@ -0,0 +1,185 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+)
+
+const (
+	// MaxKeySize is the maximum size of the keys and signature of a Key.
+	MaxKeySize = 8192
+
+	// Maximum amount of keys in a ServerMessage.
+	MaxKeys = 4096
+
+	signLabel = "homechat seal key"
+)
+
+var ErrSignature = errors.New("invalid seal key signature")
+
+// Key is the seal key a user published, signed by its identity key.
+// The identity key's fingerprint is what users verify out of band.
+type Key struct {
+	Name     string `json:"name"`
+	Key      []byte `json:"key"`
+	Identity []byte `json:"identity"`
+	Sig      []byte `json:"sig"`
+}
+
+func signData(name string, key []byte) []byte {
+	d := make([]byte, 0, len(signLabel)+len(name)+1+len(key))
+	d = append(d, signLabel...)
+	d = append(d, name...)
+	d = append(d, 0)
+	return append(d, key...)
+}
+
+// NewKey signs the public seal key of user name with its identity key.
+func NewKey(name string, key []byte, identity *crypto.Key) (Key, error) {
+	k := Key{Name: name, Key: key}
+	pub, err := identity.Public()
+	if err != nil {
+		return k, err
+	}
+	k.Identity = pub.MarshalDER()
+	k.Sig, err = identity.Sign(signData(name, key))
+	return k, err
+}
+
+// Verify checks the signature and returns the identity key.
+func (k Key) Verify() (*crypto.PubKey, error) {
+	pub := crypto.NewPubKey(channel.ClientMinKeySize)
+	if err := pub.UnmarshalDER(k.Identity); err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	if err := pub.Verify(signData(k.Name, k.Key), k.Sig); err != nil {
+		return nil, ErrSignature
+	}
+	return pub, nil
+}
+
+func (k Key) equal(o Key) bool {
+	return k.Name == o.Name &&
+		bytes.Equal(k.Key, o.Key) &&
+		bytes.Equal(k.Identity, o.Identity) &&
+		bytes.Equal(k.Sig, o.Sig)
+}
+
+func (k Key) binary(w channel.BinaryWriter) {
+	w.WriteString(k.Name, 8)
+	w.WriteBytes(k.Key, 16)
+	w.WriteBytes(k.Identity, 16)
+	w.WriteBytes(k.Sig, 16)
+}
+
+// BinaryKey decodes a single key as written by ServerMessage.
+func BinaryKey(r channel.BinaryReader) (Key, error) {
+	r = channel.Bounded(r, MaxKeySize)
+	k := Key{
+		Name:     r.ReadString(8),
+		Key:      r.ReadBytes(16),
+		Identity: r.ReadBytes(16),
+		Sig:      r.ReadBytes(16),
+	}
+	return k, r.Err()
+}
+
+// Message publishes the seal key of the sending user, the server fills in the
+// name. A message without a key only requests the published keys.
+type Message struct {
+	Key
+
+	channel.NeverEqual
+	channel.NoClose
+}
+
+func (m Message) Binary(w channel.BinaryWriter) error {
+	m.Key.binary(w)
+	return w.Err()
+}
+
+func (m Message) JSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (m Message) FromBinary(r channel.BinaryReader) (channel.Msg, error) { return BinaryMessage(r) }
+func (m Message) FromJSON(r io.Reader) (channel.Msg, io.Reader, error)   { return JSONMessage(r) }
+
+func BinaryMessage(r channel.BinaryReader) (Message, error) {
+	k, err := BinaryKey(r)
+	return Message{Key: k}, err
+}
+
+func JSONMessage(r io.Reader) (Message, io.Reader, error) {
+	c := Message{}
+	nr, err := channel.JSON(r, &c)
+	return c, nr, err
+}
+
+// ServerMessage lists all published keys.
+type ServerMessage struct {
+	Keys []Key `json:"keys"`
+
+	channel.NoClose
+}
+
+func (m ServerMessage) Binary(w channel.BinaryWriter) error {
+	w.WriteUint32(uint32(len(m.Keys)))
+	for _, k := range m.Keys {
+		k.binary(w)
+	}
+	return w.Err()
+}
+
+func (m ServerMessage) JSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (m ServerMessage) FromBinary(r channel.BinaryReader) (channel.Msg, error) {
+	return BinaryServerMessage(r)
+}
+
+func (m ServerMessage) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
+	return JSONServerMessage(r)
+}
+
+func (m ServerMessage) Equal(msg channel.Msg) bool {
+	rm, ok := msg.(ServerMessage)
+	if !ok || len(m.Keys) != len(rm.Keys) {
+		return false
+	}
+	for i := range m.Keys {
+		if !m.Keys[i].equal(rm.Keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func BinaryServerMessage(r channel.BinaryReader) (msg ServerMessage, err error) {
+	n, err := channel.ReadCount(r, 32, MaxKeys)
+	if err != nil {
+		return msg, err
+	}
+	msg.Keys = make([]Key, 0, channel.Capacity(n))
+	for i := 0; i < n; i++ {
+		k, err := BinaryKey(r)
+		if err != nil {
+			return msg, err
+		}
+		msg.Keys = append(msg.Keys, k)
+	}
+	return msg, r.Err()
+}
+
+func JSONServerMessage(r io.Reader) (ServerMessage, io.Reader, error) {
+	c := ServerMessage{}
+	nr, err := channel.JSON(r, &c)
+	return c, nr, err
+}
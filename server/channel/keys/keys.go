@@ -0,0 +1,168 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/keys/data"
+)
+
+const saveVersion = "v1"
+
+// KeysChannel relays the seal keys users publish so they can send each other
+// end-to-end encrypted private messages.
+type KeysChannel struct {
+	sem     sync.Mutex
+	keys    map[string]data.Key
+	changed bool
+
+	sender  channel.Sender
+	channel string
+
+	channel.Limit
+	channel.NoRunClose
+}
+
+func New() *KeysChannel {
+	return &KeysChannel{
+		keys:  make(map[string]data.Key),
+		Limit: channel.Limiter(data.MaxKeySize * 4),
+	}
+}
+
+func (c *KeysChannel) Register(chnl string, s channel.Sender) error {
+	c.channel = chnl
+	c.sender = s
+	return nil
+}
+
+func (c *KeysChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) error {
+	m, err := data.BinaryMessage(r)
+	if err != nil {
+		return err
+	}
+	return channel.RequestErr(c.handle(cl, m))
+}
+
+func (c *KeysChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
+	m, nr, err := data.JSONMessage(r)
+	if err != nil {
+		return nr, err
+	}
+	return nr, channel.RequestErr(c.handle(cl, m))
+}
+
+func (c *KeysChannel) handle(cl channel.Client, m data.Message) error {
+	f := channel.ClientFilter{Client: cl, Channel: c.channel}
+	if len(m.Key.Key) == 0 {
+		return c.sender.Broadcast(f, c.list())
+	}
+
+	changed, err := c.publish(cl, m.Key)
+	if changed {
+		f.Client = nil
+	}
+	// Always send the keys, the client waits for them.
+	if berr := c.sender.Broadcast(f, c.list()); err == nil {
+		err = berr
+	}
+	return err
+}
+
+func (c *KeysChannel) publish(cl channel.Client, k data.Key) (bool, error) {
+	k.Name = cl.Name()
+	if len(k.Key) != crypto.SealKeySize {
+		return false, errors.New("invalid seal key")
+	}
+	pub, err := k.Verify()
+	if err != nil {
+		return false, err
+	}
+	if !channel.Authenticated(cl, pub.FingerprintString()) {
+		return false, errors.New("seal key is not signed by the key the client authenticated with")
+	}
+
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	cur, ok := c.keys[k.Name]
+	if ok && bytes.Equal(cur.Key, k.Key) && bytes.Equal(cur.Identity, k.Identity) {
+		return false, nil
+	}
+	c.keys[k.Name] = k
+	c.changed = true
+	return true, nil
+}
+
+func (c *KeysChannel) list() data.ServerMessage {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	l := make([]data.Key, 0, len(c.keys))
+	for _, k := range c.keys {
+		l = append(l, k)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return data.ServerMessage{Keys: l}
+}
+
+func (c *KeysChannel) NeedsSave() bool {
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	return c.changed
+}
+
+func (c *KeysChannel) Save(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := binary.NewWriter(f)
+	w.WriteString(saveVersion, 16)
+	if err := c.list().Binary(w); err != nil {
+		return err
+	}
+
+	c.sem.Lock()
+	c.changed = false
+	c.sem.Unlock()
+	return nil
+}
+
+func (c *KeysChannel) Load(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := binary.NewReader(f)
+	if v := r.ReadString(16); v != saveVersion {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		return errors.New("unknown keys file version")
+	}
+
+	m, err := data.BinaryServerMessage(r)
+	if err != nil {
+		return err
+	}
+
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	for _, k := range m.Keys {
+		c.keys[k.Name] = k
+	}
+	return nil
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"strings"
+
+	"github.com/frizinak/binary"
 )
 
 type Proto byte
@@ -28,6 +31,55 @@ const (
 	ProtoBinary
 )
 
+const (
+	// ProtoTLS is set by clients on a TLS transport that want to skip
+	// the internal crypto layer.
+	ProtoTLS Proto = 1 << 7
+
+	// ProtoAEAD is set by clients that use an ephemeral key exchange and
+	// authenticated frames for the internal crypto layer.
+	// Clients without it are told to update.
+	ProtoAEAD Proto = 1 << 6
+
+	// ProtoDeflate is set by clients that want frames of at least
+	// CompressThreshold bytes to be compressed below the encryption layer.
+	ProtoDeflate Proto = 1 << 5
+
+	// ProtoMux is set by clients that can demultiplex streams, without it
+	// all messages are sent inline.
+	ProtoMux Proto = 1 << 4
+
+	// ProtoBind is set by clients on a TLS transport that send a
+	// ChallengeNonceMessage to bind the challenge to the TLS session.
+	// The server refuses ProtoTLS without it, except from browsers.
+	ProtoBind Proto = 1 << 3
+
+	// ProtoExt is set by clients whose IdentifyMsg ends with extensions,
+	// the server's reply does too. Without it no capabilities are exchanged
+	// and every channel is at version 1.
+	ProtoExt Proto = 1 << 2
+)
+
+func (p Proto) TLS() bool     { return p&ProtoTLS != 0 }
+func (p Proto) AEAD() bool    { return p&ProtoAEAD != 0 }
+func (p Proto) Deflate() bool { return p&ProtoDeflate != 0 }
+func (p Proto) Mux() bool     { return p&ProtoMux != 0 }
+func (p Proto) Bind() bool    { return p&ProtoBind != 0 }
+func (p Proto) Ext() bool     { return p&ProtoExt != 0 }
+func (p Proto) Base() Proto {
+	return p &^ (ProtoTLS | ProtoAEAD | ProtoDeflate | ProtoMux | ProtoBind | ProtoExt)
+}
+
+// ProtocolMajor returns the major part of a "major[.minor]" protocol
+// version. Peers only need the same major to talk to each other, features
+// are negotiated with Proto flags and Capabilities.
+func ProtocolMajor(v string) string {
+	if i := strings.IndexByte(v, '.'); i != -1 {
+		return v[:i]
+	}
+	return v
+}
+
 type Msg interface {
 	Binary(BinaryWriter) error
 	JSON(io.Writer) error
@@ -85,15 +137,94 @@ func JSONStatusMsg(r io.Reader) (StatusMsg, io.Reader, error) {
 	return msg, nr, err
 }
 
+// RequestError wraps errors that occurred after a client request was read
+// in its entirety, i.e.: the connection is still usable.
+type RequestError struct {
+	Err error
+}
+
+func (r RequestError) Error() string { return r.Err.Error() }
+func (r RequestError) Unwrap() error { return r.Err }
+
+func RequestErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return RequestError{err}
+}
+
+type ReplyMsg struct {
+	ID uint32 `json:"id"`
+	StatusMsg
+	NoReplay
+}
+
+func (m ReplyMsg) Binary(w BinaryWriter) error {
+	w.WriteUint32(m.ID)
+	return m.StatusMsg.Binary(w)
+}
+
+func (m ReplyMsg) JSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (m ReplyMsg) FromBinary(r BinaryReader) (Msg, error)       { return BinaryReplyMsg(r) }
+func (m ReplyMsg) FromJSON(r io.Reader) (Msg, io.Reader, error) { return JSONReplyMsg(r) }
+
+func BinaryReplyMsg(r BinaryReader) (ReplyMsg, error) {
+	var m ReplyMsg
+	m.ID = r.ReadUint32()
+	s, err := BinaryStatusMsg(r)
+	m.StatusMsg = s
+	if err != nil {
+		return m, err
+	}
+	return m, r.Err()
+}
+
+func JSONReplyMsg(r io.Reader) (ReplyMsg, io.Reader, error) {
+	msg := ReplyMsg{}
+	nr, err := JSON(r, &msg)
+	return msg, nr, err
+}
+
+// MaxChannels is the maximum amount of channels and capabilities a peer can
+// identify with.
+const MaxChannels = 64
+
+// IdentifyMsg extensions.
+const (
+	extCaps = "cp"
+
+	maxExtensions = 32
+)
+
 type IdentifyMsg struct {
 	Data     string   `json:"d"`
 	Channels []string `json:"c"`
 	Version  string   `json:"v"`
 
+	// Capabilities advertised by the client, the server replies with the
+	// negotiated set.
+	Caps Capabilities `json:"cp,omitempty"`
+
+	// Session token and sequence of the last received message.
+	Session string `json:"s,omitempty"`
+	Seq     uint32 `json:"q,omitempty"`
+
+	ext bool
+
 	NeverEqual
 	NoClose
 }
 
+// Extended returns a copy of h whose binary form ends with extensions, see
+// ProtoExt. Caps are only sent as an extension.
+func (h IdentifyMsg) Extended(ext bool) IdentifyMsg {
+	h.ext = ext
+	return h
+}
+
 func (h IdentifyMsg) Binary(w BinaryWriter) error {
 	w.WriteString(h.Version, 8)
 	w.WriteString(h.Data, 8)
@@ -101,6 +232,23 @@ func (h IdentifyMsg) Binary(w BinaryWriter) error {
 	for _, h := range h.Channels {
 		w.WriteString(h, 8)
 	}
+	w.WriteString(h.Session, 8)
+	w.WriteUint32(h.Seq)
+	if !h.ext {
+		return w.Err()
+	}
+
+	// Each extension is a name and a length prefixed payload, peers skip
+	// the ones they don't know.
+	caps := bytes.NewBuffer(nil)
+	cw := binary.NewWriter(caps)
+	h.Caps.Binary(cw)
+	if err := cw.Err(); err != nil {
+		return err
+	}
+	w.WriteUint8(1)
+	w.WriteString(extCaps, 8)
+	w.WriteBytes(caps.Bytes(), 16)
 	return w.Err()
 }
 
@@ -108,18 +256,47 @@ func (h IdentifyMsg) JSON(w io.Writer) error {
 	return json.NewEncoder(w).Encode(h)
 }
 
-func (m IdentifyMsg) FromBinary(r BinaryReader) (Msg, error)       { return BinaryIdentifyMsg(r) }
+func (m IdentifyMsg) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryIdentifyMsg(r, m.ext)
+}
 func (m IdentifyMsg) FromJSON(r io.Reader) (Msg, io.Reader, error) { return JSONIdentifyMsg(r) }
 
-func BinaryIdentifyMsg(r BinaryReader) (IdentifyMsg, error) {
+func BinaryIdentifyMsg(r BinaryReader, ext bool) (IdentifyMsg, error) {
 	v := r.ReadString(8)
 	n := r.ReadString(8)
-	nh := int(r.ReadUint8())
+	nh, err := ReadCount(r, 8, MaxChannels)
+	if err != nil {
+		return IdentifyMsg{}, err
+	}
 	l := make([]string, 0, nh)
 	for i := 0; i < nh; i++ {
 		l = append(l, r.ReadString(8))
 	}
-	return IdentifyMsg{Data: n, Channels: l, Version: v}, r.Err()
+	s := r.ReadString(8)
+	seq := r.ReadUint32()
+	m := IdentifyMsg{Data: n, Channels: l, Version: v, Session: s, Seq: seq, ext: ext}
+	if !ext {
+		return m, r.Err()
+	}
+
+	next, err := ReadCount(r, 8, maxExtensions)
+	if err != nil {
+		return m, err
+	}
+	for i := 0; i < next; i++ {
+		name := r.ReadString(8)
+		d := r.ReadBytes(16)
+		if err := r.Err(); err != nil {
+			return m, err
+		}
+		switch name {
+		case extCaps:
+			if m.Caps, err = BinaryCapabilities(binary.NewReader(bytes.NewReader(d))); err != nil {
+				return m, err
+			}
+		}
+	}
+	return m, r.Err()
 }
 
 func JSONIdentifyMsg(r io.Reader) (IdentifyMsg, io.Reader, error) {
@@ -130,11 +307,32 @@ func JSONIdentifyMsg(r io.Reader) (IdentifyMsg, io.Reader, error) {
 
 type ChannelMsg struct {
 	Data string `json:"d"`
+	ID   uint32 `json:"id,omitempty"`
+	Seq  uint32 `json:"q,omitempty"`
+
+	// Stream is set when the message that follows is sent on a stream of
+	// its own instead of inline.
+	Stream uint32 `json:"st,omitempty"`
+
+	mux bool
+
 	NoClose
 }
 
+// Multiplexed returns a copy of h whose binary form includes Stream, which
+// is only done on connections that negotiated ProtoMux.
+func (h ChannelMsg) Multiplexed(mux bool) ChannelMsg {
+	h.mux = mux
+	return h
+}
+
 func (h ChannelMsg) Binary(w BinaryWriter) error {
 	w.WriteString(h.Data, 8)
+	w.WriteUint32(h.ID)
+	w.WriteUint32(h.Seq)
+	if h.mux {
+		w.WriteUint32(h.Stream)
+	}
 	return w.Err()
 }
 
@@ -142,13 +340,19 @@ func (h ChannelMsg) JSON(w io.Writer) error {
 	return json.NewEncoder(w).Encode(h)
 }
 
-func (m ChannelMsg) FromBinary(r BinaryReader) (Msg, error)       { return BinaryChannelMsg(r) }
+func (m ChannelMsg) FromBinary(r BinaryReader) (Msg, error)       { return BinaryChannelMsg(r, m.mux) }
 func (m ChannelMsg) FromJSON(r io.Reader) (Msg, io.Reader, error) { return JSONChannelMsg(r) }
 func (m ChannelMsg) Equal(Msg) bool                               { return false }
 
-func BinaryChannelMsg(r BinaryReader) (ChannelMsg, error) {
-	n := r.ReadString(8)
-	return ChannelMsg{Data: n}, r.Err()
+func BinaryChannelMsg(r BinaryReader, mux bool) (ChannelMsg, error) {
+	m := ChannelMsg{mux: mux}
+	m.Data = r.ReadString(8)
+	m.ID = r.ReadUint32()
+	m.Seq = r.ReadUint32()
+	if mux {
+		m.Stream = r.ReadUint32()
+	}
+	return m, r.Err()
 }
 
 func JSONChannelMsg(r io.Reader) (ChannelMsg, io.Reader, error) {
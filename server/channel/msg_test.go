@@ -0,0 +1,77 @@
+package channel_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/server/channel"
+)
+
+func TestProtocolMajor(t *testing.T) {
+	for v, exp := range map[string]string{
+		"1029":     "1029",
+		"1029.1":   "1029",
+		"1029.1.2": "1029",
+		"":         "",
+	} {
+		if m := channel.ProtocolMajor(v); m != exp {
+			t.Errorf("%q: expected %q got %q", v, exp, m)
+		}
+	}
+}
+
+// TestIdentifyExtensions checks that extensions unknown to the reader are
+// skipped and that peers without ProtoExt never see them.
+func TestIdentifyExtensions(t *testing.T) {
+	caps := channel.Capabilities{"c": 4, "h": 1}
+	buf := bytes.NewBuffer(nil)
+	w := binary.NewWriter(buf)
+	w.WriteString("1029.7", 8)
+	w.WriteString("name", 8)
+	w.WriteUint8(1)
+	w.WriteString("c", 8)
+	w.WriteString("token", 8)
+	w.WriteUint32(3)
+	w.WriteUint8(3)
+	w.WriteString("future", 8)
+	w.WriteBytes([]byte("whatever this is"), 16)
+	w.WriteString("cp", 8)
+	capsBuf := bytes.NewBuffer(nil)
+	caps.Binary(binary.NewWriter(capsBuf))
+	w.WriteBytes(capsBuf.Bytes(), 16)
+	w.WriteString("", 8)
+	w.WriteBytes(nil, 16)
+	buf.WriteString("next")
+
+	r := bytes.NewReader(buf.Bytes())
+	m, err := channel.IdentifyMsg{}.Extended(true).FromBinary(binary.NewReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := m.(channel.IdentifyMsg)
+	if id.Data != "name" || id.Session != "token" || id.Seq != 3 {
+		t.Fatalf("unexpected identify: %+v", id)
+	}
+	if len(id.Caps) != len(caps) || id.Caps.Version("c") != 4 || id.Caps.Version("h") != 1 {
+		t.Fatalf("unexpected caps: %v", id.Caps)
+	}
+	if r.Len() != 4 {
+		t.Fatalf("expected the next message to be left unread, %d bytes left", r.Len())
+	}
+
+	legacy, err := encBinary(id.Extended(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = decBinary(channel.IdentifyMsg{}, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.(channel.IdentifyMsg).Caps != nil {
+		t.Fatal("caps sent without extensions")
+	}
+	if _, err := decBinary(channel.IdentifyMsg{}.Extended(true), legacy); err == nil {
+		t.Fatal("decoded extensions that were never sent")
+	}
+}
@@ -7,6 +7,14 @@ import (
 	"github.com/frizinak/homechat/server/channel"
 )
 
+const (
+	// Maximum amount of songs in a single list.
+	MaxSongs = 1024 * 1024
+
+	// Maximum size of the text of a ServerMessage.
+	MaxTextSize = 1024 * 1024
+)
+
 type Message struct {
 	Command string `json:"cmd"`
 
@@ -127,17 +135,24 @@ func (m ServerMessage) FromJSON(r io.Reader) (channel.Msg, io.Reader, error) {
 
 func BinaryServerMessage(r channel.BinaryReader) (ServerMessage, error) {
 	m := ServerMessage{}
+	r = channel.Bounded(r, MaxTextSize)
 	m.View = r.ReadUint8()
 	m.Title = r.ReadString(16)
 	m.Text = r.ReadString(32)
-	n := r.ReadUint32()
-	m.Songs = make([]Song, n)
-	for i := range m.Songs {
+	if err := r.Err(); err != nil {
+		return m, err
+	}
+	n, err := channel.ReadCount(r, 32, MaxSongs)
+	if err != nil {
+		return m, err
+	}
+	m.Songs = make([]Song, 0, channel.Capacity(n))
+	for i := 0; i < n; i++ {
 		s, err := BinarySong(r)
 		if err != nil {
 			return m, err
 		}
-		m.Songs[i] = s
+		m.Songs = append(m.Songs, s)
 	}
 	return m, r.Err()
 }
@@ -58,6 +58,7 @@ type SongDataMessage struct {
 	r  io.ReadCloser
 
 	channel.NeverEqual
+	channel.NoReplay
 }
 
 func NewSongDataMessage(song Song, size int64, filepath string) *SongDataMessage {
@@ -86,10 +87,11 @@ func (m *SongDataMessage) Binary(w channel.BinaryWriter) error {
 		return w.Err()
 	}
 
-	f, err := m.Upload()
+	f, err := os.Open(m.fp)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	w.WriteUint8(1)
 	if err := m.Song.Binary(w); err != nil {
@@ -106,6 +108,10 @@ func (m *SongDataMessage) Binary(w channel.BinaryWriter) error {
 	return err
 }
 
+// Streamed sends available songs on a stream of their own, the message is
+// shared between clients so Binary opens the file on each call.
+func (m *SongDataMessage) Streamed() bool { return m.Available }
+
 func (m *SongDataMessage) Close() error {
 	r := m.r
 	m.r = nil
@@ -74,16 +74,18 @@ func (m ServerPlaylistSongsMessage) FromJSON(r io.Reader) (channel.Msg, io.Reade
 
 func BinaryServerPlaylistSongsMessage(r channel.BinaryReader) (ServerPlaylistSongsMessage, error) {
 	c := ServerPlaylistSongsMessage{}
-	n := r.ReadUint32()
-	c.List = make([]Song, n)
-	var i uint32
-	for ; i < n; i++ {
+	n, err := channel.ReadCount(r, 32, MaxSongs)
+	if err != nil {
+		return c, err
+	}
+	c.List = make([]Song, 0, channel.Capacity(n))
+	for i := 0; i < n; i++ {
 		s, err := BinarySong(r)
 		if err != nil {
 			return c, err
 		}
 
-		c.List[i] = s
+		c.List = append(c.List, s)
 	}
 	return c, r.Err()
 }
@@ -7,10 +7,14 @@ import (
 	"github.com/frizinak/homechat/server/channel"
 )
 
+// Maximum amount of playlists in a ServerPlaylistMessage.
+const MaxPlaylists = 1024 * 64
+
 type ServerPlaylistMessage struct {
 	List []string `json:"list"`
 
 	channel.NoClose
+	channel.StateMsg
 }
 
 func (m ServerPlaylistMessage) Equal(msg channel.Msg) bool {
@@ -54,11 +58,13 @@ func (m ServerPlaylistMessage) FromJSON(r io.Reader) (channel.Msg, io.Reader, er
 
 func BinaryServerPlaylistMessage(r channel.BinaryReader) (ServerPlaylistMessage, error) {
 	c := ServerPlaylistMessage{}
-	n := r.ReadUint32()
-	c.List = make([]string, n)
-	var i uint32
-	for ; i < n; i++ {
-		c.List[i] = r.ReadString(16)
+	n, err := channel.ReadCount(r, 32, MaxPlaylists)
+	if err != nil {
+		return c, err
+	}
+	c.List = make([]string, 0, channel.Capacity(n))
+	for i := 0; i < n; i++ {
+		c.List = append(c.List, r.ReadString(16))
 	}
 	return c, r.Err()
 }
@@ -15,6 +15,7 @@ type ServerStateMessage struct {
 	Volume   float64       `json:"volume"`
 
 	channel.NoClose
+	channel.StateMsg
 }
 
 func (m ServerStateMessage) Equal(msg channel.Msg) bool {
@@ -72,6 +73,7 @@ func JSONServerStateMessage(r io.Reader) (ServerStateMessage, io.Reader, error)
 type ServerSongMessage struct {
 	Song
 	channel.NoClose
+	channel.StateMsg
 }
 
 func (m ServerSongMessage) Equal(msg channel.Msg) bool { return m == msg }
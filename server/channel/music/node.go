@@ -41,7 +41,7 @@ func (c *MusicNodeChannel) HandleBIN(cl channel.Client, r channel.BinaryReader)
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *MusicNodeChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -49,7 +49,7 @@ func (c *MusicNodeChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *MusicNodeChannel) sendSong(f channel.ClientFilter, s collection.Song) error {
@@ -36,7 +36,7 @@ func (c *PlaylistSongsChannel) HandleBIN(cl channel.Client, r channel.BinaryRead
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *PlaylistSongsChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -44,7 +44,7 @@ func (c *PlaylistSongsChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Re
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *PlaylistSongsChannel) handle(cl channel.Client, m data.PlaylistSongsMessage) error {
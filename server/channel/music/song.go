@@ -15,6 +15,9 @@ type SongChannel struct {
 	channel string
 	sender  channel.Sender
 
+	onChange func(data.Song)
+	last     data.Song
+
 	channel.NoSave
 	channel.SendOnly
 	channel.NoRunClose
@@ -30,14 +33,27 @@ func (c *SongChannel) Register(chnl string, s channel.Sender) error {
 	return nil
 }
 
-func (c *SongChannel) Send() {
-	f := channel.ClientFilter{Channel: c.channel}
+// OnChange registers cb to be called when a different song starts playing,
+// cb should not block.
+func (c *SongChannel) OnChange(cb func(data.Song)) { c.onChange = cb }
+
+func (c *SongChannel) State() channel.Msg {
 	song := data.ServerSongMessage{}
 	cur := c.q.Current()
 	s := cur.Song
 	if s != nil {
 		song.Song = data.Song{P_NS: s.NS(), P_ID: s.ID(), P_Title: s.Title()}
 	}
+	return song
+}
+
+func (c *SongChannel) Send() {
+	f := channel.ClientFilter{Channel: c.channel}
+	song := c.State().(data.ServerSongMessage)
+	if c.onChange != nil && song.Song != c.last && song.ID() != "" {
+		c.onChange(song.Song)
+	}
+	c.last = song.Song
 	if err := c.sender.Broadcast(f, song); err != nil {
 		c.log.Println(err)
 	}
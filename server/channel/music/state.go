@@ -30,14 +30,18 @@ func (c *StateChannel) Register(chnl string, s channel.Sender) error {
 	return nil
 }
 
-func (c *StateChannel) Send() {
-	f := channel.ClientFilter{Channel: c.channel}
+func (c *StateChannel) State() channel.Msg {
 	state := data.ServerStateMessage{}
 	state.Paused = c.p.Paused()
 	state.Duration = c.p.Duration()
 	state.Position = c.p.Position()
 	state.Volume = c.p.Volume()
-	if err := c.sender.Broadcast(f, state); err != nil {
+	return state
+}
+
+func (c *StateChannel) Send() {
+	f := channel.ClientFilter{Channel: c.channel}
+	if err := c.sender.Broadcast(f, c.State()); err != nil {
 		c.log.Println(err)
 	}
 }
@@ -140,7 +140,7 @@ func (c *YMChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) error {
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *YMChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -148,7 +148,7 @@ func (c *YMChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *YMChannel) handle(cl channel.Client, m data.Message) error {
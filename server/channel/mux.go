@@ -0,0 +1,430 @@
+package channel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// StreamChunk is the maximum payload of a single frame, large messages are
+	// cut in chunks of this size so they interleave with other messages.
+	StreamChunk = 16 * 1024
+
+	// StreamWindow is the amount of bytes a peer may send on a stream before
+	// the receiver acknowledges it consumed them.
+	StreamWindow = 256 * 1024
+
+	// Maximum amount of concurrent incoming streams, excluding stream 0.
+	MaxStreams = 16
+
+	muxHeader = 1 + 4 + 2
+)
+
+const (
+	muxData byte = iota
+	muxClose
+	muxWindow
+	muxReset
+)
+
+var (
+	ErrMuxFrame     = errors.New("invalid stream frame")
+	ErrStreamReset  = errors.New("stream reset by peer")
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+// Mux multiplexes streams over a single connection. Stream 0 carries regular
+// messages and is exposed by Mux itself, large messages are sent on streams
+// of their own (see Open and Accept).
+//
+// Every stream is flow-controlled so a slow consumer of one stream never
+// blocks the others.
+type Mux struct {
+	w WriteFlusher
+	r io.Reader
+
+	wsem   sync.Mutex
+	header []byte
+	werr   error
+
+	sem  sync.Mutex
+	cond *sync.Cond
+	err  error
+	in   map[uint32]*inStream
+	out  map[uint32]*outStream
+	last uint32
+	next uint32
+
+	msgsIn  *inStream
+	msgsOut *outStream
+}
+
+// NewMux starts demultiplexing r, frames are written to w.
+func NewMux(w WriteFlusher, r io.Reader) *Mux {
+	m := &Mux{
+		w:      w,
+		r:      r,
+		header: make([]byte, muxHeader),
+		in:     make(map[uint32]*inStream),
+		out:    make(map[uint32]*outStream),
+	}
+	m.cond = sync.NewCond(&m.sem)
+	m.msgsIn = m.newIn(0)
+	m.msgsOut = m.newOut(0)
+	m.in[0], m.out[0] = m.msgsIn, m.msgsOut
+
+	go m.demux()
+	return m
+}
+
+func (m *Mux) newIn(id uint32) *inStream {
+	return &inStream{m: m, id: id, window: StreamWindow}
+}
+
+func (m *Mux) newOut(id uint32) *outStream {
+	return &outStream{m: m, id: id, window: StreamWindow, buf: make([]byte, 0, StreamChunk)}
+}
+
+func (m *Mux) Read(b []byte) (int, error)  { return m.msgsIn.Read(b) }
+func (m *Mux) Write(b []byte) (int, error) { return m.msgsOut.Write(b) }
+func (m *Mux) Flush() error                { return m.msgsOut.Flush() }
+
+// Open creates a new outgoing stream, the peer is expected to Accept it
+// once it learns the returned id.
+func (m *Mux) Open() (uint32, io.WriteCloser) {
+	// Streams are announced with an empty frame in the order they are
+	// opened, the peer takes unknown ids below the last one it saw for
+	// streams that were closed.
+	m.wsem.Lock()
+	m.sem.Lock()
+	m.next++
+	s := m.newOut(m.next)
+	m.out[s.id] = s
+	m.sem.Unlock()
+	err := m.writeFrame(muxData, s.id, nil)
+	m.wsem.Unlock()
+
+	if err != nil {
+		m.sem.Lock()
+		s.err = err
+		m.sem.Unlock()
+	}
+	return s.id, s
+}
+
+// Accept returns the incoming stream with the given id. The stream must be
+// closed once no longer needed, closing it before reading it in its
+// entirety resets it.
+func (m *Mux) Accept(id uint32) (io.ReadCloser, error) {
+	if id == 0 {
+		return nil, ErrMuxFrame
+	}
+
+	m.sem.Lock()
+	defer m.sem.Unlock()
+	s, err := m.incoming(id)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrStreamClosed
+	}
+	return s, nil
+}
+
+// incoming returns the stream for id, creating it if the peer didn't use it
+// before. A nil stream means it was already closed.
+func (m *Mux) incoming(id uint32) (*inStream, error) {
+	if s, ok := m.in[id]; ok {
+		return s, nil
+	}
+	if id <= m.last {
+		return nil, nil
+	}
+	if len(m.in) > MaxStreams {
+		return nil, ErrMuxFrame
+	}
+
+	m.last = id
+	s := m.newIn(id)
+	m.in[id] = s
+	return s, nil
+}
+
+func (m *Mux) frame(typ byte, id uint32, p []byte) error {
+	m.wsem.Lock()
+	defer m.wsem.Unlock()
+	return m.writeFrame(typ, id, p)
+}
+
+// writeFrame writes a single frame, m.wsem must be held.
+func (m *Mux) writeFrame(typ byte, id uint32, p []byte) error {
+	if m.werr != nil {
+		return m.werr
+	}
+
+	m.header[0] = typ
+	binary.LittleEndian.PutUint32(m.header[1:], id)
+	binary.LittleEndian.PutUint16(m.header[5:], uint16(len(p)))
+	_, err := m.w.Write(m.header)
+	if err == nil && len(p) != 0 {
+		_, err = m.w.Write(p)
+	}
+	if err == nil {
+		err = m.w.Flush()
+	}
+	m.werr = err
+	return err
+}
+
+func (m *Mux) send(s *outStream, p []byte) error {
+	for len(p) != 0 {
+		m.sem.Lock()
+		for s.window == 0 && s.err == nil && m.err == nil {
+			m.cond.Wait()
+		}
+		if err := s.error(); err != nil {
+			m.sem.Unlock()
+			return err
+		}
+
+		n := len(p)
+		if n > s.window {
+			n = s.window
+		}
+		if n > StreamChunk {
+			n = StreamChunk
+		}
+		s.window -= n
+		m.sem.Unlock()
+
+		if err := m.frame(muxData, s.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+
+	return nil
+}
+
+func (m *Mux) demux() {
+	header := make([]byte, muxHeader)
+	payload := make([]byte, StreamChunk)
+	for {
+		if err := m.readFrame(header, payload); err != nil {
+			m.sem.Lock()
+			m.err = err
+			m.cond.Broadcast()
+			m.sem.Unlock()
+			return
+		}
+	}
+}
+
+func (m *Mux) readFrame(header, payload []byte) error {
+	if _, err := io.ReadFull(m.r, header); err != nil {
+		return err
+	}
+	typ := header[0]
+	id := binary.LittleEndian.Uint32(header[1:])
+	size := int(binary.LittleEndian.Uint16(header[5:]))
+	if size > StreamChunk {
+		return ErrMuxFrame
+	}
+
+	p := payload[:size]
+	if _, err := io.ReadFull(m.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	m.sem.Lock()
+	defer m.sem.Unlock()
+	defer m.cond.Broadcast()
+
+	switch typ {
+	case muxData, muxClose:
+		s, err := m.incoming(id)
+		if err != nil || s == nil {
+			return err
+		}
+		if typ == muxClose {
+			s.eof = true
+			return nil
+		}
+		if s.eof || size > s.window {
+			return ErrMuxFrame
+		}
+		s.window -= size
+		s.buf = append(s.buf, p...)
+
+	case muxWindow:
+		if size != 4 {
+			return ErrMuxFrame
+		}
+		if s, ok := m.out[id]; ok {
+			s.window += int(binary.LittleEndian.Uint32(p))
+		}
+
+	case muxReset:
+		if s, ok := m.out[id]; ok && id != 0 {
+			s.err = ErrStreamReset
+			delete(m.out, id)
+		}
+
+	default:
+		return ErrMuxFrame
+	}
+
+	return nil
+}
+
+type inStream struct {
+	m  *Mux
+	id uint32
+
+	buf      []byte
+	window   int
+	consumed int
+	eof      bool
+	err      error
+}
+
+func (s *inStream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	m := s.m
+	m.sem.Lock()
+	for len(s.buf) == 0 && !s.eof && s.err == nil && m.err == nil {
+		m.cond.Wait()
+	}
+
+	if len(s.buf) == 0 {
+		err := s.err
+		switch {
+		case err != nil:
+		case s.eof:
+			err = io.EOF
+			delete(m.in, s.id)
+		default:
+			err = m.err
+			if err == io.EOF && s.id != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		m.sem.Unlock()
+		return 0, err
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.consumed += n
+	var credit int
+	if s.consumed >= StreamWindow/2 && !s.eof {
+		credit, s.consumed = s.consumed, 0
+		s.window += credit
+	}
+	m.sem.Unlock()
+
+	if credit != 0 {
+		p := make([]byte, 4)
+		binary.LittleEndian.PutUint32(p, uint32(credit))
+		if err := m.frame(muxWindow, s.id, p); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *inStream) Close() error {
+	m := s.m
+	m.sem.Lock()
+	_, open := m.in[s.id]
+	reset := open && !s.eof
+	delete(m.in, s.id)
+	s.buf, s.err = nil, ErrStreamClosed
+	m.sem.Unlock()
+
+	if reset {
+		return m.frame(muxReset, s.id, nil)
+	}
+	return nil
+}
+
+type outStream struct {
+	m  *Mux
+	id uint32
+
+	buf    []byte
+	window int
+	err    error
+}
+
+func (s *outStream) error() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.m.err
+}
+
+func (s *outStream) Write(b []byte) (int, error) {
+	s.m.sem.Lock()
+	err := s.err
+	s.m.sem.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for len(b) != 0 {
+		cut := StreamChunk - len(s.buf)
+		if cut > len(b) {
+			cut = len(b)
+		}
+		s.buf = append(s.buf, b[:cut]...)
+		n += cut
+		b = b[cut:]
+		if len(s.buf) == StreamChunk {
+			if err := s.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (s *outStream) Flush() error {
+	err := s.m.send(s, s.buf)
+	s.buf = s.buf[:0]
+	return err
+}
+
+func (s *outStream) Close() error {
+	s.m.sem.Lock()
+	err := s.err
+	s.m.sem.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = s.Flush()
+	s.m.sem.Lock()
+	delete(s.m.out, s.id)
+	s.err = ErrStreamClosed
+	s.m.sem.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.m.frame(muxClose, s.id, nil)
+}
@@ -0,0 +1,287 @@
+package channel_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+)
+
+func muxPipe(t *testing.T) (a, b *channel.Mux, ca, cb net.Conn) {
+	ca, cb = net.Pipe()
+	a = channel.NewMux(channel.NewPassthrough(ca), ca)
+	b = channel.NewMux(channel.NewPassthrough(cb), cb)
+	return
+}
+
+// within fails the test if f does not return in time, e.g.: when a stream
+// waits for a window update that never comes.
+func within(t *testing.T, d time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("timeout")
+	}
+}
+
+func writeStream(w io.WriteCloser, d []byte, errs chan<- error) {
+	if _, err := w.Write(d); err != nil {
+		errs <- err
+		return
+	}
+	errs <- w.Close()
+}
+
+func TestMuxStream(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer ca.Close()
+	defer cb.Close()
+
+	// larger than the window so the writer needs the reader's credit.
+	payload := random(t, channel.StreamWindow*3+123)
+	id, w := a.Open()
+	errs := make(chan error, 1)
+	go writeStream(w, payload, errs)
+
+	within(t, 5*time.Second, func() {
+		r, err := b.Accept(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		read, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(read, payload) {
+			t.Errorf("data does not match (len: %d %d)", len(payload), len(read))
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+
+	if _, err := b.Accept(id); err != channel.ErrStreamClosed {
+		t.Fatalf("expected closed stream, got: %v", err)
+	}
+}
+
+func TestMuxMessages(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer ca.Close()
+	defer cb.Close()
+
+	// a stream nobody reads doesn't hold up regular messages.
+	_, w := a.Open()
+	errs := make(chan error, 1)
+	go writeStream(w, random(t, channel.StreamWindow*2), errs)
+
+	msgs := random(t, channel.StreamWindow*2)
+	go func() {
+		if _, err := a.Write(msgs); err != nil {
+			t.Error(err)
+		}
+		if err := a.Flush(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	within(t, 5*time.Second, func() {
+		read := make([]byte, len(msgs))
+		if _, err := io.ReadFull(b, read); err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(read, msgs) {
+			t.Error("messages do not match")
+		}
+	})
+
+	select {
+	case err := <-errs:
+		t.Fatalf("stream without a reader finished: %v", err)
+	default:
+	}
+}
+
+func TestMuxInterleave(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer ca.Close()
+	defer cb.Close()
+
+	const n = 6
+	payloads := make([][]byte, n)
+	ids := make([]uint32, n)
+	errs := make(chan error, n)
+	for i := range payloads {
+		payloads[i] = random(t, channel.StreamChunk*(i+1)*5+i)
+		var w io.WriteCloser
+		ids[i], w = a.Open()
+		go writeStream(w, payloads[i], errs)
+	}
+
+	within(t, 10*time.Second, func() {
+		var wg sync.WaitGroup
+		// accept in reverse order, streams are buffered up to their window
+		// until they are.
+		for i := n - 1; i >= 0; i-- {
+			r, err := b.Accept(ids[i])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			wg.Add(1)
+			go func(i int, r io.ReadCloser) {
+				defer wg.Done()
+				defer r.Close()
+				read, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Error(err)
+				}
+				if !bytes.Equal(read, payloads[i]) {
+					t.Errorf("stream %d: data does not match (len: %d %d)", ids[i], len(payloads[i]), len(read))
+				}
+			}(i, r)
+		}
+		wg.Wait()
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestMuxEOF(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer ca.Close()
+	defer cb.Close()
+
+	// the stream is closed before it is accepted, its data is still read
+	// before EOF.
+	id, w := a.Open()
+	if _, err := w.Write([]byte("before close")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Fatal("wrote to a closed stream")
+	}
+
+	// frames are read in order, once this message arrived the close frame
+	// was read too.
+	if _, err := a.Write([]byte("announce")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, 5*time.Second, func() {
+		if _, err := io.ReadFull(b, make([]byte, 8)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	r, err := b.Accept(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != "before close" {
+		t.Fatalf("unexpected data: %q", read)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF after the data, got %d, %v", n, err)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer ca.Close()
+	defer cb.Close()
+
+	id, w := a.Open()
+	errs := make(chan error, 1)
+	go writeStream(w, random(t, channel.StreamWindow*4), errs)
+
+	within(t, 5*time.Second, func() {
+		r, err := b.Accept(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := io.ReadFull(r, make([]byte, channel.StreamChunk)); err != nil {
+			t.Error(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+		if _, err := r.Read(make([]byte, 1)); err != channel.ErrStreamClosed {
+			t.Errorf("expected closed stream, got: %v", err)
+		}
+		if err := <-errs; err != channel.ErrStreamReset {
+			t.Errorf("expected reset, got: %v", err)
+		}
+	})
+
+	// the connection survives a reset stream.
+	go func() {
+		a.Write([]byte("still here"))
+		a.Flush()
+	}()
+	within(t, 5*time.Second, func() {
+		d := make([]byte, 10)
+		if _, err := io.ReadFull(b, d); err != nil || string(d) != "still here" {
+			t.Errorf("unexpected message %q: %v", d, err)
+		}
+	})
+}
+
+func TestMuxConnClose(t *testing.T) {
+	a, b, ca, cb := muxPipe(t)
+	defer cb.Close()
+
+	id, w := a.Open()
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, 5*time.Second, func() {
+		r, err := b.Accept(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := io.ReadFull(r, make([]byte, 7)); err != nil {
+			t.Error(err)
+		}
+
+		ca.Close()
+		if _, err := r.Read(make([]byte, 1)); err != io.ErrUnexpectedEOF {
+			t.Errorf("expected unexpected EOF on an unfinished stream, got: %v", err)
+		}
+		if _, err := b.Read(make([]byte, 1)); err == nil {
+			t.Error("read from a closed connection")
+		}
+	})
+}
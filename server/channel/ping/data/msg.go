@@ -8,16 +8,17 @@ import (
 
 type Message struct {
 	channel.NilMsg
+	channel.NoReplay
 }
 
 func BinaryMessage(r channel.BinaryReader) (Message, error) {
 	n, err := channel.BinaryNilMessage(r)
-	c := Message{n}
+	c := Message{NilMsg: n}
 	return c, err
 }
 
 func JSONMessage(r io.Reader) (Message, io.Reader, error) {
 	n, nr, err := channel.JSONNilMessage(r)
-	c := Message{n}
+	c := Message{NilMsg: n}
 	return c, nr, err
 }
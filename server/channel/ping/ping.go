@@ -31,7 +31,7 @@ func (c *PingChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) error
 	if err != nil {
 		return err
 	}
-	return c.handle(cl)
+	return channel.RequestErr(c.handle(cl))
 }
 
 func (c *PingChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -39,7 +39,7 @@ func (c *PingChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, err
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl)
+	return nr, channel.RequestErr(c.handle(cl))
 }
 
 func (c *PingChannel) handle(cl channel.Client) error {
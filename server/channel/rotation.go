@@ -0,0 +1,170 @@
+package channel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/frizinak/homechat/crypto"
+)
+
+const rotationLabel = "homechat-key-rotation"
+
+var (
+	ErrRotationExpired  = errors.New("key rotation announcement expired")
+	ErrRotationMismatch = errors.New("key rotation announcement is for a different key")
+)
+
+// KeyRotationMessage is sent by a server right after its key exchange message.
+// It announces the server's current key signed by the key it replaced so
+// clients that still trust the old key can switch without user interaction.
+// A zero KeyRotationMessage means no rotation is in progress.
+type KeyRotationMessage struct {
+	old, next  *crypto.PubKey
+	oder, nder []byte
+	expires    int64
+	sig        []byte
+	NeverEqual
+	NoClose
+}
+
+// NewKeyRotationMessage signs the hand-over from old to next. The
+// announcement is honored by clients until expires.
+func NewKeyRotationMessage(old *crypto.Key, next *crypto.PubKey, expires time.Time) (KeyRotationMessage, error) {
+	var p KeyRotationMessage
+	opkey, err := old.Public()
+	if err != nil {
+		return p, err
+	}
+
+	p.old, p.next = opkey, next
+	p.oder, p.nder = opkey.MarshalDER(), next.MarshalDER()
+	p.expires = expires.Unix()
+	p.sig, err = old.Sign(rotationData(p.oder, p.nder, p.expires))
+	return p, err
+}
+
+func rotationData(oder, nder []byte, expires int64) []byte {
+	d := make([]byte, 0, len(rotationLabel)+len(oder)+len(nder)+8)
+	d = append(d, rotationLabel...)
+	d = append(d, oder...)
+	d = append(d, nder...)
+	var e [8]byte
+	binary.LittleEndian.PutUint64(e[:], uint64(expires))
+	return append(d, e[:]...)
+}
+
+func (m KeyRotationMessage) Empty() bool        { return m.old == nil }
+func (m KeyRotationMessage) From() string       { return m.old.FingerprintString() }
+func (m KeyRotationMessage) To() string         { return m.next.FingerprintString() }
+func (m KeyRotationMessage) Expires() time.Time { return time.Unix(m.expires, 0) }
+func (m KeyRotationMessage) Expired() bool      { return time.Now().After(m.Expires()) }
+
+// Verify checks whether the announcement hands over to the given server key
+// and is still within its grace period.
+func (m KeyRotationMessage) Verify(server *crypto.PubKey) error {
+	if m.Empty() {
+		return ErrRotationMismatch
+	}
+	if m.To() != server.FingerprintString() {
+		return ErrRotationMismatch
+	}
+	if m.Expired() {
+		return ErrRotationExpired
+	}
+	return nil
+}
+
+func (m KeyRotationMessage) Binary(w BinaryWriter) error {
+	w.WriteBytes(m.oder, 16)
+	w.WriteBytes(m.nder, 16)
+	w.WriteUint64(uint64(m.expires))
+	w.WriteBytes(m.sig, 16)
+	return w.Err()
+}
+
+func (m KeyRotationMessage) JSON(w io.Writer) error {
+	d := map[string]string{
+		"o": stringEnc.EncodeToString(m.oder),
+		"n": stringEnc.EncodeToString(m.nder),
+		"e": strconv.FormatInt(m.expires, 10),
+		"s": stringEnc.EncodeToString(m.sig),
+	}
+
+	return json.NewEncoder(w).Encode(d)
+}
+
+func (m KeyRotationMessage) FromBinary(r BinaryReader) (Msg, error) {
+	return BinaryKeyRotationMessage(r)
+}
+
+func (m KeyRotationMessage) FromJSON(r io.Reader) (Msg, io.Reader, error) {
+	return JSONKeyRotationMessage(r)
+}
+
+func keyRotationMessage(oder, nder []byte, expires int64, sig []byte) (KeyRotationMessage, error) {
+	p := KeyRotationMessage{oder: oder, nder: nder, expires: expires, sig: sig}
+	if len(oder) == 0 && len(nder) == 0 {
+		return KeyRotationMessage{}, nil
+	}
+
+	p.old = crypto.NewPubKey(ServerMinKeySize)
+	if err := p.old.UnmarshalDER(oder); err != nil {
+		return p, fmt.Errorf("invalid old publickey: %w", err)
+	}
+	p.next = crypto.NewPubKey(ServerMinKeySize)
+	if err := p.next.UnmarshalDER(nder); err != nil {
+		return p, fmt.Errorf("invalid new publickey: %w", err)
+	}
+	if err := p.old.Verify(rotationData(oder, nder, expires), sig); err != nil {
+		return p, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return p, nil
+}
+
+func BinaryKeyRotationMessage(r BinaryReader) (KeyRotationMessage, error) {
+	r = Bounded(r, maxKeyData)
+	oder := r.ReadBytes(16)
+	nder := r.ReadBytes(16)
+	expires := int64(r.ReadUint64())
+	sig := r.ReadBytes(16)
+	if err := r.Err(); err != nil {
+		return KeyRotationMessage{}, err
+	}
+
+	return keyRotationMessage(oder, nder, expires, sig)
+}
+
+func JSONKeyRotationMessage(r io.Reader) (KeyRotationMessage, io.Reader, error) {
+	var p KeyRotationMessage
+	m := make(map[string]string, 4)
+	nr, err := JSON(r, &m)
+	if err != nil {
+		return p, nr, err
+	}
+
+	var oder, nder, sig []byte
+	var expires int64
+	if oder, err = stringDec.DecodeString(m["o"]); err != nil {
+		return p, nr, fmt.Errorf("old publickey not valid: %w", err)
+	}
+	if nder, err = stringDec.DecodeString(m["n"]); err != nil {
+		return p, nr, fmt.Errorf("new publickey not valid: %w", err)
+	}
+	if sig, err = stringDec.DecodeString(m["s"]); err != nil {
+		return p, nr, fmt.Errorf("sig not valid: %w", err)
+	}
+	if m["e"] != "" {
+		if expires, err = strconv.ParseInt(m["e"], 10, 64); err != nil {
+			return p, nr, fmt.Errorf("expiry not valid: %w", err)
+		}
+	}
+
+	p, err = keyRotationMessage(oder, nder, expires, sig)
+	return p, nr, err
+}
@@ -0,0 +1,132 @@
+package channel_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+)
+
+func pubKey(t *testing.T, k *crypto.Key) *crypto.PubKey {
+	pub, err := k.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, next := crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	m, err := channel.NewKeyRotationMessage(old, pubKey(t, next), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin, err := encBinary(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := encJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromBin, err := decBinary(channel.KeyRotationMessage{}, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := decJSON(channel.KeyRotationMessage{}, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, _r := range []channel.Msg{fromBin, fromJSON} {
+		r := _r.(channel.KeyRotationMessage)
+		if r.From() != pubKey(t, old).FingerprintString() || r.To() != pubKey(t, next).FingerprintString() {
+			t.Fatalf("unexpected hand-over from %s to %s", r.From(), r.To())
+		}
+		if r.Expires().Unix() != m.Expires().Unix() {
+			t.Fatalf("expected expiry %s, got %s", m.Expires(), r.Expires())
+		}
+		if err := r.Verify(pubKey(t, next)); err != nil {
+			t.Fatal(err)
+		}
+		// a server still presenting the old key is not the one handed over to.
+		if err := r.Verify(pubKey(t, old)); !errors.Is(err, channel.ErrRotationMismatch) {
+			t.Fatalf("expected %v for the old key, got %v", channel.ErrRotationMismatch, err)
+		}
+	}
+
+	empty, err := encBinary(channel.KeyRotationMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := decBinary(channel.KeyRotationMessage{}, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.(channel.KeyRotationMessage).Empty() {
+		t.Fatal("empty announcement decoded as a rotation")
+	}
+	if err := r.(channel.KeyRotationMessage).Verify(pubKey(t, next)); !errors.Is(err, channel.ErrRotationMismatch) {
+		t.Fatalf("expected %v for an empty announcement, got %v", channel.ErrRotationMismatch, err)
+	}
+
+	expired, err := channel.NewKeyRotationMessage(old, pubKey(t, next), time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expired.Verify(pubKey(t, next)); !errors.Is(err, channel.ErrRotationExpired) {
+		t.Fatalf("expected %v, got %v", channel.ErrRotationExpired, err)
+	}
+}
+
+func TestKeyRotationTampered(t *testing.T) {
+	old, next, other := crypto.NewEd25519Key(), crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	m, err := channel.NewKeyRotationMessage(old, pubKey(t, next), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := encJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := channel.NewKeyRotationMessage(other, pubKey(t, next), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fjs, err := encJSON(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var orig, fake map[string]string
+	if err := json.Unmarshal(js, &orig); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(fjs, &fake); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(m map[string]string){
+		"expiry":    func(m map[string]string) { m["e"] = "99999999999" },
+		"next key":  func(m map[string]string) { m["n"] = fake["o"] },
+		"signature": func(m map[string]string) { m["s"] = fake["s"] },
+	}
+	for name, tamper := range tests {
+		m := make(map[string]string, len(orig))
+		for k, v := range orig {
+			m[k] = v
+		}
+		tamper(m)
+		buf := bytes.NewBuffer(nil)
+		if err := json.NewEncoder(buf).Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decJSON(channel.KeyRotationMessage{}, buf.Bytes()); err == nil {
+			t.Errorf("%s: tampered announcement decoded", name)
+		}
+	}
+}
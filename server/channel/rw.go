@@ -2,6 +2,8 @@ package channel
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 
@@ -46,6 +48,75 @@ type BinaryReader interface {
 	ReadString(byte) string
 }
 
+var ErrTooLarge = errors.New("exceeds maximum size")
+
+// ReadCount reads a count or length of bitSize bits and fails if it exceeds
+// max so decoders never allocate based on an unchecked peer-controlled value.
+func ReadCount(r BinaryReader, bitSize byte, max int) (int, error) {
+	n := r.ReadUint(bitSize)
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+	if n > uint64(max) {
+		return 0, fmt.Errorf("%w: %d > %d", ErrTooLarge, n, max)
+	}
+	return int(n), nil
+}
+
+// Bounded returns a BinaryReader whose ReadBytes and ReadString fail
+// instead of allocating more than max bytes.
+func Bounded(r BinaryReader, max int) BinaryReader {
+	return &boundedReader{BinaryReader: r, max: max}
+}
+
+type boundedReader struct {
+	BinaryReader
+	max int
+	err error
+}
+
+func (b *boundedReader) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.BinaryReader.Err()
+}
+
+func (b *boundedReader) ReadBytes(bitSize byte) []byte {
+	if b.err != nil {
+		return nil
+	}
+
+	n, err := ReadCount(b.BinaryReader, bitSize, b.max)
+	if err != nil {
+		b.err = err
+		return nil
+	}
+	d := make([]byte, n)
+	if _, err := io.ReadFull(b.Reader(), d); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+		return nil
+	}
+	return d
+}
+
+func (b *boundedReader) ReadString(bitSize byte) string {
+	return string(b.ReadBytes(bitSize))
+}
+
+// Capacity returns the initial capacity for a slice of n decoded elements,
+// the slice grows as elements are actually read.
+func Capacity(n int) int {
+	const max = 1024
+	if n > max {
+		return max
+	}
+	return n
+}
+
 func NewRWFactory(debug io.Writer) RWFactory {
 	if debug != nil {
 		return &debugRWFactory{
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"sync"
 
@@ -160,11 +161,13 @@ func (g *BinaryHistory) Load(file string) error {
 	defer f.Close()
 
 	do := func(r BinaryReader, dec Decoder) error {
-		n := r.ReadUint64()
-		g.data = make([]Msg, 0, n)
+		n, err := ReadCount(r, 64, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		g.data = make([]Msg, 0, Capacity(n))
 
-		var i uint64
-		for i = 0; i < n; i++ {
+		for i := 0; i < n; i++ {
 			m, err := dec(r)
 			if err != nil {
 				return err
@@ -227,6 +230,18 @@ func (g *BinaryHistory) Last(n int, cb func(Msg) bool) {
 	g.each(g.data[l:], cb)
 }
 
+// Reverse calls cb for each message, most recent first, until it returns
+// false.
+func (g *BinaryHistory) Reverse(cb func(Msg) bool) {
+	g.sem.Lock()
+	defer g.sem.Unlock()
+	for i := len(g.data) - 1; i >= 0; i-- {
+		if !cb(g.data[i]) {
+			break
+		}
+	}
+}
+
 func (g *BinaryHistory) each(d []Msg, cb func(Msg) bool) {
 	for _, el := range d {
 		if !cb(el) {
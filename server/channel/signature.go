@@ -0,0 +1,95 @@
+package channel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/frizinak/homechat/crypto"
+)
+
+const signatureLabel = "homechat-signature"
+
+// MaxSignatureSkew is how far the stamp of a signature may be off from the
+// time its message was received. It limits how long a signed message can be
+// replayed.
+const MaxSignatureSkew = time.Hour
+
+var (
+	ErrUnsigned       = errors.New("not signed")
+	ErrSignature      = errors.New("invalid signature")
+	ErrSignatureStamp = errors.New("signature stamp too far off, replayed message?")
+)
+
+// Signature authenticates a message by the key of its author.
+type Signature struct {
+	Key   []byte `json:"key"`
+	Stamp int64  `json:"stamp"`
+	Sig   []byte `json:"sig"`
+}
+
+// NewSignature signs data with key.
+func NewSignature(key *crypto.Key, stamp time.Time, data []byte) (*Signature, error) {
+	pub, err := key.Public()
+	if err != nil {
+		return nil, err
+	}
+	s := &Signature{Key: pub.MarshalDER(), Stamp: stamp.Unix()}
+	s.Sig, err = key.Sign(s.data(data))
+	return s, err
+}
+
+func (s *Signature) data(data []byte) []byte {
+	d := make([]byte, 0, len(signatureLabel)+8+len(data))
+	d = append(d, signatureLabel...)
+	var e [8]byte
+	binary.LittleEndian.PutUint64(e[:], uint64(s.Stamp))
+	d = append(d, e[:]...)
+	return append(d, data...)
+}
+
+func (s *Signature) Time() time.Time { return time.Unix(s.Stamp, 0) }
+
+// Verify checks whether data was signed by s and the signature was made
+// around the time the message was received and returns the signing key.
+func (s *Signature) Verify(data []byte, received time.Time) (*crypto.PubKey, error) {
+	if s == nil {
+		return nil, ErrUnsigned
+	}
+	pub := crypto.NewPubKey(ClientMinKeySize)
+	if err := pub.UnmarshalDER(s.Key); err != nil {
+		return nil, fmt.Errorf("invalid signature key: %w", err)
+	}
+	if err := pub.Verify(s.data(data), s.Sig); err != nil {
+		return nil, ErrSignature
+	}
+	if d := received.Sub(s.Time()); d > MaxSignatureSkew || d < -MaxSignatureSkew {
+		return nil, ErrSignatureStamp
+	}
+	return pub, nil
+}
+
+// WriteSignature writes an optional signature.
+func WriteSignature(w BinaryWriter, s *Signature) {
+	if s == nil {
+		w.WriteUint8(0)
+		return
+	}
+	w.WriteUint8(1)
+	w.WriteBytes(s.Key, 16)
+	w.WriteUint64(uint64(s.Stamp))
+	w.WriteBytes(s.Sig, 16)
+}
+
+// ReadSignature reads a signature written by WriteSignature.
+func ReadSignature(r BinaryReader) *Signature {
+	if r.ReadUint8() == 0 {
+		return nil
+	}
+	return &Signature{
+		Key:   r.ReadBytes(16),
+		Stamp: int64(r.ReadUint64()),
+		Sig:   r.ReadBytes(16),
+	}
+}
@@ -0,0 +1,98 @@
+package channel_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frizinak/binary"
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server/channel"
+)
+
+func TestSignature(t *testing.T) {
+	key := crypto.NewEd25519Key()
+	now := time.Now()
+	data := []byte("hello")
+	sig, err := channel.NewSignature(key, now, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := binary.NewWriter(buf)
+	channel.WriteSignature(w, sig)
+	channel.WriteSignature(w, nil)
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+	r := binary.NewReader(buf)
+	got, none := channel.ReadSignature(r), channel.ReadSignature(r)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if none != nil {
+		t.Fatalf("expected no signature, got %+v", none)
+	}
+
+	pub, err := got.Verify(data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.FingerprintString() != pubKey(t, key).FingerprintString() {
+		t.Fatal("verified with a different key")
+	}
+	if _, err := none.Verify(data, now); !errors.Is(err, channel.ErrUnsigned) {
+		t.Fatalf("expected %v, got %v", channel.ErrUnsigned, err)
+	}
+}
+
+func TestSignatureInvalid(t *testing.T) {
+	key, other := crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	now := time.Now()
+	data := []byte("hello")
+	sign := func() *channel.Signature {
+		sig, err := channel.NewSignature(key, now, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	otherSig, err := channel.NewSignature(other, now, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		tamper   func(s *channel.Signature)
+		data     []byte
+		received time.Time
+		err      error
+	}{
+		{"data", nil, []byte("hellO"), now, channel.ErrSignature},
+		{"stamp", func(s *channel.Signature) { s.Stamp++ }, data, now, channel.ErrSignature},
+		{"sig", func(s *channel.Signature) { s.Sig[0] ^= 1 }, data, now, channel.ErrSignature},
+		{"wrong key", func(s *channel.Signature) { s.Key = otherSig.Key }, data, now, channel.ErrSignature},
+		{"other sig", func(s *channel.Signature) { s.Sig = otherSig.Sig }, data, now, channel.ErrSignature},
+		{"replayed", nil, data, now.Add(channel.MaxSignatureSkew + time.Minute), channel.ErrSignatureStamp},
+		{"early", nil, data, now.Add(-channel.MaxSignatureSkew - time.Minute), channel.ErrSignatureStamp},
+	}
+	for _, test := range tests {
+		sig := sign()
+		if test.tamper != nil {
+			test.tamper(sig)
+		}
+		if _, err := sig.Verify(test.data, test.received); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// a key the signature doesn't parse as.
+	sig := sign()
+	sig.Key = []byte("not a key")
+	if _, err := sig.Verify(data, now); err == nil {
+		t.Error("verified with an invalid key")
+	}
+}
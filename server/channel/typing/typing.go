@@ -37,7 +37,7 @@ func (c *TypingChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) err
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *TypingChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -45,7 +45,7 @@ func (c *TypingChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, e
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *TypingChannel) handle(cl channel.Client, m data.Message) error {
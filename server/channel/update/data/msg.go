@@ -8,6 +8,9 @@ import (
 	"github.com/frizinak/homechat/server/channel"
 )
 
+// Maximum size of the signature of an update.
+const MaxSigSize = 4096
+
 type Message struct {
 	GOOS   string
 	GOARCH string
@@ -56,6 +59,7 @@ type ServerMessage struct {
 	r io.Reader
 
 	channel.NeverEqual
+	channel.NoReplay
 }
 
 func NewServerMessage(size int64, sig []byte, r io.Reader) ServerMessage {
@@ -115,6 +119,7 @@ func BinaryServerMessage(r channel.BinaryReader) (ServerMessage, error) {
 		return m, r.Err()
 	}
 
+	r = channel.Bounded(r, MaxSigSize)
 	m.Sig = r.ReadBytes(32)
 	m.Size = int64(r.ReadUint64())
 	m.r = io.LimitReader(r.Reader(), m.Size)
@@ -36,7 +36,7 @@ func (c *UpdateChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) err
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *UpdateChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -44,7 +44,7 @@ func (c *UpdateChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, e
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *UpdateChannel) send(f channel.ClientFilter, m data.Message) error {
@@ -16,6 +16,7 @@ type Message struct {
 
 	channel.NeverEqual
 	channel.NoClose
+	channel.StreamMsg
 }
 
 func NewMessage(filename, msg string, size int64, r io.Reader) Message {
@@ -42,6 +42,9 @@ func (c *UploadChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) err
 	if err != nil {
 		return err
 	}
+	if m.Size > c.LimitReader() {
+		return fmt.Errorf("upload exceeds the maximum of %d bytes", c.LimitReader())
+	}
 
 	u, err := c.uploader.Upload(m.Filename, m.Upload())
 	if err != nil {
@@ -53,7 +56,7 @@ func (c *UploadChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) err
 		msg = fmt.Sprintf("%s %s", m.Message, msg)
 	}
 
-	return c.broadcast.Handle(cl, chatdata.Message{Data: msg})
+	return channel.RequestErr(c.broadcast.Handle(cl, chatdata.Message{Data: msg}))
 }
 
 func (c *UploadChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -26,6 +26,9 @@ func JSONMessage(r io.Reader) (Message, io.Reader, error) {
 	return c, nr, err
 }
 
+// Maximum amount of users in a ServerMessage.
+const MaxUsers = 4096
+
 type User struct {
 	Name    string `json:"name"`
 	Clients uint8  `json:"clients"`
@@ -78,10 +81,16 @@ func (m ServerMessage) Equal(msg channel.Msg) bool {
 
 func BinaryServerMessage(r channel.BinaryReader) (msg ServerMessage, err error) {
 	msg.Channel = r.ReadString(8)
-	msg.Users = make([]User, r.ReadUint16())
-	for i := range msg.Users {
-		msg.Users[i].Name = r.ReadString(8)
-		msg.Users[i].Clients = r.ReadUint8()
+	n, err := channel.ReadCount(r, 16, MaxUsers)
+	if err != nil {
+		return msg, err
+	}
+	msg.Users = make([]User, 0, channel.Capacity(n))
+	for i := 0; i < n; i++ {
+		var u User
+		u.Name = r.ReadString(8)
+		u.Clients = r.ReadUint8()
+		msg.Users = append(msg.Users, u)
 	}
 	return msg, r.Err()
 }
@@ -39,7 +39,7 @@ func (c *UsersChannel) HandleBIN(cl channel.Client, r channel.BinaryReader) erro
 	if err != nil {
 		return err
 	}
-	return c.handle(cl, m)
+	return channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *UsersChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, error) {
@@ -47,7 +47,7 @@ func (c *UsersChannel) HandleJSON(cl channel.Client, r io.Reader) (io.Reader, er
 	if err != nil {
 		return nr, err
 	}
-	return nr, c.handle(cl, m)
+	return nr, channel.RequestErr(c.handle(cl, m))
 }
 
 func (c *UsersChannel) UserUpdate(channel.Client, channel.ConnectionReason) error {
@@ -55,6 +55,10 @@ func (c *UsersChannel) UserUpdate(channel.Client, channel.ConnectionReason) erro
 	return c.err
 }
 
+// Changed marks the users of col as changed, they are sent to all clients on
+// the next SendInterval tick.
+func (c *UsersChannel) Changed() { c.change = true }
+
 func (c *UsersChannel) handle(cl channel.Client, m data.Message) error {
 	return c.do(channel.ClientFilter{Client: cl, Channel: c.channel})
 }
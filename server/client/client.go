@@ -2,11 +2,19 @@ package client
 
 import (
 	"errors"
+	"io"
 	"sync"
 
+	"github.com/frizinak/binary"
 	"github.com/frizinak/homechat/server/channel"
 )
 
+var (
+	ErrStopped = errors.New("client was stopped but still received a message")
+	ErrSlow    = errors.New("client can not keep up, disconnecting")
+	ErrResumed = errors.New("session was resumed by a new connection")
+)
+
 type Job struct {
 	WG      *sync.WaitGroup
 	Channel string
@@ -18,21 +26,51 @@ type Error struct {
 	Err    error
 }
 
+type item struct {
+	wg      *sync.WaitGroup
+	channel string
+	msg     channel.Msg
+	seq     uint32
+}
+
+func (i item) done() {
+	if i.wg != nil {
+		i.wg.Done()
+	}
+}
+
+type Stats struct {
+	Name    string
+	Queued  int
+	Max     int
+	Dropped uint64
+}
+
 type Client struct {
-	wg          sync.WaitGroup
 	proto       channel.Proto
 	frameWriter bool
 
 	w            channel.WriteFlusher
 	binaryWriter channel.BinaryWriter
+	streams      *channel.Mux
 
-	name     string
-	channels []string
+	name         string
+	fingerprints []string
+	channels     []string
+	caps         channel.Capabilities
 
 	last map[string]channel.Msg
 
-	jobs chan Job
-	errs chan<- Error
+	sem     sync.Mutex
+	sending sync.Mutex
+	queue   []item
+	max     int
+	dropped uint64
+	notify  chan struct{}
+	killed  chan struct{}
+	errs    chan<- Error
+
+	session *Session
 
 	stopped bool
 }
@@ -40,68 +78,255 @@ type Client struct {
 type Config struct {
 	FrameWriter bool
 	Proto       channel.Proto
+	Fingerprint string
 	Name        string
 	Channels    []string
-	JobBuffer   int
+
+	// Fingerprints of all keys the client presented.
+	Fingerprints []string
+
+	// Capabilities negotiated with the client.
+	Caps channel.Capabilities
+
+	// Streams is used to send streamed messages, they are sent inline
+	// when nil.
+	Streams *channel.Mux
+
+	// Maximum amount of messages that can be pending for this client.
+	// Droppable messages are coalesced or dropped once this is reached,
+	// any other message will cause the client to be disconnected.
+	JobBuffer int
 }
 
 func New(c Config, conn channel.WriteFlusher, binaryWriter channel.BinaryWriter, errs chan<- Error) *Client {
 	return &Client{
 		w:            conn,
 		binaryWriter: binaryWriter,
+		streams:      c.Streams,
 		frameWriter:  c.FrameWriter,
 		proto:        c.Proto,
 		name:         c.Name,
+		fingerprints: c.Fingerprints,
 		channels:     c.Channels,
+		caps:         c.Caps,
 		last:         make(map[string]channel.Msg),
-		jobs:         make(chan Job, c.JobBuffer),
+		queue:        make([]item, 0, 8),
+		max:          c.JobBuffer,
+		notify:       make(chan struct{}, 1),
+		killed:       make(chan struct{}),
 		errs:         errs,
 	}
 }
 
 func (c *Client) Run() {
 	go func() {
-		for j := range c.jobs {
-			for _, m := range j.Msgs {
-				if err := c.send(j.Channel, m); err != nil {
+		for range c.notify {
+			for {
+				c.sem.Lock()
+				if len(c.queue) == 0 {
+					c.sem.Unlock()
+					break
+				}
+				i := c.queue[0]
+				c.queue[0] = item{}
+				c.queue = c.queue[1:]
+				c.sending.Lock()
+				c.sem.Unlock()
+
+				if err := c.send(i); err != nil {
 					c.errs <- Error{c, err}
 				}
-				j.WG.Done()
+				c.sending.Unlock()
+				i.done()
 			}
 		}
 	}()
 }
 
 func (c *Client) Stop() {
+	c.sem.Lock()
+	if c.stopped {
+		c.sem.Unlock()
+		return
+	}
 	c.stopped = true
-	c.wg.Wait()
-	close(c.jobs)
+	pending := c.queue
+	c.queue = nil
+	close(c.notify)
+	sess := c.session
+	c.sem.Unlock()
+
+	if sess != nil {
+		// wait for an in-flight message to be recorded so pending messages
+		// are logged in order.
+		c.sending.Lock()
+		c.sending.Unlock()
+		sess.park(pending)
+	}
+
+	for _, i := range pending {
+		i.done()
+	}
+}
+
+// Killed is closed when the client's queue overflowed with messages that
+// could not be dropped or when its session was taken over,
+// its connection should be closed.
+func (c *Client) Killed() <-chan struct{} { return c.killed }
+
+// Takeover kills c and moves its pending messages, except ephemeral ones, to
+// n.
+func (c *Client) Takeover(n *Client) {
+	c.sem.Lock()
+	if c.stopped {
+		c.sem.Unlock()
+		return
+	}
+	c.stopped = true
+	pending := c.queue
+	c.queue = nil
+	close(c.notify)
+	close(c.killed)
+	c.sem.Unlock()
+
+	c.report(ErrResumed)
+
+	// wait for an in-flight message to be written (or fail) and recorded
+	c.sending.Lock()
+	c.sending.Unlock()
+
+	// replies and other ephemeral messages mean nothing to the new
+	// connection.
+	keep := pending[:0]
+	for _, i := range pending {
+		if channel.IsEphemeral(i.msg) {
+			i.done()
+			continue
+		}
+		keep = append(keep, i)
+	}
+
+	n.sem.Lock()
+	n.queue = append(n.queue, keep...)
+	n.sem.Unlock()
+}
+
+func (c *Client) Stats() Stats {
+	c.sem.Lock()
+	s := Stats{Name: c.name, Queued: len(c.queue), Max: c.max, Dropped: c.dropped}
+	c.sem.Unlock()
+	return s
+}
+
+// report passes err on without blocking, Queue is called while broadcasting
+// to all clients.
+func (c *Client) report(err error) {
+	select {
+	case c.errs <- Error{c, err}:
+	default:
+		go func() { c.errs <- Error{c, err} }()
+	}
 }
 
 func (c *Client) Queue(job Job) {
+	c.sem.Lock()
 	if c.stopped {
+		c.sem.Unlock()
 		job.WG.Add(-len(job.Msgs))
-		c.errs <- Error{c, errors.New("client was stopped but still received a message")}
+		c.report(ErrStopped)
+		return
+	}
+
+	var slow bool
+	for _, m := range job.Msgs {
+		if !c.queueMsg(item{job.WG, job.Channel, m, 0}) {
+			slow = true
+		}
+	}
+
+	if slow {
+		c.stopped = true
+		for _, i := range c.queue {
+			i.done()
+		}
+		c.queue = nil
+		close(c.notify)
+		close(c.killed)
+	}
+	c.sem.Unlock()
+
+	if slow {
+		c.report(ErrSlow)
 		return
 	}
 
-	c.wg.Add(1)
-	c.jobs <- job
-	c.wg.Done()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
 }
 
-func (c *Client) send(chnl string, msg channel.Msg) error {
+func (c *Client) queueMsg(i item) bool {
+	if c.stopped {
+		i.done()
+		return true
+	}
+
+	droppable := channel.IsDroppable(i.msg)
+	if droppable {
+		for n := len(c.queue) - 1; n >= 0; n-- {
+			if c.queue[n].seq == 0 && c.queue[n].channel == i.channel && channel.IsDroppable(c.queue[n].msg) {
+				// the new state goes at the tail so it isn't sent before
+				// messages that were queued after the old one.
+				c.queue[n].done()
+				c.queue = append(c.queue[:n], c.queue[n+1:]...)
+				c.queue = append(c.queue, i)
+				c.dropped++
+				return true
+			}
+		}
+	}
+
+	if c.max <= 0 || len(c.queue) < c.max {
+		c.queue = append(c.queue, i)
+		return true
+	}
+
+	i.done()
+	if droppable {
+		c.dropped++
+		return true
+	}
+
+	return false
+}
+
+func (c *Client) send(i item) error {
+	chnl, msg := i.channel, i.msg
 	if last, ok := c.last[chnl]; ok && msg.Equal(last) {
 		return nil
 	}
 	c.last[chnl] = msg
 
-	p := channel.ChannelMsg{Data: chnl}
+	p := channel.ChannelMsg{Data: chnl, Seq: i.seq}.Multiplexed(c.streams != nil)
+	if p.Seq == 0 && c.session != nil {
+		p.Seq = c.session.record(chnl, msg)
+	}
+	msg = channel.ForVersion(msg, c.caps.Version(chnl))
+
+	var body io.WriteCloser
+	if c.streams != nil && channel.IsStreamed(msg) {
+		p.Stream, body = c.streams.Open()
+	}
+
 	switch c.proto {
 	case channel.ProtoBinary:
 		if err := p.Binary(c.binaryWriter); err != nil {
 			return err
 		}
+		if body != nil {
+			break
+		}
 		if err := msg.Binary(c.binaryWriter); err != nil {
 			return err
 		}
@@ -109,6 +334,9 @@ func (c *Client) send(chnl string, msg channel.Msg) error {
 		if err := p.JSON(c.w); err != nil {
 			return err
 		}
+		if body != nil {
+			break
+		}
 		if err := msg.JSON(c.w); err != nil {
 			return err
 		}
@@ -116,9 +344,41 @@ func (c *Client) send(chnl string, msg channel.Msg) error {
 		return errors.New("client uses unsupported protocol")
 	}
 
-	return c.w.Flush()
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if body != nil {
+		go c.stream(body, msg)
+	}
+	return nil
 }
 
+// stream writes msg to its own stream so the queue can move on.
+func (c *Client) stream(w io.WriteCloser, msg channel.Msg) {
+	var err error
+	switch c.proto {
+	case channel.ProtoBinary:
+		err = msg.Binary(binary.NewWriter(w))
+	case channel.ProtoJSON:
+		err = msg.JSON(w)
+	default:
+		err = errors.New("client uses unsupported protocol")
+	}
+
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && !errors.Is(err, channel.ErrStreamReset) {
+		c.errs <- Error{c, err}
+	}
+}
+
+func (c *Client) Session() *Session  { return c.session }
 func (c *Client) Name() string       { return c.name }
 func (c *Client) Channels() []string { return c.channels }
-func (c *Client) Bot() bool          { return false }
+
+// Fingerprints returns the fingerprints of all keys the client presented.
+func (c *Client) Fingerprints() []string { return c.fingerprints }
+
+func (c *Client) Capabilities() channel.Capabilities { return c.caps }
+func (c *Client) Bot() bool                          { return false }
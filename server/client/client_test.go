@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+type received struct {
+	seq  uint32
+	data string
+}
+
+func newTestClient(w io.Writer, errs chan<- Error) *Client {
+	return New(
+		Config{Proto: channel.ProtoJSON, Name: "alice", Channels: []string{"chat"}},
+		channel.NewPassthrough(w),
+		nil,
+		errs,
+	)
+}
+
+func chat(d string) channel.Msg {
+	return chatdata.ServerMessage{Message: chatdata.Message{Data: d}, From: "bob"}
+}
+
+func queue(c *Client, msgs ...string) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	job := Job{WG: wg, Channel: "chat"}
+	for _, m := range msgs {
+		job.Msgs = append(job.Msgs, chat(m))
+	}
+	wg.Add(len(job.Msgs))
+	c.Queue(job)
+	return wg
+}
+
+func decode(t *testing.T, r io.Reader) []received {
+	var l []received
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var ch channel.ChannelMsg
+		var m chatdata.ServerMessage
+		if err := dec.Decode(&ch); err != nil {
+			t.Fatal(err)
+		}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		l = append(l, received{ch.Seq, m.Data})
+	}
+	return l
+}
+
+func TestSessionResumeQueued(t *testing.T) {
+	errs := make(chan Error, 10)
+	sess, err := NewSession("fp", "alice", []string{"chat"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first connection receives one message, then drops with two more
+	// still in its queue. It is never Run so the queue isn't drained.
+	buf1 := bytes.NewBuffer(nil)
+	c1 := newTestClient(buf1, errs)
+	sess.Attach(c1, 0)
+	if err := c1.send(item{channel: "chat", msg: chat("one")}); err != nil {
+		t.Fatal(err)
+	}
+	wg := queue(c1, "two", "three")
+	c1.Stop()
+	sess.Detach(c1)
+	wg.Wait()
+
+	sent := decode(t, buf1)
+	if len(sent) != 1 || sent[0].data != "one" {
+		t.Fatalf("first connection received %+v", sent)
+	}
+	lastSeq := sent[0].seq
+	if !sess.CanResume(lastSeq) {
+		t.Fatal("session can not be resumed")
+	}
+
+	buf2 := bytes.NewBuffer(nil)
+	c2 := newTestClient(buf2, errs)
+	sess.Attach(c2, lastSeq)
+	c2.Run()
+	queue(c2, "four").Wait()
+	c2.Stop()
+	sess.Detach(c2)
+
+	all := append(sent, decode(t, buf2)...)
+	exp := []string{"one", "two", "three", "four"}
+	if len(all) != len(exp) {
+		t.Fatalf("expected %v, got %+v", exp, all)
+	}
+	for i := range exp {
+		if all[i].data != exp[i] {
+			t.Fatalf("expected %v, got %+v", exp, all)
+		}
+		if i > 0 && all[i].seq <= all[i-1].seq {
+			t.Fatalf("sequence not increasing: %+v", all)
+		}
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err.Err)
+	default:
+	}
+}
+
+func TestStopWithoutSession(t *testing.T) {
+	errs := make(chan Error, 10)
+	c := newTestClient(ioutil.Discard, errs)
+	wg := queue(c, "one", "two")
+	c.Stop()
+	wg.Wait()
+
+	queue(c, "three").Wait()
+	if err := <-errs; err.Err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err.Err)
+	}
+}
+
+// state is a droppable message.
+type state struct {
+	chatdata.ServerMessage
+	channel.StateMsg
+}
+
+func queueMsgs(c *Client, msgs ...channel.Msg) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	wg.Add(len(msgs))
+	c.Queue(Job{WG: wg, Channel: "chat", Msgs: msgs})
+	return wg
+}
+
+func boundedClient(w io.Writer, max int, errs chan<- Error) *Client {
+	return New(
+		Config{Proto: channel.ProtoJSON, Name: "alice", Channels: []string{"chat"}, JobBuffer: max},
+		channel.NewPassthrough(w),
+		nil,
+		errs,
+	)
+}
+
+func TestQueueBounded(t *testing.T) {
+	// nobody reads errs while queueing, it must not block.
+	errs := make(chan Error)
+	c := boundedClient(ioutil.Discard, 3, errs)
+
+	wg := queue(c, "one", "two", "three")
+	if st := c.Stats(); st.Queued != 3 || st.Max != 3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	select {
+	case <-c.Killed():
+		t.Fatal("killed with a full queue")
+	default:
+	}
+
+	// one more and the client is too slow.
+	wg2 := queue(c, "four")
+	select {
+	case <-c.Killed():
+	default:
+		t.Fatal("slow client was not killed")
+	}
+	wg.Wait()
+	wg2.Wait()
+	if st := c.Stats(); st.Queued != 0 {
+		t.Fatalf("queue of a killed client not cleared: %+v", st)
+	}
+
+	queue(c, "five").Wait()
+	got := map[error]int{}
+	for i := 0; i < 2; i++ {
+		got[(<-errs).Err]++
+	}
+	if got[ErrSlow] != 1 || got[ErrStopped] != 1 {
+		t.Fatalf("expected ErrSlow and ErrStopped, got %v", got)
+	}
+}
+
+func TestQueueDroppable(t *testing.T) {
+	errs := make(chan Error, 10)
+	st := func(d string) channel.Msg {
+		return state{ServerMessage: chatdata.ServerMessage{Message: chatdata.Message{Data: d}}}
+	}
+
+	// a full queue drops states that can't be coalesced.
+	c := boundedClient(ioutil.Discard, 2, errs)
+	queue(c, "one", "two")
+	queueMsgs(c, st("a")).Wait()
+	if s := c.Stats(); s.Queued != 2 || s.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// newer states replace older ones and are sent after the messages
+	// that were queued in between.
+	buf := bytes.NewBuffer(nil)
+	c = boundedClient(buf, 3, errs)
+	wg := queueMsgs(c, chat("one"), st("a"), chat("two"))
+	wg2 := queueMsgs(c, st("b"), st("c"))
+	if s := c.Stats(); s.Queued != 3 || s.Dropped != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	c.Run()
+	wg.Wait()
+	wg2.Wait()
+	c.Stop()
+
+	var got []string
+	for _, r := range decode(t, buf) {
+		got = append(got, r.data)
+	}
+	if exp := []string{"one", "two", "c"}; strings.Join(got, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err.Err)
+	case <-c.Killed():
+		t.Fatal("killed for droppable messages")
+	default:
+	}
+}
+
+func TestRepliesNotReplayed(t *testing.T) {
+	errs := make(chan Error, 10)
+	sess, err := NewSession("fp", "alice", []string{"chat"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := channel.ReplyMsg{ID: 1, StatusMsg: channel.StatusMsg{Code: channel.StatusOK}}
+
+	// the reply to the first request is sent and recorded, the reply to
+	// the second is still queued when a new connection takes over.
+	buf1 := bytes.NewBuffer(nil)
+	c1 := newTestClient(buf1, errs)
+	sess.Attach(c1, 0)
+	if err := c1.send(item{channel: "chat", msg: chat("one")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.send(item{channel: "chat", msg: reply}); err != nil {
+		t.Fatal(err)
+	}
+	reply.ID = 2
+	wg := queueMsgs(c1, reply, chat("two"))
+
+	buf2 := bytes.NewBuffer(nil)
+	c2 := newTestClient(buf2, errs)
+	c1.Takeover(c2)
+	sess.Attach(c2, 0)
+	c2.Run()
+	wg.Wait()
+	c2.Stop()
+
+	var got []string
+	for _, r := range decode(t, buf2) {
+		got = append(got, r.data)
+	}
+	if exp := []string{"one", "two"}; strings.Join(got, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+	if err := <-errs; err.Err != ErrResumed {
+		t.Fatalf("expected ErrResumed, got %v", err.Err)
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+)
+
+type sent struct {
+	seq     uint32
+	channel string
+	msg     channel.Msg
+}
+
+// Session outlives a single connection and keeps a log of the most recent
+// messages sent to its client so they can be replayed after a reconnect.
+type Session struct {
+	token       string
+	fingerprint string
+	name        string
+	channels    []string
+
+	sem      sync.Mutex
+	seq      uint32
+	evicted  uint32
+	log      []sent
+	max      int
+	owner    *Client
+	detached time.Time
+}
+
+func NewSession(fingerprint, name string, channels []string, max int) (*Session, error) {
+	tok := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, tok); err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		token:       base64.RawURLEncoding.EncodeToString(tok),
+		fingerprint: fingerprint,
+		name:        name,
+		channels:    channels,
+		log:         make([]sent, 0, 8),
+		max:         max,
+	}, nil
+}
+
+func (s *Session) Token() string { return s.token }
+
+// Matches reports whether a client with the given identity can resume this
+// session.
+func (s *Session) Matches(fingerprint, name string, channels []string) bool {
+	if s.fingerprint != fingerprint || s.name != name || len(s.channels) != len(channels) {
+		return false
+	}
+	for i := range channels {
+		if s.channels[i] != channels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CanResume reports whether all messages after seq are still available.
+func (s *Session) CanResume(seq uint32) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return seq >= s.evicted && seq <= s.seq
+}
+
+// Expired reports whether the session has been without a client for longer
+// than retention.
+func (s *Session) Expired(retention time.Duration) bool {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s.owner == nil && time.Since(s.detached) > retention
+}
+
+// Owner returns the client currently attached to this session.
+func (s *Session) Owner() *Client {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s.owner
+}
+
+// Attach makes c the owner of this session and queues all messages sent after
+// seq in front of its pending messages.
+func (s *Session) Attach(c *Client, seq uint32) {
+	s.sem.Lock()
+	c.sem.Lock()
+	s.owner = c
+	c.session = s
+	replay := make([]item, 0, len(s.log))
+	for _, m := range s.log {
+		if m.seq <= seq {
+			continue
+		}
+		replay = append(replay, item{nil, m.channel, m.msg, m.seq})
+	}
+	c.queue = append(replay, c.queue...)
+	wake := len(replay) != 0 && !c.stopped
+	c.sem.Unlock()
+	s.sem.Unlock()
+
+	// the replay is sent without waiting for the next message.
+	if wake {
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Detach releases c from this session, starting its retention window.
+func (s *Session) Detach(c *Client) {
+	s.sem.Lock()
+	if s.owner == c {
+		s.owner = nil
+		s.detached = time.Now()
+	}
+	s.sem.Unlock()
+}
+
+// RecordDetached logs a broadcast message while no client is attached so it
+// can be replayed once the session is resumed.
+func (s *Session) RecordDetached(f channel.ClientFilter, msg channel.Msg) {
+	if f.Client != nil || !f.CheckName(s.name) || !f.CheckChannels(s.channels) {
+		return
+	}
+
+	found := false
+	for _, ch := range s.channels {
+		if ch == f.Channel {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+
+	s.sem.Lock()
+	if s.owner == nil {
+		s.add(f.Channel, msg)
+	}
+	s.sem.Unlock()
+}
+
+// park logs the messages that were queued for the owner but never sent so
+// they are replayed when the session is resumed.
+func (s *Session) park(pending []item) {
+	s.sem.Lock()
+	for _, i := range pending {
+		if i.seq == 0 {
+			s.add(i.channel, i.msg)
+		}
+	}
+	s.sem.Unlock()
+}
+
+func (s *Session) record(chnl string, msg channel.Msg) uint32 {
+	s.sem.Lock()
+	defer s.sem.Unlock()
+	return s.add(chnl, msg)
+}
+
+func (s *Session) add(chnl string, msg channel.Msg) uint32 {
+	s.seq++
+	if s.seq == 0 {
+		s.seq++
+	}
+
+	if channel.IsEphemeral(msg) {
+		return s.seq
+	}
+
+	s.log = append(s.log, sent{s.seq, chnl, msg})
+	if len(s.log) > s.max {
+		n := len(s.log) - s.max
+		s.evicted = s.log[n-1].seq
+		copy(s.log, s.log[n:])
+		for i := len(s.log) - n; i < len(s.log); i++ {
+			s.log[i] = sent{}
+		}
+		s.log = s.log[:len(s.log)-n]
+	}
+
+	return s.seq
+}
@@ -0,0 +1,339 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/client"
+	"github.com/frizinak/homechat/client/handler"
+	"github.com/frizinak/homechat/crypto"
+	"github.com/frizinak/homechat/server"
+	"github.com/frizinak/homechat/server/channel"
+	chatpkg "github.com/frizinak/homechat/server/channel/chat"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/server/internal/servertest"
+	"github.com/frizinak/homechat/ui"
+	"github.com/frizinak/homechat/vars"
+)
+
+// listener connects clients to the server over loopback tcp, over TLS if
+// tls is set.
+type listener struct {
+	addr string
+	tls  *tls.Config
+}
+
+func (l listener) Connect() (client.Conn, error) {
+	if l.tls != nil {
+		return tls.Dial("tcp", l.addr, l.tls)
+	}
+	return net.Dial("tcp", l.addr)
+}
+
+func (l listener) Framed() bool { return false }
+func (l listener) TLS() bool    { return l.tls != nil }
+
+// listen serves s on a loopback address until the test ends, over TLS if
+// secure is set.
+func listen(t *testing.T, s *server.Server, secure bool) listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var clientConf *tls.Config
+	if secure {
+		var serverConf *tls.Config
+		clientConf, serverConf = servertest.TLSConfigs(t)
+		l = tls.NewListener(l, serverConf)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeTCP(s, conn)
+		}
+	}()
+	return listener{l.Addr().String(), clientConf}
+}
+
+type peer struct {
+	s      *server.Server
+	l      listener
+	key    *crypto.Key
+	server string
+
+	sem   sync.Mutex
+	posts []string
+}
+
+// newPeer returns a server with a key that allows alice to connect.
+func newPeer(t *testing.T) (*peer, *crypto.Key) { return newSecurePeer(t, false) }
+
+// newSecurePeer is newPeer, over TLS if secure is set.
+func newSecurePeer(t *testing.T, secure bool) (*peer, *crypto.Key) {
+	serverKey, alice := crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	p := &peer{key: serverKey, server: fingerprint(t, serverKey)}
+	var chat *chatpkg.ChatChannel
+	p.s, chat = servertest.New(t, server.Config{
+		Key:          serverKey,
+		PolicyLoader: servertest.Policies{fingerprint(t, alice): "alice"},
+	})
+	chat.OnMessage(func(cl channel.Client, m chatdata.ServerMessage) {
+		p.sem.Lock()
+		p.posts = append(p.posts, m.Data)
+		p.sem.Unlock()
+	})
+	p.l = listen(t, p.s, secure)
+	return p, alice
+}
+
+// chat returns the messages that were posted in chat.
+func (p *peer) chat() []string {
+	p.sem.Lock()
+	defer p.sem.Unlock()
+	return append([]string{}, p.posts...)
+}
+
+func fingerprint(t *testing.T, k *crypto.Key) string {
+	pub, err := k.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub.FingerprintString()
+}
+
+// client returns a client for key, it isn't running yet.
+func (p *peer) client(key *crypto.Key, o *client.Outbox) *client.Client {
+	return client.New(p.l, handler.NoopHandler{}, ui.Plain(ioutil.Discard), client.Config{
+		Key:               key,
+		ServerFingerprint: p.server,
+		Name:              "alice",
+		Channels:          []string{vars.ChatChannel},
+		Proto:             channel.ProtoBinary,
+		Outbox:            o,
+	})
+}
+
+// run runs cl until the test ends.
+func run(t *testing.T, cl *client.Client) {
+	done := make(chan struct{})
+	go func() {
+		cl.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cl.Close()
+		<-done
+	})
+}
+
+func (p *peer) connect(t *testing.T, key *crypto.Key) *client.Client {
+	cl := p.client(key, nil)
+	run(t, cl)
+	return cl
+}
+
+func TestRequestReplies(t *testing.T) {
+	p, alice := newPeer(t)
+	cl := p.connect(t, alice)
+
+	if err := cl.Send(vars.ChatChannel, chatdata.Message{Data: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := chatdata.Message{Data: "not private", Sealed: &chatdata.Sealed{}}
+	err := cl.Send(vars.ChatChannel, invalid)
+	var rerr *client.RequestError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected a request error, got %v", err)
+	}
+	if rerr.Channel != vars.ChatChannel || rerr.Code != channel.StatusNOK || !strings.Contains(rerr.Err, "sealed") {
+		t.Fatalf("unexpected request error %+v", rerr)
+	}
+
+	// the connection survives failed requests and each request gets its
+	// own reply.
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := chatdata.Message{Data: fmt.Sprint(i)}
+			if i%2 == 1 {
+				m = invalid
+			}
+			errs[i] = cl.Send(vars.ChatChannel, m)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if failed := errors.As(err, &rerr); failed != (i%2 == 1) {
+			t.Errorf("request %d: unexpected reply %v", i, err)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	p, alice := newPeer(t)
+	dir := t.TempDir()
+
+	o, err := client.NewOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := p.client(alice, o)
+	var sent []client.OutboxEntry
+	for _, d := range []string{"one", "two", "three"} {
+		e, err := offline.QueueChat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, e)
+	}
+
+	// two was delivered before the client went down but its
+	// acknowledgement was lost.
+	cl := p.connect(t, alice)
+	two := chatdata.Message{Data: "two", ID: sent[1].MessageID}
+	if err := cl.Send(vars.ChatChannel, two); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client restarts and sends its outbox.
+	o, err = client.NewOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, p.client(alice, o))
+	for i := 0; len(o.Pending()) != 0; i++ {
+		if i == 500 {
+			t.Fatalf("outbox not sent: %+v", o.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, exp := p.chat(), []string{"two", "one", "three"}; strings.Join(got, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestTLSBind(t *testing.T) {
+	p, alice := newSecurePeer(t, true)
+	cl := p.connect(t, alice)
+	if err := cl.Send(vars.ChatChannel, chatdata.Message{Data: "bound"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a challenge that isn't bound to the session is refused.
+	conn, err := p.l.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	proto := channel.ProtoBinary | channel.ProtoTLS | channel.ProtoMux | channel.ProtoExt
+	if err := proto.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(net.Conn).SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("server did not refuse an unbound challenge: %d %v", n, err)
+	}
+}
+
+// rotations records the key rotations a client followed.
+type rotations struct {
+	handler.NoopHandler
+	sem  sync.Mutex
+	list []string
+}
+
+func (r *rotations) HandleKeyRotation(from, to string) {
+	r.sem.Lock()
+	r.list = append(r.list, from+">"+to)
+	r.sem.Unlock()
+}
+
+func (r *rotations) get() []string {
+	r.sem.Lock()
+	defer r.sem.Unlock()
+	return append([]string{}, r.list...)
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, next, alice := crypto.NewEd25519Key(), crypto.NewEd25519Key(), crypto.NewEd25519Key()
+	nextPub, err := next.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFP, nextFP := fingerprint(t, old), fingerprint(t, next)
+
+	serve := func(key *crypto.Key, rotation channel.KeyRotationMessage) listener {
+		s, _ := servertest.New(t, server.Config{
+			Key:          key,
+			KeyRotation:  rotation,
+			PolicyLoader: servertest.Policies{fingerprint(t, alice): "alice"},
+		})
+		return listen(t, s, false)
+	}
+	connect := func(l listener, trusted string, h client.Handler) *client.Client {
+		cl := client.New(l, h, ui.Plain(ioutil.Discard), client.Config{
+			Key:               alice,
+			ServerFingerprint: trusted,
+			Name:              "alice",
+			Channels:          []string{vars.ChatChannel},
+			Proto:             channel.ProtoBinary,
+		})
+		run(t, cl)
+		return cl
+	}
+
+	valid, err := channel.NewKeyRotationMessage(old, nextPub, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := channel.NewKeyRotationMessage(old, nextPub, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client that trusts the old key follows the announcement.
+	r := &rotations{}
+	cl := connect(serve(next, valid), oldFP, r)
+	for _, d := range []string{"one", "two"} {
+		if err := cl.Send(vars.ChatChannel, chatdata.Message{Data: d}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := r.get(); len(got) != 1 || got[0] != oldFP+">"+nextFP {
+		t.Fatalf("unexpected rotations %q", got)
+	}
+	if fp := cl.ServerFingerprint(); fp != nextFP {
+		t.Fatalf("expected to talk to %s, got %s", nextFP, fp)
+	}
+
+	// once rotated, a server still using the old key is refused.
+	cl = connect(serve(old, channel.KeyRotationMessage{}), nextFP, handler.NoopHandler{})
+	if err := cl.Send(vars.ChatChannel, chatdata.Message{Data: "stale"}); !errors.Is(err, client.ErrFingerPrint) {
+		t.Fatalf("expected %v for the old key, got %v", client.ErrFingerPrint, err)
+	}
+
+	// as is the new key once its announcement expired.
+	cl = connect(serve(next, expired), oldFP, handler.NoopHandler{})
+	if err := cl.Send(vars.ChatChannel, chatdata.Message{Data: "late"}); !errors.Is(err, client.ErrFingerPrint) {
+		t.Fatalf("expected %v for an expired rotation, got %v", client.ErrFingerPrint, err)
+	}
+}
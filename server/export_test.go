@@ -0,0 +1,12 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// HTTPHandler returns the handler the HTTP server routes requests with.
+func HTTPHandler(s *Server) http.Handler { return s.http.Handler }
+
+// ServeTCP serves conn as a connection accepted by the tcp listener.
+func ServeTCP(s *Server, conn net.Conn) { s.onTCP(conn) }
@@ -0,0 +1,101 @@
+// Package servertest builds servers for tests of the server and its
+// gateways.
+package servertest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server"
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/chat"
+	"github.com/frizinak/homechat/server/channel/history"
+	"github.com/frizinak/homechat/server/channel/ping"
+	"github.com/frizinak/homechat/server/channel/users"
+	"github.com/frizinak/homechat/vars"
+)
+
+// Policies allows the fingerprints it maps to names.
+type Policies map[string]string
+
+func (p Policies) Policy() server.ClientPolicy      { return server.PolicyAllow }
+func (p Policies) Exists(fp string) (string, error) { return p[fp], nil }
+
+// Tokens maps API tokens to fingerprints.
+type Tokens map[string]string
+
+func (t Tokens) Fingerprint(token string) (string, error) { return t[token], nil }
+
+type noUserUpdates struct{}
+
+func (noUserUpdates) UserUpdate(channel.Client, channel.ConnectionReason) error { return nil }
+
+// New creates a server from c with the chat, history, users and ping
+// channels. The protocol version, log and RWFactory are filled in when empty.
+func New(t testing.TB, c server.Config) (*server.Server, *chat.ChatChannel) {
+	t.Helper()
+	if c.ProtocolVersion == "" {
+		c.ProtocolVersion = vars.ProtocolVersion
+	}
+	if c.Log == nil {
+		c.Log = log.New(ioutil.Discard, "", 0)
+	}
+	if c.RWFactory == nil {
+		c.RWFactory = channel.NewRWFactory(nil)
+	}
+
+	s, err := server.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := &chat.ChatChannel{}
+	hist, err := history.New(c.Log, 100, "", ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*ch = *chat.New(c.Log, hist)
+	s.MustAddChannel(vars.ChatChannel, ch)
+	s.MustAddChannel(vars.HistoryChannel, hist)
+	s.MustAddChannel(vars.UserChannel, users.New([]string{vars.ChatChannel}, s))
+	s.MustAddChannel(vars.PingChannel, ping.New())
+	s.MustSetUserUpdateHandler(noUserUpdates{})
+	return s, ch
+}
+
+// TLSConfigs returns a server config with a self-signed certificate for
+// homechat.test and a client config that trusts it.
+func TLSConfigs(t testing.TB) (client, server *tls.Config) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"homechat.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "homechat.test"}
+	return
+}
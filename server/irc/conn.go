@@ -0,0 +1,699 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/frizinak/homechat/server"
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	usersdata "github.com/frizinak/homechat/server/channel/users/data"
+	"github.com/frizinak/homechat/server/client"
+	"github.com/frizinak/homechat/vars"
+)
+
+const (
+	maxLine      = 8192
+	maxText      = 400
+	maxEchoes    = 32
+	pingInterval = time.Second * 90
+	readTimeout  = pingInterval * 2
+	loginTimeout = time.Second * 30
+)
+
+var errQuit = errors.New("quit")
+
+type message struct {
+	cmd    string
+	params []string
+}
+
+func parse(line string) message {
+	var m message
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		line = after(line)
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		line = after(line)
+	}
+
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if line[0] == ':' && m.cmd != "" {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		p := strings.SplitN(line, " ", 2)
+		if m.cmd == "" {
+			m.cmd = strings.ToUpper(p[0])
+		} else {
+			m.params = append(m.params, p[0])
+		}
+		line = ""
+		if len(p) == 2 {
+			line = p[1]
+		}
+	}
+	return m
+}
+
+// after returns what follows the first word of line, nothing if line is a
+// single word.
+func after(line string) string {
+	if i := strings.IndexByte(line, ' '); i != -1 {
+		return line[i+1:]
+	}
+	return ""
+}
+
+// echo is a message this connection posted, it is not relayed back when the
+// server broadcasts it to us.
+type echo struct{ pm, data string }
+
+type conn struct {
+	g *Gateway
+	c net.Conn
+
+	wsem sync.Mutex
+	w    *bufio.Writer
+
+	nick, user, pass string
+	capping          bool
+	sasl             bool
+
+	name, fp string
+
+	cl     *client.Client
+	detach func()
+
+	sem    sync.Mutex
+	users  map[string]struct{}
+	echoes []echo
+}
+
+func newConn(g *Gateway, c net.Conn) *conn {
+	return &conn{g: g, c: c, w: bufio.NewWriter(c), nick: "*"}
+}
+
+func (c *conn) run() error {
+	defer c.c.Close()
+	defer func() {
+		if c.detach != nil {
+			c.detach()
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	scan := bufio.NewScanner(c.c)
+	scan.Buffer(make([]byte, 512), maxLine)
+	c.c.SetReadDeadline(time.Now().Add(loginTimeout))
+	for scan.Scan() {
+		m := parse(scan.Text())
+		if m.cmd == "" {
+			continue
+		}
+
+		registered := c.cl != nil
+		err := c.handle(m)
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !registered && c.cl != nil {
+			go c.keepalive(done)
+		}
+		if c.cl != nil {
+			c.c.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+	}
+
+	return scan.Err()
+}
+
+// keepalive pings the client and closes the connection once the server
+// kills its client.
+func (c *conn) keepalive(done <-chan struct{}) {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.cl.Killed():
+			c.send("", "ERROR", "Closing link: killed by the server")
+			c.c.Close()
+			return
+		case <-ping.C:
+			c.send("", "PING", serverName)
+		}
+	}
+}
+
+func (c *conn) send(prefix, cmd string, params ...string) error {
+	b := make([]byte, 0, 128)
+	if prefix != "" {
+		b = append(b, ':')
+		b = append(b, prefix...)
+		b = append(b, ' ')
+	}
+	b = append(b, cmd...)
+	for i, p := range params {
+		b = append(b, ' ')
+		if i == len(params)-1 && (p == "" || p[0] == ':' || strings.IndexByte(p, ' ') != -1) {
+			b = append(b, ':')
+		}
+		b = append(b, p...)
+	}
+	b = append(b, '\r', '\n')
+
+	c.wsem.Lock()
+	defer c.wsem.Unlock()
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *conn) reply(code string, params ...string) error {
+	return c.send(serverName, code, append([]string{c.nick}, params...)...)
+}
+
+func hostmask(name string) string {
+	return fmt.Sprintf("%s!%s@%s", name, name, serverName)
+}
+
+func (c *conn) handle(m message) error {
+	need := func(n int) bool {
+		if len(m.params) >= n {
+			return true
+		}
+		c.reply("461", m.cmd, "Not enough parameters")
+		return false
+	}
+
+	switch m.cmd {
+	case "CAP":
+		return c.handleCAP(m)
+	case "AUTHENTICATE":
+		if !need(1) {
+			return nil
+		}
+		return c.handleSASL(m.params[0])
+	case "PASS":
+		if c.cl != nil {
+			return c.reply("462", "You may not reregister")
+		}
+		if need(1) {
+			c.pass = m.params[0]
+		}
+		return nil
+	case "NICK":
+		if !need(1) {
+			return nil
+		}
+		if c.cl != nil {
+			if m.params[0] != c.name {
+				return c.reply("432", m.params[0], "Your nick is the name of your policy entry")
+			}
+			return nil
+		}
+		c.nick = m.params[0]
+		return c.register()
+	case "USER":
+		if c.cl != nil {
+			return c.reply("462", "You may not reregister")
+		}
+		if need(4) {
+			c.user = m.params[0]
+		}
+		return c.register()
+	case "PING":
+		token := serverName
+		if len(m.params) != 0 {
+			token = m.params[0]
+		}
+		return c.send(serverName, "PONG", serverName, token)
+	case "PONG":
+		return nil
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return errQuit
+	}
+
+	if c.cl == nil {
+		return c.reply("451", "You have not registered")
+	}
+
+	switch m.cmd {
+	case "PRIVMSG":
+		if !need(2) {
+			return nil
+		}
+		return c.privmsg(m.params[0], m.params[1])
+	case "NOTICE":
+	case "JOIN":
+		if !need(1) {
+			return nil
+		}
+		for _, ch := range strings.Split(m.params[0], ",") {
+			if !c.ours(ch) {
+				c.reply("403", ch, "No such channel")
+			}
+		}
+	case "PART":
+		if !need(1) {
+			return nil
+		}
+		for _, ch := range strings.Split(m.params[0], ",") {
+			if c.ours(ch) {
+				c.reply("442", ch, "You can't leave the chat, disconnect instead")
+				continue
+			}
+			c.reply("403", ch, "No such channel")
+		}
+	case "NAMES":
+		return c.names()
+	case "WHO":
+		if len(m.params) != 0 && c.ours(m.params[0]) {
+			for _, n := range c.nicks() {
+				c.reply("352", c.g.c.Channel, n, serverName, serverName, n, "H", "0 "+n)
+			}
+		}
+		mask := "*"
+		if len(m.params) != 0 {
+			mask = m.params[0]
+		}
+		return c.reply("315", mask, "End of WHO list")
+	case "WHOIS":
+		if !need(1) {
+			return nil
+		}
+		n := m.params[len(m.params)-1]
+		if c.online(n) {
+			c.reply("311", n, n, serverName, "*", n)
+			c.reply("319", n, c.g.c.Channel)
+		} else {
+			c.reply("401", n, "No such nick")
+		}
+		return c.reply("318", n, "End of WHOIS list")
+	case "ISON":
+		on := make([]string, 0, len(m.params))
+		for _, p := range m.params {
+			for _, n := range strings.Fields(p) {
+				if c.online(n) {
+					on = append(on, n)
+				}
+			}
+		}
+		return c.reply("303", strings.Join(on, " "))
+	case "MODE":
+		if !need(1) {
+			return nil
+		}
+		switch {
+		case c.ours(m.params[0]) && len(m.params) > 1 && strings.Trim(m.params[1], "+-") == "b":
+			return c.reply("368", c.g.c.Channel, "End of channel ban list")
+		case c.ours(m.params[0]):
+			return c.reply("324", c.g.c.Channel, "+nt")
+		case m.params[0] == c.name:
+			return c.reply("221", "+i")
+		}
+		return c.reply("403", m.params[0], "No such channel")
+	case "TOPIC":
+		if !need(1) {
+			return nil
+		}
+		if len(m.params) > 1 {
+			return c.reply("482", m.params[0], "The topic can't be changed")
+		}
+		return c.reply("331", m.params[0], "No topic is set")
+	case "LIST":
+		c.reply("322", c.g.c.Channel, fmt.Sprint(len(c.nicks())), "homechat")
+		return c.reply("323", "End of LIST")
+	case "AWAY", "USERHOST":
+	default:
+		return c.reply("421", m.cmd, "Unknown command")
+	}
+
+	return nil
+}
+
+func (c *conn) ours(ch string) bool {
+	return strings.EqualFold(ch, c.g.c.Channel)
+}
+
+func (c *conn) handleCAP(m message) error {
+	if len(m.params) == 0 {
+		return c.reply("461", m.cmd, "Not enough parameters")
+	}
+	switch strings.ToUpper(m.params[0]) {
+	case "LS":
+		if c.cl == nil {
+			c.capping = true
+		}
+		return c.send(serverName, "CAP", c.nick, "LS", "sasl=PLAIN")
+	case "LIST":
+		return c.send(serverName, "CAP", c.nick, "LIST", "")
+	case "REQ":
+		if c.cl == nil {
+			c.capping = true
+		}
+		req := ""
+		if len(m.params) > 1 {
+			req = strings.TrimSpace(m.params[1])
+		}
+		if req == "sasl" {
+			return c.send(serverName, "CAP", c.nick, "ACK", req)
+		}
+		return c.send(serverName, "CAP", c.nick, "NAK", req)
+	case "END":
+		c.capping = false
+		return c.register()
+	}
+	return c.reply("410", m.params[0], "Invalid CAP command")
+}
+
+// handleSASL implements the PLAIN mechanism with an API token as password,
+// the authorization and authentication identities are ignored.
+func (c *conn) handleSASL(arg string) error {
+	if c.cl != nil || c.name != "" {
+		return c.reply("907", "You have already authenticated")
+	}
+	if !c.sasl {
+		if strings.ToUpper(arg) != "PLAIN" {
+			return c.reply("908", "PLAIN", "are available SASL mechanisms")
+		}
+		c.sasl = true
+		return c.send("", "AUTHENTICATE", "+")
+	}
+
+	c.sasl = false
+	if arg == "*" {
+		return c.reply("906", "SASL authentication aborted")
+	}
+	raw, err := base64.StdEncoding.DecodeString(arg)
+	p := bytes.SplitN(raw, []byte{0}, 3)
+	if err != nil || len(p) != 3 {
+		return c.reply("904", "SASL authentication failed")
+	}
+	if err := c.login(string(p[2])); err != nil {
+		return c.reply("904", "SASL authentication failed")
+	}
+	c.reply("900", hostmask(c.name), c.name, "You are now logged in as "+c.name)
+	return c.reply("903", "SASL authentication successful")
+}
+
+func (c *conn) login(token string) error {
+	name, fp, err := c.g.c.Server.TokenUser(token)
+	if err != nil {
+		if err != server.ErrToken {
+			c.g.c.Log.Printf("irc login err: %s", err)
+		}
+		return err
+	}
+	c.name, c.fp = name, fp
+	return nil
+}
+
+func (c *conn) register() error {
+	if c.cl != nil || c.nick == "*" || c.user == "" || c.capping {
+		return nil
+	}
+
+	if c.name == "" {
+		if err := c.login(c.pass); err != nil {
+			c.reply("464", "Password incorrect, pass an API token with SASL PLAIN or PASS")
+			c.send("", "ERROR", "Closing link: authentication failed")
+			return errQuit
+		}
+	}
+	c.pass = ""
+
+	nicks := c.nicks()
+	c.sem.Lock()
+	c.users = make(map[string]struct{}, len(nicks))
+	for _, n := range nicks {
+		c.users[n] = struct{}{}
+	}
+	c.sem.Unlock()
+
+	if c.nick != c.name {
+		c.send(hostmask(c.nick), "NICK", c.name)
+		c.nick = c.name
+	}
+
+	cl, detach, err := c.g.c.Server.Local(
+		c.name,
+		c.fp,
+		[]string{vars.ChatChannel, vars.UserChannel},
+		&writer{c: c},
+	)
+	if err != nil {
+		c.send("", "ERROR", "Closing link: "+err.Error())
+		return err
+	}
+	c.cl, c.detach = cl, detach
+
+	c.reply("001", "Welcome to homechat, "+c.name)
+	c.reply("002", "Your host is "+serverName)
+	c.reply("003", "This server bridges homechat")
+	c.reply("004", serverName, vars.ProtocolVersion, "i", "nt")
+	c.reply(
+		"005",
+		"CHANTYPES=#",
+		"PREFIX=()",
+		"NETWORK=homechat",
+		"CASEMAPPING=ascii",
+		"are supported by this server",
+	)
+	c.reply("422", "MOTD File is missing")
+
+	c.send(hostmask(c.name), "JOIN", c.g.c.Channel)
+	c.reply("331", c.g.c.Channel, "No topic is set")
+	return c.names()
+}
+
+func (c *conn) nicks() []string {
+	users := c.g.c.Server.GetUsers(vars.ChatChannel)
+	l := make([]string, 0, len(users))
+	for _, u := range users {
+		l = append(l, u.Name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func (c *conn) online(nick string) bool {
+	for _, n := range c.nicks() {
+		if n == nick {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) names() error {
+	nicks := c.nicks()
+	line := make([]string, 0, 16)
+	size := 0
+	for i, n := range nicks {
+		line = append(line, n)
+		size += len(n) + 1
+		if size > maxText || i == len(nicks)-1 {
+			c.reply("353", "=", c.g.c.Channel, strings.Join(line, " "))
+			line, size = line[:0], 0
+		}
+	}
+	return c.reply("366", c.g.c.Channel, "End of NAMES list")
+}
+
+// privmsg posts an IRC message into chat. Bot commands can be sent as
+// !command as IRC clients handle /command themselves, which leaves !! to
+// shout.
+func (c *conn) privmsg(target, text string) error {
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "_" + strings.TrimSuffix(text[8:], "\x01") + "_"
+	} else if strings.HasPrefix(text, "\x01") {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(text, "!!"):
+		text = text[1:]
+	case strings.HasPrefix(text, "!"):
+		text = "/" + text[1:]
+	}
+
+	e := echo{data: text}
+	switch {
+	case c.ours(target):
+		// shouts are broadcast without their !.
+		e.data = strings.TrimPrefix(text, "!")
+	case isChannel(target):
+		return c.reply("403", target, "No such channel")
+	default:
+		e.pm = target
+		text = fmt.Sprintf("@%s %s", target, text)
+	}
+	if text == "" {
+		return c.reply("412", "No text to send")
+	}
+
+	c.sem.Lock()
+	c.echoes = append(c.echoes, e)
+	if len(c.echoes) > maxEchoes {
+		c.echoes = c.echoes[1:]
+	}
+	c.sem.Unlock()
+
+	if err := c.g.c.Chat.Handle(c.cl, chatdata.Message{Data: text}); err != nil {
+		return c.send(serverName, "NOTICE", c.name, err.Error())
+	}
+	return nil
+}
+
+// own reports whether m is the broadcast of a message this connection posted.
+func (c *conn) own(m chatdata.ServerMessage) bool {
+	if m.From != c.name || m.Bot {
+		return false
+	}
+	c.sem.Lock()
+	defer c.sem.Unlock()
+	for i, e := range c.echoes {
+		if e.pm == m.PM && e.data == m.Data {
+			c.echoes = append(c.echoes[:i], c.echoes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) chat(m chatdata.ServerMessage) error {
+	if c.own(m) {
+		return nil
+	}
+
+	text := m.Data
+	if m.Sealed != nil {
+		text = "[end-to-end encrypted message, use a homechat client to read it]"
+	}
+	if m.Shout {
+		text = "\x02" + text + "\x02"
+	}
+
+	// PMs to us and those our other clients sent both target m.PM.
+	target := c.g.c.Channel
+	if m.PM != "" {
+		target = m.PM
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		for line != "" {
+			chunk := line
+			if len(chunk) > maxText {
+				n := maxText
+				for n > 0 && !utf8.RuneStart(chunk[n]) {
+					n--
+				}
+				chunk = chunk[:n]
+			}
+			line = line[len(chunk):]
+			if err := c.send(hostmask(m.From), "PRIVMSG", target, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// userList turns changes in the list of users of the chat channel into JOINs
+// and PARTs.
+func (c *conn) userList(m usersdata.ServerMessage) error {
+	if m.Channel != vars.ChatChannel {
+		return nil
+	}
+
+	now := make(map[string]struct{}, len(m.Users))
+	for _, u := range m.Users {
+		now[u.Name] = struct{}{}
+	}
+
+	c.sem.Lock()
+	prev := c.users
+	c.users = now
+	c.sem.Unlock()
+
+	for n := range now {
+		if _, ok := prev[n]; !ok && n != c.name {
+			if err := c.send(hostmask(n), "JOIN", c.g.c.Channel); err != nil {
+				return err
+			}
+		}
+	}
+	for n := range prev {
+		if _, ok := now[n]; !ok && n != c.name {
+			if err := c.send(hostmask(n), "PART", c.g.c.Channel, "disconnected"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writer receives the messages of the homechat client of a connection in the
+// JSON proto, one channel header and message per flush.
+type writer struct {
+	c   *conn
+	buf bytes.Buffer
+}
+
+func (w *writer) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+func (w *writer) Flush() error {
+	defer w.buf.Reset()
+	p := bytes.SplitN(bytes.TrimSpace(w.buf.Bytes()), []byte{'\n'}, 2)
+	if len(p) != 2 {
+		return nil
+	}
+
+	var h channel.ChannelMsg
+	if err := json.Unmarshal(p[0], &h); err != nil {
+		return err
+	}
+
+	switch h.Data {
+	case vars.ChatChannel:
+		m, _, err := chatdata.JSONServerMessage(bytes.NewReader(p[1]))
+		if err != nil {
+			return err
+		}
+		return w.c.chat(m)
+	case vars.UserChannel:
+		m, _, err := usersdata.JSONServerMessage(bytes.NewReader(p[1]))
+		if err != nil {
+			return err
+		}
+		return w.c.userList(m)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package irc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/server/internal/servertest"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		exp  message
+	}{
+		{"", message{}},
+		{"\r\n", message{}},
+		{"ping", message{"PING", nil}},
+		{"PING x\r\n", message{"PING", []string{"x"}}},
+		{"NICK  alice ", message{"NICK", []string{"alice"}}},
+		{"USER a 0 * :Alice Smith", message{"USER", []string{"a", "0", "*", "Alice Smith"}}},
+		{"PRIVMSG #homechat :", message{"PRIVMSG", []string{"#homechat", ""}}},
+		{"PRIVMSG #homechat ::) hi", message{"PRIVMSG", []string{"#homechat", ":) hi"}}},
+		{"PRIVMSG bob :a  b : c", message{"PRIVMSG", []string{"bob", "a  b : c"}}},
+		{":alice!a@host PRIVMSG bob hi", message{"PRIVMSG", []string{"bob", "hi"}}},
+		{"@time=2021-01-01T00:00:00Z :alice PING x", message{"PING", []string{"x"}}},
+		{"@tag PONG :x y", message{"PONG", []string{"x y"}}},
+		{":prefix-only", message{}},
+		{":cmd", message{}},
+		{"@tags-only", message{}},
+		{"@tags :prefix", message{}},
+		{"CAP REQ :sasl multi-prefix", message{"CAP", []string{"REQ", "sasl multi-prefix"}}},
+	}
+
+	for _, test := range tests {
+		if m := parse(test.line); !reflect.DeepEqual(m, test.exp) {
+			t.Errorf("%q: expected %+v, got %+v", test.line, test.exp, m)
+		}
+	}
+}
+
+func gateway(t *testing.T) *Gateway {
+	s, chat := servertest.New(t, server.Config{
+		PolicyLoader: servertest.Policies{"fp-alice": "alice", "fp-bob": "bob"},
+		TokenLoader:  servertest.Tokens{"tok-alice": "fp-alice", "tok-bob": "fp-bob"},
+	})
+	g, err := New(Config{Log: log.New(ioutil.Discard, "", 0), Channel: "#homechat", Server: s, Chat: chat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// ircClient is the client end of a connection to the gateway.
+type ircClient struct {
+	t    *testing.T
+	c    net.Conn
+	r    *bufio.Reader
+	done chan error
+}
+
+func dial(t *testing.T, g *Gateway) *ircClient {
+	a, b := net.Pipe()
+	c := &ircClient{t: t, c: a, r: bufio.NewReader(a), done: make(chan error, 1)}
+	go func() { c.done <- newConn(g, b).run() }()
+	t.Cleanup(func() { a.Close() })
+	return c
+}
+
+func (c *ircClient) send(line string) {
+	c.t.Helper()
+	c.c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.c.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *ircClient) read() (string, message) {
+	c.t.Helper()
+	c.c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	l, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	l = strings.TrimRight(l, "\r\n")
+	return l, parse(l)
+}
+
+// expect reads lines until one with the given command and returns its
+// prefix and params.
+func (c *ircClient) expect(cmd string) (string, []string) {
+	c.t.Helper()
+	for {
+		l, m := c.read()
+		if m.cmd != cmd {
+			continue
+		}
+		prefix := ""
+		if strings.HasPrefix(l, ":") {
+			prefix = strings.SplitN(l[1:], " ", 2)[0]
+		}
+		return prefix, m.params
+	}
+}
+
+func (c *ircClient) login(token string) {
+	c.t.Helper()
+	c.send("PASS " + token)
+	c.send("NICK someone")
+	c.send("USER someone 0 * :Some One")
+	c.expect("366")
+}
+
+func TestLoginPass(t *testing.T) {
+	c := dial(t, gateway(t))
+	c.send("NICK someone")
+	c.send("JOIN #homechat")
+	c.expect("451")
+	c.send("PASS tok-alice")
+	c.send("USER someone 0 * :Some One")
+
+	// the nick is the name of the policy entry.
+	if prefix, p := c.expect("NICK"); prefix != hostmask("someone") || p[0] != "alice" {
+		t.Fatalf("unexpected nick change: %s %q", prefix, p)
+	}
+	if _, p := c.expect("001"); p[0] != "alice" {
+		t.Fatalf("unexpected welcome: %q", p)
+	}
+	if prefix, p := c.expect("JOIN"); prefix != hostmask("alice") || p[0] != "#homechat" {
+		t.Fatalf("unexpected join: %s %q", prefix, p)
+	}
+	if _, p := c.expect("353"); p[len(p)-1] != "alice" {
+		t.Fatalf("unexpected names: %q", p)
+	}
+	c.expect("366")
+
+	c.send("PASS tok-bob")
+	c.expect("462")
+	c.send("NICK bob")
+	c.expect("432")
+}
+
+func TestLoginSASL(t *testing.T) {
+	c := dial(t, gateway(t))
+	c.send("CAP LS 302")
+	if _, p := c.expect("CAP"); !reflect.DeepEqual(p, []string{"*", "LS", "sasl=PLAIN"}) {
+		t.Fatalf("unexpected caps: %q", p)
+	}
+	c.send("NICK bob")
+	c.send("USER bob 0 * :Bob")
+	c.send("CAP REQ :multi-prefix")
+	if _, p := c.expect("CAP"); p[1] != "NAK" {
+		t.Fatalf("unexpected cap reply: %q", p)
+	}
+	c.send("CAP REQ :sasl")
+	if _, p := c.expect("CAP"); p[1] != "ACK" || p[2] != "sasl" {
+		t.Fatalf("unexpected cap reply: %q", p)
+	}
+
+	c.send("AUTHENTICATE SCRAM-SHA-256")
+	c.expect("908")
+	c.send("AUTHENTICATE PLAIN")
+	if _, p := c.expect("AUTHENTICATE"); p[0] != "+" {
+		t.Fatalf("unexpected challenge: %q", p)
+	}
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00bob\x00nope")))
+	c.expect("904")
+
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("AUTHENTICATE")
+	c.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("bob\x00bob\x00tok-bob")))
+	if _, p := c.expect("900"); p[2] != "bob" {
+		t.Fatalf("unexpected login: %q", p)
+	}
+	c.expect("903")
+	c.send("AUTHENTICATE PLAIN")
+	c.expect("907")
+
+	// registration waits for the end of capability negotiation.
+	c.send("CAP END")
+	if _, p := c.expect("001"); p[0] != "bob" {
+		t.Fatalf("unexpected welcome: %q", p)
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	c := dial(t, gateway(t))
+	c.send("PASS nope")
+	c.send("NICK alice")
+	c.send("USER alice 0 * :Alice")
+	c.expect("464")
+	c.expect("ERROR")
+	select {
+	case err := <-c.done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestPrivmsg(t *testing.T) {
+	g := gateway(t)
+	alice, bob := dial(t, g), dial(t, g)
+	alice.login("tok-alice")
+	bob.login("tok-bob")
+
+	tests := []struct {
+		send   string
+		from   string
+		params []string
+	}{
+		{"PRIVMSG #homechat :hello", "alice", []string{"#homechat", "hello"}},
+		{"PRIVMSG #HOMECHAT :case", "alice", []string{"#homechat", "case"}},
+		{"PRIVMSG #homechat :\x01ACTION waves\x01", "alice", []string{"#homechat", "_waves_"}},
+		{"PRIVMSG #homechat :!!loud", "alice", []string{"#homechat", "\x02loud\x02"}},
+		{"PRIVMSG bob :just you", "alice", []string{"bob", "just you"}},
+		{"PRIVMSG bob :!!not loud", "alice", []string{"bob", "!not loud"}},
+	}
+
+	for _, test := range tests {
+		alice.send(test.send)
+		prefix, p := bob.expect("PRIVMSG")
+		if prefix != hostmask(test.from) || !reflect.DeepEqual(p, test.params) {
+			t.Errorf("%q: unexpected message %s %q", test.send, prefix, p)
+		}
+
+		// alice doesn't receive her own message, bob's reply is the first
+		// message she receives.
+		bob.send("PRIVMSG #homechat :reply")
+		if prefix, p := alice.expect("PRIVMSG"); prefix != hostmask("bob") || p[1] != "reply" {
+			t.Errorf("%q: alice received %s %q", test.send, prefix, p)
+		}
+	}
+
+	// ! invokes a bot, the server bot replies to unknown commands.
+	alice.send("PRIVMSG #homechat :!nosuchbot")
+	if prefix, p := bob.expect("PRIVMSG"); prefix != hostmask("alice") || p[1] != "/nosuchbot" {
+		t.Errorf("unexpected bot command %s %q", prefix, p)
+	}
+	for _, c := range []*ircClient{alice, bob} {
+		if prefix, _ := c.expect("PRIVMSG"); prefix != hostmask("server-bot") {
+			t.Errorf("expected a reply of the server bot, got one from %s", prefix)
+		}
+	}
+
+	alice.send("PRIVMSG #elsewhere :hi")
+	alice.expect("403")
+	alice.send("PRIVMSG #homechat :\x01VERSION\x01")
+	alice.send("PRIVMSG #homechat :")
+	alice.expect("412")
+}
+
+func TestChatLines(t *testing.T) {
+	g, err := New(Config{Channel: "#homechat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	c := newConn(g, b)
+	c.name = "alice"
+
+	long := "x" + strings.Repeat("é", 300)
+	tests := []struct {
+		m   chatdata.ServerMessage
+		exp []string
+	}{
+		{
+			chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Data: "one\r\ntwo\n\nthree"}},
+			[]string{":%s PRIVMSG #homechat one", ":%s PRIVMSG #homechat two", ":%s PRIVMSG #homechat three"},
+		},
+		{
+			chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Data: long}},
+			// utf-8 sequences are not split.
+			[]string{":%s PRIVMSG #homechat " + long[:399], ":%s PRIVMSG #homechat " + long[399:]},
+		},
+		{
+			chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Data: "psst"}, PM: "alice"},
+			[]string{":%s PRIVMSG alice psst"},
+		},
+		{
+			chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Data: "hey you"}, Shout: true},
+			[]string{":%s PRIVMSG #homechat :\x02hey you\x02"},
+		},
+		{
+			chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Sealed: &chatdata.Sealed{}}, PM: "alice"},
+			[]string{":%s PRIVMSG alice :[end-to-end encrypted message, use a homechat client to read it]"},
+		},
+	}
+
+	r := bufio.NewReader(a)
+	for _, test := range tests {
+		errs := make(chan error, 1)
+		go func() { errs <- c.chat(test.m) }()
+		for _, exp := range test.exp {
+			exp = strings.Replace(exp, "%s", hostmask(test.m.From), 1)
+			a.SetReadDeadline(time.Now().Add(5 * time.Second))
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l = strings.TrimRight(l, "\r\n"); l != exp {
+				t.Errorf("expected %q, got %q", exp, l)
+			}
+			if len(l) > maxLine {
+				t.Errorf("line too long: %d", len(l))
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOwn(t *testing.T) {
+	c := &conn{name: "alice"}
+	c.echoes = []echo{{"", "hi"}, {"bob", "hi"}, {"", "hi"}}
+
+	tests := []struct {
+		m   chatdata.ServerMessage
+		own bool
+	}{
+		{chatdata.ServerMessage{From: "bob", Message: chatdata.Message{Data: "hi"}}, false},
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}, Bot: true}, false},
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}, PM: "carol"}, false},
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}, PM: "bob"}, true},
+		// each echo is consumed once.
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}, PM: "bob"}, false},
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}}, true},
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}}, true},
+		// the same message from another client of alice.
+		{chatdata.ServerMessage{From: "alice", Message: chatdata.Message{Data: "hi"}}, false},
+	}
+	for i, test := range tests {
+		if own := c.own(test.m); own != test.own {
+			t.Errorf("%d: expected %t", i, test.own)
+		}
+	}
+	if len(c.echoes) != 0 {
+		t.Errorf("echoes left: %+v", c.echoes)
+	}
+}
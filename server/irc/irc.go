@@ -0,0 +1,128 @@
+package irc
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	"github.com/frizinak/homechat/server/client"
+)
+
+const serverName = "homechat"
+
+// Server is the homechat server the gateway attaches its clients to.
+type Server interface {
+	channel.UserCollection
+
+	// TokenUser resolves an API token to its policy entry.
+	TokenUser(token string) (name, fp string, err error)
+
+	// Local registers a client that lives in this process.
+	Local(name, fp string, channels []string, w channel.WriteFlusher) (*client.Client, func(), error)
+}
+
+// Poster delivers a chat message, i.e.: chat.ChatChannel.
+type Poster interface {
+	Handle(channel.Client, chatdata.Message) error
+}
+
+type Config struct {
+	Log *log.Logger
+
+	// Address to listen on, e.g.: ':6667'.
+	Address string
+
+	// Serve IRC over TLS, nil for plaintext.
+	TLS *tls.Config
+
+	// Name of the IRC channel the chat channel is mapped to, e.g.: #homechat.
+	Channel string
+
+	Server Server
+	Chat   Poster
+}
+
+// Gateway is an IRC server that maps the chat channel to a single IRC
+// channel and PMs to PRIVMSGs between nicks. Clients authenticate with an API
+// token, either as the SASL PLAIN password or with PASS, and are named after
+// the policy entry the token was issued for.
+type Gateway struct {
+	c Config
+
+	sem     sync.Mutex
+	l       net.Listener
+	closing bool
+}
+
+func New(c Config) (*Gateway, error) {
+	if !isChannel(c.Channel) || strings.ContainsAny(c.Channel, " ,\x07") {
+		return nil, errors.New("irc channel should start with # and contain no spaces or commas")
+	}
+	return &Gateway{c: c}, nil
+}
+
+// Run listens on the configured address and serves IRC clients until Close is
+// called.
+func (g *Gateway) Run() error {
+	l, err := net.Listen("tcp", g.c.Address)
+	if err != nil {
+		return err
+	}
+	if g.c.TLS != nil {
+		l = tls.NewListener(l, g.c.TLS)
+	}
+
+	g.sem.Lock()
+	if g.closing {
+		g.sem.Unlock()
+		return l.Close()
+	}
+	g.l = l
+	g.sem.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			g.sem.Lock()
+			closing := g.closing
+			g.sem.Unlock()
+			if closing {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				g.c.Log.Printf("irc accept err: %s", err)
+				continue
+			}
+			return err
+		}
+
+		go func() {
+			conn := newConn(g, c)
+			if err := conn.run(); err != nil {
+				g.c.Log.Printf("irc %s: %s", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections, already connected clients remain
+// connected until the server shuts down.
+func (g *Gateway) Close() error {
+	g.sem.Lock()
+	defer g.sem.Unlock()
+	g.closing = true
+	if g.l == nil {
+		return nil
+	}
+	return g.l.Close()
+}
+
+func isChannel(s string) bool {
+	return len(s) > 1 && s[0] == '#'
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/client"
+)
+
+var ErrToken = errors.New("invalid token")
+
+// TokenUser returns the name and fingerprint of the policy entry an API
+// token was issued for. Removing that entry revokes the token.
+func (s *Server) TokenUser(token string) (name, fp string, err error) {
+	if token == "" || s.c.TokenLoader == nil {
+		return "", "", ErrToken
+	}
+
+	fp, err = s.c.TokenLoader.Fingerprint(token)
+	if err != nil {
+		return "", "", fmt.Errorf("token-loader err: %w", err)
+	}
+	if fp == "" {
+		return "", "", ErrToken
+	}
+
+	name, err = s.c.PolicyLoader.Exists(fp)
+	if err != nil {
+		return "", "", fmt.Errorf("policy-loader err: %w", err)
+	}
+	if name == "" {
+		s.c.Log.Printf("api token of %s is not tied to a policy entry", fp)
+		return "", "", ErrToken
+	}
+
+	return name, fp, nil
+}
+
+// TLSConfig returns the tls config of the server, nil if TLS is disabled.
+func (s *Server) TLSConfig() *tls.Config {
+	return s.http.TLSConfig
+}
+
+// localConfig configures a client that lives in this process. It speaks the
+// JSON proto and the highest version of each channel.
+func (s *Server) localConfig(name, fp string, channels []string) client.Config {
+	return client.Config{
+		FrameWriter:  true,
+		Proto:        channel.ProtoJSON,
+		Fingerprint:  fp,
+		Fingerprints: []string{fp},
+		Caps:         s.capabilities(),
+		Name:         name,
+		Channels:     channels,
+		JobBuffer:    s.c.ClientQueueSize,
+	}
+}
+
+// Local registers a client that lives in this process, e.g.: a gateway to
+// another protocol, as the user name that authenticated with the key of
+// fingerprint fp. Messages of the given channels are written to w in the JSON
+// proto: a channel header followed by the message, one message per flush.
+// Call the returned function once it disconnects.
+func (s *Server) Local(name, fp string, channels []string, w channel.WriteFlusher) (*client.Client, func(), error) {
+	for _, h := range channels {
+		if _, ok := s.channels[h]; !ok {
+			return nil, nil, fmt.Errorf("invalid channel subscribe: %s", h)
+		}
+		if r, ok := s.channels[h].(channel.Restricted); ok && !r.CanSubscribe([]string{fp}) {
+			return nil, nil, fmt.Errorf("not allowed to subscribe to %s", h)
+		}
+	}
+
+	conf := s.localConfig(name, fp, channels)
+	sess, seq, err := s.session(channel.IdentifyMsg{}, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := client.New(conf, w, nil, s.clientErrs)
+	s.setClient(conf, c, sess, seq)
+	return c, func() { s.unsetClient(c) }, nil
+}
@@ -11,12 +11,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -42,10 +44,10 @@ var (
 )
 
 const (
-	clientJobBuf = 100000
-	clientErrBuf = 8
-	outgoingBuf  = 50
-	saveInterval = time.Second * 5
+	clientJobBuf     = 1000
+	clientErrBuf     = 8
+	saveInterval     = time.Second * 5
+	sessionRetention = time.Minute * 2
 )
 
 type writeJob struct {
@@ -66,6 +68,13 @@ type PolicyLoader interface {
 	Exists(fingerprint string) (name string, err error)
 }
 
+// TokenLoader resolves the tokens of the HTTP API.
+type TokenLoader interface {
+	// Fingerprint returns the fingerprint of the policy entry token was
+	// issued for or an empty string if the token does not exist.
+	Fingerprint(token string) (string, error)
+}
+
 type Config struct {
 	// Arbitrary string clients will need to be able to connect
 	ProtocolVersion string
@@ -73,8 +82,16 @@ type Config struct {
 	// PolicyLoader should return all allowed users and their names
 	PolicyLoader PolicyLoader
 
+	// TokenLoader authenticates scripts using the HTTP API as the user of
+	// a policy entry, nil disables the API.
+	TokenLoader TokenLoader
+
 	Key *crypto.Key
 
+	// Signed hand-over from the previous server key to Key, sent to clients
+	// until it expires. Leave empty when the key was not rotated.
+	KeyRotation channel.KeyRotationMessage
+
 	Log *log.Logger
 
 	// HTTP link address
@@ -91,7 +108,8 @@ type Config struct {
 	UploadsPath   string
 	MaxUploadSize int64
 
-	// HTTPS certs, leave empty to disable TLS
+	// HTTPS and TCP TLS certs, leave empty to disable TLS.
+	// Clients connecting over TLS can skip the internal crypto layer.
 	Cert    []byte
 	CertKey []byte
 
@@ -100,15 +118,28 @@ type Config struct {
 
 	// Interval to log bandwidth, 0 = no logging
 	LogBandwidth time.Duration
+
+	// Maximum amount of pending messages per client, 0 = default.
+	// Slow clients will have their pending state messages coalesced
+	// or dropped and are disconnected once other messages don't fit.
+	ClientQueueSize int
+
+	// Interval to log client queue depths, 0 = no logging
+	LogQueues time.Duration
+
+	// Duration a disconnected client's session can still be resumed,
+	// 0 = default.
+	SessionRetention time.Duration
 }
 
 type Server struct {
-	c    Config
-	tls  bool
-	http *http.Server
-	s    *simplehttp.Server
-	ws   websocket.Server
-	tcp  net.Listener
+	c      Config
+	tls    bool
+	http   *http.Server
+	s      *simplehttp.Server
+	ws     websocket.Server
+	wsText websocket.Server
+	tcp    net.Listener
 
 	saveMutex sync.Mutex
 
@@ -117,7 +148,8 @@ type Server struct {
 
 	clientErrs chan client.Error
 
-	outgoing chan writeJob
+	sessionsMutex sync.Mutex
+	sessions      map[string]*client.Session
 
 	channels map[string]channel.Channel
 
@@ -133,9 +165,8 @@ func New(c Config) (*Server, error) {
 		c:        c,
 		channels: make(map[string]channel.Channel),
 
-		outgoing: make(chan writeJob, outgoingBuf),
-
 		clients:    make(map[string]map[string][]*client.Client),
+		sessions:   make(map[string]*client.Session),
 		clientErrs: make(chan client.Error, clientErrBuf),
 
 		bw: &bandwidth.Noop{},
@@ -145,7 +176,16 @@ func New(c Config) (*Server, error) {
 		s.bw = bandwidth.New()
 	}
 
+	if s.c.ClientQueueSize <= 0 {
+		s.c.ClientQueueSize = clientJobBuf
+	}
+
+	if s.c.SessionRetention <= 0 {
+		s.c.SessionRetention = sessionRetention
+	}
+
 	s.ws = websocket.Server{Handler: s.onWS}
+	s.wsText = websocket.Server{Handler: s.onWSText}
 
 	var tlsConf *tls.Config
 	if c.Cert != nil {
@@ -195,8 +235,30 @@ func (s *Server) Init() error {
 	}()
 
 	go func() {
-		for j := range s.outgoing {
-			j.c.Queue(j.Job)
+		for {
+			time.Sleep(s.c.SessionRetention / 2)
+			s.sessionsMutex.Lock()
+			for tok, sess := range s.sessions {
+				if sess.Expired(s.c.SessionRetention) {
+					delete(s.sessions, tok)
+				}
+			}
+			s.sessionsMutex.Unlock()
+		}
+	}()
+
+	go func() {
+		if s.c.LogQueues == 0 {
+			return
+		}
+		for {
+			time.Sleep(s.c.LogQueues)
+			for _, st := range s.Queues() {
+				if st.Queued == 0 && st.Dropped == 0 {
+					continue
+				}
+				s.c.Log.Printf("Queue '%s': %d/%d dropped:%d", st.Name, st.Queued, st.Max, st.Dropped)
+			}
 		}
 	}()
 
@@ -278,6 +340,14 @@ func (s *Server) BroadcastBatch(b []channel.Batch) error {
 		}
 	}
 
+	s.sessionsMutex.Lock()
+	for _, sess := range s.sessions {
+		for _, bat := range b {
+			sess.RecordDetached(bat.Filter, bat.Msg)
+		}
+	}
+	s.sessionsMutex.Unlock()
+
 	var _wg sync.WaitGroup
 	wg := &_wg
 
@@ -293,7 +363,7 @@ func (s *Server) BroadcastBatch(b []channel.Batch) error {
 
 	for _, j := range clean {
 		j.Job.WG = wg
-		s.outgoing <- j
+		j.c.Queue(j.Job)
 	}
 
 	go func() {
@@ -307,7 +377,29 @@ func (s *Server) BroadcastBatch(b []channel.Batch) error {
 }
 
 func (s *Server) Broadcast(f channel.ClientFilter, m channel.Msg) error {
-	return s.BroadcastBatch([]channel.Batch{{f, m}})
+	return s.BroadcastBatch([]channel.Batch{{Filter: f, Msg: m}})
+}
+
+// Queues returns the queue depth of each connected client.
+func (s *Server) Queues() []client.Stats {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	seen := make(map[*client.Client]struct{})
+	l := make([]client.Stats, 0)
+	for _, names := range s.clients {
+		for _, cls := range names {
+			for _, c := range cls {
+				if _, ok := seen[c]; ok {
+					continue
+				}
+				seen[c] = struct{}{}
+				l = append(l, c.Stats())
+			}
+		}
+	}
+
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l
 }
 
 func (s *Server) MustSetUserUpdateHandler(h channel.UserUpdateHandler) {
@@ -342,6 +434,15 @@ func (s *Server) AddChannel(name string, c channel.Channel) error {
 	return nil
 }
 
+// capabilities returns the highest message version of each channel.
+func (s *Server) capabilities() channel.Capabilities {
+	caps := make(channel.Capabilities, len(s.channels))
+	for name, ch := range s.channels {
+		_, caps[name] = channel.Versions(ch)
+	}
+	return caps
+}
+
 func (s *Server) GetUsers(ch string) []channel.User {
 	n := make([]channel.User, 0)
 	s.clientsMutex.RLock()
@@ -410,10 +511,16 @@ func (s *Server) route(r *http.Request, l *log.Logger) (simplehttp.HandleFunc, i
 	switch p {
 	case "/ws":
 		return s.handleWS, 0
+	case "/ws/text":
+		return s.handleWSText, 0
 	case "/upload":
 		return s.handleUpload, 0
 	}
 
+	if strings.HasPrefix(p, "/api/") && s.c.TokenLoader != nil {
+		return s.routeAPI(p), 0
+	}
+
 	if strings.HasPrefix(p, "/f/") {
 		return func(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
 			file := fileRE.ReplaceAllString(p[3:], "-")
@@ -529,11 +636,37 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request, l *log.Logger)
 	return 0, nil
 }
 
+func (s *Server) handleWSText(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
+	if gz, ok := w.(*simplehttp.GZIPWriter); ok {
+		w = gz.ResponseWriter
+	}
+
+	s.wsText.ServeHTTP(w, r)
+	return 0, nil
+}
+
 func (s *Server) unsetClient(c *client.Client) {
 	s.clientsMutex.Lock()
 	c.Stop()
-	ch := c.Channels()
-	for _, h := range ch {
+	if sess := c.Session(); sess != nil {
+		sess.Detach(c)
+	}
+	s.removeClient(c)
+	s.clientsMutex.Unlock()
+
+	if len(c.Channels()) == 0 {
+		s.c.Log.Printf("remove client '%s[0]'", c.Name())
+	}
+
+	go func() {
+		if err := s.onUserUpdate.UserUpdate(c, channel.Disconnect); err != nil {
+			s.c.Log.Printf("userupdate handler: %s", err)
+		}
+	}()
+}
+
+func (s *Server) removeClient(c *client.Client) {
+	for _, h := range c.Channels() {
 		ix := -1
 		if _, ok := s.clients[h]; !ok {
 			continue
@@ -558,21 +691,36 @@ func (s *Server) unsetClient(c *client.Client) {
 		l := len(s.clients[h][name])
 		s.c.Log.Printf("remove client '%s[%d]' for '%s'", name, l, h)
 	}
-	s.clientsMutex.Unlock()
+}
 
-	if len(ch) == 0 {
-		s.c.Log.Printf("remove client '%s[0]'", c.Name())
+func (s *Server) session(id channel.IdentifyMsg, conf client.Config) (*client.Session, uint32, error) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	if sess, ok := s.sessions[id.Session]; ok &&
+		sess.Matches(conf.Fingerprint, conf.Name, conf.Channels) &&
+		sess.CanResume(id.Seq) {
+		return sess, id.Seq, nil
 	}
 
-	go func() {
-		if err := s.onUserUpdate.UserUpdate(c, channel.Disconnect); err != nil {
-			s.c.Log.Printf("userupdate handler: %s", err)
-		}
-	}()
+	sess, err := client.NewSession(conf.Fingerprint, conf.Name, conf.Channels, s.c.ClientQueueSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.sessions[sess.Token()] = sess
+	return sess, 0, nil
 }
 
-func (s *Server) setClient(conf client.Config, c *client.Client) {
+func (s *Server) setClient(conf client.Config, c *client.Client, sess *client.Session, seq uint32) {
 	s.clientsMutex.Lock()
+	if prev := sess.Owner(); prev != nil {
+		prev.Takeover(c)
+		s.removeClient(prev)
+	}
+	sess.Attach(c, seq)
+	if seq != 0 {
+		s.c.Log.Printf("resume session of '%s' from %d", conf.Name, seq)
+	}
+
 	for _, h := range conf.Channels {
 		if _, ok := s.clients[h]; !ok {
 			s.clients[h] = make(map[string][]*client.Client)
@@ -606,51 +754,89 @@ func (s *Server) newClient(
 	proto channel.Proto,
 	frameWriter bool,
 	id channel.IdentifyMsg,
-	pubkey channel.PubKeyMessage,
+	fps []string,
+	streams *channel.Mux,
 	w channel.WriteFlusher,
 	binW channel.BinaryWriter,
 ) (client.Config, *client.Client, error) {
 	var conf client.Config
 	filtered := make([]rune, 0, len(id.Data))
 	for _, n := range id.Data {
-		if unicode.IsPrint(n) && !unicode.IsSpace(n) {
+		// @ is reserved for users of bridged servers, e.g.: alice@home.
+		if unicode.IsPrint(n) && !unicode.IsSpace(n) && n != '@' {
 			filtered = append(filtered, n)
 		}
 	}
 
 	reqName := string(filtered)
 	name := reqName
+	fp := fps[0]
 
 	if policy := s.c.PolicyLoader.Policy(); policy != PolicyWorld {
-		fp := pubkey.Fingerprint()
-		forced, err := s.c.PolicyLoader.Exists(fp)
-		if policy == PolicyFixed {
-			name = forced
+		var forced string
+		for i, f := range fps {
+			var err error
+			forced, err = s.c.PolicyLoader.Exists(f)
+			if err != nil {
+				s.c.Log.Printf("policy-loader err: %s", err)
+				return conf, nil, errors.New("server error")
+			}
+			if forced == "" {
+				continue
+			}
+
+			fp = f
+			if i != 0 {
+				s.c.Log.Printf(
+					"client %s authenticated with its legacy key %s, add %s to the policy file to complete its migration",
+					forced,
+					f,
+					fps[0],
+				)
+			}
+			break
 		}
 
-		if err != nil {
-			s.c.Log.Printf("policy-loader err: %s", err)
-			return conf, nil, errors.New("server error")
-		} else if forced == "" {
+		if forced == "" {
 			s.c.Log.Printf(
 				"client with fingerprint %s and requested username %s is not in allow list",
-				fp,
+				strings.Join(fps, ", "),
 				reqName,
 			)
 			return conf, nil, errNotAllowed
 		}
+
+		if policy == PolicyFixed {
+			name = forced
+		}
 	}
 
 	for _, h := range id.Channels {
 		if _, ok := s.channels[h]; !ok {
 			return conf, nil, fmt.Errorf("invalid channel subscribe: %s", h)
 		}
+		if r, ok := s.channels[h].(channel.Restricted); ok && !r.CanSubscribe(fps) {
+			s.c.Log.Printf("client %s is not allowed to subscribe to '%s'", fp, h)
+			return conf, nil, errNotAllowed
+		}
 	}
 
-	if id.Version != s.c.ProtocolVersion {
+	if channel.ProtocolMajor(id.Version) != channel.ProtocolMajor(s.c.ProtocolVersion) {
 		return conf, nil, errProto
 	}
 
+	// Clients that don't exchange capabilities predate them.
+	clientCaps := id.Caps
+	if clientCaps == nil {
+		clientCaps = s.capabilities().Initial()
+	}
+	caps := s.capabilities().Negotiate(clientCaps)
+	for _, h := range id.Channels {
+		if min, _ := channel.Versions(s.channels[h]); caps.Version(h) < min {
+			return conf, nil, errProto
+		}
+	}
+
 	if name == "" {
 		return conf, nil, errors.New("invalid name")
 	}
@@ -663,14 +849,31 @@ func (s *Server) newClient(
 
 	conf.FrameWriter = frameWriter
 	conf.Proto = proto
+	conf.Fingerprint = fp
+	conf.Fingerprints = fps
+	conf.Caps = caps
+	conf.Streams = streams
 	conf.Name = name
 	conf.Channels = id.Channels
-	conf.JobBuffer = clientJobBuf
+	conf.JobBuffer = s.c.ClientQueueSize
 
 	return conf, client.New(conf, w, binW, s.clientErrs), nil
 }
 
-func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, frameWriter bool) error {
+// rotation returns the key rotation announcement or an empty one once its
+// grace period ended and the previous key is retired.
+func (s *Server) rotation() channel.KeyRotationMessage {
+	if s.c.KeyRotation.Empty() || s.c.KeyRotation.Expired() {
+		return channel.KeyRotationMessage{}
+	}
+	return s.c.KeyRotation
+}
+
+func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, frameWriter bool, state *tls.ConnectionState) error {
+	native, aead, deflate, muxed := proto.TLS(), proto.AEAD(), proto.Deflate(), proto.Mux()
+	bind, ext := native && proto.Bind(), proto.Ext()
+	proto = proto.Base()
+
 	read := func(r io.Reader, typ channel.Msg) (channel.Msg, io.Reader, error) {
 		m, err := typ.FromBinary(s.c.RWFactory.BinaryReader(r))
 		return m, r, err
@@ -712,74 +915,189 @@ func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, fra
 		writeFlusher = channel.NewBuffered(writer)
 	}
 
+	// Messages are read from stream 0 once multiplexed, the demuxer
+	// reads the underlying connection without limits.
+	// Clients that can't demultiplex get all messages inline.
+	var mux *channel.Mux
+	multiplex := func(wf channel.WriteFlusher, r io.Reader) {
+		limited.N = math.MaxInt64
+		if !muxed {
+			limited = &io.LimitedReader{R: r, N: 1024 * 10}
+			writer = s.c.RWFactory.Writer(wf)
+			reader = s.c.RWFactory.Reader(limited)
+			writeFlusher = &channel.WriterFlusher{Writer: writer, Flusher: wf}
+			return
+		}
+		mux = channel.NewMux(wf, r)
+		limited = &io.LimitedReader{R: mux, N: 1024 * 10}
+		writer = s.c.RWFactory.Writer(mux)
+		reader = s.c.RWFactory.Reader(limited)
+		writeFlusher = &channel.WriterFlusher{Writer: writer, Flusher: mux}
+	}
+
 	var msg channel.Msg
+	var fps []string
+	var err error
 
 	key := s.c.Key
-	server, err := channel.NewPubKeyServerMessage(key)
-	if err != nil {
-		return err
-	}
+	switch {
+	case native:
+		server, err := channel.NewPubKeyServerMessage(key)
+		if err != nil {
+			return err
+		}
 
-	if err := write(writeFlusher, server); err != nil {
-		return err
-	}
+		if bind {
+			msg, reader, err = read(reader, channel.ChallengeNonceMessage{})
+			if err != nil {
+				return err
+			}
+			b, err := channel.TLSBinding(*state, msg.(channel.ChallengeNonceMessage).Nonce)
+			if err != nil {
+				return err
+			}
+			server = server.Bind(b)
+		}
 
-	msg, reader, err = read(reader, channel.PubKeyMessage{})
-	if err != nil {
-		return err
-	}
-	clientKey := msg.(channel.PubKeyMessage)
+		if err := write(writeFlusher, server); err != nil {
+			return err
+		}
+		if err := write(writeFlusher, s.rotation()); err != nil {
+			return err
+		}
 
-	derive, err := channel.CommonSecret32(clientKey, server, key)
-	if err != nil {
-		return err
-	}
+		msg, reader, err = read(reader, channel.PubKeyChallengeMessage{})
+		if err != nil {
+			return err
+		}
+		challenge := msg.(channel.PubKeyChallengeMessage)
+		if err := challenge.Verify(server); err != nil {
+			return err
+		}
+		fps = challenge.Fingerprints()
 
-	encryptedRW := &crypto.ReadWriter{
-		crypto.NewDecrypter(reader, derive(channel.CryptoServerRead)),
-		crypto.NewEncrypter(writeFlusher, derive(channel.CryptoServerWrite)),
-	}
+		var wf channel.WriteFlusher = channel.NewBuffered(writer)
+		if deflate {
+			wf, reader = channel.NewCompressed(wf, reader)
+		}
 
-	macRSecret := derive(channel.CryptoServerMacRead)
-	macWSecret := derive(channel.CryptoServerMacWrite)
-	macR := crypto.NewSHA1HMACReader(encryptedRW, macRSecret[:])
-	macW := crypto.NewSHA1HMACWriter(encryptedRW, macWSecret[:], 1<<16-1)
+		multiplex(wf, reader)
 
-	writer = s.c.RWFactory.Writer(macW)
-	reader = s.c.RWFactory.Reader(macR)
+	case aead:
+		server, err := channel.NewKeyExchangeServerMessage(key)
+		if err != nil {
+			return err
+		}
 
-	writeFlusher = &channel.WriterFlusher{writer, channel.NewFlushFlusher(macW, writeFlusher)}
+		if err := write(writeFlusher, server); err != nil {
+			return err
+		}
+		if err := write(writeFlusher, s.rotation()); err != nil {
+			return err
+		}
 
-	test, err := channel.NewSymmetricTestMessage()
-	if err != nil {
-		return err
-	}
+		msg, reader, err = read(reader, channel.KeyExchangeMessage{})
+		if err != nil {
+			return err
+		}
+		kx := msg.(channel.KeyExchangeMessage)
+		if err := kx.Verify(server); err != nil {
+			return err
+		}
+		fps = kx.Fingerprints()
 
-	if err := write(writeFlusher, test); err != nil {
-		return err
-	}
+		derive, err := channel.EphemeralSecret32(kx, server)
+		if err != nil {
+			return err
+		}
 
-	limited.N = 1024 * 10
-	msg, reader, err = read(reader, channel.SymmetricTestMessage{})
-	if err != nil {
-		if err == channel.ErrKeyExchange {
-			return errKeyExchange
+		aeadW := crypto.NewAEADWriter(writeFlusher, derive(channel.CryptoServerWrite), channel.FrameSize)
+		aeadR := crypto.NewAEADReader(reader, derive(channel.CryptoServerRead), channel.FrameSize)
+
+		var wf channel.WriteFlusher = &channel.WriterFlusher{Writer: aeadW, Flusher: channel.NewFlushFlusher(aeadW, writeFlusher)}
+		var r io.Reader = aeadR
+		if deflate {
+			wf, r = channel.NewCompressed(wf, r)
 		}
 
-		return err
+		multiplex(wf, r)
+
+	default:
+		// Legacy clients, only used to tell them to update.
+		server, err := channel.NewPubKeyServerMessage(key)
+		if err != nil {
+			return err
+		}
+
+		if err := write(writeFlusher, server); err != nil {
+			return err
+		}
+
+		msg, reader, err = read(reader, channel.PubKeyMessage{})
+		if err != nil {
+			return err
+		}
+		clientKey := msg.(channel.PubKeyMessage)
+		fps = []string{clientKey.Fingerprint()}
+
+		derive, err := channel.CommonSecret32(clientKey, server, key)
+		if err != nil {
+			return err
+		}
+
+		encryptedRW := &crypto.ReadWriter{
+			Decrypter: crypto.NewDecrypter(reader, derive(channel.CryptoServerRead)),
+			Encrypter: crypto.NewEncrypter(writeFlusher, derive(channel.CryptoServerWrite)),
+		}
+
+		macRSecret := derive(channel.CryptoServerMacRead)
+		macWSecret := derive(channel.CryptoServerMacWrite)
+		macR := crypto.NewSHA1HMACReader(encryptedRW, macRSecret[:])
+		macW := crypto.NewSHA1HMACWriter(encryptedRW, macWSecret[:], channel.FrameSize)
+
+		writer = s.c.RWFactory.Writer(macW)
+		reader = s.c.RWFactory.Reader(macR)
+
+		writeFlusher = &channel.WriterFlusher{Writer: writer, Flusher: channel.NewFlushFlusher(macW, writeFlusher)}
 	}
 
-	if !test.Equal(msg) {
-		return errKeyExchange
+	if !native {
+		test, err := channel.NewSymmetricTestMessage()
+		if err != nil {
+			return err
+		}
+
+		if err := write(writeFlusher, test); err != nil {
+			return err
+		}
+
+		limited.N = 1024 * 10
+		msg, reader, err = read(reader, channel.SymmetricTestMessage{})
+		if err != nil {
+			if err == channel.ErrKeyExchange {
+				return errKeyExchange
+			}
+
+			return err
+		}
+
+		if !test.Equal(msg) {
+			return errKeyExchange
+		}
 	}
 
-	msg, reader, err = read(reader, channel.IdentifyMsg{})
+	msg, reader, err = read(reader, channel.IdentifyMsg{}.Extended(ext))
 	if err != nil {
 		return fmt.Errorf("identify: %w", err)
 	}
 	id := msg.(channel.IdentifyMsg)
 
-	conf, c, err := s.newClient(proto, frameWriter, id, clientKey, writeFlusher, s.c.RWFactory.BinaryWriter(writeFlusher))
+	var conf client.Config
+	var c *client.Client
+	err = errProto
+	if native || aead {
+		conf, c, err = s.newClient(proto, frameWriter, id, fps, mux, writeFlusher, s.c.RWFactory.BinaryWriter(writeFlusher))
+	}
 	status := channel.StatusMsg{Code: channel.StatusOK}
 	if err != nil {
 		status.Code = channel.StatusNOK
@@ -798,12 +1116,46 @@ func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, fra
 	if err != nil {
 		return err
 	}
-	if err := write(writeFlusher, channel.IdentifyMsg{Data: conf.Name}); err != nil {
+	sess, seq, err := s.session(id, conf)
+	if err != nil {
+		return err
+	}
+	ident := channel.IdentifyMsg{
+		Data:    conf.Name,
+		Version: s.c.ProtocolVersion,
+		Session: sess.Token(),
+		Seq:     seq,
+		Caps:    conf.Caps,
+	}.Extended(ext)
+	if err := write(writeFlusher, ident); err != nil {
 		return err
 	}
-	s.setClient(conf, c)
+	s.setClient(conf, c, sess, seq)
 	defer s.unsetClient(c)
 
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Killed():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	// Streamed messages are handled concurrently, errors only fail the
+	// request as the connection itself is still in a known state.
+	stream := func(chnl channel.ChannelMsg, h channel.Channel, body io.ReadCloser, max int64) {
+		defer body.Close()
+		_, err := do(s.c.RWFactory.Reader(&io.LimitedReader{R: body, N: max}), c, h)
+		if chnl.ID != 0 {
+			s.reply(c, chnl.ID, err)
+		}
+		if err != nil {
+			s.c.Log.Printf("stream error '%s' channel %s: %s", c.Name(), chnl.Data, err)
+		}
+	}
+
 	var chnl channel.ChannelMsg
 	for {
 		if s.closing {
@@ -815,8 +1167,11 @@ func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, fra
 		}
 
 		limited.N = 255
-		msg, reader, err = read(reader, channel.ChannelMsg{})
-		if err == io.EOF {
+		msg, reader, err = read(reader, channel.ChannelMsg{}.Multiplexed(mux != nil))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Encrypted streams are never closed cleanly by clients that
+			// drop their connection, a missing final frame between
+			// messages is a plain disconnect.
 			return nil
 		}
 		if err != nil {
@@ -833,18 +1188,52 @@ func (s *Server) handleConn(proto channel.Proto, conn net.Conn, addr string, fra
 			return fmt.Errorf("impossible channel '%s'", chnl.Data)
 		}
 
-		limited.N = h.LimitReader()
-		if proto != channel.ProtoBinary && limited.N > jsonMax {
-			limited.N = jsonMax
+		max := h.LimitReader()
+		if proto != channel.ProtoBinary && max > jsonMax {
+			max = jsonMax
+		}
+
+		if chnl.Stream != 0 {
+			if mux == nil {
+				return errors.New("stream on a connection that isn't multiplexed")
+			}
+			body, err := mux.Accept(chnl.Stream)
+			if err != nil {
+				return fmt.Errorf("channel %s: %w", chnl.Data, err)
+			}
+			go stream(chnl, h, body, max)
+			continue
 		}
 
+		limited.N = max
 		reader, err = do(reader, c, h)
+		if chnl.ID != 0 {
+			s.reply(c, chnl.ID, err)
+		}
 		if err != nil {
+			var rerr channel.RequestError
+			if errors.As(err, &rerr) {
+				s.c.Log.Printf("request error '%s' channel %s: %s", c.Name(), chnl.Data, err)
+				continue
+			}
 			return fmt.Errorf("channel %s: %w", chnl.Data, err)
 		}
 	}
 }
 
+func (s *Server) reply(c *client.Client, id uint32, err error) {
+	m := channel.ReplyMsg{ID: id}
+	m.Code = channel.StatusOK
+	if err != nil {
+		m.Code = channel.StatusNOK
+		m.Err = err.Error()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.Queue(client.Job{WG: &wg, Channel: vars.ReplyChannel, Msgs: []channel.Msg{m}})
+}
+
 func (s *Server) onWS(conn *websocket.Conn) {
 	defer conn.Close()
 	if err := conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
@@ -855,21 +1244,28 @@ func (s *Server) onWS(conn *websocket.Conn) {
 	address := conn.Request().RemoteAddr
 
 	proto := channel.ReadProto(conn)
-	// TODO uncomment when tls lands and when/if internal encryption is disabled
-	// conn.PayloadType = websocket.TextFrame
-	// if proto == channel.ProtoBinary {
 	conn.PayloadType = websocket.BinaryFrame
-	//}
 
-	switch proto {
-	case channel.ProtoJSON, channel.ProtoBinary:
-		if err := s.handleConn(proto, conn, address, true); err != nil {
-			s.c.Log.Printf("client error: %s", err)
-		}
-	default:
-		s.c.Log.Printf("client requested invalid protocol: %d", proto)
+	s.onConn(proto, conn, address, true, conn.Request().TLS, false)
+}
+
+// onWSText serves clients that can only deal with text frames, e.g.:
+// browsers without the wasm client. They speak the JSON proto over TLS
+// without the internal crypto layer and without multiplexing.
+// Browsers can't export keying material so their challenge is the only one
+// that isn't bound to the TLS session, anyone terminating their TLS
+// connection could relay it.
+func (s *Server) onWSText(conn *websocket.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
 		return
 	}
+
+	address := conn.Request().RemoteAddr
+	conn.PayloadType = websocket.TextFrame
+	proto := channel.ProtoJSON | channel.ProtoTLS
+
+	s.onConn(proto, conn, address, true, conn.Request().TLS, true)
 }
 
 func (s *Server) onTCP(conn net.Conn) {
@@ -879,10 +1275,30 @@ func (s *Server) onTCP(conn net.Conn) {
 	}
 
 	proto := channel.ReadProto(conn)
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		st := tc.ConnectionState()
+		state = &st
+	}
+	s.onConn(proto, conn, conn.RemoteAddr().String(), false, state, false)
+}
 
-	switch proto {
+// onConn serves a client, state is nil unless the connection is secured by
+// TLS. Native TLS clients have to bind their challenge to it unless unbound
+// is set, see onWSText.
+func (s *Server) onConn(proto channel.Proto, conn net.Conn, addr string, frameWriter bool, state *tls.ConnectionState, unbound bool) {
+	if proto.TLS() && state == nil {
+		s.c.Log.Printf("client requested native tls on an insecure connection: %s", addr)
+		return
+	}
+	if proto.TLS() && !proto.Bind() && !unbound {
+		s.c.Log.Printf("client requested native tls without binding its challenge: %s", addr)
+		return
+	}
+
+	switch proto.Base() {
 	case channel.ProtoJSON, channel.ProtoBinary:
-		if err := s.handleConn(proto, conn, conn.RemoteAddr().String(), false); err != nil {
+		if err := s.handleConn(proto, conn, addr, frameWriter, state); err != nil {
 			s.c.Log.Printf("client error: %s", err)
 		}
 	default:
@@ -905,6 +1321,9 @@ func (s *Server) RunTCP() error {
 	if err != nil {
 		return fmt.Errorf("could not open tcp connection %s: %w", s.c.TCPAddress, err)
 	}
+	if s.tls {
+		s.tcp = tls.NewListener(s.tcp, s.http.TLSConfig)
+	}
 
 	for {
 		if s.closing {
@@ -0,0 +1,290 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+	"github.com/frizinak/homechat/server/channel/chat"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+	musicdata "github.com/frizinak/homechat/server/channel/music/data"
+)
+
+const (
+	outgoingQueue   = 64
+	outgoingTimeout = time.Second * 30
+	defaultRetries  = 3
+)
+
+// retryWait is the wait before the first retry, it doubles with each retry.
+var retryWait = time.Second
+
+// Event types.
+const (
+	EventMessage    = "message"
+	EventMention    = "mention"
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventSong       = "song"
+)
+
+// Event is delivered to outgoing hooks as JSON.
+type Event struct {
+	Hook  string    `json:"hook"`
+	Type  string    `json:"type"`
+	Stamp time.Time `json:"stamp"`
+
+	// Author of the message or the user that (dis)connected.
+	User    string          `json:"user,omitempty"`
+	Message string          `json:"message,omitempty"`
+	PM      string          `json:"pm,omitempty"`
+	Song    *musicdata.Song `json:"song,omitempty"`
+}
+
+// OutgoingConfig of a single outgoing hook. It is triggered by any of Match,
+// Mention and Events and either POSTs the event to URL or runs Command with
+// the event on stdin.
+type OutgoingConfig struct {
+	// Regex public chat messages are matched against.
+	Match string
+
+	// Name that triggers the hook when it is mentioned (e.g.: 'hello @hass')
+	// or sent a PM (e.g.: '@hass leaving work').
+	Mention string
+
+	// Any of connect, disconnect and song.
+	Events []string
+
+	URL     string
+	Command []string
+
+	// Amount of retries of failed deliveries, 0 = default, < 0 = none.
+	Retries int
+}
+
+type outgoing struct {
+	name string
+	OutgoingConfig
+	match  *regexp.Regexp
+	events map[string]bool
+	queue  chan Event
+}
+
+// Outgoing delivers chat, user and music events to outgoing hooks.
+type Outgoing struct {
+	delivery *log.Logger
+	client   *http.Client
+
+	hooks []*outgoing
+
+	sem   sync.Mutex
+	users map[string]int
+}
+
+// NewOutgoing creates the outgoing hooks, deliveries are logged to
+// deliveryLog.
+func NewOutgoing(deliveryLog io.Writer, hooks map[string]OutgoingConfig) (*Outgoing, error) {
+	o := &Outgoing{
+		delivery: log.New(deliveryLog, "", log.LstdFlags),
+		client:   &http.Client{Timeout: outgoingTimeout},
+		hooks:    make([]*outgoing, 0, len(hooks)),
+		users:    make(map[string]int),
+	}
+
+	for name, c := range hooks {
+		if (c.URL == "") == (len(c.Command) == 0) {
+			return nil, fmt.Errorf("outgoing hook %s: specify either a url or a command", name)
+		}
+		h := &outgoing{
+			name:           name,
+			OutgoingConfig: c,
+			events:         make(map[string]bool, len(c.Events)),
+			queue:          make(chan Event, outgoingQueue),
+		}
+		if h.Retries == 0 {
+			h.Retries = defaultRetries
+		}
+		if c.Match != "" {
+			var err error
+			if h.match, err = regexp.Compile(c.Match); err != nil {
+				return nil, fmt.Errorf("outgoing hook %s: %w", name, err)
+			}
+		}
+		for _, e := range c.Events {
+			switch e {
+			case EventConnect, EventDisconnect, EventSong:
+				h.events[e] = true
+			default:
+				return nil, fmt.Errorf("outgoing hook %s: no such event: '%s'", name, e)
+			}
+		}
+
+		o.hooks = append(o.hooks, h)
+		go o.run(h)
+	}
+
+	return o, nil
+}
+
+func (o *Outgoing) run(h *outgoing) {
+	for e := range h.queue {
+		wait := retryWait
+		for attempt := 0; ; attempt++ {
+			err := o.deliver(h, e)
+			if err == nil {
+				o.delivery.Printf("%s %s %s: ok", h.name, e.Type, e.User)
+				break
+			}
+			if attempt >= h.Retries {
+				o.delivery.Printf("%s %s %s: giving up: %s", h.name, e.Type, e.User, err)
+				break
+			}
+			o.delivery.Printf("%s %s %s: retrying in %s: %s", h.name, e.Type, e.User, wait, err)
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+func (o *Outgoing) deliver(h *outgoing, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if h.URL != "" {
+		res, err := o.client.Post(h.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("status %s", res.Status)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), outgoingTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(
+		os.Environ(),
+		"HOMECHAT_HOOK="+h.name,
+		"HOMECHAT_EVENT="+e.Type,
+		"HOMECHAT_USER="+e.User,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 200 {
+			out = out[:200]
+		}
+		if len(out) != 0 {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+	}
+	return err
+}
+
+func (o *Outgoing) trigger(h *outgoing, e Event) {
+	e.Hook = h.name
+	select {
+	case h.queue <- e:
+	default:
+		o.delivery.Printf("%s %s %s: dropped, queue is full", h.name, e.Type, e.User)
+	}
+}
+
+// ChatMessage triggers hooks that match m, see chat.ChatChannel.OnMessage.
+// Messages from bots and end-to-end encrypted messages are ignored.
+func (o *Outgoing) ChatMessage(cl channel.Client, m chatdata.ServerMessage) {
+	if m.Bot || m.Sealed != nil {
+		return
+	}
+
+	var mentions []string
+	e := Event{Stamp: m.Stamp, User: m.From, Message: m.Data, PM: m.PM}
+	for _, h := range o.hooks {
+		if h.Mention != "" {
+			if mentions == nil {
+				mentions = chat.Mentions(m.Data)
+			}
+			if strings.EqualFold(m.PM, h.Mention) || (m.PM == "" && contains(mentions, h.Mention)) {
+				e.Type = EventMention
+				o.trigger(h, e)
+				continue
+			}
+		}
+		if h.match != nil && m.PM == "" && h.match.MatchString(m.Data) {
+			e.Type = EventMessage
+			o.trigger(h, e)
+		}
+	}
+}
+
+// SongChange triggers hooks interested in song changes, see
+// music.SongChannel.OnChange.
+func (o *Outgoing) SongChange(s musicdata.Song) {
+	e := Event{Type: EventSong, Stamp: time.Now(), Song: &s}
+	for _, h := range o.hooks {
+		if h.events[EventSong] {
+			o.trigger(h, e)
+		}
+	}
+}
+
+// UserUpdate triggers hooks when the first client of a user connects or its
+// last one disconnects.
+func (o *Outgoing) UserUpdate(cl channel.Client, r channel.ConnectionReason) error {
+	name := cl.Name()
+	typ := EventConnect
+	o.sem.Lock()
+	switch r {
+	case channel.Connect:
+		o.users[name]++
+		if o.users[name] != 1 {
+			typ = ""
+		}
+	case channel.Disconnect:
+		typ = EventDisconnect
+		o.users[name]--
+		if o.users[name] > 0 {
+			typ = ""
+		} else {
+			delete(o.users, name)
+		}
+	}
+	o.sem.Unlock()
+
+	if typ == "" {
+		return nil
+	}
+
+	e := Event{Type: typ, Stamp: time.Now(), User: name}
+	for _, h := range o.hooks {
+		if h.events[typ] {
+			o.trigger(h, e)
+		}
+	}
+	return nil
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
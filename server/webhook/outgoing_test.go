@@ -0,0 +1,296 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+// lockedBuffer is a delivery log that can be read while hooks write to it.
+type lockedBuffer struct {
+	sem sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.sem.Lock()
+	defer b.sem.Unlock()
+	return b.buf.String()
+}
+
+// receiver is an endpoint of outgoing hooks that fails the first fail
+// deliveries.
+type receiver struct {
+	sem      sync.Mutex
+	fail     int
+	attempts []time.Time
+	events   chan Event
+}
+
+func newReceiver(t *testing.T, fail int) (*receiver, string) {
+	r := &receiver{fail: fail, events: make(chan Event, 32)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.sem.Lock()
+		r.attempts = append(r.attempts, time.Now())
+		fail := len(r.attempts) <= r.fail
+		r.sem.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var e Event
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		r.events <- e
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(ts.Close)
+	return r, ts.URL
+}
+
+// wait returns n events and fails if more arrive.
+func (r *receiver) wait(t *testing.T, n int) []Event {
+	t.Helper()
+	l := make([]Event, 0, n)
+	for len(l) < n {
+		select {
+		case e := <-r.events:
+			l = append(l, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d events, got %+v", n, l)
+		}
+	}
+	select {
+	case e := <-r.events:
+		t.Fatalf("unexpected event: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return l
+}
+
+func waitLog(t *testing.T, b *lockedBuffer, s string) {
+	t.Helper()
+	for i := 0; !strings.Contains(b.String(), s); i++ {
+		if i == 500 {
+			t.Fatalf("'%s' not in delivery log:\n%s", s, b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutgoingConfig(t *testing.T) {
+	tests := map[string]OutgoingConfig{
+		"no target":     {},
+		"both targets":  {URL: "http://localhost", Command: []string{"true"}},
+		"invalid regex": {URL: "http://localhost", Match: "("},
+		"invalid event": {URL: "http://localhost", Events: []string{"nope"}},
+	}
+	for name, c := range tests {
+		if _, err := NewOutgoing(ioutil.Discard, map[string]OutgoingConfig{"h": c}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestChatMessage(t *testing.T) {
+	r, url := newReceiver(t, 0)
+	o, err := NewOutgoing(ioutil.Discard, map[string]OutgoingConfig{
+		"hass":   {URL: url, Mention: "hass"},
+		"deploy": {URL: url, Match: "^deploy"},
+		"both":   {URL: url, Mention: "bot", Match: "hello"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob := channel.NewClient("bob", false)
+	msgs := []chatdata.ServerMessage{
+		{From: "bob", Message: chatdata.Message{Data: "hello @hass"}},
+		{From: "bob", Message: chatdata.Message{Data: "leaving work"}, PM: "hass"},
+		{From: "bob", Message: chatdata.Message{Data: "hi @HASS."}},
+		{From: "bob", Message: chatdata.Message{Data: "deploy now"}},
+		// mentions take precedence over matches.
+		{From: "bob", Message: chatdata.Message{Data: "hello @bot"}},
+		// PMs only trigger mentions.
+		{From: "bob", Message: chatdata.Message{Data: "deploy hello"}, PM: "carol"},
+		{From: "bob", Message: chatdata.Message{Data: "x @hass"}, PM: "carol"},
+		// bots and sealed messages never trigger hooks.
+		{From: "bot", Message: chatdata.Message{Data: "deploy @hass"}, Bot: true},
+		{From: "bob", Message: chatdata.Message{Sealed: &chatdata.Sealed{}}, PM: "hass"},
+	}
+	for _, m := range msgs {
+		o.ChatMessage(bob, m)
+	}
+
+	got := make([]string, 0)
+	for _, e := range r.wait(t, 6) {
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", e.Hook, e.Type, e.User, e.PM, e.Message))
+	}
+	sort.Strings(got)
+	exp := []string{
+		"both mention bob  hello @bot",
+		"both message bob  hello @hass",
+		"deploy message bob  deploy now",
+		"hass mention bob  hello @hass",
+		"hass mention bob  hi @HASS.",
+		"hass mention bob hass leaving work",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected:\n%s\ngot:\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestUserUpdate(t *testing.T) {
+	r, url := newReceiver(t, 0)
+	o, err := NewOutgoing(ioutil.Discard, map[string]OutgoingConfig{
+		"presence": {URL: url, Events: []string{EventConnect, EventDisconnect}},
+		"ignored":  {URL: url, Events: []string{EventSong}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := channel.NewClient("alice", false), channel.NewClient("bob", false)
+	updates := []struct {
+		cl channel.Client
+		r  channel.ConnectionReason
+	}{
+		{alice, channel.Connect},
+		{alice, channel.Connect},
+		{alice, channel.Disconnect},
+		{bob, channel.Connect},
+		{alice, channel.Disconnect},
+		{bob, channel.Disconnect},
+		{alice, channel.Connect},
+	}
+	for _, u := range updates {
+		if err := o.UserUpdate(u.cl, u.r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make([]string, 0)
+	for _, e := range r.wait(t, 5) {
+		got = append(got, e.Hook+" "+e.Type+" "+e.User)
+	}
+	exp := []string{
+		"presence connect alice",
+		"presence connect bob",
+		"presence disconnect alice",
+		"presence disconnect bob",
+		"presence connect alice",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+	if len(o.users) != 1 || o.users["alice"] != 1 {
+		t.Fatalf("unexpected connection counts: %v", o.users)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(w time.Duration) { retryWait = w }(retryWait)
+	retryWait = 20 * time.Millisecond
+
+	r, url := newReceiver(t, 2)
+	retried, retriedURL := newReceiver(t, 1000)
+	none, noneURL := newReceiver(t, 1000)
+
+	buf := &lockedBuffer{}
+	o, err := NewOutgoing(buf, map[string]OutgoingConfig{
+		"flaky":   {URL: url, Events: []string{EventConnect}},
+		"retried": {URL: retriedURL, Events: []string{EventConnect}, Retries: 1},
+		"none":    {URL: noneURL, Events: []string{EventConnect}, Retries: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.UserUpdate(channel.NewClient("alice", false), channel.Connect); err != nil {
+		t.Fatal(err)
+	}
+
+	r.wait(t, 1)
+	waitLog(t, buf, "flaky connect alice: ok")
+	waitLog(t, buf, "retried connect alice: giving up: status 500")
+	waitLog(t, buf, "none connect alice: giving up")
+
+	attempts := func(rec *receiver) []time.Time {
+		rec.sem.Lock()
+		defer rec.sem.Unlock()
+		return rec.attempts
+	}
+	if a := attempts(r); len(a) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(a))
+	} else {
+		// the wait doubles after each retry.
+		for i, min := range []time.Duration{retryWait, retryWait * 2} {
+			if d := a[i+1].Sub(a[i]); d < min {
+				t.Errorf("retry %d after %s, expected at least %s", i+1, d, min)
+			}
+		}
+	}
+	if n := len(attempts(retried)); n != 2 {
+		t.Errorf("expected 2 attempts with 1 retry, got %d", n)
+	}
+	if n := len(attempts(none)); n != 1 {
+		t.Errorf("expected 1 attempt without retries, got %d", n)
+	}
+	if n := strings.Count(buf.String(), "flaky connect alice: retrying in"); n != 2 {
+		t.Errorf("expected 2 retries in the delivery log, got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	buf := &lockedBuffer{}
+	o, err := NewOutgoing(buf, map[string]OutgoingConfig{
+		"cmd": {
+			Command: []string{"sh", "-c", `printf '%s %s\n' "$HOMECHAT_HOOK" "$HOMECHAT_EVENT" > "$0"; cat >> "$0"`, out},
+			Events:  []string{EventConnect},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.UserUpdate(channel.NewClient("alice", false), channel.Connect); err != nil {
+		t.Fatal(err)
+	}
+	waitLog(t, buf, "cmd connect alice: ok")
+
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := strings.SplitN(string(d), "\n", 2)
+	if p[0] != "cmd connect" {
+		t.Errorf("unexpected environment: %q", p[0])
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(p[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Hook != "cmd" || e.Type != EventConnect || e.User != "alice" {
+		t.Errorf("unexpected event on stdin: %+v", e)
+	}
+}
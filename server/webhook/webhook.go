@@ -0,0 +1,218 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/frizinak/gotls/simplehttp"
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+const (
+	maxBody = 1024 * 64
+	Prefix  = "/hook/"
+)
+
+// Presets are templates for the payloads of common webhook senders.
+var Presets = map[string]string{
+	"slack":   `{{.text}}`,
+	"discord": `{{.content}}`,
+	// Home Assistant, Grafana, Gotify, ...
+	"title": `{{with .title}}{{.}}: {{end}}{{.message}}`,
+	"alertmanager": `{{range .alerts}}[{{.status}}] {{.labels.alertname}}` +
+		`{{with .annotations.summary}}: {{.}}{{end}}` + "\n{{end}}",
+}
+
+// Poster delivers a chat message, i.e.: chat.ChatChannel.
+type Poster interface {
+	Handle(channel.Client, chatdata.Message) error
+}
+
+// Config of a single webhook.
+type Config struct {
+	// Secret the sender has to pass as a bearer token or the token query
+	// parameter.
+	Token string
+
+	// Name of a preset or a text/template executed with the decoded JSON
+	// payload. Empty to post text payloads as is and use the text, message,
+	// content or body field of JSON payloads.
+	Template string
+
+	// Send the messages as PMs to this user instead of to everyone.
+	To string
+
+	// Maximum amount of messages per minute, 0 = unlimited.
+	RateLimit int
+}
+
+type hook struct {
+	name string
+	Config
+	tpl *template.Template
+
+	sem    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of h, it is refilled with RateLimit
+// tokens per minute.
+func (h *hook) allow() (time.Duration, bool) {
+	if h.RateLimit <= 0 {
+		return 0, true
+	}
+
+	h.sem.Lock()
+	defer h.sem.Unlock()
+	rate := float64(h.RateLimit) / float64(time.Minute)
+	now := time.Now()
+	h.tokens = math.Min(float64(h.RateLimit), h.tokens+float64(now.Sub(h.last))*rate)
+	h.last = now
+	if h.tokens < 1 {
+		return time.Duration((1 - h.tokens) / rate), false
+	}
+	h.tokens--
+	return 0, true
+}
+
+func (h *hook) message(contentType string, body []byte) (string, error) {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt != "application/json" {
+		if h.tpl == nil {
+			return string(body), nil
+		}
+		buf := bytes.NewBuffer(nil)
+		err := h.tpl.Execute(buf, string(body))
+		return buf.String(), err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "", err
+	}
+	if h.tpl != nil {
+		buf := bytes.NewBuffer(nil)
+		err := h.tpl.Execute(buf, v)
+		return buf.String(), err
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, k := range []string{"text", "message", "content", "body"} {
+			if s, ok := m[k].(string); ok {
+				return s, nil
+			}
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	err := json.Compact(buf, body)
+	return buf.String(), err
+}
+
+// Hooks posts the payloads of named webhooks into chat, each as a bot with
+// the name of its webhook.
+type Hooks struct {
+	log    *log.Logger
+	poster Poster
+	hooks  map[string]*hook
+}
+
+func New(l *log.Logger, p Poster, hooks map[string]Config) (*Hooks, error) {
+	h := &Hooks{log: l, poster: p, hooks: make(map[string]*hook, len(hooks))}
+	for name, c := range hooks {
+		if c.Token == "" {
+			return nil, fmt.Errorf("webhook %s: no token", name)
+		}
+		hk := &hook{name: name, Config: c, tokens: float64(c.RateLimit), last: time.Now()}
+		if c.Template != "" {
+			tpl := c.Template
+			if p, ok := Presets[tpl]; ok {
+				tpl = p
+			}
+			var err error
+			hk.tpl, err = template.New(name).Parse(tpl)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", name, err)
+			}
+		}
+		h.hooks[name] = hk
+	}
+
+	return h, nil
+}
+
+func jsonErr(w http.ResponseWriter, status int, err error) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return 0, json.NewEncoder(w).Encode(map[string]string{"err": err.Error()})
+}
+
+// Route returns the handler of the webhook at path p, nil if there is none.
+func (h *Hooks) Route(p string) simplehttp.HandleFunc {
+	if !strings.HasPrefix(p, Prefix) {
+		return nil
+	}
+	hk, ok := h.hooks[p[len(Prefix):]]
+	if !ok {
+		return nil
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, l *log.Logger) (int, error) {
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, nil
+		}
+
+		const bearer = "Bearer "
+		token := r.URL.Query().Get("token")
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, bearer) {
+			token = strings.TrimSpace(a[len(bearer):])
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(hk.Token)) != 1 {
+			return jsonErr(w, http.StatusUnauthorized, errors.New("invalid token"))
+		}
+
+		if wait, ok := hk.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			return jsonErr(w, http.StatusTooManyRequests, errors.New("rate limited"))
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			return jsonErr(w, http.StatusBadRequest, err)
+		}
+
+		msg, err := hk.message(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			return jsonErr(w, http.StatusBadRequest, err)
+		}
+		msg = strings.TrimSpace(msg)
+		if msg == "" {
+			return jsonErr(w, http.StatusBadRequest, errors.New("empty message"))
+		}
+		if hk.To != "" {
+			msg = fmt.Sprintf("@%s %s", hk.To, msg)
+		}
+
+		if err := h.poster.Handle(channel.NewBot(hk.name), chatdata.Message{Data: msg}); err != nil {
+			h.log.Printf("webhook %s: %s", hk.name, err)
+			return jsonErr(w, http.StatusBadRequest, err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+}
@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frizinak/homechat/server/channel"
+	chatdata "github.com/frizinak/homechat/server/channel/chat/data"
+)
+
+type posted struct {
+	from string
+	bot  bool
+	data string
+}
+
+type poster struct{ msgs []posted }
+
+func (p *poster) Handle(cl channel.Client, m chatdata.Message) error {
+	p.msgs = append(p.msgs, posted{cl.Name(), cl.Bot(), m.Data})
+	return nil
+}
+
+func newHooks(t *testing.T, p Poster, hooks map[string]Config) *Hooks {
+	t.Helper()
+	h, err := New(log.New(ioutil.Discard, "", 0), p, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestMessage(t *testing.T) {
+	const js = "application/json; charset=utf-8"
+	tests := []struct {
+		name        string
+		tpl         string
+		contentType string
+		body        string
+		exp         string
+		err         bool
+	}{
+		{"text", "", "text/plain", "hello", "hello", false},
+		{"no content type", "", "", "hello", "hello", false},
+		{"text template", "> {{.}}", "text/plain", "hello", "> hello", false},
+		{"text field", "", js, `{"body":"b","text":"t"}`, "t", false},
+		{"message field", "", js, `{"message":"m","content":"c"}`, "m", false},
+		{"content field", "", js, `{"content":"c","body":"b"}`, "c", false},
+		{"body field", "", js, `{"body":"b"}`, "b", false},
+		{"non-string field", "", js, `{"text":1,"body":"b"}`, "b", false},
+		{"no field", "", js, `{ "a": 1 }`, `{"a":1}`, false},
+		{"array", "", js, `[1, 2]`, `[1,2]`, false},
+		{"invalid json", "", js, `{`, "", true},
+		{"slack", "slack", js, `{"text":"hi"}`, "hi", false},
+		{"discord", "discord", js, `{"content":"hi"}`, "hi", false},
+		{"title", "title", js, `{"title":"t","message":"m"}`, "t: m", false},
+		{"no title", "title", js, `{"message":"m"}`, "m", false},
+		{
+			"alertmanager",
+			"alertmanager",
+			js,
+			`{"alerts":[
+				{"status":"firing","labels":{"alertname":"disk"},"annotations":{"summary":"full"}},
+				{"status":"resolved","labels":{"alertname":"cpu"}}
+			]}`,
+			"[firing] disk: full\n[resolved] cpu\n",
+			false,
+		},
+		{"template", "{{.a.b}}!", js, `{"a":{"b":"c"}}`, "c!", false},
+		{"template error", "{{.a.b}}", js, `{"a":"c"}`, "", true},
+	}
+
+	for _, test := range tests {
+		h := newHooks(t, &poster{}, map[string]Config{"h": {Token: "t", Template: test.tpl}})
+		msg, err := h.hooks["h"].message(test.contentType, []byte(test.body))
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if err == nil && msg != test.exp {
+			t.Errorf("%s: expected %q, got %q", test.name, test.exp, msg)
+		}
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	_, err := New(log.New(ioutil.Discard, "", 0), &poster{}, map[string]Config{"h": {Token: "t", Template: "{{"}})
+	if err == nil {
+		t.Fatal("expected an error for an invalid template")
+	}
+	_, err = New(log.New(ioutil.Discard, "", 0), &poster{}, map[string]Config{"h": {}})
+	if err == nil {
+		t.Fatal("expected an error for a hook without a token")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	type step struct {
+		elapsed time.Duration
+		allow   bool
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		steps []step
+	}{
+		{"unlimited", 0, []step{{0, true}, {0, true}, {0, true}}},
+		{"burst", 2, []step{{0, true}, {0, true}, {0, false}, {0, false}}},
+		{"refill", 2, []step{{0, true}, {0, true}, {0, false}, {30 * time.Second, true}, {0, false}}},
+		{"partial refill", 2, []step{{0, true}, {0, true}, {15 * time.Second, false}, {15 * time.Second, true}}},
+		{"capped", 2, []step{{time.Hour, true}, {0, true}, {0, false}}},
+	}
+
+	for _, test := range tests {
+		h := newHooks(t, &poster{}, map[string]Config{"h": {Token: "t", RateLimit: test.rate}})
+		hk := h.hooks["h"]
+		for i, s := range test.steps {
+			// pretend s.elapsed passed since the last call.
+			hk.last = hk.last.Add(-s.elapsed)
+			wait, ok := hk.allow()
+			if ok != s.allow {
+				t.Errorf("%s: step %d: expected %t", test.name, i, s.allow)
+			}
+			if !ok && (wait <= 0 || wait > time.Minute/time.Duration(test.rate)) {
+				t.Errorf("%s: step %d: unexpected wait %s", test.name, i, wait)
+			}
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	p := &poster{}
+	h := newHooks(t, p, map[string]Config{
+		"ci":    {Token: "secret", Template: "slack", To: "alice"},
+		"alarm": {Token: "other", RateLimit: 1},
+	})
+
+	if h.Route("/hook/nope") != nil || h.Route("/ci") != nil {
+		t.Fatal("route for an unknown hook")
+	}
+
+	post := func(p, token, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, p, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		status, err := h.Route(req.URL.Path)(w, req, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"bad token", "/hook/ci", "nope", `{"text":"x"}`, http.StatusUnauthorized},
+		{"other hook's token", "/hook/ci", "other", `{"text":"x"}`, http.StatusUnauthorized},
+		{"empty", "/hook/ci", "secret", `{"text":"  "}`, http.StatusBadRequest},
+		{"invalid", "/hook/ci", "secret", `{`, http.StatusBadRequest},
+		{"query token", "/hook/ci?token=secret", "", `{"text":" build ok "}`, http.StatusNoContent},
+		{"alarm", "/hook/alarm", "other", `{"message":"fire"}`, http.StatusNoContent},
+		{"rate limited", "/hook/alarm", "other", `{"message":"fire"}`, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		w := post(test.path, test.token, "application/json", test.body)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After header", test.name)
+		}
+	}
+
+	exp := []posted{
+		{"ci", true, "@alice build ok"},
+		{"alarm", true, "fire"},
+	}
+	if len(p.msgs) != len(exp) {
+		t.Fatalf("expected %+v, got %+v", exp, p.msgs)
+	}
+	for i := range exp {
+		if p.msgs[i] != exp[i] {
+			t.Errorf("expected %+v, got %+v", exp[i], p.msgs[i])
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hook/ci?token=secret", nil)
+	if status, _ := h.Route(req.URL.Path)(httptest.NewRecorder(), req, nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for GET, got %d", http.StatusMethodNotAllowed, status)
+	}
+}
@@ -19,6 +19,7 @@ func Plain(w io.Writer) *PlainUI {
 func (p *PlainUI) Users([]string)          {}
 func (p *PlainUI) UserTyping(string, bool) {}
 func (p *PlainUI) Latency(time.Duration)   {}
+func (p *PlainUI) Online(bool)             {}
 func (p *PlainUI) Log(msg string)          { fmt.Fprintln(p.Writer, str.StripUnprintable(msg)) }
 func (p *PlainUI) Err(err error)           { fmt.Fprintln(p.Writer, "[err]", str.StripUnprintable(err.Error())) }
 
@@ -26,8 +27,10 @@ func (p *PlainUI) Flash(msg string, dur time.Duration) {
 	fmt.Fprintln(p.Writer, "[notice]", str.StripUnprintable(msg))
 }
 
-func (p *PlainUI) Clear()        {}
-func (p *PlainUI) JumpToActive() {}
+func (p *PlainUI) Clear()                   {}
+func (p *PlainUI) Pending(id uint64, m Msg) {}
+func (p *PlainUI) Unpending(id uint64)      {}
+func (p *PlainUI) JumpToActive()            {}
 func (p *PlainUI) Broadcast(msgs []Msg, scroll bool) {
 	for _, m := range msgs {
 		p.broadcast(m)
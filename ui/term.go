@@ -70,6 +70,7 @@ type TermUI struct {
 	flashExpiry time.Time
 
 	latency *time.Duration
+	offline bool
 
 	z          *Zug
 	zLayers    []*zug.Layer
@@ -125,6 +126,7 @@ type msg struct {
 	mwidths   widths
 	pwidth    int
 	mwidth    int
+	pending   uint64
 }
 
 func Term(
@@ -227,6 +229,11 @@ func (ui *TermUI) Latency(n time.Duration) {
 	ui.Flush()
 }
 
+func (ui *TermUI) Online(online bool) {
+	ui.offline = !online
+	ui.Flush()
+}
+
 func (ui *TermUI) Flash(msg string, dur time.Duration) {
 	if dur == 0 {
 		dur = time.Second * 5
@@ -242,10 +249,55 @@ func (ui *TermUI) Err(err error)     { ui.ErrStr(err.Error()) }
 
 func (ui *TermUI) Clear() {
 	ui.sem.Lock()
+	pending := ui.takePending()
 	ui.log = make([]msg, 0)
 	ui.metaWidth = 0
+	ui.log = append(ui.log, pending...)
+	ui.cache.Invalidate()
+	ui.sem.Unlock()
+}
+
+func (ui *TermUI) takePending() []msg {
+	pending := make([]msg, 0)
+	n := 0
+	for _, l := range ui.log {
+		if l.pending != 0 {
+			pending = append(pending, l)
+			continue
+		}
+		ui.log[n] = l
+		n++
+	}
+	ui.log = ui.log[:n]
+	return pending
+}
+
+// Pending shows m below all other messages until Unpending(id) is called.
+func (ui *TermUI) Pending(id uint64, m Msg) {
+	if ui.visible&VisibleBrowser == 0 {
+		return
+	}
+	ui.sem.Lock()
+	ui.log = append(ui.log, ui.lines(m, id)...)
 	ui.cache.Invalidate()
 	ui.sem.Unlock()
+	ui.Flush()
+}
+
+func (ui *TermUI) Unpending(id uint64) {
+	ui.sem.Lock()
+	n := 0
+	for _, l := range ui.log {
+		if l.pending == id {
+			continue
+		}
+		ui.log[n] = l
+		n++
+	}
+	ui.log = ui.log[:n]
+	ui.cache.Invalidate()
+	ui.sem.Unlock()
+	ui.Flush()
 }
 
 func (ui *TermUI) JumpToActive() { ui.jumpToActive = true }
@@ -269,50 +321,11 @@ func (ui *TermUI) Broadcast(msgs []Msg, scroll bool) {
 		return
 	}
 	ui.sem.Lock()
+	pending := ui.takePending()
 	for _, m := range msgs {
-		m.Message = str.StripUnprintable(m.Message)
-		texts := strings.Split(strings.ReplaceAll(m.Message, "\r", ""), "\n")
-		for _, text := range texts {
-			text = linkRE.ReplaceAllStringFunc(text, func(m string) string {
-				u, err := url.Parse(m)
-				if err != nil {
-					return m
-				}
-				ui.links = append(ui.links, u)
-				return fmt.Sprintf("[%d]%s", len(ui.links), m)
-			})
-
-			msg := msg{"", text, m.Highlight, nil, 0, 0}
-			if ui.metaPrefix {
-				msg.prefix = str.StripUnprintable(m.Meta)
-				width := width(msg.prefix, -1)
-				if width > ui.metaWidth {
-					ui.metaWidth = width
-				}
-			}
-
-			ptotal := 0
-			for _, r := range msg.prefix {
-				w := rwidth(r)
-				ptotal += w
-			}
-			msg.pwidth = ptotal
-
-			mwidths := make([]uint8, 0, len(msg.msg))
-			mtotal := 0
-			c := 0
-			for _, r := range msg.msg {
-				c++
-				w := rwidth(r)
-				mwidths = append(mwidths, uint8(w))
-				mtotal += w
-			}
-			msg.mwidths = mwidths
-			msg.mwidth = mtotal
-
-			ui.log = append(ui.log, msg)
-		}
+		ui.log = append(ui.log, ui.lines(m, 0)...)
 	}
+	ui.log = append(ui.log, pending...)
 
 	if len(ui.log) > ui.maxMessages {
 		ui.log = ui.log[len(ui.log)-ui.maxMessages:]
@@ -325,6 +338,54 @@ func (ui *TermUI) Broadcast(msgs []Msg, scroll bool) {
 	ui.Flush()
 }
 
+func (ui *TermUI) lines(m Msg, pending uint64) []msg {
+	m.Message = str.StripUnprintable(m.Message)
+	texts := strings.Split(strings.ReplaceAll(m.Message, "\r", ""), "\n")
+	lines := make([]msg, 0, len(texts))
+	for _, text := range texts {
+		text = linkRE.ReplaceAllStringFunc(text, func(m string) string {
+			u, err := url.Parse(m)
+			if err != nil {
+				return m
+			}
+			ui.links = append(ui.links, u)
+			return fmt.Sprintf("[%d]%s", len(ui.links), m)
+		})
+
+		msg := msg{"", text, m.Highlight, nil, 0, 0, pending}
+		if ui.metaPrefix {
+			msg.prefix = str.StripUnprintable(m.Meta)
+			width := width(msg.prefix, -1)
+			if width > ui.metaWidth {
+				ui.metaWidth = width
+			}
+		}
+
+		ptotal := 0
+		for _, r := range msg.prefix {
+			w := rwidth(r)
+			ptotal += w
+		}
+		msg.pwidth = ptotal
+
+		mwidths := make([]uint8, 0, len(msg.msg))
+		mtotal := 0
+		c := 0
+		for _, r := range msg.msg {
+			c++
+			w := rwidth(r)
+			mwidths = append(mwidths, uint8(w))
+			mtotal += w
+		}
+		msg.mwidths = mwidths
+		msg.mwidth = mtotal
+
+		lines = append(lines, msg)
+	}
+
+	return lines
+}
+
 func (ui *TermUI) MusicState(s State) {
 	if s == ui.s {
 		return
@@ -797,6 +858,9 @@ func (ui *TermUI) Flush() {
 			lat = ">1s"
 		}
 	}
+	if ui.offline {
+		lat = "offline"
+	}
 
 	status := ui.status
 	if time.Now().Before(ui.flashExpiry) {
@@ -3,8 +3,12 @@ package vars
 var GitVersion string
 
 const (
-	Version         = "custom"
-	ProtocolVersion = "1023"
+	Version = "custom"
+
+	// ProtocolVersion is the handshake and framing version as "major[.minor]",
+	// only peers with a different major are told to update. Features are
+	// negotiated with channel.Proto flags and Capabilities instead.
+	ProtocolVersion = "1033"
 
 	UpdateChannel = "update" // rw
 
@@ -26,5 +30,32 @@ const (
 
 	EOFChannel = "eof"
 
+	ReplyChannel = "r" // r
+
 	UserChannel = "u" // r
+
+	KeysChannel = "k" // rw
+
+	BridgeChannel = "b" // rw
 )
+
+// Capabilities lists the highest message version of each channel this build
+// understands.
+var Capabilities = map[string]uint8{
+	UpdateChannel:             1,
+	ChatChannel:               4,
+	HistoryChannel:            1,
+	UploadChannel:             1,
+	PingChannel:               1,
+	TypingChannel:             1,
+	MusicChannel:              1,
+	MusicStateChannel:         1,
+	MusicSongChannel:          1,
+	MusicPlaylistChannel:      1,
+	MusicPlaylistSongsChannel: 1,
+	MusicErrorChannel:         1,
+	MusicNodeChannel:          1,
+	UserChannel:               1,
+	KeysChannel:               1,
+	BridgeChannel:             1,
+}